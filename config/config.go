@@ -5,13 +5,84 @@ type Config struct {
 		ConnString string `toml:"conn_string"`
 	} `toml:"storage"`
 
+	// Id configures the node id of the id generator, which has to be unique
+	// per instance sharing the storage
+	Id struct {
+		NodeId    int16 `toml:"node_id"`
+		ElementId int32 `toml:"element_id"`
+
+		// Lease claims a free node id from the storage instead of node_id
+		Lease struct {
+			Enable           bool  `toml:"enable"`
+			MinNodeId        int16 `toml:"min_node_id"`
+			MaxNodeId        int16 `toml:"max_node_id"`
+			TTLSeconds       int   `toml:"ttl_seconds"`
+			HeartbeatSeconds int   `toml:"heartbeat_seconds"`
+		} `toml:"lease"`
+
+		// Clock configures the handling of the clock going backward
+		Clock struct {
+			WaitToleranceMillis int `toml:"wait_tolerance_millis"`
+			BorrowLimitMillis   int `toml:"borrow_limit_millis"`
+			// TimeFile keeps the last time issued across restarts, the lease
+			// keeps it in lease mode
+			TimeFile string `toml:"time_file"`
+		} `toml:"clock"`
+
+		// Service configures the http api generating ids
+		Service struct {
+			MaxBatch int `toml:"max_batch"`
+			// Callers are the element ids of the callers by name, distinct
+			// from element_id
+			Callers map[string]int32 `toml:"callers"`
+		} `toml:"service"`
+
+		// Segment configures the sequential ids of namespaces reserved in
+		// ranges from the storage
+		Segment struct {
+			Enable bool  `toml:"enable"`
+			Step   int64 `toml:"step"`
+			// AutoCreate creates unknown namespaces on their first id
+			AutoCreate bool `toml:"auto_create"`
+			// MaxNamespaces stops auto creating namespaces, 10000 by default
+			MaxNamespaces int `toml:"max_namespaces"`
+		} `toml:"segment"`
+	} `toml:"id"`
+
 	Http struct {
 		Address string `toml:"address"`
+		// TrustedProxies may set X-Forwarded-For for the client ip limits are
+		// kept by, none when empty
+		TrustedProxies []string `toml:"trusted_proxies"`
+
+		// Auth protects the http apis matched by its rules with directory users
+		Auth struct {
+			Enable bool `toml:"enable"`
+			// ApiKeyAttribute holds the api keys of an entry, empty disables
+			// bearer api keys
+			ApiKeyAttribute string `toml:"api_key_attribute"`
+			// ApiKeyBaseDN is searched for the entry holding an api key
+			ApiKeyBaseDN string `toml:"api_key_base_dn"`
+			// GroupsBaseDN is searched for the groups of the rules, when empty
+			// the memberOf values of the user are used
+			GroupsBaseDN string         `toml:"groups_base_dn"`
+			Rules        []HttpAuthRule `toml:"rules"`
+		} `toml:"auth"`
 	} `toml:"http"`
 
 	LDAP struct {
 		Address    string `toml:"address"`
 		BindBaseDN string `toml:"bind_base_dn"`
+		// LdapiPath is the unix socket of the ldapi listener, empty disables it
+		LdapiPath string `toml:"ldapi_path"`
+		// HttpGateway enables the http api of the directory entries
+		HttpGateway bool `toml:"http_gateway"`
+		// AdminDNs may write any entry over LDAP and http, a group DN
+		// admits its members. Other users may only modify their own entry.
+		AdminDNs []string `toml:"admin_dns"`
+
+		// Suffixes replaces BindBaseDN when set
+		Suffixes []LdapSuffix `toml:"suffixes"`
 
 		TLS struct {
 			Enable     bool   `toml:"enable"`
@@ -20,20 +91,136 @@ type Config struct {
 			KeyPath    string `toml:"key_path"`
 		} `toml:"tls"`
 
+		// Limits apply to every listener, a zero value disables the limit
+		Limits struct {
+			MaxConnections     int `toml:"max_connections"`
+			IdleTimeoutSeconds int `toml:"idle_timeout_seconds"`
+			// MaxPDUSize is 1048576 when zero
+			MaxPDUSize int `toml:"max_pdu_size"`
+
+			// failed binds allowed per source ip/bind name within the window
+			// before further binds are rejected for the lockout time
+			BindFailuresPerIP        int `toml:"bind_failures_per_ip"`
+			BindFailuresPerDN        int `toml:"bind_failures_per_dn"`
+			BindFailureWindowSeconds int `toml:"bind_failure_window_seconds"`
+			BindLockoutSeconds       int `toml:"bind_lockout_seconds"`
+		} `toml:"limits"`
+
+		Storage struct {
+			Backend      string `toml:"backend"`
+			SnapshotFile string `toml:"snapshot_file"`
+			// memory only, zero uses the defaults of 5 seconds and 10000 changes
+			SnapshotIntervalSeconds int `toml:"snapshot_interval_seconds"`
+			ChangelogMaxEntries     int `toml:"changelog_max_entries"`
+		} `toml:"storage"`
+
 		Init struct {
-			InitScripts []struct {
-				DN            string   `toml:"dn"`
-				ObjectClasses []string `toml:"object_classes"`
-			} `toml:"run_simple_init_scripts"`
-			InitAdmin struct {
-				DN            string   `toml:"dn"`
-				ObjectClasses []string `toml:"object_classes"`
-				UserPassword  string   `toml:"user_password"`
-			} `toml:"run_init_admin"`
+			SeedFiles      []string `toml:"seed_files"`
+			UpdateExisting bool     `toml:"update_existing"`
 		} `toml:"init"`
+
+		SCIM struct {
+			Enable       bool   `toml:"enable"`
+			UsersBaseDN  string `toml:"users_base_dn"`
+			GroupsBaseDN string `toml:"groups_base_dn"`
+		} `toml:"scim"`
+
+		// MFA enables totp codes for accounts with mfaRequired TRUE
+		MFA struct {
+			Enable bool `toml:"enable"`
+			// EncryptionKey encrypts the totp secrets, 32 bytes base64 encoded
+			EncryptionKey string `toml:"encryption_key"`
+			// Issuer is shown by authenticator apps
+			Issuer string `toml:"issuer"`
+		} `toml:"mfa"`
+
+		OIDC struct {
+			Enable bool `toml:"enable"`
+			// Issuer is the external url of the http server, the endpoints are
+			// below its path
+			Issuer string `toml:"issuer"`
+			// lifetimes, zero uses the defaults of 1 hour, 30 days and 24 hours
+			AccessTokenSeconds  int `toml:"access_token_seconds"`
+			RefreshTokenSeconds int `toml:"refresh_token_seconds"`
+			KeyRotationHours    int `toml:"key_rotation_hours"`
+			// GroupsBaseDN is searched for the groups claim, when empty the
+			// memberOf values of the user are used
+			GroupsBaseDN string `toml:"groups_base_dn"`
+			// Claims maps claim names to attributes in addition to the standard
+			// claims, an empty attribute removes a claim
+			Claims  map[string]string `toml:"claims"`
+			Clients []OidcClient      `toml:"clients"`
+		} `toml:"oidc"`
 	} `toml:"ldap"`
 
 	FullTextSearch struct {
 		IndexFolder string `toml:"index_folder"`
 	} `toml:"full_text_search"`
+
+	// RateLimiter grants tokens of rate limited resources to their clients
+	RateLimiter struct {
+		Enable bool `toml:"enable"`
+		// Storage of the buckets, memory(default) or postgresql shared by the
+		// instances
+		Storage string `toml:"storage"`
+		// LeaseTokens with postgresql are taken at least at once by every
+		// instance, granted from memory within lease_millis
+		LeaseTokens int32 `toml:"lease_tokens"`
+		LeaseMillis int   `toml:"lease_millis"`
+		// IdempotencySeconds keeps the responses by request id, 60 by default
+		IdempotencySeconds int                 `toml:"idempotency_seconds"`
+		Resources          []RateLimitResource `toml:"resources"`
+	} `toml:"rate_limiter"`
+}
+
+// LdapSuffix is a naming context hosted by the ldap server and how bind names
+// are resolved in it
+type LdapSuffix struct {
+	Suffix     string `toml:"suffix"`
+	BindBaseDN string `toml:"bind_base_dn"`
+	// BindFilter such as (uid=%s), %s is replaced by the escaped bind name.
+	// When empty the bind name is used as cn=<name>,<bind_base_dn>.
+	BindFilter string `toml:"bind_filter"`
+	// BindScope is one or sub(default)
+	BindScope string `toml:"bind_scope"`
+}
+
+// HttpAuthRule protects the requests below a path, the first matching rule
+// of http.auth applies
+type HttpAuthRule struct {
+	PathPrefix string `toml:"path_prefix"`
+	// Methods the rule applies to, empty for all
+	Methods []string `toml:"methods"`
+	// Anonymous allows requests without credentials
+	Anonymous bool `toml:"anonymous"`
+	// Groups the user has to be member of one of, by cn or DN. Empty allows
+	// every authenticated user.
+	Groups []string `toml:"groups"`
+}
+
+// OidcClient is a client registered at the oidc provider
+type OidcClient struct {
+	ClientId string `toml:"client_id"`
+	// ClientSecret empty makes a public client, which has to use PKCE
+	ClientSecret string   `toml:"client_secret"`
+	RedirectURIs []string `toml:"redirect_uris"`
+	// GrantTypes of authorization_code, refresh_token and client_credentials,
+	// the first two by default
+	GrantTypes []string `toml:"grant_types"`
+	// Scopes the client may request, empty allows any
+	Scopes []string `toml:"scopes"`
+}
+
+// RateLimitResource is a token bucket of the rate limiter
+type RateLimitResource struct {
+	ResourceId string `toml:"resource_id"`
+	// Rate of the tokens per second refilling the bucket
+	Rate float64 `toml:"rate"`
+	// Burst is the capacity of the bucket, the rate by default
+	Burst int32 `toml:"burst"`
+	// ClientMaxCount caps the tokens a single client holds within their ttl,
+	// unlimited when 0
+	ClientMaxCount int32 `toml:"client_max_count"`
+	// TtlMillis is how long clients may keep tokens, 1000 by default
+	TtlMillis int32 `toml:"ttl_millis"`
 }
@@ -1,20 +1,54 @@
 package config
 
 import (
+	"io"
+
 	"github.com/blevesearch/bleve"
 	"github.com/jimlambrt/gldap"
 )
 
 type Container struct {
-	GldapServer *gldap.Server
-	BleveIndex  bleve.Index
+	GldapServers  []*gldap.Server
+	LdapFrontends []io.Closer
+	LdapNotifier  io.Closer
+	// LdapBackend writes the last snapshot of the memory backend
+	LdapBackend io.Closer
+	// LdapCertReloader watches the ldap tls certificate
+	LdapCertReloader io.Closer
+	// LdapOidcKeys rotates the oidc signing keys
+	LdapOidcKeys io.Closer
+	BleveIndex   bleve.Index
+	// IdNodeLease releases the leased node id
+	IdNodeLease io.Closer
 }
 
 func (this *Container) Stop() {
-	if this.GldapServer != nil {
-		this.GldapServer.Stop()
+	// ends persistent searches, otherwise stopping ldap servers waits for them
+	if this.LdapNotifier != nil {
+		this.LdapNotifier.Close()
+	}
+	// stop accepting and close the open connections
+	for _, f := range this.LdapFrontends {
+		f.Close()
+	}
+	for _, s := range this.GldapServers {
+		s.Stop()
+	}
+	// after the ldap servers, which may still write
+	if this.LdapBackend != nil {
+		this.LdapBackend.Close()
+	}
+	if this.LdapCertReloader != nil {
+		this.LdapCertReloader.Close()
+	}
+	if this.LdapOidcKeys != nil {
+		this.LdapOidcKeys.Close()
 	}
 	if this.BleveIndex != nil {
 		this.BleveIndex.Close()
 	}
+	// after the services, which may still generate ids
+	if this.IdNodeLease != nil {
+		this.IdNodeLease.Close()
+	}
 }
@@ -19,6 +19,59 @@ create unique index if not exists misc_ldap_entries_uk
 
 CREATE INDEX misc_ldap_entries_attr ON misc_ldap_entries USING gin (attribute);
 CREATE INDEX misc_ldap_entries_meta ON misc_ldap_entries USING gin (metadata);
+-- case-insensitive attribute value lookups, e.g. of bind names
+CREATE INDEX misc_ldap_entries_attr_lower ON misc_ldap_entries USING gin ((lower(attribute::text)::jsonb) jsonb_path_ops);
+
+-- old entries of deletes too large for a notification payload
+create table misc_ldap_deleted_entries
+(
+    entry_id     uuid,
+    attribute    jsonb,
+    time_deleted bigint NOT NULL,
+    CONSTRAINT misc_ldap_deleted_entries_pkey PRIMARY KEY (entry_id)
+);
+
+CREATE INDEX misc_ldap_deleted_entries_time ON misc_ldap_deleted_entries (time_deleted);
+
+-- notify every committed entry write on channel misc_ldap_entries for persistent searches
+create or replace function misc_ldap_entries_notify() returns trigger as
+$$
+declare
+    payload    text;
+    now_millis bigint;
+begin
+    if TG_OP = 'INSERT' then
+        payload := json_build_object('op', 'add', 'dn', NEW.attribute ->> 'DN')::text;
+    elsif TG_OP = 'UPDATE' then
+        if OLD.entry_name <> NEW.entry_name or
+           OLD.parent_full_entry_path is distinct from NEW.parent_full_entry_path then
+            payload := json_build_object('op', 'modrdn', 'dn', NEW.attribute ->> 'DN')::text;
+        else
+            payload := json_build_object('op', 'modify', 'dn', NEW.attribute ->> 'DN')::text;
+        end if;
+    else
+        payload := json_build_object('op', 'delete', 'dn', OLD.attribute ->> 'DN', 'entry', OLD.attribute)::text;
+        -- notification payloads are limited to 8000 bytes, larger old entries are
+        -- kept for an hour for the listeners to load them
+        if octet_length(payload) > 7900 then
+            now_millis := (extract(epoch from clock_timestamp()) * 1000)::bigint;
+            delete from misc_ldap_deleted_entries where time_deleted < now_millis - 3600000;
+            insert into misc_ldap_deleted_entries (entry_id, attribute, time_deleted)
+            values (OLD.entry_id, OLD.attribute, now_millis)
+            on conflict (entry_id) do update set attribute = excluded.attribute, time_deleted = excluded.time_deleted;
+            payload := json_build_object('op', 'delete', 'dn', OLD.attribute ->> 'DN', 'entry_id', OLD.entry_id)::text;
+        end if;
+    end if;
+    perform pg_notify('misc_ldap_entries', payload);
+    return null;
+end;
+$$ language plpgsql;
+
+create trigger misc_ldap_entries_notify
+    after insert or update or delete
+    on misc_ldap_entries
+    for each row
+execute function misc_ldap_entries_notify();
 
 create table misc_ldap_uniqueness
 (
@@ -37,6 +90,50 @@ create unique index if not exists misc_ldap_uniqueness_uk
 
 CREATE INDEX misc_ldap_uniqueness_meta ON misc_ldap_uniqueness USING gin (metadata);
 
+create table misc_ldap_changelog
+(
+    change_number bigserial,
+    time_created  bigint        NOT NULL,
+    bound_dn      varchar(1000) NOT NULL,
+    target_dn     varchar(1000) NOT NULL,
+    change_type   varchar(20)   NOT NULL,
+    changes       text          NOT NULL,
+    CONSTRAINT misc_ldap_changelog_pkey PRIMARY KEY (change_number)
+);
+
+CREATE INDEX misc_ldap_changelog_time ON misc_ldap_changelog (time_created);
+
+-- oidc signing keys, time_retired is 0 for the signing key
+create table misc_ldap_oidc_keys
+(
+    key_id       varchar(100)  NOT NULL,
+    private_key  bytea         NOT NULL,
+    time_created bigint        NOT NULL,
+    time_retired bigint        NOT NULL,
+    CONSTRAINT misc_ldap_oidc_keys_pkey PRIMARY KEY (key_id)
+);
+
+-- oidc authorization codes and refresh tokens by the sha-256 hex of the secret
+create table misc_ldap_oidc_grants
+(
+    grant_key    varchar(100)  NOT NULL,
+    grant_type   varchar(20)   NOT NULL,
+    grant_data   jsonb         NOT NULL,
+    time_expires bigint        NOT NULL,
+    CONSTRAINT misc_ldap_oidc_grants_pkey PRIMARY KEY (grant_key)
+);
+
+CREATE INDEX misc_ldap_oidc_grants_expires ON misc_ldap_oidc_grants (time_expires);
+
+-- last accepted totp time step per account by normalized DN
+create table misc_ldap_totp_steps
+(
+    dn           varchar(1000) NOT NULL,
+    last_step    bigint        NOT NULL,
+    time_updated bigint        NOT NULL,
+    CONSTRAINT misc_ldap_totp_steps_pkey PRIMARY KEY (dn)
+);
+
 ------------------------------------------------------------------------
 -- Small Object tables
 ------------------------------------------------------------------------
@@ -49,3 +146,64 @@ create table misc_small_object
     metadata     varchar(4000),
     file_content bytea
 );
+
+------------------------------------------------------------------------
+-- Id tables
+------------------------------------------------------------------------
+
+create table misc_id_node_lease
+(
+    node_id      int           NOT NULL,
+    owner        varchar(300)  NOT NULL,
+    expire_time  bigint        NOT NULL,
+    last_time    bigint        NOT NULL DEFAULT 0,
+    time_created bigint        NOT NULL,
+    time_updated bigint        NOT NULL,
+    CONSTRAINT misc_id_node_lease_pkey PRIMARY KEY (node_id)
+);
+
+create table misc_id_segment
+(
+    namespace    varchar(200)  NOT NULL,
+    max_id       bigint        NOT NULL,
+    step         int           NOT NULL,
+    time_created bigint        NOT NULL,
+    time_updated bigint        NOT NULL,
+    CONSTRAINT misc_id_segment_pkey PRIMARY KEY (namespace),
+    CONSTRAINT misc_id_segment_step_check CHECK (step > 0)
+);
+
+------------------------------------------------------------------------
+-- Rate limiter tables
+------------------------------------------------------------------------
+
+create table misc_rate_limit_resource
+(
+    resource_id      varchar(200)      NOT NULL,
+    rate             double precision  NOT NULL,
+    burst            int               NOT NULL,
+    client_max_count int               NOT NULL DEFAULT 0,
+    ttl_millis       int               NOT NULL DEFAULT 0,
+    tokens           double precision  NOT NULL,
+    last_refill      bigint            NOT NULL,
+    time_created     bigint            NOT NULL,
+    time_updated     bigint            NOT NULL,
+    CONSTRAINT misc_rate_limit_resource_pkey PRIMARY KEY (resource_id)
+);
+
+-- responses by client and request id, kept until the idempotency time and
+-- the ttl of the granted tokens passed
+create table misc_rate_limit_response
+(
+    client_id      varchar(200)  NOT NULL,
+    request_id     varchar(200)  NOT NULL,
+    resource_id    varchar(200)  NOT NULL,
+    acquired_count int           NOT NULL,
+    ttl_millis     int           NOT NULL,
+    grant_expires  bigint        NOT NULL,
+    time_expires   bigint        NOT NULL,
+    CONSTRAINT misc_rate_limit_response_pkey PRIMARY KEY (client_id, request_id)
+);
+
+CREATE INDEX misc_rate_limit_response_client ON misc_rate_limit_response (resource_id, client_id);
+CREATE INDEX misc_rate_limit_response_expires ON misc_rate_limit_response (time_expires);
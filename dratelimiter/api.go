@@ -1,21 +1,21 @@
 package dratelimiter
 
 type RateTokenRequest struct {
-	ResourceId string
-	MaxCount   int32
+	ResourceId string `json:"resource_id"`
+	MaxCount   int32  `json:"max_count"`
 
-	RequestId    string
-	ClientId     string
-	ReqTimestamp int64
+	RequestId    string `json:"request_id"`
+	ClientId     string `json:"client_id"`
+	ReqTimestamp int64  `json:"req_timestamp"`
 }
 
 type RateTokenResponse struct {
-	AcquiredCount int32 // min(request.MaxCount, server available count, server configuration of max count of a single client)
+	AcquiredCount int32 `json:"acquired_count"` // min(request.MaxCount, server available count, server configuration of max count of a single client)
 
-	TtlInMillis int32 // server side ttl which tells the client to keep at most the certain amount time of the tokens
+	TtlInMillis int32 `json:"ttl_in_millis"` // server side ttl which tells the client to keep at most the certain amount time of the tokens
 
-	ResourceId   string
-	RequestId    string
-	ClientId     string
-	ReqTimestamp int64 // client side will check the availability of the token and discord invalid tokens if the time exceeded when client received the response
+	ResourceId   string `json:"resource_id"`
+	RequestId    string `json:"request_id"`
+	ClientId     string `json:"client_id"`
+	ReqTimestamp int64  `json:"req_timestamp"` // client side will check the availability of the token and discord invalid tokens if the time exceeded when client received the response
 }
@@ -0,0 +1,321 @@
+package dratelimiter
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	_DEFAULT_CLIENT_BATCH_SIZE = 10
+	_DEFAULT_RETRY_INTERVAL    = 100 * time.Millisecond
+	_DEFAULT_CLIENT_TIMEOUT    = 3 * time.Second
+)
+
+// ClientOptions configures a Client of one resource
+type ClientOptions struct {
+	// ServerURL is the base url of the misc-service serving the rate limiter
+	ServerURL  string
+	ResourceId string
+	ClientId   string
+	// BatchSize is the max count of every request for tokens, 10 by default
+	BatchSize int32
+	// RefillThreshold of tokens left starts requesting more in the
+	// background, a quarter of the batch size by default
+	RefillThreshold int32
+	// FailOpen allows every call while the server is unreachable, otherwise
+	// they are denied
+	FailOpen bool
+	// RetryInterval after failed requests and requests granting no tokens,
+	// 100ms by default
+	RetryInterval time.Duration
+	// HttpClient with a timeout of 3s by default
+	HttpClient *http.Client
+}
+
+// Client serves Allow and Wait from tokens requested from the rate limiter
+// in batches. Tokens are discarded once their ttl passed since the request
+// for them was sent.
+type Client struct {
+	opts ClientOptions
+	url  string
+
+	lock    sync.Mutex
+	batches []*tokenBatch
+	// unavailable is set while requests for tokens fail
+	unavailable bool
+	// refilled is closed and replaced after every request for tokens
+	refilled chan struct{}
+	// pending is retried with its request id after it failed, so tokens
+	// granted to a lost response are not granted again
+	pending *pendingRequest
+
+	trigger   chan struct{}
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+type tokenBatch struct {
+	remaining int32
+	expires   time.Time
+}
+
+type pendingRequest struct {
+	req  *RateTokenRequest
+	sent time.Time
+}
+
+type clientResponse struct {
+	Status       string             `json:"status"`
+	Data         *RateTokenResponse `json:"data"`
+	ErrorCode    string             `json:"error_code"`
+	ErrorMessage string             `json:"error_message"`
+}
+
+// NewClient starts requesting tokens in the background until Close
+func NewClient(opts ClientOptions) (*Client, error) {
+	if len(opts.ServerURL) == 0 || len(opts.ResourceId) == 0 || len(opts.ClientId) == 0 {
+		return nil, errors.New("rate limiter client requires server url, resource id and client id")
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = _DEFAULT_CLIENT_BATCH_SIZE
+	}
+	if opts.RefillThreshold <= 0 {
+		opts.RefillThreshold = opts.BatchSize / 4
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = _DEFAULT_RETRY_INTERVAL
+	}
+	if opts.HttpClient == nil {
+		opts.HttpClient = &http.Client{Timeout: _DEFAULT_CLIENT_TIMEOUT}
+	}
+	this := &Client{
+		opts:     opts,
+		url:      strings.TrimSuffix(opts.ServerURL, "/") + "/rate_limiter/tokens",
+		refilled: make(chan struct{}),
+		trigger:  make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+	go this.refillLoop()
+	this.requestRefill()
+	return this, nil
+}
+
+// Allow takes a token if one is available, without waiting
+func (this *Client) Allow() bool {
+	ok, unavailable, _ := this.take()
+	if !ok && unavailable {
+		return this.opts.FailOpen
+	}
+	return ok
+}
+
+// Wait blocks until a token is taken or ctx is done. While the server is
+// unreachable it returns at once when failing open, and keeps waiting for
+// the server otherwise.
+func (this *Client) Wait(ctx context.Context) error {
+	for {
+		ok, unavailable, refilled := this.take()
+		if ok || (unavailable && this.opts.FailOpen) {
+			return nil
+		}
+		timer := time.NewTimer(this.opts.RetryInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-this.closed:
+			timer.Stop()
+			return errors.New("rate limiter client closed")
+		case <-refilled:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// Available returns the count of tokens held, expired ones excluded
+func (this *Client) Available() int32 {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.discardExpired(time.Now())
+	return this.availableLocked()
+}
+
+func (this *Client) Close() error {
+	this.closeOnce.Do(func() {
+		close(this.closed)
+	})
+	return nil
+}
+
+func (this *Client) take() (bool, bool, chan struct{}) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.discardExpired(time.Now())
+	ok := false
+	if len(this.batches) > 0 {
+		b := this.batches[0]
+		b.remaining--
+		if b.remaining == 0 {
+			this.batches = this.batches[1:]
+		}
+		ok = true
+	}
+	if this.availableLocked() <= this.opts.RefillThreshold {
+		this.requestRefill()
+	}
+	return ok, this.unavailable, this.refilled
+}
+
+func (this *Client) discardExpired(now time.Time) {
+	batches := this.batches[:0]
+	for _, b := range this.batches {
+		if now.Before(b.expires) {
+			batches = append(batches, b)
+		}
+	}
+	this.batches = batches
+}
+
+func (this *Client) availableLocked() int32 {
+	var count int32
+	for _, b := range this.batches {
+		count += b.remaining
+	}
+	return count
+}
+
+func (this *Client) requestRefill() {
+	select {
+	case this.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (this *Client) refillLoop() {
+	for {
+		select {
+		case <-this.closed:
+			return
+		case <-this.trigger:
+		}
+		for {
+			granted, err := this.refill()
+			if err != nil {
+				log.Println("request rate tokens error:", err, "resource:", this.opts.ResourceId)
+			}
+			if err == nil && granted > 0 {
+				if this.Available() > this.opts.RefillThreshold {
+					break
+				}
+				continue
+			}
+			// the server is unreachable or out of tokens
+			timer := time.NewTimer(this.opts.RetryInterval)
+			select {
+			case <-this.closed:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			if this.Available() > this.opts.RefillThreshold {
+				break
+			}
+		}
+	}
+}
+
+// refill requests a batch of tokens and wakes the waiting callers
+func (this *Client) refill() (int32, error) {
+	this.lock.Lock()
+	pending := this.pending
+	if pending == nil {
+		requestId, err := newRequestId()
+		if err != nil {
+			this.lock.Unlock()
+			return 0, err
+		}
+		now := time.Now()
+		pending = &pendingRequest{
+			req: &RateTokenRequest{
+				ResourceId:   this.opts.ResourceId,
+				MaxCount:     this.opts.BatchSize,
+				RequestId:    requestId,
+				ClientId:     this.opts.ClientId,
+				ReqTimestamp: now.UnixMilli(),
+			},
+			sent: now,
+		}
+		this.pending = pending
+	}
+	this.lock.Unlock()
+
+	resp, answered, err := this.send(pending.req)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	defer func() {
+		close(this.refilled)
+		this.refilled = make(chan struct{})
+	}()
+	if err != nil {
+		this.unavailable = true
+		if answered {
+			// refused by the server, nothing to be granted twice
+			this.pending = nil
+		}
+		return 0, err
+	}
+	this.unavailable = false
+	this.pending = nil
+	if resp.ResourceId != pending.req.ResourceId || resp.ClientId != pending.req.ClientId ||
+		resp.RequestId != pending.req.RequestId || resp.ReqTimestamp != pending.req.ReqTimestamp {
+		return 0, errors.New("rate token response doesn't match the request")
+	}
+	// the ttl counts from sending the request, by the monotonic clock
+	expires := pending.sent.Add(time.Duration(resp.TtlInMillis) * time.Millisecond)
+	if resp.AcquiredCount <= 0 || !time.Now().Before(expires) {
+		return 0, nil
+	}
+	this.batches = append(this.batches, &tokenBatch{remaining: resp.AcquiredCount, expires: expires})
+	return resp.AcquiredCount, nil
+}
+
+// send reports whether the server answered the request, also when failing
+func (this *Client) send(req *RateTokenRequest) (*RateTokenResponse, bool, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, false, err
+	}
+	httpResp, err := this.opts.HttpClient.Post(this.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	defer httpResp.Body.Close()
+	resp := new(clientResponse)
+	if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		return nil, false, fmt.Errorf("decode rate token response, http status %d: %w", httpResp.StatusCode, err)
+	}
+	if httpResp.StatusCode != http.StatusOK || resp.Data == nil {
+		return nil, true, fmt.Errorf("rate token request failed, http status %d: %s %s", httpResp.StatusCode, resp.ErrorCode, resp.ErrorMessage)
+	}
+	return resp.Data, true, nil
+}
+
+func newRequestId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
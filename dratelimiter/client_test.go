@@ -0,0 +1,129 @@
+package dratelimiter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/meidomx/misc-service/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestClient(t *testing.T, opts ClientOptions) *Client {
+	t.Helper()
+	opts.ResourceId = "r"
+	opts.ClientId = "c"
+	opts.RetryInterval = 10 * time.Millisecond
+	client, err := NewClient(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+	})
+	return client
+}
+
+// waitFor polls cond for up to a second
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestClientWait(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	c := new(config.Config)
+	c.RateLimiter.Resources = []config.RateLimitResource{{ResourceId: "r", Rate: 1000, Burst: 20}}
+	server, err := NewTokenServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine.POST("/rate_limiter/tokens", AcquireTokens(server))
+	s := httptest.NewServer(engine)
+	t.Cleanup(s.Close)
+
+	client := newTestClient(t, ClientOptions{ServerURL: s.URL, BatchSize: 5})
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for i := 0; i < 50; i++ {
+		if err := client.Wait(ctx); err != nil {
+			t.Fatalf("wait %d: %v", i, err)
+		}
+	}
+}
+
+func TestClientTokensExpire(t *testing.T) {
+	var requests int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := new(RateTokenRequest)
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// only the first request is granted tokens
+		count := int32(0)
+		if atomic.AddInt32(&requests, 1) == 1 {
+			count = req.MaxCount
+		}
+		json.NewEncoder(w).Encode(ResponseBody(&RateTokenResponse{
+			AcquiredCount: count,
+			TtlInMillis:   50,
+			ResourceId:    req.ResourceId,
+			RequestId:     req.RequestId,
+			ClientId:      req.ClientId,
+			ReqTimestamp:  req.ReqTimestamp,
+		}))
+	}))
+	t.Cleanup(s.Close)
+
+	client := newTestClient(t, ClientOptions{ServerURL: s.URL, BatchSize: 5})
+	waitFor(t, "tokens", func() bool {
+		return client.Available() > 0
+	})
+	time.Sleep(60 * time.Millisecond)
+	if n := client.Available(); n != 0 {
+		t.Errorf("%d tokens left after their ttl", n)
+	}
+	if client.Allow() {
+		t.Error("allowed without tokens")
+	}
+}
+
+func TestClientUnavailable(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ResponseErr("5000", "internal error"))
+	}))
+	t.Cleanup(s.Close)
+
+	open := newTestClient(t, ClientOptions{ServerURL: s.URL, FailOpen: true})
+	waitFor(t, "fail open", open.Allow)
+	if err := open.Wait(context.Background()); err != nil {
+		t.Errorf("wait failing open: %v", err)
+	}
+
+	closed := newTestClient(t, ClientOptions{ServerURL: s.URL})
+	for i := 0; i < 10; i++ {
+		if closed.Allow() {
+			t.Fatal("allowed while the server is unavailable")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := closed.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("wait failing closed: %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+package dratelimiter
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func AcquireTokens(server *TokenServer) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		req := new(RateTokenRequest)
+		if err := ctx.ShouldBindJSON(req); err != nil {
+			ctx.JSON(http.StatusBadRequest, ResponseErr("4000", "invalid request"))
+			return
+		}
+		resp, err := server.Acquire(req)
+		switch {
+		case errors.Is(err, ErrInvalidRequest):
+			ctx.JSON(http.StatusBadRequest, ResponseErr("4000", "resource_id, client_id, request_id and a positive max_count are required"))
+		case errors.Is(err, ErrUnknownResource):
+			ctx.JSON(http.StatusNotFound, ResponseErr("4040", "unknown resource"))
+		case errors.Is(err, ErrRequestIdReused):
+			ctx.JSON(http.StatusConflict, ResponseErr("4090", "request id reused for another resource"))
+		case err != nil:
+			log.Println("acquire rate tokens error:", err)
+			ctx.JSON(http.StatusInternalServerError, ResponseErr("5000", "internal error"))
+		default:
+			ctx.JSON(http.StatusOK, ResponseBody(resp))
+		}
+	}
+}
+
+func ResponseOk() map[string]interface{} {
+	return map[string]interface{}{
+		"status": "0",
+	}
+}
+
+func ResponseBody(body interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"status": "0",
+		"data":   body,
+	}
+}
+
+func ResponseErr(errorCode, errorMessage string) map[string]interface{} {
+	return map[string]interface{}{
+		"status":        "1000",
+		"error_code":    errorCode,
+		"error_message": errorMessage,
+	}
+}
@@ -0,0 +1,21 @@
+package dratelimiter
+
+import (
+	"log"
+
+	"github.com/meidomx/misc-service/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+func InitRateLimiter(c *config.Config, engine *gin.Engine, container *config.Container) {
+	if !c.RateLimiter.Enable {
+		return
+	}
+	server, err := NewTokenServer(c)
+	if err != nil {
+		log.Fatalf("init rate limiter error: %v", err)
+	}
+
+	engine.POST("/rate_limiter/tokens", AcquireTokens(server))
+}
@@ -0,0 +1,293 @@
+package dratelimiter
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/meidomx/misc-service/config"
+)
+
+const (
+	_DEFAULT_TTL_MILLIS          = 1000
+	_DEFAULT_IDEMPOTENCY_SECONDS = 60
+	// _PURGE_INTERVAL between removing expired responses and client grants
+	_PURGE_INTERVAL = time.Minute
+	// _RELOAD_INTERVAL after which the configuration of a resource is loaded
+	// from the storage again
+	_RELOAD_INTERVAL = time.Minute
+
+	StorageMemory     = "memory"
+	StoragePostgresql = "postgresql"
+)
+
+var (
+	ErrUnknownResource = errors.New("unknown resource")
+	ErrInvalidRequest  = errors.New("invalid rate token request")
+	// ErrRequestIdReused is returned for a request id already used by the
+	// client for another resource
+	ErrRequestIdReused = errors.New("request id reused for another resource")
+)
+
+// TokenServer grants the tokens of token buckets per resource. A request is
+// granted min(max count, tokens available, client max count less the tokens
+// the client still holds). Responses are kept by client and request id, a
+// repeated request gets the same response without taking tokens again. They
+// are kept here unless the store keeps them for every instance.
+type TokenServer struct {
+	idempotency time.Duration
+	store       tokenStore
+	// localResponses keeps the responses and client grants in memory
+	localResponses bool
+
+	lock      sync.Mutex
+	resources map[string]*resource
+	responses map[string]*cachedResponse
+	lastPurge time.Time
+}
+
+// tokenStore keeps the buckets and the configuration of the resources
+type tokenStore interface {
+	// load returns the configuration of the resource, nil when unknown
+	load(resourceId string) (*config.RateLimitResource, error)
+	// take takes up to count tokens of the bucket, res.lock is held
+	take(res *resource, count int32, now time.Time) (int32, error)
+}
+
+// sharedStore keeps the responses and the client grants itself, shared by
+// the instances
+type sharedStore interface {
+	// acquire grants the request, res.lock is held
+	acquire(res *resource, req *RateTokenRequest, idempotency time.Duration, now time.Time) (*RateTokenResponse, error)
+}
+
+type resource struct {
+	id string
+
+	lock           sync.Mutex
+	clientMaxCount int32
+	ttl            time.Duration
+	loaded         time.Time
+	// grants of the clients still within their ttl
+	grants map[string][]clientGrant
+
+	// leased tokens of the bucket in the storage, usable until leaseExpires
+	leased       int32
+	leaseExpires time.Time
+}
+
+type clientGrant struct {
+	count   int32
+	expires time.Time
+}
+
+// cachedResponse is done once the response or error is set
+type cachedResponse struct {
+	response *RateTokenResponse
+	err      error
+	done     chan struct{}
+	expires  time.Time
+}
+
+func NewTokenServer(c *config.Config) (*TokenServer, error) {
+	for _, r := range c.RateLimiter.Resources {
+		if len(r.ResourceId) == 0 || r.Rate <= 0 {
+			return nil, errors.New("rate limiter resource requires resource_id and a positive rate")
+		}
+	}
+	var store tokenStore
+	var err error
+	switch c.RateLimiter.Storage {
+	case "", StorageMemory:
+		store, err = newMemoryStore(c.RateLimiter.Resources)
+	case StoragePostgresql:
+		store, err = newPgStore(c.RateLimiter.Resources, c.RateLimiter.LeaseTokens, time.Duration(c.RateLimiter.LeaseMillis)*time.Millisecond)
+	default:
+		err = errors.New("unknown rate limiter storage: " + c.RateLimiter.Storage)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, shared := store.(sharedStore)
+	this := &TokenServer{
+		idempotency:    time.Duration(c.RateLimiter.IdempotencySeconds) * time.Second,
+		store:          store,
+		localResponses: !shared,
+		resources:      map[string]*resource{},
+		responses:      map[string]*cachedResponse{},
+		lastPurge:      time.Now(),
+	}
+	if this.idempotency <= 0 {
+		this.idempotency = _DEFAULT_IDEMPOTENCY_SECONDS * time.Second
+	}
+	return this, nil
+}
+
+func (this *TokenServer) Acquire(req *RateTokenRequest) (*RateTokenResponse, error) {
+	if len(req.ResourceId) == 0 || len(req.ClientId) == 0 || len(req.RequestId) == 0 || req.MaxCount <= 0 {
+		return nil, ErrInvalidRequest
+	}
+	now := time.Now()
+	if !this.localResponses {
+		return this.acquire(req, now)
+	}
+	key := req.ClientId + "\x00" + req.RequestId
+
+	this.lock.Lock()
+	var purged []*resource
+	if now.Sub(this.lastPurge) >= _PURGE_INTERVAL {
+		purged = this.purgeResponses(now)
+	}
+	// outside of lock, a resource may be locked during a request to the store
+	defer func() {
+		for _, res := range purged {
+			res.purgeGrants(now)
+		}
+	}()
+	if cached, ok := this.responses[key]; ok && now.Before(cached.expires) {
+		this.lock.Unlock()
+		<-cached.done
+		if cached.err != nil {
+			return nil, cached.err
+		}
+		if cached.response.ResourceId != req.ResourceId {
+			return nil, ErrRequestIdReused
+		}
+		return cached.response, nil
+	}
+	cached := &cachedResponse{done: make(chan struct{}), expires: now.Add(this.idempotency)}
+	this.responses[key] = cached
+	this.lock.Unlock()
+
+	cached.response, cached.err = this.acquire(req, now)
+	close(cached.done)
+	if cached.err != nil {
+		// only granted responses are kept, failed requests may be retried
+		this.lock.Lock()
+		if this.responses[key] == cached {
+			delete(this.responses, key)
+		}
+		this.lock.Unlock()
+	}
+	return cached.response, cached.err
+}
+
+func (this *TokenServer) acquire(req *RateTokenRequest, now time.Time) (*RateTokenResponse, error) {
+	res, err := this.resource(req.ResourceId, now)
+	if err != nil {
+		return nil, err
+	}
+	res.lock.Lock()
+	defer res.lock.Unlock()
+	if shared, ok := this.store.(sharedStore); ok {
+		return shared.acquire(res, req, this.idempotency, now)
+	}
+
+	count := req.MaxCount
+	if res.clientMaxCount > 0 {
+		held := int32(0)
+		grants := res.grants[req.ClientId][:0]
+		for _, g := range res.grants[req.ClientId] {
+			if now.Before(g.expires) {
+				grants = append(grants, g)
+				held += g.count
+			}
+		}
+		res.grants[req.ClientId] = grants
+		if left := res.clientMaxCount - held; left < count {
+			count = left
+		}
+	}
+	if count > 0 {
+		if count, err = this.store.take(res, count, now); err != nil {
+			return nil, err
+		}
+	} else {
+		count = 0
+	}
+	if count > 0 && res.clientMaxCount > 0 {
+		res.grants[req.ClientId] = append(res.grants[req.ClientId], clientGrant{count: count, expires: now.Add(res.ttl)})
+	}
+	return newRateTokenResponse(req, count, res.ttl), nil
+}
+
+func newRateTokenResponse(req *RateTokenRequest, count int32, ttl time.Duration) *RateTokenResponse {
+	return &RateTokenResponse{
+		AcquiredCount: count,
+		TtlInMillis:   int32(ttl.Milliseconds()),
+		ResourceId:    req.ResourceId,
+		RequestId:     req.RequestId,
+		ClientId:      req.ClientId,
+		ReqTimestamp:  req.ReqTimestamp,
+	}
+}
+
+// resource returns the resource with its configuration loaded from the store
+// within _RELOAD_INTERVAL
+func (this *TokenServer) resource(resourceId string, now time.Time) (*resource, error) {
+	this.lock.Lock()
+	res, ok := this.resources[resourceId]
+	this.lock.Unlock()
+	if ok {
+		res.lock.Lock()
+		fresh := now.Sub(res.loaded) < _RELOAD_INTERVAL
+		res.lock.Unlock()
+		if fresh {
+			return res, nil
+		}
+	}
+
+	c, err := this.store.load(resourceId)
+	if err != nil {
+		return nil, err
+	}
+	this.lock.Lock()
+	if c == nil {
+		delete(this.resources, resourceId)
+		this.lock.Unlock()
+		return nil, ErrUnknownResource
+	}
+	if res, ok = this.resources[resourceId]; !ok {
+		res = &resource{id: resourceId, grants: map[string][]clientGrant{}}
+		this.resources[resourceId] = res
+	}
+	this.lock.Unlock()
+
+	res.lock.Lock()
+	defer res.lock.Unlock()
+	res.clientMaxCount = c.ClientMaxCount
+	res.ttl = time.Duration(c.TtlMillis) * time.Millisecond
+	if res.ttl <= 0 {
+		res.ttl = _DEFAULT_TTL_MILLIS * time.Millisecond
+	}
+	res.loaded = now
+	return res, nil
+}
+
+// purgeResponses removes expired responses and returns the resources to
+// purge the grants of, lock is held
+func (this *TokenServer) purgeResponses(now time.Time) []*resource {
+	this.lastPurge = now
+	for key, cached := range this.responses {
+		if !now.Before(cached.expires) {
+			delete(this.responses, key)
+		}
+	}
+	resources := make([]*resource, 0, len(this.resources))
+	for _, res := range this.resources {
+		resources = append(resources, res)
+	}
+	return resources
+}
+
+// purgeGrants removes the clients without grants within their ttl
+func (this *resource) purgeGrants(now time.Time) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for clientId, grants := range this.grants {
+		if len(grants) == 0 || !now.Before(grants[len(grants)-1].expires) {
+			delete(this.grants, clientId)
+		}
+	}
+}
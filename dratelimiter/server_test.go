@@ -0,0 +1,119 @@
+package dratelimiter
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meidomx/misc-service/config"
+)
+
+func newTestTokenServer(t *testing.T, resources ...config.RateLimitResource) *TokenServer {
+	t.Helper()
+	c := new(config.Config)
+	c.RateLimiter.Resources = resources
+	server, err := NewTokenServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func acquireTokens(t *testing.T, server *TokenServer, resourceId, clientId, requestId string, maxCount int32) int32 {
+	t.Helper()
+	resp, err := server.Acquire(&RateTokenRequest{
+		ResourceId: resourceId,
+		MaxCount:   maxCount,
+		RequestId:  requestId,
+		ClientId:   clientId,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.AcquiredCount
+}
+
+func TestTokenServerClientMaxCount(t *testing.T) {
+	// slow enough not to refill within the test
+	server := newTestTokenServer(t, config.RateLimitResource{ResourceId: "r", Rate: 0.001, Burst: 100, ClientMaxCount: 5, TtlMillis: 60000})
+
+	if n := acquireTokens(t, server, "r", "a", "1", 4); n != 4 {
+		t.Errorf("first request of a = %d, want 4", n)
+	}
+	if n := acquireTokens(t, server, "r", "a", "2", 4); n != 1 {
+		t.Errorf("second request of a = %d, want 1", n)
+	}
+	if n := acquireTokens(t, server, "r", "a", "3", 4); n != 0 {
+		t.Errorf("third request of a = %d, want 0", n)
+	}
+	if n := acquireTokens(t, server, "r", "b", "1", 10); n != 5 {
+		t.Errorf("request of b = %d, want 5", n)
+	}
+}
+
+func TestMemoryStoreRefill(t *testing.T) {
+	store, err := newMemoryStore([]config.RateLimitResource{{ResourceId: "r", Rate: 100, Burst: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := &resource{id: "r"}
+	now := store.buckets["r"].last
+
+	if n, _ := store.take(res, 20, now); n != 10 {
+		t.Errorf("take from a full bucket = %d, want 10", n)
+	}
+	if n, _ := store.take(res, 1, now); n != 0 {
+		t.Errorf("take from an empty bucket = %d, want 0", n)
+	}
+	if n, _ := store.take(res, 20, now.Add(50*time.Millisecond)); n != 5 {
+		t.Errorf("take after 50ms = %d, want 5", n)
+	}
+	if n, _ := store.take(res, 20, now.Add(time.Hour)); n != 10 {
+		t.Errorf("take after an hour = %d, want the burst", n)
+	}
+}
+
+func TestTokenServerIdempotentReplay(t *testing.T) {
+	server := newTestTokenServer(t,
+		config.RateLimitResource{ResourceId: "r", Rate: 0.001, Burst: 10, TtlMillis: 60000},
+		config.RateLimitResource{ResourceId: "other", Rate: 0.001, Burst: 10},
+	)
+
+	// concurrent retries of the same request get the same response
+	var wg sync.WaitGroup
+	counts := make([]int32, 8)
+	for i := range counts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := server.Acquire(&RateTokenRequest{ResourceId: "r", MaxCount: 6, RequestId: "1", ClientId: "a"})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			counts[i] = resp.AcquiredCount
+		}(i)
+	}
+	wg.Wait()
+	for i, n := range counts {
+		if n != 6 {
+			t.Errorf("retry %d = %d, want 6", i, n)
+		}
+	}
+	if n := acquireTokens(t, server, "r", "a", "2", 6); n != 4 {
+		t.Errorf("new request = %d, want the 4 tokens left", n)
+	}
+	if n := acquireTokens(t, server, "r", "b", "1", 6); n != 0 {
+		t.Errorf("request id of another client = %d, want 0", n)
+	}
+
+	_, err := server.Acquire(&RateTokenRequest{ResourceId: "other", MaxCount: 1, RequestId: "1", ClientId: "a"})
+	if !errors.Is(err, ErrRequestIdReused) {
+		t.Errorf("request id reused for another resource: %v", err)
+	}
+	_, err = server.Acquire(&RateTokenRequest{ResourceId: "unknown", MaxCount: 1, RequestId: "3", ClientId: "a"})
+	if !errors.Is(err, ErrUnknownResource) {
+		t.Errorf("unknown resource: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package dratelimiter
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"github.com/meidomx/misc-service/config"
+)
+
+// memoryStore keeps the buckets of the configured resources in memory, for
+// a single instance
+type memoryStore struct {
+	resources map[string]*config.RateLimitResource
+	buckets   map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newMemoryStore(resources []config.RateLimitResource) (*memoryStore, error) {
+	this := &memoryStore{
+		resources: map[string]*config.RateLimitResource{},
+		buckets:   map[string]*tokenBucket{},
+	}
+	now := time.Now()
+	for i := range resources {
+		r := resources[i]
+		if _, ok := this.resources[r.ResourceId]; ok {
+			return nil, errors.New("duplicated rate limiter resource: " + r.ResourceId)
+		}
+		r.Burst = defaultBurst(r)
+		this.resources[r.ResourceId] = &r
+		this.buckets[r.ResourceId] = &tokenBucket{
+			rate:   r.Rate,
+			burst:  float64(r.Burst),
+			tokens: float64(r.Burst),
+			last:   now,
+		}
+	}
+	return this, nil
+}
+
+// defaultBurst is the rate when no burst is configured
+func defaultBurst(r config.RateLimitResource) int32 {
+	if r.Burst > 0 {
+		return r.Burst
+	}
+	return int32(math.Max(1, math.Floor(r.Rate)))
+}
+
+func (this *memoryStore) load(resourceId string) (*config.RateLimitResource, error) {
+	return this.resources[resourceId], nil
+}
+
+func (this *memoryStore) take(res *resource, count int32, now time.Time) (int32, error) {
+	bucket := this.buckets[res.id]
+	if elapsed := now.Sub(bucket.last).Seconds(); elapsed > 0 {
+		bucket.tokens = math.Min(bucket.burst, bucket.tokens+elapsed*bucket.rate)
+		bucket.last = now
+	}
+	if available := int32(bucket.tokens); available < count {
+		count = available
+	}
+	bucket.tokens -= float64(count)
+	return count, nil
+}
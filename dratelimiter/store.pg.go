@@ -0,0 +1,272 @@
+package dratelimiter
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/meidomx/misc-service/config"
+	"github.com/meidomx/misc-service/pgbackend"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const (
+	RateLimiterServiceName = "rate_limiter"
+
+	_DEFAULT_LEASE_MILLIS = 1000
+)
+
+// pgStore keeps the buckets and the configuration of the resources in
+// misc_rate_limit_resource, shared by the instances. Tokens are taken by an
+// atomic update measured by the database clock. With leaseTokens every
+// instance takes at least that many tokens at once and grants them from
+// memory until leaseTTL passed, unused ones are dropped then.
+//
+// The responses are kept in misc_rate_limit_response, so a request retried
+// through another instance gets the same response, and client_max_count
+// counts the grants of every instance.
+type pgStore struct {
+	leaseTokens int32
+	leaseTTL    time.Duration
+
+	lock      sync.Mutex
+	lastPurge time.Time
+}
+
+func newPgStore(resources []config.RateLimitResource, leaseTokens int32, leaseTTL time.Duration) (*pgStore, error) {
+	this := &pgStore{
+		leaseTokens: leaseTokens,
+		leaseTTL:    leaseTTL,
+		lastPurge:   time.Now(),
+	}
+	if this.leaseTTL <= 0 {
+		this.leaseTTL = _DEFAULT_LEASE_MILLIS * time.Millisecond
+	}
+	for _, r := range resources {
+		if err := this.save(r); err != nil {
+			return nil, err
+		}
+	}
+	return this, nil
+}
+
+// save creates or updates the configuration of the resource, keeping the
+// tokens of its bucket
+func (this *pgStore) save(r config.RateLimitResource) error {
+	_, err := pgbackend.RunQuery(RateLimiterServiceName, nil, func(conn *pgxpool.Conn, result any) error {
+		_, err := conn.Exec(context.Background(), `
+with now_millis as (select (extract(epoch from clock_timestamp()) * 1000)::bigint as t)
+insert into misc_rate_limit_resource (resource_id, rate, burst, client_max_count, ttl_millis, tokens, last_refill, time_created, time_updated)
+select $1, $2, $3::int, $4, $5, $3::int, t, t, t from now_millis
+on conflict (resource_id) do update
+    set rate             = excluded.rate,
+        burst            = excluded.burst,
+        client_max_count = excluded.client_max_count,
+        ttl_millis       = excluded.ttl_millis,
+        tokens           = least(misc_rate_limit_resource.tokens, excluded.burst),
+        time_updated     = excluded.time_updated;`,
+			r.ResourceId, r.Rate, defaultBurst(r), r.ClientMaxCount, r.TtlMillis,
+		)
+		return err
+	})
+	return err
+}
+
+func (this *pgStore) load(resourceId string) (*config.RateLimitResource, error) {
+	r := &config.RateLimitResource{ResourceId: resourceId}
+	_, err := pgbackend.RunQuery(RateLimiterServiceName, r, func(conn *pgxpool.Conn, result *config.RateLimitResource) error {
+		return conn.QueryRow(context.Background(),
+			"select rate, burst, client_max_count, ttl_millis from misc_rate_limit_resource where resource_id = $1;",
+			resourceId,
+		).Scan(&result.Rate, &result.Burst, &result.ClientMaxCount, &result.TtlMillis)
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// acquire grants the request within a transaction holding the lock of the
+// client of the resource. A response of the request id is returned again
+// until the idempotency time and the ttl of its tokens passed.
+func (this *pgStore) acquire(res *resource, req *RateTokenRequest, idempotency time.Duration, now time.Time) (*RateTokenResponse, error) {
+	this.purge(now)
+	resp := new(RateTokenResponse)
+	_, err := pgbackend.RunTx(RateLimiterServiceName, resp, func(tx pgx.Tx, result *RateTokenResponse) error {
+		ctx := context.Background()
+		if _, err := tx.Exec(ctx, "select pg_advisory_xact_lock(hashtext($1), hashtext($2))", req.ResourceId, req.ClientId); err != nil {
+			return err
+		}
+		var t int64
+		if err := tx.QueryRow(ctx, "select (extract(epoch from clock_timestamp()) * 1000)::bigint").Scan(&t); err != nil {
+			return err
+		}
+
+		var resourceId string
+		var count, ttlMillis int32
+		err := tx.QueryRow(ctx,
+			"select resource_id, acquired_count, ttl_millis from misc_rate_limit_response where client_id = $1 and request_id = $2 and time_expires > $3",
+			req.ClientId, req.RequestId, t,
+		).Scan(&resourceId, &count, &ttlMillis)
+		if err == nil {
+			if resourceId != req.ResourceId {
+				return ErrRequestIdReused
+			}
+			*result = *newRateTokenResponse(req, count, time.Duration(ttlMillis)*time.Millisecond)
+			return nil
+		} else if !errors.Is(err, pgx.ErrNoRows) {
+			return err
+		}
+
+		count = req.MaxCount
+		if res.clientMaxCount > 0 {
+			var held int32
+			if err := tx.QueryRow(ctx,
+				"select coalesce(sum(acquired_count), 0)::int from misc_rate_limit_response where resource_id = $1 and client_id = $2 and grant_expires > $3",
+				req.ResourceId, req.ClientId, t,
+			).Scan(&held); err != nil {
+				return err
+			}
+			if left := res.clientMaxCount - held; left < count {
+				count = left
+			}
+		}
+		if count > 0 {
+			if count, err = this.takeLeased(tx, res, count, now); err != nil {
+				return err
+			}
+		} else {
+			count = 0
+		}
+
+		ttl := res.ttl.Milliseconds()
+		expires := t + idempotency.Milliseconds()
+		if expires < t+ttl {
+			expires = t + ttl
+		}
+		// an expired response of the request id is replaced, a current one was
+		// written for another resource meanwhile
+		tag, err := tx.Exec(ctx, `
+insert into misc_rate_limit_response (client_id, request_id, resource_id, acquired_count, ttl_millis, grant_expires, time_expires)
+values ($1, $2, $3, $4, $5, $6, $7)
+on conflict (client_id, request_id) do update
+    set resource_id    = excluded.resource_id,
+        acquired_count = excluded.acquired_count,
+        ttl_millis     = excluded.ttl_millis,
+        grant_expires  = excluded.grant_expires,
+        time_expires   = excluded.time_expires
+    where misc_rate_limit_response.time_expires <= $8;`,
+			req.ClientId, req.RequestId, req.ResourceId, count, ttl, t+ttl, expires, t,
+		)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrRequestIdReused
+		}
+		*result = *newRateTokenResponse(req, count, res.ttl)
+		return nil
+	})
+	if err != nil {
+		// tokens leased within the rolled back transaction are not taken
+		res.leased = 0
+		return nil, err
+	}
+	return resp, nil
+}
+
+// purge deletes the expired responses, at most once per interval per instance
+func (this *pgStore) purge(now time.Time) {
+	this.lock.Lock()
+	if now.Sub(this.lastPurge) < _PURGE_INTERVAL {
+		this.lock.Unlock()
+		return
+	}
+	this.lastPurge = now
+	this.lock.Unlock()
+
+	if _, err := pgbackend.RunQuery(RateLimiterServiceName, nil, func(conn *pgxpool.Conn, result any) error {
+		_, err := conn.Exec(context.Background(),
+			"delete from misc_rate_limit_response where time_expires < (extract(epoch from clock_timestamp()) * 1000)::bigint")
+		return err
+	}); err != nil {
+		log.Println("purge rate limiter responses error:", err)
+	}
+}
+
+// take takes tokens without keeping a response
+func (this *pgStore) take(res *resource, count int32, now time.Time) (int32, error) {
+	var taken int32
+	_, err := pgbackend.RunTx(RateLimiterServiceName, &taken, func(tx pgx.Tx, result *int32) error {
+		var err error
+		*result, err = this.takeLeased(tx, res, count, now)
+		return err
+	})
+	if err != nil {
+		res.leased = 0
+	}
+	return taken, err
+}
+
+// takeLeased takes the tokens from the lease of the instance, leasing more
+// within tx when it runs short
+func (this *pgStore) takeLeased(tx pgx.Tx, res *resource, count int32, now time.Time) (int32, error) {
+	if this.leaseTokens <= 0 {
+		return this.takeStored(tx, res.id, count)
+	}
+	if !now.Before(res.leaseExpires) {
+		res.leased = 0
+	}
+	if res.leased < count {
+		want := count - res.leased
+		if want < this.leaseTokens {
+			want = this.leaseTokens
+		}
+		// the transaction fails with the statement, the lease is dropped then
+		taken, err := this.takeStored(tx, res.id, want)
+		if err != nil {
+			return 0, err
+		} else if taken > 0 {
+			res.leased += taken
+			res.leaseExpires = now.Add(this.leaseTTL)
+		}
+	}
+	if res.leased < count {
+		count = res.leased
+	}
+	res.leased -= count
+	return count, nil
+}
+
+// takeStored refills the bucket in the storage and takes up to count tokens
+func (this *pgStore) takeStored(tx pgx.Tx, resourceId string, count int32) (int32, error) {
+	var taken int32
+	err := tx.QueryRow(context.Background(), `
+with now_millis as (select (extract(epoch from clock_timestamp()) * 1000)::bigint as t),
+     refilled as (
+         select r.resource_id, n.t,
+                least(r.burst, r.tokens + greatest(0, n.t - r.last_refill) * r.rate / 1000.0) as tokens
+         from misc_rate_limit_resource r, now_millis n
+         where r.resource_id = $1
+         for update of r
+     )
+update misc_rate_limit_resource r
+set tokens       = f.tokens - least($2::int, floor(f.tokens)),
+    last_refill  = greatest(r.last_refill, f.t),
+    time_updated = f.t
+from refilled f
+where r.resource_id = f.resource_id
+returning least($2::int, floor(f.tokens))::int;`,
+		resourceId, count,
+	).Scan(&taken)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrUnknownResource
+	}
+	return taken, err
+}
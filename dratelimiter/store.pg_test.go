@@ -0,0 +1,24 @@
+package dratelimiter
+
+import (
+	"testing"
+	"time"
+)
+
+// the lease is only refilled from the table when it runs short, these takes
+// don't reach the database
+func TestPgStoreLease(t *testing.T) {
+	store := &pgStore{leaseTokens: 10, leaseTTL: time.Second}
+	now := time.Now()
+	res := &resource{id: "r", leased: 5, leaseExpires: now.Add(time.Second)}
+
+	if n, err := store.takeLeased(nil, res, 3, now); err != nil || n != 3 {
+		t.Errorf("take from the lease = %d, %v", n, err)
+	}
+	if n, err := store.takeLeased(nil, res, 2, now); err != nil || n != 2 {
+		t.Errorf("take the rest of the lease = %d, %v", n, err)
+	}
+	if res.leased != 0 {
+		t.Errorf("%d tokens left in the lease", res.leased)
+	}
+}
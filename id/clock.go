@@ -0,0 +1,153 @@
+package id
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// _TIME_STORE_WINDOW_MILLIS is persisted ahead of the time issued, so the
+	// store is written once a window instead of for every millisecond
+	_TIME_STORE_WINDOW_MILLIS int64 = 1000
+)
+
+// ClockStats counts clock rollbacks seen by an IdGen
+type ClockStats struct {
+	Rollbacks          uint64 `json:"rollbacks"`
+	Waited             uint64 `json:"waited"`
+	Borrowed           uint64 `json:"borrowed"`
+	Failed             uint64 `json:"failed"`
+	LastRollbackMillis int64  `json:"last_rollback_millis"`
+	MaxRollbackMillis  int64  `json:"max_rollback_millis"`
+	// BorrowedMillis is how far the last time issued is ahead of the clock
+	BorrowedMillis int64 `json:"borrowed_millis"`
+}
+
+// TimeStore persists the last time ids were issued at, in unix millis
+type TimeStore interface {
+	LoadTime() (int64, error)
+	SaveTime(t int64) error
+}
+
+func (this *IdGen) ClockStats() ClockStats {
+	this.lock.Lock()
+	stats := this.stats
+	this.lock.Unlock()
+	last := this.loadState().time
+	if now := this.getTimeMillis(); last > now {
+		stats.BorrowedMillis = last - now
+	}
+	return stats
+}
+
+// SetTimeStore restores the last time issued from the store and persists it
+// from now on, so a restart after the clock went back can't issue ids
+// again. The unused rest of the persisted window is waited out.
+func (this *IdGen) SetTimeStore(store TimeStore) error {
+	last, err := store.LoadTime()
+	if err != nil {
+		return err
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.timeStore = store
+	atomic.StoreInt64(&this.savedUntil, 0)
+	for {
+		old := this.loadState()
+		if last <= old.time {
+			break
+		}
+		// all sequences of the last time may have been issued
+		if this.state.CompareAndSwap(old, &idState{time: last, seq: _MAX_SEQ}) {
+			break
+		}
+	}
+	if wait := last - this.getTimeMillis(); wait > 0 && wait <= _TIME_STORE_WINDOW_MILLIS {
+		this.tillMillisecond(last + 1)
+	}
+	return nil
+}
+
+// persistTime saves a window ahead of the time issued once it passed the
+// time saved before
+func (this *IdGen) persistTime(t int64) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.timeStore == nil || t <= atomic.LoadInt64(&this.savedUntil) {
+		return nil
+	}
+	until := t + _TIME_STORE_WINDOW_MILLIS
+	if err := this.timeStore.SaveTime(until); err != nil {
+		log.Println("save id time error:", err)
+		return err
+	}
+	atomic.StoreInt64(&this.savedUntil, until)
+	return nil
+}
+
+// FileTimeStore keeps the time in a file, replaced on every save. Ids
+// generators of several element ids may share it, it keeps the latest time.
+type FileTimeStore struct {
+	path string
+
+	lock  sync.Mutex
+	saved int64
+}
+
+func NewFileTimeStore(path string) *FileTimeStore {
+	return &FileTimeStore{path: path}
+}
+
+func (this *FileTimeStore) LoadTime() (int64, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	data, err := os.ReadFile(this.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return this.saved, nil
+	} else if err != nil {
+		return 0, err
+	}
+	t, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if t > this.saved {
+		this.saved = t
+	}
+	return this.saved, nil
+}
+
+func (this *FileTimeStore) SaveTime(t int64) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if t <= this.saved {
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(this.path), filepath.Base(this.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(strconv.FormatInt(t, 10) + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), this.path); err != nil {
+		return err
+	}
+	this.saved = t
+	return nil
+}
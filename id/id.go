@@ -2,8 +2,11 @@ package id
 
 import (
 	"errors"
-	"runtime"
+	"log"
+	"math"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -11,11 +14,16 @@ var (
 	_EMPTY_RESULT         = [2]int64{0, 0}
 	_EMPTY_RANGE_RESULT   = []ItemId{}
 	_ERROR_CLOCK_BACKWARD = errors.New("clock backward")
-	_MAX_VALUE_INT32      = int32(0x7fffffff)
+	_ERROR_INVALID_COUNT  = errors.New("invalid id count")
+
+	// ErrClockBackward is returned while the clock is behind beyond tolerance
+	ErrClockBackward = _ERROR_CLOCK_BACKWARD
 )
 
 const (
 	_START_TIME_MILLIS int64 = 1521639000000 // 20180321213000
+
+	_MAX_SEQ = math.MaxInt32
 )
 
 type ItemId [2]int64
@@ -43,6 +51,12 @@ func (this ItemId) HexString() string {
 	return Int64Hex(this[0]) + Int64Hex(this[1])
 }
 
+// UUIDString formats the id like a UUID, 8-4-4-4-12 lowercase hex digits
+func (this ItemId) UUIDString() string {
+	h := strings.ToLower(this.HexString())
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
 func (this ItemId) CompareTo(id2 ItemId) int {
 	if this[0] > id2[0] {
 		return 1
@@ -57,24 +71,84 @@ func (this ItemId) CompareTo(id2 ItemId) int {
 	}
 }
 
+// IdGen issues ids without locks: the time and the last sequence issued are
+// held by state, which every call replaces by compare and swap. Only clock
+// rollbacks and persisting the time take the lock.
 type IdGen struct {
-	lock sync.Mutex
-
-	time int64
-	seq  int32
+	// accessed atomically, first to be 64-bit aligned
+	savedUntil    int64
+	waitTolerance int64
+	borrowLimit   int64
+	borrowing     int32
 
 	nodeIdMask    int64
 	elementIdMask int64
+
+	// state is the *idState of the last ids issued
+	state atomic.Value
+
+	// lease of the node id, nil when it is configured
+	lease *NodeLease
+
+	lock  sync.Mutex
+	stats ClockStats
+	// timeStore keeps the last time issued across restarts, persisted up to
+	// savedUntil
+	timeStore TimeStore
 }
 
 // 48 bits time + 16 bits nodeId + 32 bits elementId + 32 bits inc
 func NewIdGen(nodeId int16, elementId int32) *IdGen {
-	return &IdGen{
-		time:          0,
-		seq:           0,
+	g := &IdGen{
+		savedUntil:    math.MaxInt64,
 		nodeIdMask:    int64(nodeId) & 0x000000000000FFFF,
 		elementIdMask: (int64(elementId) & 0x00000000FFFFFFFF) << 32,
 	}
+	g.state.Store(&idState{})
+	return g
+}
+
+// NewLeasedIdGen generates ids with the node id of the lease, failing with
+// ErrLeaseLost once the lease isn't valid anymore
+func NewLeasedIdGen(lease *NodeLease, elementId int32) *IdGen {
+	g := NewIdGen(lease.NodeId(), elementId)
+	g.lease = lease
+	return g
+}
+
+func (this *IdGen) ElementId() int32 {
+	return int32(this.elementIdMask >> 32)
+}
+
+// ForElement returns a generator of the same node for another element id,
+// sharing the lease, clock tolerance and time store
+func (this *IdGen) ForElement(elementId int32) (*IdGen, error) {
+	g := NewIdGen(0, elementId)
+	g.nodeIdMask = this.nodeIdMask
+	g.lease = this.lease
+	g.SetClockTolerance(
+		time.Duration(atomic.LoadInt64(&this.waitTolerance))*time.Millisecond,
+		time.Duration(atomic.LoadInt64(&this.borrowLimit))*time.Millisecond,
+	)
+	this.lock.Lock()
+	store := this.timeStore
+	this.lock.Unlock()
+
+	if store != nil {
+		if err := g.SetTimeStore(store); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// SetClockTolerance configures the handling of the clock going backward.
+// Rollbacks up to wait block until the clock caught up again, larger ones up
+// to borrow continue from the last time issued as if the clock hadn't gone
+// back. Larger rollbacks fail with the clock backward error.
+func (this *IdGen) SetClockTolerance(wait, borrow time.Duration) {
+	atomic.StoreInt64(&this.waitTolerance, wait.Milliseconds())
+	atomic.StoreInt64(&this.borrowLimit, borrow.Milliseconds())
 }
 
 func (id *IdGen) getTimeMillis() int64 {
@@ -83,72 +157,126 @@ func (id *IdGen) getTimeMillis() int64 {
 }
 
 func (this *IdGen) NextN(cnt int) ([]ItemId, error) {
+	if cnt <= 0 || cnt > _MAX_SEQ {
+		return _EMPTY_RANGE_RESULT, _ERROR_INVALID_COUNT
+	}
+	if this.lease != nil && !this.lease.Valid() {
+		return _EMPTY_RANGE_RESULT, ErrLeaseLost
+	}
+	timeInMills, seqStart, err := this.reserve(int32(cnt))
+	if err != nil {
+		return _EMPTY_RANGE_RESULT, err
+	}
 	result := make([]ItemId, cnt)
-	timeInMills := this.getTimeMillis()
-	this.lock.Lock()
+	return makeIdRange(timeInMills, this.nodeIdMask, this.elementIdMask, result, seqStart, seqStart+int32(cnt-1)), nil
+}
 
-	if timeInMills > this.time {
-		// set seq to zero & return result
-		this.time = timeInMills
-		this.seq = int32(cnt - 1)
-		this.lock.Unlock()
-		return makeIdRange(timeInMills, this.nodeIdMask, this.elementIdMask, result, 0, int32(cnt-1)), nil
-	} else if timeInMills == this.time {
-		newSeq := this.seq + int32(cnt-1)
-		// inc seq or wait until next time
-		if newSeq < _MAX_VALUE_INT32 {
-			// inc seq
-			prevSeq := this.seq
-			this.seq = newSeq
-			this.lock.Unlock()
-			return makeIdRange(timeInMills, this.nodeIdMask, this.elementIdMask, result, prevSeq, newSeq-1), nil
-		} else {
-			// wait until next time
-			newtime := this.tillNextMillisecond(timeInMills)
-			// success
-			this.time = newtime
-			this.seq = int32(cnt - 1)
-			this.lock.Unlock()
-			return makeIdRange(newtime, this.nodeIdMask, this.elementIdMask, result, 0, int32(cnt-1)), nil
-		}
-	} else {
-		// error: clock backward
-		this.lock.Unlock()
-		return _EMPTY_RANGE_RESULT, _ERROR_CLOCK_BACKWARD
+func (id *IdGen) Next() (ItemId, error) {
+	if id.lease != nil && !id.lease.Valid() {
+		return _EMPTY_RESULT, ErrLeaseLost
 	}
+	timeInMills, seq, err := id.reserve(1)
+	if err != nil {
+		return _EMPTY_RESULT, err
+	}
+	return makeId(timeInMills, id.nodeIdMask, id.elementIdMask, seq), nil
 }
 
-func (id *IdGen) Next() (ItemId, error) {
-	timeInMills := id.getTimeMillis()
-	id.lock.Lock()
-
-	if timeInMills > id.time {
-		// set seq to zero & return result
-		id.time = timeInMills
-		id.seq = 0
-		id.lock.Unlock()
-		return makeId(timeInMills, id.nodeIdMask, id.elementIdMask, 0), nil
-	} else if timeInMills == id.time {
-		// inc seq or wait until next time
-		if id.seq < _MAX_VALUE_INT32 {
+// idState is the time of the last ids and the last sequence issued at it.
+// It is never modified, a new one replaces it, so the time and the full
+// 32-bit sequence change together.
+type idState struct {
+	time int64
+	seq  int32
+}
+
+func (this *IdGen) loadState() *idState {
+	return this.state.Load().(*idState)
+}
+
+// reserve returns the time and the first of cnt sequences for new ids
+func (this *IdGen) reserve(cnt int32) (int64, int32, error) {
+	for {
+		old := this.loadState()
+		last, lastSeq := old.time, old.seq
+		timeInMills := this.getTimeMillis()
+
+		var seqStart int32
+		caughtUp := false
+		switch {
+		case timeInMills > last:
+			// set seq to zero
+			last = timeInMills
+			seqStart = 0
+			caughtUp = true
+		case timeInMills < last && !this.borrowingOver(last-timeInMills):
+			if err := this.clockBackward(); err != nil {
+				return 0, 0, err
+			}
+			continue
+		case lastSeq <= _MAX_SEQ-cnt:
 			// inc seq
-			id.seq = id.seq + 1
-			newseq := id.seq
-			id.lock.Unlock()
-			return makeId(timeInMills, id.nodeIdMask, id.elementIdMask, newseq), nil
-		} else {
+			seqStart = lastSeq + 1
+		case timeInMills < last && last+1-timeInMills <= atomic.LoadInt64(&this.borrowLimit):
+			// still behind the clock, borrow the next time as well
+			last++
+			seqStart = 0
+		default:
 			// wait until next time
-			newtime := id.tillNextMillisecond(timeInMills)
-			// success
-			id.time = newtime
-			id.seq = 0
-			id.lock.Unlock()
-			return makeId(newtime, id.nodeIdMask, id.elementIdMask, 0), nil
+			this.tillMillisecond(last + 1)
+			continue
 		}
-	} else {
-		// error: clock backward
-		id.lock.Unlock()
-		return _EMPTY_RESULT, _ERROR_CLOCK_BACKWARD
+		if !this.state.CompareAndSwap(old, &idState{time: last, seq: seqStart + cnt - 1}) {
+			continue
+		}
+
+		if caughtUp && atomic.LoadInt32(&this.borrowing) != 0 {
+			atomic.StoreInt32(&this.borrowing, 0)
+		}
+		if last > atomic.LoadInt64(&this.savedUntil) {
+			if err := this.persistTime(last); err != nil {
+				return 0, 0, err
+			}
+		}
+		return last, seqStart, nil
+	}
+}
+
+// borrowingOver reports whether a rollback is still being borrowed over
+func (this *IdGen) borrowingOver(back int64) bool {
+	return atomic.LoadInt32(&this.borrowing) != 0 && back <= atomic.LoadInt64(&this.borrowLimit)
+}
+
+// clockBackward handles the clock being behind the last time issued, callers
+// retry after it. Concurrent callers see a rollback once, after the first of
+// them waited or started borrowing.
+func (this *IdGen) clockBackward() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	last := this.loadState().time
+	back := last - this.getTimeMillis()
+	if back <= 0 || this.borrowingOver(back) {
+		return nil
+	}
+	this.stats.Rollbacks++
+	this.stats.LastRollbackMillis = back
+	if back > this.stats.MaxRollbackMillis {
+		this.stats.MaxRollbackMillis = back
+	}
+	switch {
+	case back <= atomic.LoadInt64(&this.waitTolerance):
+		this.stats.Waited++
+		this.tillMillisecond(last)
+		return nil
+	case back <= atomic.LoadInt64(&this.borrowLimit):
+		this.stats.Borrowed++
+		atomic.StoreInt32(&this.borrowing, 1)
+		return nil
+	default:
+		this.stats.Failed++
+		log.Println("clock backward", back, "ms, beyond tolerance. node id:", this.nodeIdMask)
+		return _ERROR_CLOCK_BACKWARD
 	}
 }
 
@@ -165,12 +293,13 @@ func makeId(time, nodeIdMask int64, elementId int64, seq int32) ItemId {
 	return [2]int64{((time - _START_TIME_MILLIS) << 16) | nodeIdMask, l}
 }
 
-func (id *IdGen) tillNextMillisecond(time int64) int64 {
+// tillMillisecond sleeps until the clock reached time
+func (id *IdGen) tillMillisecond(t int64) int64 {
 	for {
 		newtime := id.getTimeMillis()
-		if newtime > time {
+		if newtime >= t {
 			return newtime
 		}
-		runtime.Gosched()
+		time.Sleep(time.Duration(t-newtime) * time.Millisecond)
 	}
 }
@@ -0,0 +1,93 @@
+package id
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestNextNRangesDontOverlap(t *testing.T) {
+	idGen := NewIdGen(1, 1)
+	const workers = 8
+	results := make([][]ItemId, workers)
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; n < 200; n++ {
+				cnt := 1 + (i*31+n*17)%100
+				ids, err := idGen.NextN(cnt)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				if len(ids) != cnt {
+					t.Errorf("NextN(%d) returned %d ids", cnt, len(ids))
+				}
+				results[i] = append(results[i], ids...)
+				one, err := idGen.Next()
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				results[i] = append(results[i], one)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[ItemId]bool{}
+	for i, ids := range results {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		for _, id := range ids {
+			if seen[id] {
+				t.Fatalf("id %s issued twice", id.HexString())
+			}
+			seen[id] = true
+		}
+	}
+}
+
+func TestNextNFullSequence(t *testing.T) {
+	idGen := NewIdGen(1, 1)
+	cnt := 1<<22 + 1
+	ids, err := idGen.NextN(cnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != cnt || ids[0] == ids[cnt-1] {
+		t.Fatalf("NextN(%d) returned %d ids", cnt, len(ids))
+	}
+	next, err := idGen.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.CompareTo(ids[cnt-1]) <= 0 {
+		t.Errorf("id %s not after %s", next.HexString(), ids[cnt-1].HexString())
+	}
+}
+
+func BenchmarkNext(b *testing.B) {
+	idGen := NewIdGen(1, 1)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := idGen.Next(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkNextN(b *testing.B) {
+	idGen := NewIdGen(1, 1)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := idGen.NextN(16); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
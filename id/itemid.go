@@ -0,0 +1,218 @@
+package id
+
+import (
+	"database/sql/driver"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Text forms of ItemId. The hex, UUID and base32 forms are the 128 bits of
+// the id as they are: 48 bits time since _START_TIME_MILLIS, 16 bits node id,
+// 32 bits element id and 32 bits sequence. The UUIDv7 form rearranges them
+// into a version 7 UUID, which holds node ids up to 12 bits and element ids
+// up to 30 bits.
+const (
+	crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	// _BASE32_LENGTH characters hold 130 bits, the first character 3 of them
+	_BASE32_LENGTH = 26
+
+	_UUIDV7_MAX_NODE_ID    = 1<<12 - 1
+	_UUIDV7_MAX_ELEMENT_ID = 1<<30 - 1
+)
+
+var (
+	ErrInvalidItemId = errors.New("invalid item id")
+
+	crockfordValues [256]byte
+)
+
+func init() {
+	for i := range crockfordValues {
+		crockfordValues[i] = 0xff
+	}
+	for i := 0; i < len(crockfordAlphabet); i++ {
+		crockfordValues[crockfordAlphabet[i]] = byte(i)
+		crockfordValues[strings.ToLower(crockfordAlphabet[i : i+1])[0]] = byte(i)
+	}
+	// read alike characters of crockford's base32
+	for _, c := range "oO" {
+		crockfordValues[c] = 0
+	}
+	for _, c := range "iIlL" {
+		crockfordValues[c] = 1
+	}
+}
+
+// ItemIdParts are the fields of an ItemId
+type ItemIdParts struct {
+	Time       time.Time `json:"time"`
+	TimeMillis int64     `json:"time_millis"`
+	NodeId     int16     `json:"node_id"`
+	ElementId  int32     `json:"element_id"`
+	Sequence   int32     `json:"sequence"`
+}
+
+func (this ItemId) Decode() ItemIdParts {
+	millis := int64(uint64(this[0])>>16) + _START_TIME_MILLIS
+	return ItemIdParts{
+		Time:       time.UnixMilli(millis).UTC(),
+		TimeMillis: millis,
+		NodeId:     int16(this[0]),
+		ElementId:  int32(uint64(this[1]) >> 32),
+		Sequence:   int32(this[1]),
+	}
+}
+
+func (this ItemId) Bytes() [16]byte {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(this[0]))
+	binary.BigEndian.PutUint64(b[8:], uint64(this[1]))
+	return b
+}
+
+func ItemIdFromBytes(b []byte) (ItemId, error) {
+	if len(b) != 16 {
+		return _EMPTY_RESULT, ErrInvalidItemId
+	}
+	return ItemId{int64(binary.BigEndian.Uint64(b[:8])), int64(binary.BigEndian.Uint64(b[8:]))}, nil
+}
+
+// Base32String encodes with crockford's base32 in 26 characters, which sort
+// like the ids
+func (this ItemId) Base32String() string {
+	hi, lo := uint64(this[0]), uint64(this[1])
+	result := make([]byte, _BASE32_LENGTH)
+	for i := _BASE32_LENGTH - 1; i >= 0; i-- {
+		result[i] = crockfordAlphabet[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(result)
+}
+
+func parseBase32(s string) (ItemId, error) {
+	var hi, lo uint64
+	for i := 0; i < len(s); i++ {
+		v := crockfordValues[s[i]]
+		if v == 0xff {
+			return _EMPTY_RESULT, ErrInvalidItemId
+		}
+		if i == 0 && v > 7 {
+			// more than 128 bits
+			return _EMPTY_RESULT, ErrInvalidItemId
+		}
+		hi = hi<<5 | lo>>59
+		lo = lo<<5 | uint64(v)
+	}
+	return ItemId{int64(hi), int64(lo)}, nil
+}
+
+// UUIDv7String encodes the id as version 7 UUID: the unix time in millis,
+// the version, 12 bits node id, the variant, 30 bits element id and the
+// sequence. It fails for node and element ids exceeding these bits.
+func (this ItemId) UUIDv7String() (string, error) {
+	parts := this.Decode()
+	if parts.NodeId < 0 || parts.NodeId > _UUIDV7_MAX_NODE_ID || parts.ElementId < 0 || parts.ElementId > _UUIDV7_MAX_ELEMENT_ID {
+		return "", fmt.Errorf("node id %d or element id %d exceeds the uuidv7 layout", parts.NodeId, parts.ElementId)
+	}
+	hi := uint64(parts.TimeMillis)<<16 | 0x7<<12 | uint64(parts.NodeId)
+	lo := uint64(0x2)<<62 | uint64(parts.ElementId)<<32 | uint64(uint32(parts.Sequence))
+	return ItemId{int64(hi), int64(lo)}.UUIDString(), nil
+}
+
+// ParseUUIDv7 parses the form of UUIDv7String
+func ParseUUIDv7(s string) (ItemId, error) {
+	if len(s) != 36 {
+		return _EMPTY_RESULT, ErrInvalidItemId
+	}
+	raw, err := ParseItemId(s)
+	if err != nil {
+		return _EMPTY_RESULT, err
+	}
+	hi, lo := uint64(raw[0]), uint64(raw[1])
+	if hi>>12&0xf != 0x7 || lo>>62 != 0x2 {
+		return _EMPTY_RESULT, ErrInvalidItemId
+	}
+	millis := int64(hi >> 16)
+	if millis < _START_TIME_MILLIS {
+		return _EMPTY_RESULT, ErrInvalidItemId
+	}
+	nodeId := int64(hi & 0xfff)
+	elementId := int64(lo >> 32 & _UUIDV7_MAX_ELEMENT_ID)
+	return ItemId{(millis-_START_TIME_MILLIS)<<16 | nodeId, elementId<<32 | int64(uint32(lo))}, nil
+}
+
+// ParseItemId parses the hex form of HexString, the UUID form of UUIDString
+// and the base32 form of Base32String, case-insensitively
+func ParseItemId(s string) (ItemId, error) {
+	s = strings.TrimSpace(s)
+	switch len(s) {
+	case 32:
+		return parseHex(s)
+	case 36:
+		if s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+			return _EMPTY_RESULT, ErrInvalidItemId
+		}
+		return parseHex(s[0:8] + s[9:13] + s[14:18] + s[19:23] + s[24:])
+	case _BASE32_LENGTH:
+		return parseBase32(s)
+	default:
+		return _EMPTY_RESULT, ErrInvalidItemId
+	}
+}
+
+func parseHex(s string) (ItemId, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return _EMPTY_RESULT, ErrInvalidItemId
+	}
+	return ItemIdFromBytes(b)
+}
+
+// MarshalText encodes with HexString
+func (this ItemId) MarshalText() ([]byte, error) {
+	return []byte(this.HexString()), nil
+}
+
+func (this *ItemId) UnmarshalText(text []byte) error {
+	i, err := ParseItemId(string(text))
+	if err != nil {
+		return err
+	}
+	*this = i
+	return nil
+}
+
+// Scan reads ids of uuid columns as well as the text forms
+func (this *ItemId) Scan(src interface{}) error {
+	var i ItemId
+	var err error
+	switch v := src.(type) {
+	case string:
+		i, err = ParseItemId(v)
+	case []byte:
+		if len(v) == 16 {
+			i, err = ItemIdFromBytes(v)
+		} else {
+			i, err = ParseItemId(string(v))
+		}
+	case [16]byte:
+		i, err = ItemIdFromBytes(v[:])
+	default:
+		err = fmt.Errorf("scan item id from %T", src)
+	}
+	if err != nil {
+		return err
+	}
+	*this = i
+	return nil
+}
+
+// Value writes the UUID form, for uuid columns
+func (this ItemId) Value() (driver.Value, error) {
+	return this.UUIDString(), nil
+}
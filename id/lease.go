@@ -0,0 +1,275 @@
+package id
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/meidomx/misc-service/pgbackend"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const (
+	NodeLeaseServiceName = "id_node_lease"
+
+	// _LEASE_CLAIM_RETRIES covers instances claiming the same free node id at once
+	_LEASE_CLAIM_RETRIES = 5
+	_LEASE_MAX_NODE_ID   = 0x7fff
+)
+
+var (
+	ErrLeaseLost       = errors.New("node id lease lost")
+	ErrNoFreeNodeId    = errors.New("no free node id to lease")
+	errLeaseNotRenewed = errors.New("node id lease is held by another owner")
+)
+
+// NodeLease is a node id claimed in misc_id_node_lease. The row expires
+// unless renewed by the heartbeat, so node ids of stopped instances are
+// reused. Expiry is measured by the database clock. The lease is valid
+// locally until ttl after the start of the last successful heartbeat, which
+// ends before the row can expire and another instance can claim the id.
+type NodeLease struct {
+	// accessed atomically, first to be 64-bit aligned. validUntil is in
+	// nanos since epoch, measured by the monotonic clock
+	validUntil int64
+	lost       int32
+	epoch      time.Time
+
+	nodeId int16
+	owner  string
+	// lastTime is the time saved by the holders of the node id
+	lastTime  int64
+	ttl       time.Duration
+	heartbeat time.Duration
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// ClaimNodeLease claims the lowest free or expired node id between minNodeId
+// and maxNodeId
+func ClaimNodeLease(minNodeId, maxNodeId int16, ttl, heartbeat time.Duration) (*NodeLease, error) {
+	if minNodeId <= 0 {
+		minNodeId = 1
+	}
+	if maxNodeId <= 0 || maxNodeId > _LEASE_MAX_NODE_ID {
+		maxNodeId = _LEASE_MAX_NODE_ID
+	}
+	if minNodeId > maxNodeId {
+		return nil, fmt.Errorf("invalid node id range %d-%d", minNodeId, maxNodeId)
+	}
+	if heartbeat <= 0 || heartbeat >= ttl {
+		return nil, errors.New("lease heartbeat has to be shorter than its ttl")
+	}
+	owner, err := newLeaseOwner()
+	if err != nil {
+		return nil, err
+	}
+
+	lease := &NodeLease{
+		owner:     owner,
+		ttl:       ttl,
+		heartbeat: heartbeat,
+		closed:    make(chan struct{}),
+	}
+	for i := 0; i < _LEASE_CLAIM_RETRIES; i++ {
+		start := time.Now()
+		nodeId, lastTime, err := claimNodeId(owner, minNodeId, maxNodeId, ttl)
+		if err != nil {
+			return nil, err
+		}
+		if nodeId > 0 {
+			lease.nodeId = nodeId
+			lease.lastTime = lastTime
+			lease.epoch = start
+			lease.validUntil = int64(ttl)
+			log.Println("leased node id:", nodeId, "owner:", owner)
+			return lease, nil
+		}
+	}
+	return nil, ErrNoFreeNodeId
+}
+
+func newLeaseOwner() (string, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%d/%s", host, os.Getpid(), hex.EncodeToString(b)), nil
+}
+
+type claimedNodeId struct {
+	NodeId   int16
+	LastTime int64
+}
+
+// claimNodeId returns the node id claimed and its last time, 0 when another
+// instance claimed the candidate at the same time
+func claimNodeId(owner string, minNodeId, maxNodeId int16, ttl time.Duration) (int16, int64, error) {
+	var claimed claimedNodeId
+	_, err := pgbackend.RunQuery(NodeLeaseServiceName, &claimed, func(conn *pgxpool.Conn, result *claimedNodeId) error {
+		rows, err := conn.Query(context.Background(), `
+with now_millis as (select (extract(epoch from clock_timestamp()) * 1000)::bigint as t)
+insert into misc_id_node_lease (node_id, owner, expire_time, time_created, time_updated)
+select n, $1, now_millis.t + $4, now_millis.t, now_millis.t
+from generate_series($2::int, $3::int) n, now_millis
+where not exists(select 1 from misc_id_node_lease l where l.node_id = n and l.expire_time > now_millis.t)
+order by n
+limit 1
+on conflict (node_id) do update
+    set owner        = excluded.owner,
+        expire_time  = excluded.expire_time,
+        time_created = excluded.time_created,
+        time_updated = excluded.time_updated
+    where misc_id_node_lease.expire_time <= excluded.time_updated
+returning node_id, last_time;`,
+			owner, int(minNodeId), int(maxNodeId), ttl.Milliseconds(),
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		if rows.Next() {
+			if err := rows.Scan(&result.NodeId, &result.LastTime); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if claimed.NodeId == 0 && !hasFreeNodeId(minNodeId, maxNodeId) {
+		return 0, 0, ErrNoFreeNodeId
+	}
+	return claimed.NodeId, claimed.LastTime, nil
+}
+
+func hasFreeNodeId(minNodeId, maxNodeId int16) bool {
+	var count int64
+	_, err := pgbackend.RunQuery(NodeLeaseServiceName, &count, func(conn *pgxpool.Conn, result *int64) error {
+		return conn.QueryRow(context.Background(), `
+select count(*) from misc_id_node_lease
+where node_id between $1 and $2 and expire_time > (extract(epoch from clock_timestamp()) * 1000)::bigint;`,
+			int(minNodeId), int(maxNodeId),
+		).Scan(result)
+	})
+	return err != nil || count < int64(maxNodeId)-int64(minNodeId)+1
+}
+
+func (this *NodeLease) NodeId() int16 {
+	return this.nodeId
+}
+
+// Valid reports whether ids may be generated with the node id
+func (this *NodeLease) Valid() bool {
+	return atomic.LoadInt32(&this.lost) == 0 && int64(time.Since(this.epoch)) < atomic.LoadInt64(&this.validUntil)
+}
+
+// Start renews the lease every heartbeat until Close
+func (this *NodeLease) Start() {
+	go func() {
+		ticker := time.NewTicker(this.heartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-this.closed:
+				return
+			case <-ticker.C:
+				if err := this.renew(); err != nil {
+					log.Println("renew node id lease error:", err)
+					if err == errLeaseNotRenewed {
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+func (this *NodeLease) renew() error {
+	start := time.Now()
+	var updated int64
+	_, err := pgbackend.RunQuery(NodeLeaseServiceName, &updated, func(conn *pgxpool.Conn, result *int64) error {
+		tag, err := conn.Exec(context.Background(), `
+update misc_id_node_lease
+set expire_time  = (extract(epoch from clock_timestamp()) * 1000)::bigint + $3,
+    time_updated = (extract(epoch from clock_timestamp()) * 1000)::bigint
+where node_id = $1 and owner = $2;`,
+			int(this.nodeId), this.owner, this.ttl.Milliseconds(),
+		)
+		*result = tag.RowsAffected()
+		return err
+	})
+	if err != nil {
+		// the lease stays valid until its local deadline, later heartbeats may succeed
+		return err
+	}
+
+	if updated == 0 {
+		atomic.StoreInt32(&this.lost, 1)
+		log.Println("node id lease lost, id generation stopped. node id:", this.nodeId)
+		return errLeaseNotRenewed
+	}
+	atomic.StoreInt64(&this.validUntil, int64(start.Sub(this.epoch)+this.ttl))
+	return nil
+}
+
+// LoadTime returns the last time saved for the node id, also by its previous
+// holders, so an IdGen of the lease can use it as TimeStore
+func (this *NodeLease) LoadTime() (int64, error) {
+	return this.lastTime, nil
+}
+
+func (this *NodeLease) SaveTime(t int64) error {
+	var updated int64
+	_, err := pgbackend.RunQuery(NodeLeaseServiceName, &updated, func(conn *pgxpool.Conn, result *int64) error {
+		tag, err := conn.Exec(context.Background(),
+			"update misc_id_node_lease set last_time = greatest(last_time, $3) where node_id = $1 and owner = $2;",
+			int(this.nodeId), this.owner, t,
+		)
+		*result = tag.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		atomic.StoreInt32(&this.lost, 1)
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// Close stops the heartbeat and releases the node id. The row is expired
+// rather than deleted, so the next holder still starts after its last_time.
+func (this *NodeLease) Close() error {
+	var err error
+	this.closeOnce.Do(func() {
+		atomic.StoreInt32(&this.lost, 1)
+		close(this.closed)
+		_, err = pgbackend.RunQuery(NodeLeaseServiceName, nil, func(conn *pgxpool.Conn, result any) error {
+			_, err := conn.Exec(context.Background(), `
+update misc_id_node_lease
+set expire_time  = (extract(epoch from clock_timestamp()) * 1000)::bigint,
+    time_updated = (extract(epoch from clock_timestamp()) * 1000)::bigint
+where node_id = $1 and owner = $2;`,
+				int(this.nodeId), this.owner,
+			)
+			return err
+		})
+	})
+	return err
+}
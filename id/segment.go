@@ -0,0 +1,230 @@
+package id
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/meidomx/misc-service/pgbackend"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const (
+	SegmentServiceName = "id_segment"
+
+	_DEFAULT_SEGMENT_STEP = 1000
+	// _DEFAULT_MAX_SEGMENT_NAMESPACES auto created at most
+	_DEFAULT_MAX_SEGMENT_NAMESPACES = 10000
+	// _SEGMENT_PREFETCH_RATIO of a segment issued starts loading the next one
+	_SEGMENT_PREFETCH_RATIO = 0.1
+)
+
+var (
+	ErrUnknownNamespace = errors.New("unknown id namespace")
+	// ErrTooManyNamespaces is returned instead of auto creating a namespace
+	// beyond the max namespaces
+	ErrTooManyNamespaces = errors.New("too many id namespaces")
+	// ErrInvalidStep is returned for a namespace whose step isn't positive
+	ErrInvalidStep = errors.New("id segment step must be positive")
+)
+
+// SegmentAllocator issues increasing int64 ids per namespace from ranges
+// reserved in misc_id_segment, so allocating is an increment in memory. The
+// next range is loaded in the background while the current one is issued.
+// Ids of ranges not used up before a restart are skipped.
+type SegmentAllocator struct {
+	step          int64
+	autoCreate    bool
+	maxNamespaces int
+
+	lock    sync.Mutex
+	buffers map[string]*segmentBuffer
+}
+
+type segment struct {
+	start int64
+	next  int64
+	max   int64
+}
+
+// segmentBuffer holds the segment issued from and the one loaded next
+type segmentBuffer struct {
+	lock       sync.Mutex
+	current    *segment
+	prefetched *segment
+	loading    bool
+	loaded     chan struct{}
+	loadErr    error
+}
+
+// NewSegmentAllocator reserves step ids at once for namespaces created by
+// it. Without autoCreate only the namespaces in misc_id_segment are served,
+// with it namespaces are created while there are less than maxNamespaces.
+func NewSegmentAllocator(step int64, autoCreate bool, maxNamespaces int) *SegmentAllocator {
+	if step <= 0 {
+		step = _DEFAULT_SEGMENT_STEP
+	}
+	if maxNamespaces <= 0 {
+		maxNamespaces = _DEFAULT_MAX_SEGMENT_NAMESPACES
+	}
+	return &SegmentAllocator{
+		step:          step,
+		autoCreate:    autoCreate,
+		maxNamespaces: maxNamespaces,
+		buffers:       map[string]*segmentBuffer{},
+	}
+}
+
+func (this *SegmentAllocator) Next(namespace string) (int64, error) {
+	buf := this.buffer(namespace)
+	buf.lock.Lock()
+	for {
+		if cur := buf.current; cur != nil && cur.next <= cur.max {
+			v := cur.next
+			cur.next++
+			if buf.prefetched == nil && !buf.loading &&
+				float64(cur.next-cur.start) >= float64(cur.max-cur.start+1)*_SEGMENT_PREFETCH_RATIO {
+				this.load(namespace, buf)
+			}
+			buf.lock.Unlock()
+			return v, nil
+		}
+		if buf.prefetched != nil {
+			buf.current = buf.prefetched
+			buf.prefetched = nil
+			continue
+		}
+		if !buf.loading {
+			this.load(namespace, buf)
+		}
+		loaded := buf.loaded
+		buf.lock.Unlock()
+		<-loaded
+		buf.lock.Lock()
+		if buf.prefetched == nil && buf.loadErr != nil {
+			err := buf.loadErr
+			buf.lock.Unlock()
+			if err == ErrUnknownNamespace || err == ErrTooManyNamespaces {
+				this.forget(namespace, buf)
+			}
+			return 0, err
+		}
+	}
+}
+
+// NextN returns cnt ids, increasing but not necessarily consecutive
+func (this *SegmentAllocator) NextN(namespace string, cnt int) ([]int64, error) {
+	if cnt <= 0 {
+		return nil, _ERROR_INVALID_COUNT
+	}
+	result := make([]int64, 0, cnt)
+	for i := 0; i < cnt; i++ {
+		v, err := this.Next(namespace)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, v)
+	}
+	return result, nil
+}
+
+func (this *SegmentAllocator) buffer(namespace string) *segmentBuffer {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	buf, ok := this.buffers[namespace]
+	if !ok {
+		buf = &segmentBuffer{}
+		this.buffers[namespace] = buf
+	}
+	return buf
+}
+
+func (this *SegmentAllocator) forget(namespace string, buf *segmentBuffer) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.buffers[namespace] == buf {
+		delete(this.buffers, namespace)
+	}
+}
+
+// load reserves the next segment in the background, buf.lock is held
+func (this *SegmentAllocator) load(namespace string, buf *segmentBuffer) {
+	buf.loading = true
+	buf.loaded = make(chan struct{})
+	go func() {
+		seg, err := this.reserve(namespace)
+		if err != nil {
+			log.Println("reserve id segment error:", err, "namespace:", namespace)
+		}
+		buf.lock.Lock()
+		defer buf.lock.Unlock()
+		buf.loading = false
+		buf.loadErr = err
+		if err == nil {
+			buf.prefetched = seg
+		}
+		close(buf.loaded)
+	}()
+}
+
+func (this *SegmentAllocator) reserve(namespace string) (*segment, error) {
+	seg := &segment{}
+	_, err := pgbackend.RunQuery(SegmentServiceName, seg, func(conn *pgxpool.Conn, result *segment) error {
+		now := time.Now().UnixMilli()
+		var step int64
+		err := conn.QueryRow(context.Background(),
+			"update misc_id_segment set max_id = max_id + step, time_updated = $2 where namespace = $1 and step > 0 returning max_id, step;",
+			namespace, now,
+		).Scan(&result.max, &step)
+		if errors.Is(err, pgx.ErrNoRows) {
+			err = this.create(conn, namespace, now, result, &step)
+		}
+		if err != nil {
+			return err
+		}
+		result.start = result.max - step + 1
+		result.next = result.start
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return seg, nil
+}
+
+// create inserts the namespace with the first segment when it is missing and
+// may be auto created, a namespace inserted concurrently is reserved from
+func (this *SegmentAllocator) create(conn *pgxpool.Conn, namespace string, now int64, result *segment, step *int64) error {
+	var exists bool
+	if err := conn.QueryRow(context.Background(),
+		"select exists(select 1 from misc_id_segment where namespace = $1);", namespace,
+	).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		// the update skipped it for its step
+		return ErrInvalidStep
+	}
+	if !this.autoCreate {
+		return ErrUnknownNamespace
+	}
+	err := conn.QueryRow(context.Background(), `
+insert into misc_id_segment (namespace, max_id, step, time_created, time_updated)
+select $1, $2, $2, $3, $3
+where (select count(*) from misc_id_segment) < $4
+on conflict (namespace) do update
+    set max_id       = misc_id_segment.max_id + misc_id_segment.step,
+        time_updated = excluded.time_updated
+    where misc_id_segment.step > 0
+returning max_id, step;`,
+		namespace, this.step, now, this.maxNamespaces,
+	).Scan(&result.max, step)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrTooManyNamespaces
+	}
+	return err
+}
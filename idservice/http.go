@@ -0,0 +1,155 @@
+package idservice
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/meidomx/misc-service/id"
+
+	"github.com/gin-gonic/gin"
+)
+
+type idService struct {
+	idGen *id.IdGen
+	// callers are the generators of the element ids of the callers
+	callers  map[string]*id.IdGen
+	maxBatch int
+}
+
+// Id is an id in the text forms of the api. The decimal pair are the two
+// int64 halves as strings, exceeding the integers of JSON numbers.
+type Id struct {
+	Hex     string    `json:"hex"`
+	Decimal [2]string `json:"decimal"`
+	UUID    string    `json:"uuid"`
+}
+
+func newId(itemId id.ItemId) Id {
+	return Id{
+		Hex:     itemId.HexString(),
+		Decimal: [2]string{strconv.FormatInt(itemId[0], 10), strconv.FormatInt(itemId[1], 10)},
+		UUID:    itemId.UUIDString(),
+	}
+}
+
+func (this *idService) NextId(ctx *gin.Context) {
+	idGen, ok := this.generator(ctx)
+	if !ok {
+		return
+	}
+	itemId, err := idGen.Next()
+	if err != nil {
+		this.generateError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, ResponseBody(newId(itemId)))
+}
+
+func (this *idService) NextIdBatch(ctx *gin.Context) {
+	idGen, ok := this.generator(ctx)
+	if !ok {
+		return
+	}
+	count, err := strconv.Atoi(ctx.Query("count"))
+	if err != nil || count <= 0 || count > this.maxBatch {
+		ctx.JSON(http.StatusBadRequest, ResponseErr("4000", "count must be between 1 and "+strconv.Itoa(this.maxBatch)))
+		return
+	}
+	itemIds, err := idGen.NextN(count)
+	if err != nil {
+		this.generateError(ctx, err)
+		return
+	}
+	ids := make([]Id, 0, len(itemIds))
+	for _, itemId := range itemIds {
+		ids = append(ids, newId(itemId))
+	}
+	ctx.JSON(http.StatusOK, ResponseBody(ids))
+}
+
+// generator returns the generator of the caller parameter, the one of the
+// service without
+func (this *idService) generator(ctx *gin.Context) (*id.IdGen, bool) {
+	caller := ctx.Query("caller")
+	if len(caller) == 0 {
+		return this.idGen, true
+	}
+	idGen, ok := this.callers[caller]
+	if !ok {
+		ctx.JSON(http.StatusBadRequest, ResponseErr("4000", "unknown caller"))
+		return nil, false
+	}
+	return idGen, true
+}
+
+func (this *idService) generateError(ctx *gin.Context, err error) {
+	log.Println("generate id error:", err)
+	if errors.Is(err, id.ErrLeaseLost) || errors.Is(err, id.ErrClockBackward) {
+		ctx.JSON(http.StatusServiceUnavailable, ResponseErr("5030", "id generation unavailable"))
+		return
+	}
+	ctx.JSON(http.StatusInternalServerError, ResponseErr("5000", "internal error"))
+}
+
+// IdInspection is an id in all its forms with its fields
+type IdInspection struct {
+	Id
+	Base32 string `json:"base32"`
+	// UUIDv7 is empty when the node or element id exceed its layout
+	UUIDv7 string `json:"uuidv7,omitempty"`
+	id.ItemIdParts
+}
+
+// InspectId decodes an id of any text form, with ?layout=uuidv7 the UUID
+// text is read in the UUIDv7 layout
+func InspectId(ctx *gin.Context) {
+	text := ctx.Param("id")
+	var itemId id.ItemId
+	var err error
+	if ctx.Query("layout") == "uuidv7" {
+		itemId, err = id.ParseUUIDv7(text)
+	} else {
+		itemId, err = id.ParseItemId(text)
+	}
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ResponseErr("4000", "invalid id"))
+		return
+	}
+	inspection := IdInspection{
+		Id:          newId(itemId),
+		Base32:      itemId.Base32String(),
+		ItemIdParts: itemId.Decode(),
+	}
+	inspection.UUIDv7, _ = itemId.UUIDv7String()
+	ctx.JSON(http.StatusOK, ResponseBody(inspection))
+}
+
+// GetClockStats returns the clock rollbacks the id generator went through
+func GetClockStats(idGen *id.IdGen) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, ResponseBody(idGen.ClockStats()))
+	}
+}
+
+func ResponseOk() map[string]interface{} {
+	return map[string]interface{}{
+		"status": "0",
+	}
+}
+
+func ResponseBody(body interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"status": "0",
+		"data":   body,
+	}
+}
+
+func ResponseErr(errorCode, errorMessage string) map[string]interface{} {
+	return map[string]interface{}{
+		"status":        "1000",
+		"error_code":    errorCode,
+		"error_message": errorMessage,
+	}
+}
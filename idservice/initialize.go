@@ -0,0 +1,50 @@
+package idservice
+
+import (
+	"log"
+
+	"github.com/meidomx/misc-service/config"
+	"github.com/meidomx/misc-service/id"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	_DEFAULT_MAX_BATCH = 1000
+)
+
+func InitIdService(c *config.Config, engine *gin.Engine, container *config.Container, idGen *id.IdGen) {
+	service := &idService{
+		idGen:    idGen,
+		callers:  map[string]*id.IdGen{},
+		maxBatch: c.Id.Service.MaxBatch,
+	}
+	if service.maxBatch <= 0 {
+		service.maxBatch = _DEFAULT_MAX_BATCH
+	}
+	elementIds := map[int32]string{idGen.ElementId(): "element_id"}
+	for caller, elementId := range c.Id.Service.Callers {
+		if other, ok := elementIds[elementId]; ok {
+			log.Fatalf("id service caller %s has the element id %d of %s", caller, elementId, other)
+		}
+		elementIds[elementId] = caller
+		g, err := idGen.ForElement(elementId)
+		if err != nil {
+			log.Fatalf("init id generator of caller %s error: %v", caller, err)
+		}
+		service.callers[caller] = g
+	}
+
+	engine.GET("/id/next", service.NextId)
+	engine.GET("/id/batch", service.NextIdBatch)
+	engine.GET("/id/inspect/:id", InspectId)
+	if c.Id.Segment.Enable {
+		segments := &segmentService{
+			allocator: id.NewSegmentAllocator(c.Id.Segment.Step, c.Id.Segment.AutoCreate, c.Id.Segment.MaxNamespaces),
+			maxBatch:  service.maxBatch,
+		}
+		engine.GET("/id/segment/:namespace", segments.NextSegmentId)
+		engine.GET("/id/segment/:namespace/batch", segments.NextSegmentIdBatch)
+	}
+	engine.GET("/id/clock_stats", GetClockStats(idGen))
+}
@@ -0,0 +1,73 @@
+package idservice
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/meidomx/misc-service/id"
+
+	"github.com/gin-gonic/gin"
+)
+
+var namespacePattern = regexp.MustCompile(`^[A-Za-z0-9_.\-]{1,200}$`)
+
+type segmentService struct {
+	allocator *id.SegmentAllocator
+	maxBatch  int
+}
+
+func (this *segmentService) NextSegmentId(ctx *gin.Context) {
+	namespace, ok := this.namespace(ctx)
+	if !ok {
+		return
+	}
+	v, err := this.allocator.Next(namespace)
+	if err != nil {
+		this.allocateError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, ResponseBody(map[string]interface{}{"id": v}))
+}
+
+func (this *segmentService) NextSegmentIdBatch(ctx *gin.Context) {
+	namespace, ok := this.namespace(ctx)
+	if !ok {
+		return
+	}
+	count, err := strconv.Atoi(ctx.Query("count"))
+	if err != nil || count <= 0 || count > this.maxBatch {
+		ctx.JSON(http.StatusBadRequest, ResponseErr("4000", "count must be between 1 and "+strconv.Itoa(this.maxBatch)))
+		return
+	}
+	ids, err := this.allocator.NextN(namespace, count)
+	if err != nil {
+		this.allocateError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, ResponseBody(map[string]interface{}{"ids": ids}))
+}
+
+func (this *segmentService) namespace(ctx *gin.Context) (string, bool) {
+	namespace := ctx.Param("namespace")
+	if !namespacePattern.MatchString(namespace) {
+		ctx.JSON(http.StatusBadRequest, ResponseErr("4000", "invalid namespace"))
+		return "", false
+	}
+	return namespace, true
+}
+
+func (this *segmentService) allocateError(ctx *gin.Context, err error) {
+	if errors.Is(err, id.ErrUnknownNamespace) {
+		ctx.JSON(http.StatusNotFound, ResponseErr("4040", "unknown namespace"))
+		return
+	}
+	if errors.Is(err, id.ErrTooManyNamespaces) {
+		ctx.JSON(http.StatusForbidden, ResponseErr("4030", "namespace limit reached"))
+		return
+	}
+	log.Println("allocate segment id error:", err)
+	ctx.JSON(http.StatusServiceUnavailable, ResponseErr("5030", "id allocation unavailable"))
+}
@@ -0,0 +1,97 @@
+package ldap
+
+import (
+	"log"
+	"strings"
+
+	"github.com/jimlambrt/gldap"
+)
+
+// Administrators of the directory are the DNs of ldap.admin_dns and the
+// members of the groups among them. Only they add and delete entries, other
+// users may only change their own entry, and not its protected attributes.
+
+// protectedAttributes are only changed by administrators, keyed by the
+// lower-cased name. The mfa enrollment writes the totp secrets on its own.
+var protectedAttributes = map[string]bool{
+	"objectclass":                               true,
+	strings.ToLower(attributeMemberOf):          true,
+	strings.ToLower(attributeScimActive):        true,
+	strings.ToLower(attributeMfaRequired):       true,
+	strings.ToLower(attributeTotpSecret):        true,
+	strings.ToLower(attributeTotpPendingSecret): true,
+}
+
+// isProtectedAttribute ignores attribute options like isSecretAttribute
+func isProtectedAttribute(name string) bool {
+	return protectedAttributes[baseAttributeName(name)]
+}
+
+// baseAttributeName is the lower-cased name without options
+func baseAttributeName(name string) string {
+	if i := strings.IndexByte(name, ';'); i >= 0 {
+		name = name[:i]
+	}
+	return strings.ToLower(name)
+}
+
+func (this *ldapServer) isAdmin(dn string) bool {
+	const op = "ldap.(Directory).isAdmin"
+
+	if len(dn) == 0 {
+		return false
+	}
+	key := NormalizeDN(dn)
+	for _, admin := range this.adminDNs {
+		if NormalizeDN(admin) == key {
+			return true
+		}
+	}
+	for _, admin := range this.adminDNs {
+		group, err := this.backend.FindOneEntry(admin)
+		if err != nil {
+			log.Println("load admin group error", "op", op, "err", err)
+			continue
+		}
+		if len(group.DN) <= 0 {
+			continue
+		}
+		group = expandDynamicGroup(this.backend, group)
+		var members []string
+		members = append(members, EntryAttributeValues(group, attributeMember)...)
+		members = append(members, EntryAttributeValues(group, attributeUniqueMember)...)
+		for _, member := range members {
+			if NormalizeDN(member) == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// canModify reports whether boundDN may apply the changes to the entry at dn
+func (this *ldapServer) canModify(boundDN, dn string, changes []gldap.Change) bool {
+	if this.isAdmin(boundDN) {
+		return true
+	}
+	if len(boundDN) == 0 || NormalizeDN(boundDN) != NormalizeDN(dn) {
+		return false
+	}
+	for _, c := range changes {
+		if isProtectedAttribute(c.Modification.Type) {
+			return false
+		}
+	}
+	return true
+}
+
+// withoutSecrets returns a copy of the entry without its secret attributes
+func withoutSecrets(entry *gldap.Entry) *gldap.Entry {
+	c := &gldap.Entry{DN: entry.DN}
+	for _, a := range entry.Attributes {
+		if !isSecretAttribute(a.Name) {
+			c.Attributes = append(c.Attributes, a)
+		}
+	}
+	return c
+}
@@ -0,0 +1,159 @@
+package ldap
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/meidomx/misc-service/config"
+	"github.com/meidomx/misc-service/id"
+
+	"github.com/jimlambrt/gldap"
+)
+
+const (
+	BackendPostgres = "postgres"
+	BackendMemory   = "memory"
+)
+
+// DirectoryBackend stores the entries and the changelog of the directory.
+//
+// Lookups of a missing entry return an empty entry instead of an error, so
+// callers check len(entry.DN). Writes record their change (when not nil) in
+// the changelog atomically with the write.
+type DirectoryBackend interface {
+	FindOneEntry(dn string) (*gldap.Entry, error)
+	FindChildren(dn string) ([]*gldap.Entry, error)
+	// FindRoots returns the entries without parent
+	FindRoots() ([]*gldap.Entry, error)
+	// FindByAttribute returns the entries with a value of the attribute equal
+	// to value, both compared case-insensitively, in no particular order
+	FindByAttribute(name, value string) ([]*gldap.Entry, error)
+
+	SaveEntry(entry *gldap.Entry, i id.ItemId, change *ChangeRecord) error
+	UpdateEntry(entry *gldap.Entry, change *ChangeRecord) error
+	DeleteEntry(dn string, change *ChangeRecord) error
+	// MoveEntry replaces the entry at dn by entry with its new DN, keeping
+	// its id. The entries below dn have to be moved one by one.
+	MoveEntry(dn string, entry *gldap.Entry, change *ChangeRecord) error
+
+	// FindChanges returns at most limit changes with change number >=
+	// fromNumber in ascending order. Change numbers are assigned in commit
+	// order, a change committed later never gets a smaller number.
+	FindChanges(fromNumber int64, limit int) ([]*ChangeRecord, error)
+
+	// RunTx calls f with a backend whose writes are applied all together when
+	// f returns nil and discarded otherwise. Nested calls join the outer one.
+	RunTx(f func(tx DirectoryBackend) error) error
+
+	// Listen calls f for every committed entry write until ctx is done or the
+	// backend fails.
+	Listen(ctx context.Context, f func(n *EntryNotification)) error
+}
+
+var errListenInTx = errors.New("listen is not supported within a transaction")
+
+// NewDirectoryBackend creates the backend selected by ldap.storage.backend,
+// PostgreSQL by default
+func NewDirectoryBackend(c *config.Config) (DirectoryBackend, error) {
+	switch c.LDAP.Storage.Backend {
+	case "", BackendPostgres:
+		return NewPgDirectoryBackend(), nil
+	case BackendMemory:
+		return NewMemoryDirectoryBackend(c.LDAP.Storage.SnapshotFile,
+			time.Duration(c.LDAP.Storage.SnapshotIntervalSeconds)*time.Second, c.LDAP.Storage.ChangelogMaxEntries)
+	default:
+		return nil, errors.New("unknown ldap storage backend: " + c.LDAP.Storage.Backend)
+	}
+}
+
+// WalkSubtree calls f for the entry at dn and all entries below it, parents
+// before children, until f returns false
+func WalkSubtree(backend DirectoryBackend, dn string, f func(entry *gldap.Entry) bool) error {
+	base, err := backend.FindOneEntry(dn)
+	if err != nil {
+		return err
+	}
+	if len(base.DN) <= 0 {
+		return nil
+	}
+	queue := []*gldap.Entry{base}
+	for len(queue) > 0 {
+		entry := queue[0]
+		queue = queue[1:]
+		if !f(entry) {
+			return nil
+		}
+		children, err := backend.FindChildren(entry.DN)
+		if err != nil {
+			return err
+		}
+		queue = append(queue, children...)
+	}
+	return nil
+}
+
+// WalkScope calls f for the entries selected by a search with the given base
+// and scope until f returns false. An empty base selects the roots.
+func WalkScope(backend DirectoryBackend, base string, scope gldap.Scope, f func(entry *gldap.Entry) bool) error {
+	switch scope {
+	case gldap.BaseObject:
+		var entry *gldap.Entry
+		if len(base) > 0 {
+			e, err := backend.FindOneEntry(base)
+			if err != nil {
+				return err
+			}
+			entry = e
+		} else {
+			roots, err := backend.FindRoots()
+			if err != nil {
+				return err
+			}
+			entry = new(gldap.Entry)
+			if len(roots) > 0 {
+				entry = roots[0]
+			}
+		}
+		if len(entry.DN) > 0 {
+			f(entry)
+		}
+		return nil
+	case gldap.SingleLevel:
+		var entries []*gldap.Entry
+		var err error
+		if len(base) > 0 {
+			entries, err = backend.FindChildren(base)
+		} else {
+			entries, err = backend.FindRoots()
+		}
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if !f(e) {
+				return nil
+			}
+		}
+		return nil
+	case gldap.WholeSubtree:
+		if len(base) > 0 {
+			return WalkSubtree(backend, base, f)
+		}
+		roots, err := backend.FindRoots()
+		if err != nil {
+			return err
+		}
+		stopped := false
+		for _, root := range roots {
+			if err := WalkSubtree(backend, root.DN, func(entry *gldap.Entry) bool {
+				stopped = !f(entry)
+				return !stopped
+			}); err != nil || stopped {
+				return err
+			}
+		}
+		return nil
+	}
+	return errors.New("unsupported scope")
+}
@@ -0,0 +1,194 @@
+package ldap
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/meidomx/misc-service/config"
+
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/jimlambrt/gldap"
+)
+
+// bindRule resolves a bind name to entries below one suffix
+type bindRule struct {
+	Suffix string
+	BaseDN string
+	Filter string
+	Scope  gldap.Scope
+}
+
+// newBindRules builds the rules of ldap.suffixes, or the single cn rule of
+// ldap.bind_base_dn when no suffix is configured
+func newBindRules(c *config.Config) ([]*bindRule, error) {
+	if len(c.LDAP.Suffixes) == 0 {
+		if len(c.LDAP.BindBaseDN) == 0 {
+			return nil, nil
+		}
+		return []*bindRule{{BaseDN: c.LDAP.BindBaseDN}}, nil
+	}
+
+	var rules []*bindRule
+	for _, s := range c.LDAP.Suffixes {
+		if len(s.Suffix) == 0 {
+			return nil, errors.New("ldap suffix is empty")
+		}
+		rule := &bindRule{
+			Suffix: s.Suffix,
+			BaseDN: s.BindBaseDN,
+			Filter: s.BindFilter,
+		}
+		if len(rule.BaseDN) == 0 {
+			rule.BaseDN = s.Suffix
+		}
+		if !IsDNInScope(rule.BaseDN, s.Suffix, gldap.WholeSubtree) {
+			return nil, errors.New("bind base dn is not below suffix: " + rule.BaseDN)
+		}
+		switch strings.ToLower(s.BindScope) {
+		case "", "sub":
+			rule.Scope = gldap.WholeSubtree
+		case "one":
+			rule.Scope = gldap.SingleLevel
+		default:
+			return nil, errors.New("unknown bind scope: " + s.BindScope)
+		}
+		if len(rule.Filter) > 0 {
+			if _, err := CompileEntryFilter(rule.filterFor("x")); err != nil {
+				return nil, fmt.Errorf("invalid bind filter %s: %w", rule.Filter, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (this *bindRule) filterFor(name string) string {
+	return strings.ReplaceAll(this.Filter, "%s", goldap.EscapeFilter(name))
+}
+
+// resolve returns the entry the name refers to in this rule, or nil when
+// there is none or the name is ambiguous
+func (this *bindRule) resolve(backend DirectoryBackend, name string) (*gldap.Entry, error) {
+	const op = "ldap.(Directory).resolveBindName"
+
+	if len(this.Filter) == 0 {
+		entry, err := backend.FindOneEntry(fmt.Sprint("cn=", goldap.EscapeDN(name), ",", this.BaseDN))
+		if err != nil || len(entry.DN) <= 0 || !IsDNInScope(entry.DN, this.BaseDN, gldap.SingleLevel) {
+			return nil, err
+		}
+		return entry, nil
+	}
+
+	filter, err := CompileEntryFilter(this.filterFor(name))
+	if err != nil {
+		return nil, err
+	}
+	var found []*gldap.Entry
+	seen := map[string]bool{}
+	collect := func(entry *gldap.Entry) bool {
+		key := NormalizeDN(entry.DN)
+		if !seen[key] && IsDNInScope(entry.DN, this.BaseDN, this.Scope) && filter.Match(entry) {
+			seen[key] = true
+			found = append(found, entry)
+		}
+		return len(found) <= 1
+	}
+	if terms, ok := filter.EqualityTerms(); ok {
+		// looked up by the attribute index instead of walking the base
+	lookup:
+		for _, term := range terms {
+			entries, err := backend.FindByAttribute(term.Name, term.Value)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range entries {
+				if !collect(e) {
+					break lookup
+				}
+			}
+		}
+	} else if this.Scope == gldap.SingleLevel {
+		children, err := backend.FindChildren(this.BaseDN)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range children {
+			if !collect(e) {
+				break
+			}
+		}
+	} else if err := WalkSubtree(backend, this.BaseDN, collect); err != nil {
+		return nil, err
+	}
+
+	if len(found) > 1 {
+		log.Println("ambiguous bind name", "op", op, "suffix", this.Suffix, "name", name)
+		return nil, nil
+	}
+	if len(found) == 0 {
+		return nil, nil
+	}
+	return found[0], nil
+}
+
+// inSuffixes reports whether a full DN bind is allowed for dn. Without
+// configured suffixes any DN is.
+func inSuffixes(rules []*bindRule, dn string) bool {
+	suffixed := false
+	for _, r := range rules {
+		if len(r.Suffix) == 0 {
+			continue
+		}
+		suffixed = true
+		if IsDNInScope(dn, r.Suffix, gldap.WholeSubtree) {
+			return true
+		}
+	}
+	return !suffixed
+}
+
+// checkPassword rejects accounts deactivated by SCIM, as the api keys and the
+// oidc tokens do
+func checkPassword(entry *gldap.Entry, password gldap.Password) bool {
+	if isDeactivated(entry) {
+		return false
+	}
+	values := entry.GetAttributeValues("userPassword")
+	return len(values) > 0 && string(password) == values[0]
+}
+
+func isDeactivated(entry *gldap.Entry) bool {
+	values := EntryAttributeValues(entry, attributeScimActive)
+	return len(values) > 0 && strings.EqualFold(values[0], "FALSE")
+}
+
+// PeerCredBaseDN is the parent of the authorization DNs SASL EXTERNAL maps
+// ldapi peer credentials to
+const PeerCredBaseDN = "cn=peercred,cn=external,cn=auth"
+
+func newExternalSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// isPeerCredDN reports whether dn is an authorization DN of SASL EXTERNAL
+func isPeerCredDN(dn string) bool {
+	return len(dn) > 0 && IsDNInScope(dn, PeerCredBaseDN, gldap.WholeSubtree) && NormalizeDN(dn) != NormalizeDN(PeerCredBaseDN)
+}
+
+// isExternalBind reports whether a simple bind is a SASL EXTERNAL bind the
+// frontend has forwarded
+func isExternalBind(name string, password gldap.Password, secret string) bool {
+	if len(secret) == 0 || !isPeerCredDN(name) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(secret)) == 1
+}
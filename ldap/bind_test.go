@@ -0,0 +1,46 @@
+package ldap
+
+import (
+	"testing"
+
+	"github.com/meidomx/misc-service/id"
+
+	"github.com/jimlambrt/gldap"
+)
+
+func TestBindRuleResolve(t *testing.T) {
+	backend := newTestMemoryBackend(t, "", 0)
+	idGen := id.NewIdGen(1, 1)
+	saveTestEntry(t, backend, idGen, "cn=alice,ou=people,dc=example", map[string][]string{"uid": {"Alice"}, "mail": {"alice@example.com"}})
+	saveTestEntry(t, backend, idGen, "cn=admin,ou=admins,ou=people,dc=example", map[string][]string{"uid": {"admin"}})
+	saveTestEntry(t, backend, idGen, "cn=bob,dc=other", map[string][]string{"uid": {"bob"}})
+
+	byFilter := &bindRule{BaseDN: "ou=people,dc=example", Filter: "(|(uid=%s)(mail=%s))", Scope: gldap.WholeSubtree}
+	byCn := &bindRule{BaseDN: "ou=people,dc=example"}
+	tests := []struct {
+		rule *bindRule
+		name string
+		dn   string
+	}{
+		{byFilter, "alice", "cn=alice,ou=people,dc=example"},
+		{byFilter, "ALICE@example.com", "cn=alice,ou=people,dc=example"},
+		{byFilter, "admin", "cn=admin,ou=admins,ou=people,dc=example"},
+		{byFilter, "bob", ""},
+		{byFilter, "*", ""},
+		{byCn, "alice", "cn=alice,ou=people,dc=example"},
+		{byCn, "admin,ou=admins", ""},
+	}
+	for _, tt := range tests {
+		entry, err := tt.rule.resolve(backend, tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dn := ""
+		if entry != nil {
+			dn = entry.DN
+		}
+		if dn != tt.dn {
+			t.Errorf("resolve %q with filter %q = %q, want %q", tt.name, tt.rule.Filter, dn, tt.dn)
+		}
+	}
+}
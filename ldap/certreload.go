@@ -0,0 +1,153 @@
+package ldap
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	certReloadInterval = 30 * time.Second
+)
+
+// certReloader serves the certificate of cert_path/key_path to TLS handshakes
+// and reloads it when either file changes or on SIGHUP. A pair which fails to
+// load keeps the previous certificate in use.
+type certReloader struct {
+	certPath string
+	keyPath  string
+
+	lock sync.RWMutex
+	cert *tls.Certificate
+	// stamp identifies the file versions of the last load attempt
+	stamp string
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	r := &certReloader{
+		certPath: certPath,
+		keyPath:  keyPath,
+		closed:   make(chan struct{}),
+	}
+	stamp, err := r.fileStamp()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := loadCertificate(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	r.cert = cert
+	r.stamp = stamp
+	return r, nil
+}
+
+// GetCertificate is the tls.Config callback returning the current certificate
+func (this *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return this.cert, nil
+}
+
+// Start watches the files and SIGHUP until Close
+func (this *certReloader) Start() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		ticker := time.NewTicker(certReloadInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-this.closed:
+				return
+			case <-ticker.C:
+				this.reload(false)
+			case <-hup:
+				log.Println("reload ldap tls certificate on SIGHUP")
+				this.reload(true)
+			}
+		}
+	}()
+}
+
+func (this *certReloader) Close() error {
+	this.closeOnce.Do(func() {
+		close(this.closed)
+	})
+	return nil
+}
+
+// reload loads the files when they changed since the last attempt, or always
+// when forced
+func (this *certReloader) reload(force bool) {
+	const op = "ldap.(Directory).reloadCertificate"
+
+	stamp, err := this.fileStamp()
+	if err != nil {
+		log.Println("stat tls certificate error, keeping current certificate", "op", op, "err", err)
+		return
+	}
+	this.lock.RLock()
+	unchanged := stamp == this.stamp
+	this.lock.RUnlock()
+	if unchanged && !force {
+		return
+	}
+
+	cert, err := loadCertificate(this.certPath, this.keyPath)
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	// a failed pair is not retried until the files change again, a
+	// certificate written before its key is picked up with the key
+	this.stamp = stamp
+	if err != nil {
+		log.Println("load tls certificate error, keeping current certificate", "op", op, "err", err)
+		return
+	}
+	this.cert = cert
+	log.Println("tls certificate reloaded", "op", op, "subject", cert.Leaf.Subject.String(), "notAfter", cert.Leaf.NotAfter)
+}
+
+func (this *certReloader) fileStamp() (string, error) {
+	var stamp string
+	for _, path := range []string{this.certPath, this.keyPath} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		stamp += fmt.Sprint(fi.ModTime().UnixNano(), "/", fi.Size(), ";")
+	}
+	return stamp, nil
+}
+
+// loadCertificate loads the pair and checks the leaf certificate
+func loadCertificate(certPath, keyPath string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("no certificate in " + certPath)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf = leaf
+	now := time.Now()
+	if now.After(leaf.NotAfter) || now.Before(leaf.NotBefore) {
+		log.Println("tls certificate is not valid now", "subject", leaf.Subject.String(), "notBefore", leaf.NotBefore, "notAfter", leaf.NotAfter)
+	}
+	return &cert, nil
+}
@@ -0,0 +1,234 @@
+package ldap
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jimlambrt/gldap"
+)
+
+const (
+	ChangeTypeAdd    = "add"
+	ChangeTypeModify = "modify"
+	ChangeTypeDelete = "delete"
+	ChangeTypeModRDN = "modrdn"
+)
+
+const (
+	ChangelogBaseDN = "cn=changelog"
+
+	changelogTimeLayout = "20060102150405Z"
+	// redactedValue replaces the values of secret attributes in change bodies
+	redactedValue = "{REDACTED}"
+)
+
+// secretAttributes hold credentials, keyed by the lower-cased name. They are
+// extended by StartService before serving and only read afterwards.
+var secretAttributes = map[string]bool{
+	"userpassword":                              true,
+	strings.ToLower(attributeTotpSecret):        true,
+	strings.ToLower(attributeTotpPendingSecret): true,
+}
+
+// addSecretAttribute makes the values of the attribute redacted
+func addSecretAttribute(name string) {
+	secretAttributes[strings.ToLower(name)] = true
+}
+
+// isSecretAttribute ignores attribute options, such as userPassword;binary
+func isSecretAttribute(name string) bool {
+	if i := strings.IndexByte(name, ';'); i >= 0 {
+		name = name[:i]
+	}
+	return secretAttributes[strings.ToLower(name)]
+}
+
+// ChangeRecord is a single directory write, recorded in misc_ldap_changelog
+// within the same transaction as the write itself. Changes holds the
+// LDIF-style change body (without the dn and changetype lines), the values of
+// secret attributes are redacted.
+type ChangeRecord struct {
+	ChangeNumber int64  `json:"change_number"`
+	TimeCreated  int64  `json:"time_created"`
+	BoundDN      string `json:"bound_dn"`
+	TargetDN     string `json:"target_dn"`
+	ChangeType   string `json:"change_type"`
+	Changes      string `json:"changes"`
+}
+
+func NewAddChange(boundDN string, entry *gldap.Entry) *ChangeRecord {
+	sb := new(strings.Builder)
+	for _, a := range entry.Attributes {
+		for _, v := range a.Values {
+			writeChangeValue(sb, a.Name, v)
+		}
+	}
+	return &ChangeRecord{
+		BoundDN:    boundDN,
+		TargetDN:   entry.DN,
+		ChangeType: ChangeTypeAdd,
+		Changes:    sb.String(),
+	}
+}
+
+func NewModifyChange(boundDN, dn string, changes []gldap.Change) *ChangeRecord {
+	sb := new(strings.Builder)
+	for _, chg := range changes {
+		switch chg.Operation {
+		case gldap.AddAttribute:
+			sb.WriteString("add: ")
+		case gldap.DeleteAttribute:
+			sb.WriteString("delete: ")
+		case gldap.ReplaceAttribute:
+			sb.WriteString("replace: ")
+		case gldap.IncrementAttribute:
+			sb.WriteString("increment: ")
+		}
+		sb.WriteString(chg.Modification.Type)
+		sb.WriteString("\n")
+		for _, v := range chg.Modification.Vals {
+			writeChangeValue(sb, chg.Modification.Type, v)
+		}
+		sb.WriteString("-\n")
+	}
+	return &ChangeRecord{
+		BoundDN:    boundDN,
+		TargetDN:   dn,
+		ChangeType: ChangeTypeModify,
+		Changes:    sb.String(),
+	}
+}
+
+func NewDeleteChange(boundDN, dn string) *ChangeRecord {
+	return &ChangeRecord{
+		BoundDN:    boundDN,
+		TargetDN:   dn,
+		ChangeType: ChangeTypeDelete,
+	}
+}
+
+func NewModRDNChange(boundDN, dn, newRDN string, deleteOldRDN bool, newSuperior string) *ChangeRecord {
+	sb := new(strings.Builder)
+	writeLdifValue(sb, "newrdn", newRDN)
+	if deleteOldRDN {
+		sb.WriteString("deleteoldrdn: 1\n")
+	} else {
+		sb.WriteString("deleteoldrdn: 0\n")
+	}
+	if len(newSuperior) > 0 {
+		writeLdifValue(sb, "newsuperior", newSuperior)
+	}
+	return &ChangeRecord{
+		BoundDN:    boundDN,
+		TargetDN:   dn,
+		ChangeType: ChangeTypeModRDN,
+		Changes:    sb.String(),
+	}
+}
+
+// writeChangeValue writes an attribute line of a change body
+func writeChangeValue(sb *strings.Builder, name, value string) {
+	if isSecretAttribute(name) {
+		value = redactedValue
+	}
+	writeLdifValue(sb, name, value)
+}
+
+// writeLdifValue writes an attribute line, base64 encoding values which are
+// not safe strings according to RFC 2849.
+func writeLdifValue(sb *strings.Builder, name, value string) {
+	sb.WriteString(name)
+	if isLdifSafeString(value) {
+		sb.WriteString(": ")
+		sb.WriteString(value)
+	} else {
+		sb.WriteString(":: ")
+		sb.WriteString(base64.StdEncoding.EncodeToString([]byte(value)))
+	}
+	sb.WriteString("\n")
+}
+
+func isLdifSafeString(value string) bool {
+	if len(value) == 0 {
+		return true
+	}
+	if !utf8.ValidString(value) {
+		return false
+	}
+	switch value[0] {
+	case ' ', ':', '<':
+		return false
+	}
+	if value[len(value)-1] == ' ' {
+		return false
+	}
+	for _, c := range value {
+		if c == 0 || c == '\n' || c == '\r' || c > 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// ToEntry renders the record as a changeLogEntry (draft-good-ldap-changelog)
+// below cn=changelog.
+func (this *ChangeRecord) ToEntry() *gldap.Entry {
+	attrs := map[string][]string{
+		"objectClass":  {"top", "changeLogEntry"},
+		"changeNumber": {strconv.FormatInt(this.ChangeNumber, 10)},
+		"changeTime":   {time.UnixMilli(this.TimeCreated).UTC().Format(changelogTimeLayout)},
+		"changeType":   {this.ChangeType},
+		"targetDN":     {this.TargetDN},
+	}
+	if len(this.Changes) > 0 {
+		attrs["changes"] = []string{this.Changes}
+	}
+	if len(this.BoundDN) > 0 {
+		attrs["changeInitiatorsName"] = []string{this.BoundDN}
+	}
+	return gldap.NewEntry(fmt.Sprint("changeNumber=", this.ChangeNumber, ",", ChangelogBaseDN), attrs)
+}
+
+func changelogRootEntry() *gldap.Entry {
+	return gldap.NewEntry(ChangelogBaseDN, map[string][]string{
+		"objectClass": {"top", "container"},
+		"cn":          {"changelog"},
+	})
+}
+
+func FindChange(backend DirectoryBackend, changeNumber int64) (*ChangeRecord, error) {
+	changes, err := backend.FindChanges(changeNumber, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(changes) == 0 || changes[0].ChangeNumber != changeNumber {
+		return nil, nil
+	}
+	return changes[0], nil
+}
+
+func isChangelogDN(dn string) bool {
+	sp := SplitDN(dn)
+	return len(sp) > 0 && strings.EqualFold(sp[len(sp)-1], ChangelogBaseDN)
+}
+
+// parseChangelogEntryDN extracts N from changeNumber=N,cn=changelog
+func parseChangelogEntryDN(dn string) (int64, bool) {
+	sp := SplitDN(dn)
+	if len(sp) != 2 {
+		return 0, false
+	}
+	kv := strings.SplitN(sp[0], "=", 2)
+	if len(kv) != 2 || !strings.EqualFold(kv[0], "changeNumber") {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(kv[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
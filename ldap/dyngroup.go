@@ -0,0 +1,190 @@
+package ldap
+
+import (
+	"errors"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/jimlambrt/gldap"
+)
+
+const (
+	objectClassGroupOfURLs = "groupOfURLs"
+	attributeMemberURL     = "memberURL"
+	attributeMember        = "member"
+	attributeUniqueMember  = "uniqueMember"
+)
+
+// ldapURL is the part of an RFC 4516 LDAP URL used by memberURL:
+// ldap:///<dn>?<attributes>?<scope>?<filter>. Host and attributes are ignored.
+type ldapURL struct {
+	BaseDN string
+	Scope  gldap.Scope
+	Filter string
+}
+
+func parseLdapURL(s string) (*ldapURL, error) {
+	lower := strings.ToLower(s)
+	if !strings.HasPrefix(lower, "ldap://") {
+		return nil, errors.New("not an ldap url: " + s)
+	}
+	rest := s[len("ldap://"):]
+	// skip host
+	slash := strings.Index(rest, "/")
+	if slash < 0 {
+		return nil, errors.New("ldap url without dn: " + s)
+	}
+	parts := strings.SplitN(rest[slash+1:], "?", 4)
+
+	u := &ldapURL{
+		Scope:  gldap.BaseObject,
+		Filter: "(objectClass=*)",
+	}
+	dn, err := url.PathUnescape(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	u.BaseDN = dn
+	if len(parts) > 2 {
+		switch strings.ToLower(parts[2]) {
+		case "", "base":
+			u.Scope = gldap.BaseObject
+		case "one":
+			u.Scope = gldap.SingleLevel
+		case "sub":
+			u.Scope = gldap.WholeSubtree
+		default:
+			return nil, errors.New("unknown ldap url scope: " + parts[2])
+		}
+	}
+	if len(parts) > 3 && len(parts[3]) > 0 {
+		f, err := url.PathUnescape(parts[3])
+		if err != nil {
+			return nil, err
+		}
+		u.Filter = f
+	}
+	return u, nil
+}
+
+func isDynamicGroup(entry *gldap.Entry) bool {
+	for _, oc := range EntryAttributeValues(entry, "objectClass") {
+		if strings.EqualFold(oc, objectClassGroupOfURLs) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandDynamicGroup adds the DNs selected by the memberURL values of a
+// groupOfURLs entry to its member attribute. Other entries are returned as
+// they are. Members which are dynamic groups themselves are not expanded.
+func expandDynamicGroup(backend DirectoryBackend, entry *gldap.Entry) *gldap.Entry {
+	const op = "ldap.(Directory).expandDynamicGroup"
+
+	if !isDynamicGroup(entry) {
+		return entry
+	}
+
+	var members []string
+	seen := map[string]bool{}
+	add := func(dn string) {
+		key := NormalizeDN(dn)
+		if !seen[key] {
+			seen[key] = true
+			members = append(members, dn)
+		}
+	}
+	for _, dn := range EntryAttributeValues(entry, attributeMember) {
+		add(dn)
+	}
+	static := len(members)
+
+	for _, v := range EntryAttributeValues(entry, attributeMemberURL) {
+		u, err := parseLdapURL(v)
+		if err != nil {
+			log.Println("invalid memberURL", "op", op, "dn", entry.DN, "err", err)
+			continue
+		}
+		filter, err := CompileEntryFilter(u.Filter)
+		if err != nil {
+			log.Println("invalid memberURL filter", "op", op, "dn", entry.DN, "err", err)
+			continue
+		}
+		err = WalkScope(backend, u.BaseDN, u.Scope, func(e *gldap.Entry) bool {
+			if filter.Match(e) {
+				add(e.DN)
+			}
+			return true
+		})
+		if err != nil {
+			log.Println("expand memberURL error", "op", op, "dn", entry.DN, "err", err)
+		}
+	}
+	if len(members) == static {
+		return entry
+	}
+
+	expanded := &gldap.Entry{DN: entry.DN}
+	for _, a := range entry.Attributes {
+		if !strings.EqualFold(a.Name, attributeMember) {
+			expanded.Attributes = append(expanded.Attributes, a)
+		}
+	}
+	expanded.Attributes = append(expanded.Attributes, gldap.NewEntryAttribute(attributeMember, members))
+	return expanded
+}
+
+// findMemberGroups returns the entries below baseDN having dn as member or
+// uniqueMember, dynamic groups included. Static groups are looked up through
+// the attribute index, which matches member values written like the DN.
+func findMemberGroups(backend DirectoryBackend, baseDN, dn string) []*gldap.Entry {
+	const op = "ldap.(Directory).findMemberGroups"
+
+	var groups []*gldap.Entry
+	seen := map[string]bool{}
+	add := func(group *gldap.Entry) {
+		key := NormalizeDN(group.DN)
+		if !seen[key] && IsDNInScope(group.DN, baseDN, gldap.WholeSubtree) {
+			seen[key] = true
+			groups = append(groups, group)
+		}
+	}
+	values := []string{dn}
+	if NormalizeDN(dn) != strings.ToLower(dn) {
+		values = append(values, NormalizeDN(dn))
+	}
+	for _, name := range []string{attributeMember, attributeUniqueMember} {
+		for _, value := range values {
+			entries, err := backend.FindByAttribute(name, value)
+			if err != nil {
+				log.Println("find member groups error", "op", op, "err", err)
+				return groups
+			}
+			for _, group := range entries {
+				add(group)
+			}
+		}
+	}
+
+	dynamic, err := backend.FindByAttribute("objectClass", objectClassGroupOfURLs)
+	if err != nil {
+		log.Println("find dynamic groups error", "op", op, "err", err)
+		return groups
+	}
+	dn = NormalizeDN(dn)
+	for _, group := range dynamic {
+		if seen[NormalizeDN(group.DN)] || !IsDNInScope(group.DN, baseDN, gldap.WholeSubtree) {
+			continue
+		}
+		group = expandDynamicGroup(backend, group)
+		for _, member := range EntryAttributeValues(group, attributeMember) {
+			if NormalizeDN(member) == dn {
+				add(group)
+				break
+			}
+		}
+	}
+	return groups
+}
@@ -0,0 +1,206 @@
+package ldap
+
+import (
+	"strconv"
+	"strings"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/jimlambrt/gldap"
+)
+
+// EntryFilter evaluates an RFC 4515 search filter against entries.
+// Matching is case-insensitive for attribute names and values, ordering
+// filters compare numerically when both sides are integers. Extensible match
+// is not supported and evaluates to false.
+type EntryFilter struct {
+	packet *ber.Packet
+}
+
+func CompileEntryFilter(filter string) (*EntryFilter, error) {
+	if len(strings.TrimSpace(filter)) == 0 {
+		return &EntryFilter{}, nil
+	}
+	p, err := goldap.CompileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	return &EntryFilter{packet: p}, nil
+}
+
+func (this *EntryFilter) Match(entry *gldap.Entry) bool {
+	if this == nil || this.packet == nil {
+		return true
+	}
+	return matchFilterPacket(this.packet, entry)
+}
+
+func matchFilterPacket(p *ber.Packet, entry *gldap.Entry) bool {
+	switch p.Tag {
+	case goldap.FilterAnd:
+		for _, c := range p.Children {
+			if !matchFilterPacket(c, entry) {
+				return false
+			}
+		}
+		return true
+	case goldap.FilterOr:
+		for _, c := range p.Children {
+			if matchFilterPacket(c, entry) {
+				return true
+			}
+		}
+		return false
+	case goldap.FilterNot:
+		if len(p.Children) != 1 {
+			return false
+		}
+		return !matchFilterPacket(p.Children[0], entry)
+	case goldap.FilterPresent:
+		return len(EntryAttributeValues(entry, ber.DecodeString(p.Data.Bytes()))) > 0
+	case goldap.FilterEqualityMatch, goldap.FilterApproxMatch:
+		name, value := filterAssertion(p)
+		for _, v := range EntryAttributeValues(entry, name) {
+			if strings.EqualFold(v, value) {
+				return true
+			}
+		}
+		return false
+	case goldap.FilterGreaterOrEqual:
+		name, value := filterAssertion(p)
+		for _, v := range EntryAttributeValues(entry, name) {
+			if compareFilterValue(v, value) >= 0 {
+				return true
+			}
+		}
+		return false
+	case goldap.FilterLessOrEqual:
+		name, value := filterAssertion(p)
+		for _, v := range EntryAttributeValues(entry, name) {
+			if compareFilterValue(v, value) <= 0 {
+				return true
+			}
+		}
+		return false
+	case goldap.FilterSubstrings:
+		if len(p.Children) != 2 {
+			return false
+		}
+		name := ber.DecodeString(p.Children[0].Data.Bytes())
+		for _, v := range EntryAttributeValues(entry, name) {
+			if matchSubstrings(strings.ToLower(v), p.Children[1].Children) {
+				return true
+			}
+		}
+		return false
+	default:
+		return false
+	}
+}
+
+// filterTerm is an attribute value assertion of a filter
+type filterTerm struct {
+	Name  string
+	Value string
+}
+
+// EqualityTerms returns equality assertions at least one of which every
+// matching entry satisfies, so the entries can be looked up by them instead
+// of evaluating the filter on all. ok is false when the filter has no such
+// assertions, e.g. for presence or substring filters.
+func (this *EntryFilter) EqualityTerms() ([]filterTerm, bool) {
+	if this == nil || this.packet == nil {
+		return nil, false
+	}
+	return equalityTerms(this.packet)
+}
+
+func equalityTerms(p *ber.Packet) ([]filterTerm, bool) {
+	switch p.Tag {
+	case goldap.FilterEqualityMatch, goldap.FilterApproxMatch:
+		name, value := filterAssertion(p)
+		if len(name) == 0 {
+			return nil, false
+		}
+		return []filterTerm{{Name: name, Value: value}}, true
+	case goldap.FilterAnd:
+		// the terms of any child narrow the entries enough
+		for _, c := range p.Children {
+			if terms, ok := equalityTerms(c); ok {
+				return terms, true
+			}
+		}
+		return nil, false
+	case goldap.FilterOr:
+		var terms []filterTerm
+		for _, c := range p.Children {
+			t, ok := equalityTerms(c)
+			if !ok {
+				return nil, false
+			}
+			terms = append(terms, t...)
+		}
+		return terms, len(terms) > 0
+	default:
+		return nil, false
+	}
+}
+
+func filterAssertion(p *ber.Packet) (string, string) {
+	if len(p.Children) != 2 {
+		return "", ""
+	}
+	return ber.DecodeString(p.Children[0].Data.Bytes()), ber.DecodeString(p.Children[1].Data.Bytes())
+}
+
+func compareFilterValue(v, assertion string) int {
+	a, errA := strconv.ParseInt(v, 10, 64)
+	b, errB := strconv.ParseInt(assertion, 10, 64)
+	if errA == nil && errB == nil {
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		default:
+			return 0
+		}
+	}
+	return strings.Compare(strings.ToLower(v), strings.ToLower(assertion))
+}
+
+func matchSubstrings(v string, parts []*ber.Packet) bool {
+	for i, part := range parts {
+		s := strings.ToLower(ber.DecodeString(part.Data.Bytes()))
+		switch part.Tag {
+		case goldap.FilterSubstringsInitial:
+			if i != 0 || !strings.HasPrefix(v, s) {
+				return false
+			}
+			v = v[len(s):]
+		case goldap.FilterSubstringsAny:
+			idx := strings.Index(v, s)
+			if idx < 0 {
+				return false
+			}
+			v = v[idx+len(s):]
+		case goldap.FilterSubstringsFinal:
+			if i != len(parts)-1 || !strings.HasSuffix(v, s) {
+				return false
+			}
+			v = ""
+		}
+	}
+	return true
+}
+
+// EntryAttributeValues returns the values of the named attribute, matching
+// the name case-insensitively.
+func EntryAttributeValues(entry *gldap.Entry, name string) []string {
+	for _, a := range entry.Attributes {
+		if strings.EqualFold(a.Name, name) {
+			return a.Values
+		}
+	}
+	return nil
+}
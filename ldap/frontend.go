@@ -0,0 +1,642 @@
+package ldap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/jimlambrt/gldap"
+)
+
+// The frontend wraps the listener a gldap server accepts its connections from
+// and the connections themselves. gldap has no access to the client address
+// nor a way to limit connections, so the limits, the bind throttling,
+// StartTLS and SASL EXTERNAL are handled on the LDAP messages gldap reads
+// from and writes to the client.
+
+const (
+	applicationBindRequest     = 0
+	applicationBindResponse    = 1
+	applicationExtendedRequest = 23
+
+	bindAuthSimple = 0
+	bindAuthSASL   = 3
+
+	saslMechanismExternal = "EXTERNAL"
+
+	noticeOfDisconnectionOID = "1.3.6.1.4.1.1466.20036"
+
+	// defaultMaxPDUSize applies without max_pdu_size, the length of a message
+	// is declared by the client before it is authenticated
+	defaultMaxPDUSize = 1 << 20
+)
+
+var errPDUTooLarge = errors.New("ldap message exceeds the max pdu size")
+
+type frontendLimits struct {
+	MaxConnections int
+	IdleTimeout    time.Duration
+	MaxPDUSize     int
+}
+
+type frontend struct {
+	net.Listener
+
+	limits   frontendLimits
+	throttle *bindThrottle
+	// startTLS is the server config of StartTLS, nil disables StartTLS
+	startTLS *tls.Config
+	// externalSecret authenticates the simple binds SASL EXTERNAL binds of
+	// ldapi connections are passed to gldap as
+	externalSecret string
+
+	slots chan struct{}
+
+	lock  sync.Mutex
+	conns map[*frontendConn]struct{}
+}
+
+// newFrontend wraps l for a gldap server to serve
+func newFrontend(l net.Listener, startTLS *tls.Config, externalSecret string, limits frontendLimits, throttle *bindThrottle) *frontend {
+	fe := &frontend{
+		Listener:       l,
+		limits:         limits,
+		throttle:       throttle,
+		startTLS:       startTLS,
+		externalSecret: externalSecret,
+		conns:          map[*frontendConn]struct{}{},
+	}
+	if limits.MaxConnections > 0 {
+		fe.slots = make(chan struct{}, limits.MaxConnections)
+	}
+	return fe
+}
+
+// listenTCP listens on addr, with TLS when tlsConfig is set
+func listenTCP(addr string, tlsConfig *tls.Config) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	return l, nil
+}
+
+// listenUnix listens on the unix socket at path, replacing a stale socket file
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// Accept returns the next connection within the connection limit, the ones
+// beyond it are rejected with a notice of disconnection
+func (this *frontend) Accept() (net.Conn, error) {
+	for {
+		c, err := this.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if this.slots != nil {
+			select {
+			case this.slots <- struct{}{}:
+			default:
+				log.Println("ldap connection limit reached, rejecting:", c.RemoteAddr())
+				go rejectConnection(c)
+				continue
+			}
+		}
+		return this.newConn(c), nil
+	}
+}
+
+// Close stops accepting connections and closes the open ones
+func (this *frontend) Close() error {
+	err := this.Listener.Close()
+	this.lock.Lock()
+	conns := make([]*frontendConn, 0, len(this.conns))
+	for c := range this.conns {
+		conns = append(conns, c)
+	}
+	this.lock.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+	return err
+}
+
+func rejectConnection(c net.Conn) {
+	defer c.Close()
+	c.SetWriteDeadline(time.Now().Add(time.Second))
+	c.Write(encodeLdapResult(0, gldap.ApplicationExtendedResponse, gldap.ResultBusy, "too many connections", noticeOfDisconnectionOID))
+}
+
+// frontendConn is the connection gldap serves. Read is only called by the
+// gldap goroutine reading the requests, Write by the ones answering them.
+type frontendConn struct {
+	fe  *frontend
+	raw net.Conn
+	ip  string
+	// externalDN is the authorization identity of the peer on ldapi connections
+	externalDN string
+
+	// writeLock guards client, which StartTLS replaces, and the scanning of
+	// the responses
+	writeLock sync.Mutex
+	client    net.Conn
+	reader    *bufio.Reader
+	// pending is the rest of the request gldap is reading
+	pending []byte
+	// readDeadline is the read deadline gldap has set, in unix nanos
+	readDeadline int64
+
+	// respBuf holds the start of a response until its protocol op is known,
+	// or a whole bind response. respSkip is the rest of a response which
+	// isn't looked at.
+	respBuf  []byte
+	respSkip int
+
+	pendingLock  sync.Mutex
+	pendingBinds map[int64]string
+
+	lastActivity int64
+	closeOnce    sync.Once
+	closeErr     error
+}
+
+func (this *frontend) newConn(client net.Conn) *frontendConn {
+	ip := client.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	c := &frontendConn{
+		fe:           this,
+		raw:          client,
+		ip:           ip,
+		client:       client,
+		reader:       bufio.NewReader(client),
+		pendingBinds: map[int64]string{},
+	}
+	if uc, ok := client.(*net.UnixConn); ok {
+		uid, gid, err := peerCredentials(uc)
+		if err != nil {
+			log.Println("read ldapi peer credentials error:", err)
+		} else {
+			c.ip = "ldapi"
+			c.externalDN = fmt.Sprint("gidNumber=", gid, "+uidNumber=", uid, ",", PeerCredBaseDN)
+		}
+	}
+	c.touch()
+	this.lock.Lock()
+	this.conns[c] = struct{}{}
+	this.lock.Unlock()
+	return c
+}
+
+func (this *frontendConn) touch() {
+	atomic.StoreInt64(&this.lastActivity, time.Now().UnixNano())
+}
+
+// idle reports whether neither side has sent anything within the idle timeout
+func (this *frontendConn) idle() bool {
+	last := time.Unix(0, atomic.LoadInt64(&this.lastActivity))
+	return time.Since(last) >= this.fe.limits.IdleTimeout
+}
+
+func (this *frontendConn) Close() error {
+	this.closeOnce.Do(func() {
+		this.writeLock.Lock()
+		this.closeErr = this.client.Close()
+		this.writeLock.Unlock()
+		this.fe.lock.Lock()
+		delete(this.fe.conns, this)
+		this.fe.lock.Unlock()
+		if this.fe.slots != nil {
+			<-this.fe.slots
+		}
+	})
+	return this.closeErr
+}
+
+func (this *frontendConn) LocalAddr() net.Addr {
+	return this.raw.LocalAddr()
+}
+
+func (this *frontendConn) RemoteAddr() net.Addr {
+	return this.raw.RemoteAddr()
+}
+
+func (this *frontendConn) SetDeadline(t time.Time) error {
+	if err := this.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return this.SetWriteDeadline(t)
+}
+
+// SetReadDeadline keeps the deadline gldap sets, the reads combine it with
+// the idle timeout
+func (this *frontendConn) SetReadDeadline(t time.Time) error {
+	var deadline int64
+	if !t.IsZero() {
+		deadline = t.UnixNano()
+	}
+	atomic.StoreInt64(&this.readDeadline, deadline)
+	return this.client.SetReadDeadline(t)
+}
+
+func (this *frontendConn) SetWriteDeadline(t time.Time) error {
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+	return this.client.SetWriteDeadline(t)
+}
+
+// Read passes the requests of the client to gldap once inspectRequest lets
+// them through
+func (this *frontendConn) Read(p []byte) (int, error) {
+	for len(this.pending) == 0 {
+		data, err := this.readRequest()
+		if err != nil {
+			return 0, err
+		}
+		forward, err := this.inspectRequest(data)
+		if err != nil {
+			log.Println("invalid ldap request, closing connection:", this.ip, err)
+			return 0, io.EOF
+		}
+		this.pending = forward
+	}
+	n := copy(p, this.pending)
+	this.pending = this.pending[n:]
+	return n, nil
+}
+
+// deadline returns the earliest of the gldap read deadline and the idle
+// timeout, zero for none
+func (this *frontendConn) deadline() time.Time {
+	var deadline time.Time
+	if d := atomic.LoadInt64(&this.readDeadline); d != 0 {
+		deadline = time.Unix(0, d)
+	}
+	if this.fe.limits.IdleTimeout > 0 {
+		idle := time.Now().Add(this.fe.limits.IdleTimeout)
+		if deadline.IsZero() || idle.Before(deadline) {
+			deadline = idle
+		}
+	}
+	return deadline
+}
+
+func (this *frontendConn) readRequest() ([]byte, error) {
+	for this.fe.limits.IdleTimeout > 0 {
+		// wait for the next message, a message itself must not take longer
+		// than the idle timeout either
+		this.client.SetReadDeadline(this.deadline())
+		_, err := this.reader.Peek(1)
+		if err == nil {
+			this.client.SetReadDeadline(this.deadline())
+			break
+		}
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() || this.idle() {
+			return nil, err
+		}
+		if d := atomic.LoadInt64(&this.readDeadline); d != 0 && time.Now().UnixNano() >= d {
+			return nil, err
+		}
+		// gldap is still sending, e.g. a persistent search
+	}
+	data, err := readPDU(this.reader, this.fe.limits.MaxPDUSize)
+	if err != nil {
+		if errors.Is(err, errPDUTooLarge) {
+			log.Println("ldap request too large, closing connection:", this.ip)
+			this.writeClient(encodeLdapResult(0, gldap.ApplicationExtendedResponse, gldap.ResultProtocolError, err.Error(), noticeOfDisconnectionOID))
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	this.touch()
+	return data, nil
+}
+
+// Write passes the responses of gldap to the client and follows the bind
+// results for the throttle
+func (this *frontendConn) Write(p []byte) (int, error) {
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+	this.touch()
+	this.scanResponses(p)
+	return this.client.Write(p)
+}
+
+func (this *frontendConn) writeClient(data []byte) error {
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+	_, err := this.client.Write(data)
+	return err
+}
+
+// scanResponses finds the bind responses in the written data. A write may
+// hold a part of a response or several ones.
+func (this *frontendConn) scanResponses(p []byte) {
+	for len(p) > 0 {
+		if this.respSkip > 0 {
+			n := this.respSkip
+			if n > len(p) {
+				n = len(p)
+			}
+			this.respSkip -= n
+			p = p[n:]
+			continue
+		}
+		data := p
+		if len(this.respBuf) > 0 {
+			this.respBuf = append(this.respBuf, p...)
+			data = this.respBuf
+		}
+		size, messageId, opTag, ok := pduHeader(data)
+		if !ok || (opTag == applicationBindResponse && len(data) < size) {
+			if len(this.respBuf) == 0 {
+				this.respBuf = append(this.respBuf, p...)
+			}
+			return
+		}
+		if opTag == applicationBindResponse {
+			this.bindDone(messageId, data[:size])
+		}
+		// the part of the response in p, the rest of respBuf came before
+		consumed := size - (len(data) - len(p))
+		this.respBuf = this.respBuf[:0]
+		if consumed > len(p) {
+			this.respSkip = consumed - len(p)
+			return
+		}
+		p = p[consumed:]
+	}
+}
+
+// inspectRequest handles throttled binds, SASL binds and StartTLS. It returns
+// the message to pass to gldap, nil when the request has been answered.
+func (this *frontendConn) inspectRequest(data []byte) ([]byte, error) {
+	messageId, opTag, ok := peekPDU(data)
+	if !ok {
+		return nil, errors.New("malformed ldap message")
+	}
+	switch opTag {
+	case applicationBindRequest:
+		p, err := ber.DecodePacketErr(data)
+		if err != nil || len(p.Children) < 2 || len(p.Children[1].Children) < 3 {
+			return nil, errors.New("malformed bind request")
+		}
+		auth := p.Children[1].Children[2]
+		if auth.ClassType == ber.ClassContext && auth.Tag == bindAuthSASL {
+			return this.saslBind(messageId, p, auth)
+		}
+		name := p.Children[1].Children[1].Data.String()
+		if isPeerCredDN(name) {
+			// the external identities can only be bound by SASL EXTERNAL
+			return nil, this.writeClient(encodeLdapResult(messageId, gldap.ApplicationBindResponse, gldap.ResultInvalidCredentials, "", ""))
+		}
+		key := this.fe.throttle.Key(name)
+		if !this.fe.throttle.Allowed(this.ip, key) {
+			log.Println("bind throttled", "ip", this.ip, "name", name)
+			return nil, this.writeClient(encodeLdapResult(messageId, gldap.ApplicationBindResponse, gldap.ResultUnwillingToPerform, "too many failed binds, try again later", ""))
+		}
+		this.pendingLock.Lock()
+		this.pendingBinds[messageId] = key
+		this.pendingLock.Unlock()
+	case applicationExtendedRequest:
+		p, err := ber.DecodePacketErr(data)
+		if err != nil || len(p.Children) < 2 || len(p.Children[1].Children) < 1 {
+			return nil, errors.New("malformed extended request")
+		}
+		if p.Children[1].Children[0].Data.String() == string(gldap.ExtendedOperationStartTLS) {
+			return nil, this.startTLS(messageId)
+		}
+	}
+	return data, nil
+}
+
+// saslBind supports EXTERNAL on ldapi connections by passing gldap a simple
+// bind of the peer credentials DN authenticated with the external secret
+func (this *frontendConn) saslBind(messageId int64, p *ber.Packet, auth *ber.Packet) ([]byte, error) {
+	if len(auth.Children) < 1 {
+		return nil, errors.New("malformed sasl credentials")
+	}
+	mechanism := auth.Children[0].Data.String()
+	if mechanism != saslMechanismExternal || len(this.externalDN) == 0 {
+		return nil, this.writeClient(encodeLdapResult(messageId, gldap.ApplicationBindResponse, gldap.ResultAuthMethodNotSupported, "SASL mechanism not supported: "+mechanism, ""))
+	}
+	// an authorization identity may only repeat the authentication identity
+	if len(auth.Children) > 1 {
+		authzId := auth.Children[1].Data.String()
+		if len(authzId) > 0 && !strings.EqualFold(NormalizeDN(strings.TrimPrefix(authzId, "dn:")), NormalizeDN(this.externalDN)) {
+			return nil, this.writeClient(encodeLdapResult(messageId, gldap.ApplicationBindResponse, gldap.ResultInsufficientAccessRights, "authorization identity not permitted", ""))
+		}
+	}
+	var controls *ber.Packet
+	if len(p.Children) > 2 {
+		controls = p.Children[2]
+	}
+	return encodeSimpleBind(messageId, this.externalDN, this.fe.externalSecret, controls), nil
+}
+
+func (this *frontendConn) startTLS(messageId int64) error {
+	name := string(gldap.ExtendedOperationStartTLS)
+	if this.fe.startTLS == nil {
+		return this.writeClient(encodeLdapResult(messageId, gldap.ApplicationExtendedResponse, gldap.ResultProtocolError, "StartTLS is not available", name))
+	}
+	if _, ok := this.client.(*tls.Conn); ok {
+		return this.writeClient(encodeLdapResult(messageId, gldap.ApplicationExtendedResponse, gldap.ResultOperationsError, "TLS already established", name))
+	}
+
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+	if _, err := this.client.Write(encodeLdapResult(messageId, gldap.ApplicationExtendedResponse, gldap.ResultSuccess, "", name)); err != nil {
+		return err
+	}
+	if this.reader.Buffered() > 0 {
+		return errors.New("data received before TLS handshake")
+	}
+	tlsConn := tls.Server(this.client, this.fe.startTLS)
+	tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	this.client = tlsConn
+	this.reader = bufio.NewReader(tlsConn)
+	log.Println("StartTLS OK", "ip", this.ip)
+	return nil
+}
+
+func (this *frontendConn) bindDone(messageId int64, data []byte) {
+	this.pendingLock.Lock()
+	key, ok := this.pendingBinds[messageId]
+	delete(this.pendingBinds, messageId)
+	this.pendingLock.Unlock()
+	if !ok {
+		return
+	}
+	p, err := ber.DecodePacketErr(data)
+	if err != nil || len(p.Children) < 2 || len(p.Children[1].Children) < 1 {
+		return
+	}
+	code, _ := p.Children[1].Children[0].Value.(int64)
+	switch code {
+	case gldap.ResultSuccess:
+		this.fe.throttle.Succeeded(this.ip, key)
+	case gldap.ResultInvalidCredentials:
+		this.fe.throttle.Failed(this.ip, key)
+	}
+}
+
+// readPDU reads one LDAPMessage, maxSize limits its encoded size and is
+// defaultMaxPDUSize when <= 0
+func readPDU(r *bufio.Reader, maxSize int) ([]byte, error) {
+	if maxSize <= 0 {
+		maxSize = defaultMaxPDUSize
+	}
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if tag != 0x30 {
+		return nil, errors.New("ldap message is not a sequence")
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	header := []byte{tag, first}
+	length := 0
+	switch {
+	case first&0x80 == 0:
+		length = int(first)
+	case first == 0x80:
+		return nil, errors.New("indefinite length is not supported")
+	default:
+		n := int(first & 0x7f)
+		if n > 4 {
+			return nil, errPDUTooLarge
+		}
+		for i := 0; i < n; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			header = append(header, b)
+			length = length<<8 | int(b)
+		}
+	}
+	if len(header)+length > maxSize {
+		return nil, errPDUTooLarge
+	}
+	data := make([]byte, len(header)+length)
+	copy(data, header)
+	if _, err := io.ReadFull(r, data[len(header):]); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// peekPDU returns the message id and the application tag of the protocol op
+// without decoding the whole message
+func peekPDU(data []byte) (int64, int, bool) {
+	_, read, err := readLength(data[1:])
+	if err != nil {
+		return 0, 0, false
+	}
+	pos := 1 + read
+	if pos+2 > len(data) || data[pos] != 0x02 {
+		return 0, 0, false
+	}
+	idLen := int(data[pos+1])
+	pos += 2
+	if idLen > 8 || pos+idLen >= len(data) {
+		return 0, 0, false
+	}
+	var messageId int64
+	for _, b := range data[pos : pos+idLen] {
+		messageId = messageId<<8 | int64(b)
+	}
+	pos += idLen
+	return messageId, int(data[pos] & 0x1f), true
+}
+
+// pduHeader returns the encoded size of the message data starts with, its
+// message id and the application tag of its protocol op. ok is false while
+// data is too short to tell. It expects the well formed messages of gldap.
+func pduHeader(data []byte) (size int, messageId int64, opTag int, ok bool) {
+	if len(data) < 2 {
+		return
+	}
+	pos := 2
+	length := int(data[1])
+	if data[1]&0x80 != 0 {
+		n := int(data[1] & 0x7f)
+		if len(data) < pos+n {
+			return
+		}
+		length = 0
+		for _, b := range data[pos : pos+n] {
+			length = length<<8 | int(b)
+		}
+		pos += n
+	}
+	size = pos + length
+	if len(data) < pos+2 {
+		return
+	}
+	idLen := int(data[pos+1])
+	pos += 2
+	if len(data) < pos+idLen+1 {
+		return
+	}
+	for _, b := range data[pos : pos+idLen] {
+		messageId = messageId<<8 | int64(b)
+	}
+	return size, messageId, int(data[pos+idLen] & 0x1f), true
+}
+
+func encodeSimpleBind(messageId int64, name, password string, controls *ber.Packet) []byte {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageId, "MessageID"))
+	r := ber.Encode(ber.ClassApplication, ber.TypeConstructed, applicationBindRequest, nil, "Bind Request")
+	r.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 3, "Version"))
+	r.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "User Name"))
+	r.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, bindAuthSimple, password, "Password"))
+	p.AppendChild(r)
+	if controls != nil {
+		p.AppendChild(controls)
+	}
+	return p.Bytes()
+}
+
+func encodeLdapResult(messageId int64, application int, code int, diag string, responseName string) []byte {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageId, "MessageID"))
+	r := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ber.Tag(application), nil, "Result")
+	r.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "resultCode"))
+	r.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	r.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, diag, "diagnosticMessage"))
+	if len(responseName) > 0 {
+		r.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 10, responseName, "responseName"))
+	}
+	p.AppendChild(r)
+	return p.Bytes()
+}
@@ -0,0 +1,73 @@
+package ldap
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	changelogDefaultLimit = 100
+	changelogMaxLimit     = 1000
+)
+
+// InitChangelogHttp serves the changelog to users authenticated like the
+// http gateway
+func InitChangelogHttp(engine *gin.Engine, server *ldapServer, throttle *bindThrottle) {
+	engine.GET("/ldap/changelog", RestAuth(server, throttle), ListChanges(server.backend))
+}
+
+// ListChanges returns changes in ascending change number order starting from
+// the "from" query parameter, so a consumer can poll with from = last + 1.
+func ListChanges(backend DirectoryBackend) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		from, err := strconv.ParseInt(ctx.DefaultQuery("from", "0"), 10, 64)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, ResponseErr("4000", "invalid from"))
+			return
+		}
+		limit, err := strconv.Atoi(ctx.DefaultQuery("limit", strconv.Itoa(changelogDefaultLimit)))
+		if err != nil || limit <= 0 {
+			ctx.JSON(http.StatusBadRequest, ResponseErr("4000", "invalid limit"))
+			return
+		}
+		if limit > changelogMaxLimit {
+			limit = changelogMaxLimit
+		}
+
+		changes, err := backend.FindChanges(from, limit)
+		if err != nil {
+			log.Println("list changes error:", err)
+			ctx.JSON(http.StatusInternalServerError, ResponseErr("5000", "internal error"))
+			return
+		}
+		if changes == nil {
+			changes = []*ChangeRecord{}
+		}
+
+		ctx.JSON(http.StatusOK, ResponseBody(changes))
+	}
+}
+
+func ResponseOk() map[string]interface{} {
+	return map[string]interface{}{
+		"status": "0",
+	}
+}
+
+func ResponseBody(body interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"status": "0",
+		"data":   body,
+	}
+}
+
+func ResponseErr(errorCode, errorMessage string) map[string]interface{} {
+	return map[string]interface{}{
+		"status":        "1000",
+		"error_code":    errorCode,
+		"error_message": errorMessage,
+	}
+}
@@ -0,0 +1,268 @@
+package ldap
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/meidomx/misc-service/config"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jimlambrt/gldap"
+)
+
+// Authentication of the http apis of all services by directory users. The
+// first rule matching the path and method of a request applies, requests
+// no rule matches are denied unless they are for the apis of the directory,
+// which authenticate on their own. Users authenticate with HTTP basic auth
+// resolved like an LDAP simple bind, or with an API key stored in an
+// attribute of their entry sent as bearer token.
+const (
+	// HttpAuthDNKey is the gin context key of the DN of the authenticated user
+	HttpAuthDNKey = "http_auth_dn"
+
+	httpAuthRealm = "misc-service"
+	// apiKeySHA256Prefix marks an api key stored as base64 of its SHA-256
+	apiKeySHA256Prefix = "{SHA256}"
+)
+
+type httpAuth struct {
+	server   *ldapServer
+	throttle *bindThrottle
+	rules    []*httpAuthRule
+	// ownAuth are the path prefixes authenticating on their own
+	ownAuth      []string
+	apiKeyAttr   string
+	apiKeyBaseDN string
+	groupsBaseDN string
+}
+
+type httpAuthRule struct {
+	PathPrefix string
+	Methods    []string
+	Anonymous  bool
+	Groups     []string
+}
+
+// HttpAuth is the middleware enforcing http.auth. It has to be used before
+// the routes of the services are added.
+func HttpAuth(c *config.Config, server *ldapServer, throttle *bindThrottle) func(ctx *gin.Context) {
+	this := &httpAuth{
+		server:       server,
+		throttle:     throttle,
+		apiKeyAttr:   c.Http.Auth.ApiKeyAttribute,
+		apiKeyBaseDN: c.Http.Auth.ApiKeyBaseDN,
+		groupsBaseDN: c.Http.Auth.GroupsBaseDN,
+	}
+	if len(this.apiKeyAttr) > 0 && len(this.apiKeyBaseDN) == 0 {
+		log.Fatalf("http auth api keys require http.auth.api_key_base_dn")
+	}
+	for _, r := range c.Http.Auth.Rules {
+		prefix := path.Clean("/" + r.PathPrefix)
+		rule := &httpAuthRule{
+			PathPrefix: strings.TrimSuffix(prefix, "/"),
+			Methods:    r.Methods,
+			Anonymous:  r.Anonymous,
+			Groups:     r.Groups,
+		}
+		this.rules = append(this.rules, rule)
+	}
+	this.ownAuth = []string{"/ldap"}
+	if c.LDAP.SCIM.Enable {
+		this.ownAuth = append(this.ownAuth, "/scim/v2")
+	}
+	if c.LDAP.OIDC.Enable {
+		if issuer, err := url.Parse(c.LDAP.OIDC.Issuer); err == nil {
+			prefix := strings.TrimSuffix(path.Clean("/"+issuer.Path), "/")
+			this.ownAuth = append(this.ownAuth, prefix+"/oidc", prefix+"/.well-known/openid-configuration")
+		}
+	}
+	return this.Handle
+}
+
+func (this *httpAuth) Handle(ctx *gin.Context) {
+	const op = "ldap.(Directory).httpAuth"
+
+	rule := this.match(ctx.Request)
+	if rule == nil {
+		if hasPathPrefix(path.Clean("/"+ctx.Request.URL.Path), this.ownAuth) {
+			ctx.Next()
+			return
+		}
+		log.Println("http request without rule denied", "op", op, "path", ctx.Request.URL.Path)
+		ctx.AbortWithStatusJSON(http.StatusForbidden, ResponseErr("4030", "access denied"))
+		return
+	}
+	header := ctx.GetHeader("Authorization")
+	if len(header) == 0 && rule.Anonymous {
+		ctx.Next()
+		return
+	}
+
+	ip := ctx.ClientIP()
+	var dn string
+	switch {
+	case len(this.apiKeyAttr) > 0 && len(header) > 7 && strings.EqualFold(header[:7], "bearer "):
+		if !this.throttle.Allowed(ip, "") {
+			ctx.AbortWithStatusJSON(http.StatusTooManyRequests, ResponseErr("4290", "too many failed attempts, try again later"))
+			return
+		}
+		dn = this.findApiKey(strings.TrimSpace(header[7:]))
+		if len(dn) == 0 {
+			// counted for the ip only, there is no name to count
+			this.throttle.Failed(ip, "")
+			this.unauthorized(ctx, "invalid api key")
+			return
+		}
+	default:
+		name, password, ok := ctx.Request.BasicAuth()
+		if !ok || len(name) == 0 || len(password) == 0 {
+			this.unauthorized(ctx, "authentication required")
+			return
+		}
+		key := this.throttle.Key(name)
+		if !this.throttle.Allowed(ip, key) {
+			ctx.AbortWithStatusJSON(http.StatusTooManyRequests, ResponseErr("4290", "too many failed binds, try again later"))
+			return
+		}
+		dn = this.server.authenticate(name, gldap.Password(password))
+		if len(dn) == 0 {
+			this.throttle.Failed(ip, key)
+			this.unauthorized(ctx, "invalid credentials")
+			return
+		}
+		this.throttle.Succeeded(ip, key)
+	}
+
+	if !this.authorized(rule, dn) {
+		log.Println("http request denied", "op", op, "DN", dn, "path", ctx.Request.URL.Path)
+		ctx.AbortWithStatusJSON(http.StatusForbidden, ResponseErr("4030", "access denied"))
+		return
+	}
+	ctx.Set(HttpAuthDNKey, dn)
+	ctx.Next()
+}
+
+func (this *httpAuth) match(r *http.Request) *httpAuthRule {
+	p := path.Clean("/" + r.URL.Path)
+	for _, rule := range this.rules {
+		if len(rule.Methods) > 0 && !containsFold(rule.Methods, r.Method) {
+			continue
+		}
+		if hasPathPrefix(p, []string{rule.PathPrefix}) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// hasPathPrefix reports whether the cleaned path is at or below one of the
+// prefixes, an empty prefix matches every path
+func hasPathPrefix(p string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if prefix == "" || p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *httpAuth) unauthorized(ctx *gin.Context, msg string) {
+	ctx.Writer.Header().Add("WWW-Authenticate", `Basic realm="`+httpAuthRealm+`"`)
+	if len(this.apiKeyAttr) > 0 {
+		ctx.Writer.Header().Add("WWW-Authenticate", `Bearer realm="`+httpAuthRealm+`"`)
+	}
+	ctx.AbortWithStatusJSON(http.StatusUnauthorized, ResponseErr("4010", msg))
+}
+
+// authorized reports whether the user is member of one of the groups of the
+// rule, given by cn or DN. Without groups_base_dn the memberOf values of the
+// user are the groups.
+func (this *httpAuth) authorized(rule *httpAuthRule, dn string) bool {
+	const op = "ldap.(Directory).httpAuthorize"
+
+	if len(rule.Groups) == 0 {
+		return true
+	}
+	var groups []*gldap.Entry
+	if len(this.groupsBaseDN) > 0 {
+		groups = findMemberGroups(this.server.backend, this.groupsBaseDN, dn)
+	} else {
+		entry, err := this.server.backend.FindOneEntry(dn)
+		if err != nil {
+			log.Println("FindOneEntry error", "op", op, "err", err)
+			return false
+		}
+		for _, group := range EntryAttributeValues(entry, attributeMemberOf) {
+			groups = append(groups, &gldap.Entry{DN: group})
+		}
+	}
+	for _, group := range groups {
+		for _, want := range rule.Groups {
+			if NormalizeDN(group.DN) == NormalizeDN(want) || containsFold(EntryAttributeValues(group, "cn"), want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// findApiKey returns the DN of the only entry below api_key_base_dn holding
+// the key, empty when there is none or several. Keys are looked up through
+// the attribute index, plain and as SHA-256 digest. Keys of accounts
+// deactivated by SCIM are rejected.
+func (this *httpAuth) findApiKey(key string) string {
+	const op = "ldap.(Directory).findApiKey"
+
+	if len(key) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	var found []string
+	deactivated := false
+	for _, value := range []string{key, apiKeySHA256Prefix + base64.StdEncoding.EncodeToString(sum[:])} {
+		entries, err := this.server.backend.FindByAttribute(this.apiKeyAttr, value)
+		if err != nil {
+			log.Println("find api key error", "op", op, "err", err)
+			return ""
+		}
+		for _, entry := range entries {
+			if !IsDNInScope(entry.DN, this.apiKeyBaseDN, gldap.WholeSubtree) || containsFold(found, entry.DN) {
+				continue
+			}
+			// the index ignores case
+			for _, v := range EntryAttributeValues(entry, this.apiKeyAttr) {
+				if matchApiKey(v, key) {
+					found = append(found, entry.DN)
+					deactivated = isDeactivated(entry)
+					break
+				}
+			}
+		}
+	}
+	if len(found) != 1 {
+		if len(found) > 1 {
+			log.Println("api key held by several entries", "op", op)
+		}
+		return ""
+	}
+	if deactivated {
+		return ""
+	}
+	return found[0]
+}
+
+// matchApiKey compares with a stored key, plain or {SHA256}<base64 digest>
+func matchApiKey(stored, key string) bool {
+	if len(stored) > len(apiKeySHA256Prefix) && strings.EqualFold(stored[:len(apiKeySHA256Prefix)], apiKeySHA256Prefix) {
+		sum := sha256.Sum256([]byte(key))
+		digest := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(stored[len(apiKeySHA256Prefix):]), []byte(digest)) == 1
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(key)) == 1
+}
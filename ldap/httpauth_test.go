@@ -0,0 +1,91 @@
+package ldap
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/meidomx/misc-service/config"
+	"github.com/meidomx/misc-service/id"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestHttpAuth(t *testing.T) {
+	c := new(config.Config)
+	c.LDAP.Suffixes = []config.LdapSuffix{{
+		Suffix:     "dc=example",
+		BindBaseDN: "ou=people,dc=example",
+		BindFilter: "(uid=%s)",
+	}}
+	c.Http.Auth.ApiKeyAttribute = "apiKey"
+	c.Http.Auth.ApiKeyBaseDN = "ou=people,dc=example"
+	c.Http.Auth.GroupsBaseDN = "ou=groups,dc=example"
+	c.Http.Auth.Rules = []config.HttpAuthRule{
+		{PathPrefix: "/public", Anonymous: true},
+		{PathPrefix: "/writers", Groups: []string{"writers"}},
+	}
+	backend := newTestMemoryBackend(t, "", 0)
+	idGen := id.NewIdGen(1, 1)
+	sum := sha256.Sum256([]byte("bob-key"))
+	saveTestEntry(t, backend, idGen, "dc=example", map[string][]string{"objectClass": {"top", "domain"}})
+	saveTestEntry(t, backend, idGen, "ou=people,dc=example", map[string][]string{"objectClass": {"top", "organizationalUnit"}})
+	saveTestEntry(t, backend, idGen, "cn=alice,ou=people,dc=example", map[string][]string{
+		"objectClass": {"top", "inetOrgPerson"},
+		"uid":         {"alice"},
+		"apiKey":      {"Alice-Key"},
+	})
+	saveTestEntry(t, backend, idGen, "cn=bob,ou=people,dc=example", map[string][]string{
+		"objectClass": {"top", "inetOrgPerson"},
+		"uid":         {"bob"},
+		"apiKey":      {apiKeySHA256Prefix + base64.StdEncoding.EncodeToString(sum[:])},
+	})
+	saveTestEntry(t, backend, idGen, "cn=carol,ou=people,dc=example", map[string][]string{
+		"objectClass":       {"top", "inetOrgPerson"},
+		"uid":               {"carol"},
+		"apiKey":            {"Carol-Key"},
+		attributeScimActive: {"FALSE"},
+	})
+	saveTestEntry(t, backend, idGen, "ou=groups,dc=example", map[string][]string{"objectClass": {"top", "organizationalUnit"}})
+	saveTestEntry(t, backend, idGen, "cn=writers,ou=groups,dc=example", map[string][]string{
+		"objectClass": {"top", "groupOfNames"},
+		"cn":          {"writers"},
+		"member":      {"cn=bob,ou=people,dc=example", "cn=carol,ou=people,dc=example"},
+	})
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	server := newLdapServer(idGen, c, backend, nil, "external", nil)
+	engine.Use(HttpAuth(c, server, nil))
+	for _, p := range []string{"/public", "/writers", "/other", "/ldap/search"} {
+		engine.GET(p, func(ctx *gin.Context) {
+			ctx.JSON(http.StatusOK, ResponseOk())
+		})
+	}
+
+	for _, c := range []struct {
+		path, key string
+		status    int
+	}{
+		{"/public", "", http.StatusOK},
+		{"/other", "Alice-Key", http.StatusForbidden},
+		{"/ldap/search", "", http.StatusOK},
+		{"/writers", "", http.StatusUnauthorized},
+		{"/writers", "alice-key", http.StatusUnauthorized},
+		{"/writers", "Alice-Key", http.StatusForbidden},
+		{"/writers", "bob-key", http.StatusOK},
+		{"/writers", "Carol-Key", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest(http.MethodGet, c.path, nil)
+		if len(c.key) > 0 {
+			req.Header.Set("Authorization", "Bearer "+c.key)
+		}
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		if w.Code != c.status {
+			t.Errorf("%s with %q: %d", c.path, c.key, w.Code)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package ldap
 
 import (
 	"log"
+	"strings"
 
 	"github.com/meidomx/misc-service/config"
 	"github.com/meidomx/misc-service/id"
@@ -9,81 +10,111 @@ import (
 	"github.com/jimlambrt/gldap"
 )
 
-func InitBaseDN(c *config.Config, idGen *id.IdGen) error {
-	// skip if initialized
-	if r, err := FindAllRoots(); err != nil {
-		log.Println("InitBaseDN - query roots error:", err)
-		return err
-	} else if len(r) > 0 {
-		log.Println("ldap is already initialized")
-		return nil
-	}
-
-	// run dn init
-	for _, v := range c.LDAP.Init.InitScripts {
-		if err := runInit(v, idGen); err != nil {
-			log.Println("InitBaseDN - run init error:", err)
+// InitBaseDN applies the configured LDIF seed files in order. Missing entries
+// are created and existing entries are left untouched unless update_existing
+// is set, in which case the attributes listed in the seed replace the stored
+// ones. Running it repeatedly is safe.
+func InitBaseDN(c *config.Config, idGen *id.IdGen, backend DirectoryBackend) error {
+	created, updated := 0, 0
+	for _, file := range c.LDAP.Init.SeedFiles {
+		records, err := ReadLdifFile(file)
+		if err != nil {
+			log.Println("InitBaseDN - read seed file error:", err)
 			return err
 		}
+		for _, rec := range records {
+			r, err := applySeedRecord(backend, rec, c.LDAP.Init.UpdateExisting, idGen)
+			if err != nil {
+				log.Println("InitBaseDN - apply seed record error:", rec.DN, err)
+				return err
+			}
+			switch r {
+			case seedCreated:
+				created++
+			case seedUpdated:
+				updated++
+			}
+		}
+		log.Println("ldap seed file applied:", file)
 	}
 
-	// run admin init
-	if err := runAdminInit(c.LDAP.Init.InitAdmin, idGen); err != nil {
-		log.Println("InitBaseDN - run admin init error:", err)
-		return err
-	}
-
-	log.Println("ldap has successfully initialized")
+	log.Println("ldap has successfully initialized, created:", created, "updated:", updated)
 
 	return nil
 }
 
-func runAdminInit(admin struct {
-	DN            string   `toml:"dn"`
-	ObjectClasses []string `toml:"object_classes"`
-	UserPassword  string   `toml:"user_password"`
-}, idGen *id.IdGen) error {
-
-	attrs := map[string][]string{}
-	attrs["objectClass"] = admin.ObjectClasses
-	attrs["userPassword"] = []string{admin.UserPassword}
+type seedResult int
 
-	newEntry := gldap.NewEntry(admin.DN, attrs)
+const (
+	seedSkipped seedResult = iota
+	seedCreated
+	seedUpdated
+)
 
-	newId, err := idGen.Next()
+func applySeedRecord(backend DirectoryBackend, rec *LdifRecord, updateExisting bool, idGen *id.IdGen) (seedResult, error) {
+	entry, err := backend.FindOneEntry(rec.DN)
 	if err != nil {
-		log.Println("generate id error:", err)
-		return err
-	}
-	err = SaveEntry(newEntry, newId)
-	if err != nil {
-		log.Println("SaveEntry error:", err)
-		return err
+		return seedSkipped, err
 	}
 
-	return nil
-}
-
-func runInit(v struct {
-	DN            string   `toml:"dn"`
-	ObjectClasses []string `toml:"object_classes"`
-}, idGen *id.IdGen) error {
-
-	attrs := map[string][]string{}
-	attrs["objectClass"] = v.ObjectClasses
+	if len(entry.DN) <= 0 {
+		newEntry := gldap.NewEntry(rec.DN, rec.Attributes)
+		newId, err := idGen.Next()
+		if err != nil {
+			log.Println("generate id error:", err)
+			return seedSkipped, err
+		}
+		if err := backend.SaveEntry(newEntry, newId, NewAddChange("", newEntry)); err != nil {
+			log.Println("SaveEntry error:", err)
+			return seedSkipped, err
+		}
+		return seedCreated, nil
+	}
 
-	newEntry := gldap.NewEntry(v.DN, attrs)
+	if !updateExisting {
+		return seedSkipped, nil
+	}
 
-	newId, err := idGen.Next()
-	if err != nil {
-		log.Println("generate id error:", err)
-		return err
+	var changes []gldap.Change
+	for _, name := range rec.AttrNames {
+		values := rec.Attributes[name]
+		var found *gldap.EntryAttribute
+		for _, a := range entry.Attributes {
+			if strings.EqualFold(a.Name, name) {
+				found = a
+				break
+			}
+		}
+		if found == nil {
+			entry.Attributes = append(entry.Attributes, gldap.NewEntryAttribute(name, values))
+		} else if !sameValues(found.Values, values) {
+			*found = *gldap.NewEntryAttribute(found.Name, values)
+		} else {
+			continue
+		}
+		changes = append(changes, gldap.Change{
+			Operation:    gldap.ReplaceAttribute,
+			Modification: gldap.PartialAttribute{Type: name, Vals: values},
+		})
 	}
-	err = SaveEntry(newEntry, newId)
-	if err != nil {
-		log.Println("SaveEntry error:", err)
-		return err
+	if len(changes) == 0 {
+		return seedSkipped, nil
 	}
+	if err := backend.UpdateEntry(entry, NewModifyChange("", entry.DN, changes)); err != nil {
+		log.Println("UpdateEntry error:", err)
+		return seedSkipped, err
+	}
+	return seedUpdated, nil
+}
 
-	return nil
+func sameValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,209 @@
+package ldap
+
+import (
+	"strings"
+
+	"github.com/jimlambrt/gldap"
+)
+
+// Aliases (RFC 4512 alias objectClass) and referrals (RFC 3296 referral
+// objectClass).
+//
+// gldap can neither send searchResultReference messages nor fill the referral
+// field of a result, so a referral result carries the ref URLs in the
+// diagnostic message and referral objects inside the scope of a search are
+// left out of the results.
+const (
+	ControlTypeManageDsaIT = "2.16.840.1.113730.3.4.2"
+
+	objectClassAlias    = "alias"
+	objectClassReferral = "referral"
+
+	attributeAliasedObjectName = "aliasedObjectName"
+	attributeRef               = "ref"
+
+	derefInSearching     = 1
+	derefFindingBaseObj  = 2
+	aliasMaxDereferences = 10
+)
+
+// resultSetter is implemented by the responses of all update and search requests
+type resultSetter interface {
+	SetResultCode(code int)
+	SetDiagnosticMessage(msg string)
+	SetMatchedDN(dn string)
+}
+
+func hasObjectClass(entry *gldap.Entry, objectClass string) bool {
+	for _, oc := range EntryAttributeValues(entry, "objectClass") {
+		if strings.EqualFold(oc, objectClass) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasManageDsaITControl(controls []gldap.Control) bool {
+	for _, c := range controls {
+		if c.GetControlType() == ControlTypeManageDsaIT {
+			return true
+		}
+	}
+	return false
+}
+
+// findReferral returns the referral object at dn or above it, nil if there is none
+func (this *ldapServer) findReferral(dn string) (*gldap.Entry, error) {
+	levels := SplitDN(dn)
+	for i := range levels {
+		entry, err := this.backend.FindOneEntry(CombineDN(levels[i:]))
+		if err != nil {
+			return nil, err
+		}
+		if len(entry.DN) > 0 && hasObjectClass(entry, objectClassReferral) {
+			return entry, nil
+		}
+	}
+	return nil, nil
+}
+
+// checkReferral sets a referral result and returns true when dn is at or below
+// a referral object, unless the ManageDsaIT control is present
+func (this *ldapServer) checkReferral(dn string, controls []gldap.Control, res resultSetter) (bool, error) {
+	if len(dn) == 0 || hasManageDsaITControl(controls) {
+		return false, nil
+	}
+	ref, err := this.findReferral(dn)
+	if err != nil || ref == nil {
+		return false, err
+	}
+	res.SetResultCode(gldap.ResultReferral)
+	res.SetMatchedDN(ref.DN)
+	res.SetDiagnosticMessage("referral: " + strings.Join(EntryAttributeValues(ref, attributeRef), " "))
+	return true, nil
+}
+
+// dereferenceAlias follows aliasedObjectName until a non alias entry. The
+// returned code is set when the alias can't be dereferenced.
+func (this *ldapServer) dereferenceAlias(entry *gldap.Entry) (*gldap.Entry, int, error) {
+	for i := 0; i < aliasMaxDereferences; i++ {
+		if !hasObjectClass(entry, objectClassAlias) {
+			return entry, gldap.ResultSuccess, nil
+		}
+		targets := EntryAttributeValues(entry, attributeAliasedObjectName)
+		if len(targets) != 1 {
+			return nil, gldap.ResultAliasProblem, nil
+		}
+		target, err := this.backend.FindOneEntry(targets[0])
+		if err != nil {
+			return nil, gldap.ResultOperationsError, err
+		}
+		if len(target.DN) <= 0 {
+			return nil, gldap.ResultAliasProblem, nil
+		}
+		entry = target
+	}
+	return nil, gldap.ResultAliasDereferencingProblem, nil
+}
+
+// walkSearch calls f for the entries in scope of the search below base,
+// dereferencing aliases found while searching when requested and leaving out
+// referral objects unless manageDsaIT is set. Every entry is passed once.
+func (this *ldapServer) walkSearch(base string, scope gldap.Scope, deref int, manageDsaIT bool, f func(entry *gldap.Entry) bool) error {
+	seen := map[string]bool{}
+	// resolve returns the entry to use in place of e, nil to leave it out
+	resolve := func(e *gldap.Entry) (*gldap.Entry, error) {
+		if !manageDsaIT && hasObjectClass(e, objectClassReferral) {
+			return nil, nil
+		}
+		if deref&derefInSearching != 0 && hasObjectClass(e, objectClassAlias) {
+			target, code, err := this.dereferenceAlias(e)
+			if err != nil || code != gldap.ResultSuccess {
+				// an alias which can't be dereferenced is left out
+				return nil, err
+			}
+			e = target
+		}
+		key := NormalizeDN(e.DN)
+		if seen[key] {
+			return nil, nil
+		}
+		seen[key] = true
+		return e, nil
+	}
+
+	switch scope {
+	case gldap.BaseObject:
+		return WalkScope(this.backend, base, scope, f)
+	case gldap.SingleLevel:
+		var entries []*gldap.Entry
+		err := WalkScope(this.backend, base, scope, func(e *gldap.Entry) bool {
+			entries = append(entries, e)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			r, err := resolve(e)
+			if err != nil {
+				return err
+			}
+			if r != nil && !f(r) {
+				return nil
+			}
+		}
+		return nil
+	case gldap.WholeSubtree:
+		var queue []*gldap.Entry
+		if len(base) > 0 {
+			b, err := this.backend.FindOneEntry(base)
+			if err != nil {
+				return err
+			}
+			if len(b.DN) <= 0 {
+				return nil
+			}
+			// the base has been resolved by the caller already
+			seen[NormalizeDN(b.DN)] = true
+			queue = append(queue, b)
+		} else {
+			roots, err := this.backend.FindRoots()
+			if err != nil {
+				return err
+			}
+			for _, root := range roots {
+				r, err := resolve(root)
+				if err != nil {
+					return err
+				}
+				if r != nil {
+					queue = append(queue, r)
+				}
+			}
+		}
+		for len(queue) > 0 {
+			e := queue[0]
+			queue = queue[1:]
+			if !f(e) {
+				return nil
+			}
+			children, err := this.backend.FindChildren(e.DN)
+			if err != nil {
+				return err
+			}
+			for _, c := range children {
+				r, err := resolve(c)
+				if err != nil {
+					return err
+				}
+				if r != nil {
+					// a dereferenced alias continues the search below its target
+					queue = append(queue, r)
+				}
+			}
+		}
+		return nil
+	}
+	return WalkScope(this.backend, base, scope, f)
+}
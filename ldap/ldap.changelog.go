@@ -0,0 +1,117 @@
+package ldap
+
+import (
+	"log"
+	"strings"
+
+	"github.com/jimlambrt/gldap"
+)
+
+const (
+	changelogScanBatch = 500
+)
+
+func (this *ldapServer) searchChangelog(w *gldap.ResponseWriter, r *gldap.Request, m *gldap.SearchMessage, res *gldap.SearchResponseDone) {
+	const op = "ldap.(Directory).handleSearchChangelog"
+
+	filter, err := CompileEntryFilter(m.Filter)
+	if err != nil {
+		log.Println("compile filter error", "op", op, "err", err)
+		res.SetResultCode(gldap.ResultFilterError)
+		return
+	}
+
+	sent := int64(0)
+	send := func(entry *gldap.Entry) bool {
+		if !filter.Match(entry) {
+			return true
+		}
+		if m.SizeLimit > 0 && sent >= m.SizeLimit {
+			res.SetResultCode(gldap.ResultSizeLimitExceeded)
+			return false
+		}
+		if err := writeSearchEntry(w, r, m, entry); err != nil {
+			log.Println("write result error", "op", op, "err", err)
+			return false
+		}
+		sent++
+		return true
+	}
+
+	// base object of a single change
+	if n, ok := parseChangelogEntryDN(m.BaseDN); ok {
+		if m.Scope != gldap.BaseObject {
+			res.SetResultCode(gldap.ResultSuccess)
+			return
+		}
+		change, err := FindChange(this.backend, n)
+		if err != nil {
+			log.Println("FindChange error", "op", op, "err", err)
+			res.SetResultCode(gldap.ResultOperationsError)
+			return
+		}
+		if change == nil {
+			return
+		}
+		res.SetResultCode(gldap.ResultSuccess)
+		send(change.ToEntry())
+		return
+	}
+	if !strings.EqualFold(strings.TrimSpace(m.BaseDN), ChangelogBaseDN) {
+		return
+	}
+
+	res.SetResultCode(gldap.ResultSuccess)
+	if m.Scope == gldap.BaseObject || m.Scope == gldap.WholeSubtree {
+		if !send(changelogRootEntry()) || m.Scope == gldap.BaseObject {
+			return
+		}
+	}
+
+	from := int64(0)
+	for {
+		changes, err := this.backend.FindChanges(from, changelogScanBatch)
+		if err != nil {
+			log.Println("FindChanges error", "op", op, "err", err)
+			res.SetResultCode(gldap.ResultOperationsError)
+			return
+		}
+		for _, c := range changes {
+			if !send(c.ToEntry()) {
+				return
+			}
+			from = c.ChangeNumber + 1
+		}
+		if len(changes) < changelogScanBatch {
+			return
+		}
+	}
+}
+
+func writeSearchEntry(w *gldap.ResponseWriter, r *gldap.Request, m *gldap.SearchMessage, entry *gldap.Entry) error {
+	result := r.NewSearchResponseEntry(entry.DN)
+	for _, attr := range entry.Attributes {
+		if !isRequestedAttribute(m.Attributes, attr.Name) {
+			continue
+		}
+		if m.TypesOnly {
+			result.AddAttribute(attr.Name, []string{})
+		} else {
+			result.AddAttribute(attr.Name, attr.Values)
+		}
+	}
+	return w.Write(result)
+}
+
+// isRequestedAttribute follows RFC 4511: an empty list or "*" selects all user attributes
+func isRequestedAttribute(requested []string, name string) bool {
+	if len(requested) == 0 {
+		return true
+	}
+	for _, a := range requested {
+		if a == "*" || strings.EqualFold(a, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -4,11 +4,15 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"time"
 
 	"github.com/meidomx/misc-service/config"
 	"github.com/meidomx/misc-service/id"
 
+	"github.com/gin-gonic/gin"
 	ber "github.com/go-asn1-ber/asn1-ber"
 	"github.com/jimlambrt/gldap"
 )
@@ -16,22 +20,163 @@ import (
 type ldapServer struct {
 	IdGen *id.IdGen
 
-	BindBaseDN string
-
-	serverTlsConfig *tls.Config
+	bindRules []*bindRule
+	// externalSecret is the password of the binds forwarded for SASL EXTERNAL
+	externalSecret string
+	// mfa checks the totp codes of accounts requiring them, nil when disabled
+	mfa *mfaService
+	// adminDNs are the administrators and the groups of them
+	adminDNs []string
+
+	backend  DirectoryBackend
+	sessions *sessionTable
+	notifier *ChangeNotifier
 }
 
-func StartService(idGen *id.IdGen, c *config.Config, container *config.Container) {
-	s, err := gldap.NewServer()
+func StartService(idGen *id.IdGen, c *config.Config, engine *gin.Engine, container *config.Container) {
+	if len(c.Http.Auth.ApiKeyAttribute) > 0 {
+		addSecretAttribute(c.Http.Auth.ApiKeyAttribute)
+	}
+
+	backend, err := NewDirectoryBackend(c)
 	if err != nil {
-		log.Fatalf("unable to create server: %s", err.Error())
+		log.Fatalf("create ldap backend error: %s", err.Error())
+	}
+	if closer, ok := backend.(io.Closer); ok {
+		container.LdapBackend = closer
+	}
+
+	if err := InitBaseDN(c, idGen, backend); err != nil {
+		log.Fatalf("unable to cinit base dn: %s", err.Error())
+	}
+
+	var serverTlsConfig *tls.Config
+	if c.LDAP.TLS.Enable {
+		// shared by the ldaps listener and StartTLS
+		certReloader, err := newCertReloader(c.LDAP.TLS.CertPath, c.LDAP.TLS.KeyPath)
+		if err != nil {
+			log.Fatalf("prepare server cert error: %s", err.Error())
+		}
+		certReloader.Start()
+		container.LdapCertReloader = certReloader
+		serverTlsConfig = &tls.Config{
+			GetCertificate: certReloader.GetCertificate,
+		}
+	}
+
+	notifier := NewChangeNotifier(backend)
+	notifier.Start()
+	container.LdapNotifier = notifier
+
+	limits := frontendLimits{
+		MaxConnections: c.LDAP.Limits.MaxConnections,
+		IdleTimeout:    time.Duration(c.LDAP.Limits.IdleTimeoutSeconds) * time.Second,
+		MaxPDUSize:     c.LDAP.Limits.MaxPDUSize,
+	}
+	throttle := newBindThrottle(c.LDAP.Limits.BindFailuresPerIP, c.LDAP.Limits.BindFailuresPerDN,
+		time.Duration(c.LDAP.Limits.BindFailureWindowSeconds)*time.Second,
+		time.Duration(c.LDAP.Limits.BindLockoutSeconds)*time.Second)
+
+	externalSecret, err := newExternalSecret()
+	if err != nil {
+		log.Fatalf("prepare ldap external secret error: %s", err.Error())
+	}
+
+	var mfa *mfaService
+	if c.LDAP.MFA.Enable {
+		mfa, err = newMfaService(c)
+		if err != nil {
+			log.Fatalf("prepare ldap mfa error: %s", err.Error())
+		}
+	}
+
+	// serves the http apis, the changelog is always available
+	gateway := newLdapServer(idGen, c, backend, notifier, externalSecret, mfa)
+	throttle.resolve = gateway.bindDN
+
+	startListener := func(addr string, l net.Listener, startTLS *tls.Config) {
+		// every listener owns a gldap server since connection ids are only unique per listener
+		s := newGldapServer(idGen, c, backend, notifier, externalSecret, mfa)
+		fe := newFrontend(l, startTLS, externalSecret, limits, throttle)
+		go func() {
+			fmt.Println("start ldap on:", addr)
+			if err := s.Serve(fe); err != nil {
+				log.Fatalf("run ldap error: %s", err.Error())
+			}
+		}()
+		container.GldapServers = append(container.GldapServers, s)
+		container.LdapFrontends = append(container.LdapFrontends, fe)
 	}
 
+	l, err := listenTCP(c.LDAP.Address, nil)
+	if err != nil {
+		log.Fatalf("listen ldap error: %s", err.Error())
+	}
+	startListener(c.LDAP.Address, l, serverTlsConfig)
+	if c.LDAP.TLS.Enable {
+		l, err := listenTCP(c.LDAP.TLS.TLSAddress, serverTlsConfig)
+		if err != nil {
+			log.Fatalf("listen ldaps error: %s", err.Error())
+		}
+		startListener(c.LDAP.TLS.TLSAddress, l, nil)
+	}
+	if len(c.LDAP.LdapiPath) > 0 {
+		l, err := listenUnix(c.LDAP.LdapiPath)
+		if err != nil {
+			log.Fatalf("listen ldapi error: %s", err.Error())
+		}
+		startListener("ldapi://"+c.LDAP.LdapiPath, l, nil)
+	}
+
+	if c.Http.Auth.Enable {
+		// used before any route is added, so it covers the routes of every service
+		engine.Use(HttpAuth(c, gateway, throttle))
+	}
+
+	InitChangelogHttp(engine, gateway, throttle)
+	if c.LDAP.HttpGateway {
+		InitRestGateway(engine, gateway, throttle)
+	}
+	if c.LDAP.MFA.Enable {
+		InitMfa(engine, gateway, throttle)
+	}
+	if c.LDAP.SCIM.Enable {
+		InitScim(engine, c, gateway, throttle)
+	}
+	if c.LDAP.OIDC.Enable {
+		keys, err := newOidcKeySet(oidcKeyRotation(c), oidcAccessLifetime(c))
+		if err != nil {
+			log.Fatalf("prepare oidc keys error: %s", err.Error())
+		}
+		keys.Start()
+		container.LdapOidcKeys = keys
+		InitOidc(engine, c, gateway, throttle, keys)
+	}
+}
+
+func newLdapServer(idGen *id.IdGen, c *config.Config, backend DirectoryBackend, notifier *ChangeNotifier, externalSecret string, mfa *mfaService) *ldapServer {
 	server := new(ldapServer)
 	server.IdGen = idGen
-	server.BindBaseDN = c.LDAP.BindBaseDN
-	if err := InitBaseDN(c, idGen); err != nil {
-		log.Fatalf("unable to cinit base dn: %s", err.Error())
+	bindRules, err := newBindRules(c)
+	if err != nil {
+		log.Fatalf("invalid ldap suffixes: %s", err.Error())
+	}
+	server.bindRules = bindRules
+	server.backend = backend
+	server.sessions = newSessionTable()
+	server.notifier = notifier
+	server.externalSecret = externalSecret
+	server.mfa = mfa
+	server.adminDNs = c.LDAP.AdminDNs
+	return server
+}
+
+func newGldapServer(idGen *id.IdGen, c *config.Config, backend DirectoryBackend, notifier *ChangeNotifier, externalSecret string, mfa *mfaService) *gldap.Server {
+	server := newLdapServer(idGen, c, backend, notifier, externalSecret, mfa)
+
+	s, err := gldap.NewServer(gldap.WithOnClose(server.sessions.Remove))
+	if err != nil {
+		log.Fatalf("unable to create server: %s", err.Error())
 	}
 
 	// create a router and add a bind handler
@@ -57,59 +202,44 @@ func StartService(idGen *id.IdGen, c *config.Config, container *config.Container
 	if err := r.Modify(server.Modify, gldap.WithLabel("Modify")); err != nil {
 		log.Fatalf("bind op error: %s", err.Error())
 	}
-	if c.LDAP.TLS.Enable {
-		if err := r.ExtendedOperation(server.ExtendedOperationStartTLS, gldap.ExtendedOperationStartTLS); err != nil {
-			log.Fatalf("bind ExtendedOperationStartTLS op error: %s", err.Error())
-		}
+	if err := r.ExtendedOperation(server.ExtendedOperationStartTxn, ExtendedOperationStartTxn); err != nil {
+		log.Fatalf("bind ExtendedOperationStartTxn op error: %s", err.Error())
+	}
+	if err := r.ExtendedOperation(server.ExtendedOperationEndTxn, ExtendedOperationEndTxn); err != nil {
+		log.Fatalf("bind ExtendedOperationEndTxn op error: %s", err.Error())
 	}
 	if err := s.Router(r); err != nil {
 		log.Fatalf("router error: %s", err.Error())
 	}
 
-	var connOpts []gldap.Option
-	if c.LDAP.TLS.Enable {
-		serverCert, err := tls.LoadX509KeyPair(c.LDAP.TLS.CertPath, c.LDAP.TLS.KeyPath)
-		if err != nil {
-			log.Fatalf("prepare server cert error: %s", err.Error())
-		}
-		server.serverTlsConfig = &tls.Config{
-			Certificates: []tls.Certificate{serverCert},
-		}
-		connOpts = append(connOpts, gldap.WithTLSConfig(server.serverTlsConfig))
-	}
-
-	go func() {
-		fmt.Println("start ldap on:", c.LDAP.Address)
-		if err := s.Run(c.LDAP.Address); err != nil {
-			log.Fatalf("run ldap error: %s", err.Error())
-		}
-	}()
-	if c.LDAP.TLS.Enable {
-		go func() {
-			fmt.Println("start tls ldap on:", c.LDAP.TLS.TLSAddress)
-			if err := s.Run(c.LDAP.TLS.TLSAddress, connOpts...); err != nil {
-				log.Fatalf("run tls ldap error: %s", err.Error())
-			}
-		}()
-	}
-
-	container.GldapServer = s
+	return s
 }
 
 func convertLDAPStringToNormal(ldapstrings []string) ([]string, error) {
-	n := make([]string, len(ldapstrings))
-	for i, v := range ldapstrings {
+	n := make([]string, 0, len(ldapstrings))
+	for _, v := range ldapstrings {
 		data := []byte(v)
+		if len(data) == 0 {
+			// a modification without values
+			continue
+		}
 		// convert to normal
 		// see comments in github.com/go-asn1-ber/asn1-ber@v1.5.4/ber.go func -> readPacket(reader io.Reader) (*Packet, int, error)
-		if ber.Tag(data[0]) == ber.TagOctetString {
-			_, s, err := readLength(data[1:])
+		if ber.Tag(data[0]) != ber.TagOctetString {
+			n = append(n, v)
+			continue
+		}
+		// the values of a modification arrive as the encoded SET OF AttributeValue
+		for len(data) > 0 {
+			l, s, err := readLength(data[1:])
 			if err != nil {
 				return nil, err
 			}
-			n[i] = string(data[(1 + s):])
-		} else {
-			n[i] = v
+			if l < 0 || 1+s+l > len(data) {
+				return nil, errors.New("invalid attribute value length")
+			}
+			n = append(n, string(data[1+s:1+s+l]))
+			data = data[1+s+l:]
 		}
 	}
 	return n, nil
@@ -176,26 +306,95 @@ func (this *ldapServer) Modify(w *gldap.ResponseWriter, r *gldap.Request) {
 	defer w.Write(res)
 	m, err := r.GetModifyMessage()
 	if err != nil {
-		log.Println("not a modify message: %s", "op", op, "err", err)
+		log.Println("not a modify message", "op", op, "err", err)
 		return
 	}
 	log.Println("modify request", "dn", m.DN)
 
-	entry, err := FindOneEntry(m.DN)
+	changes, err := convertChanges(m.Changes)
+	if err != nil {
+		log.Println("convertLDAPStringToNormal error", "op", op, "err", err)
+		res.SetResultCode(gldap.ResultProtocolError)
+		return
+	}
+
+	if !this.canModify(this.sessions.BoundDN(r.ConnectionID()), m.DN, changes) {
+		res.SetResultCode(gldap.ResultInsufficientAccessRights)
+		res.SetDiagnosticMessage("only administrators change other entries and protected attributes")
+		return
+	}
+
+	if referral, err := this.checkReferral(m.DN, m.Controls, res); err != nil {
+		log.Println("check referral error", "op", op, "err", err)
+		res.SetResultCode(gldap.ResultOperationsError)
+		return
+	} else if referral {
+		return
+	}
+
+	if queued, code := this.queueTxnOp(r, m.Controls, &txnOp{
+		MessageId: m.GetID(),
+		Kind:      ChangeTypeModify,
+		DN:        m.DN,
+		Changes:   changes,
+	}); queued {
+		res.SetResultCode(code)
+		return
+	}
+
+	this.modifyEntry(this.sessions.BoundDN(r.ConnectionID()), m.DN, changes, res)
+}
+
+// modifyEntry applies changes to the entry at dn and sets the result on res
+func (this *ldapServer) modifyEntry(boundDN, dn string, changes []gldap.Change, res resultSetter) {
+	const op = "ldap.(Directory).modifyEntry"
+
+	entry, err := this.backend.FindOneEntry(dn)
 	if err != nil {
 		log.Println("FindOneEntry error", "op", op, "err", err)
+		res.SetResultCode(gldap.ResultOperationsError)
 		return
 	}
 	if len(entry.DN) <= 0 {
-		log.Println("FindOneEntry empty", "op", op, "err", err)
+		log.Println("FindOneEntry empty", "op", op, "dn", dn)
+		res.SetResultCode(gldap.ResultNoSuchObject)
 		return
 	}
 
+	res.SetMatchedDN(entry.DN)
+	applyChanges(entry, changes)
+
+	change := NewModifyChange(boundDN, entry.DN, changes)
+	if err := this.backend.UpdateEntry(entry, change); err != nil {
+		log.Println("UpdateEntry error", "op", op, "err", err)
+		res.SetResultCode(gldap.ResultOperationsError)
+		return
+	}
+
+	res.SetResultCode(gldap.ResultSuccess)
+}
+
+// convertChanges decodes the raw modification values of a modify request
+func convertChanges(changes []gldap.Change) ([]gldap.Change, error) {
+	converted := make([]gldap.Change, 0, len(changes))
+	for _, chg := range changes {
+		vals, err := convertLDAPStringToNormal(chg.Modification.Vals)
+		if err != nil {
+			return nil, err
+		}
+		converted = append(converted, gldap.Change{
+			Operation:    chg.Operation,
+			Modification: gldap.PartialAttribute{Type: chg.Modification.Type, Vals: vals},
+		})
+	}
+	return converted, nil
+}
+
+func applyChanges(entry *gldap.Entry, changes []gldap.Change) {
 	if entry.Attributes == nil {
 		entry.Attributes = []*gldap.EntryAttribute{}
 	}
-	res.SetMatchedDN(entry.DN)
-	for _, chg := range m.Changes {
+	for _, chg := range changes {
 		// find specific attr
 		var foundAttr *gldap.EntryAttribute
 		var foundAt int
@@ -206,18 +405,13 @@ func (this *ldapServer) Modify(w *gldap.ResponseWriter, r *gldap.Request) {
 			}
 		}
 
-		converted, err := convertLDAPStringToNormal(chg.Modification.Vals)
-		if err != nil {
-			log.Println("convertLDAPStringToNormal error", "op", op, "err", err)
-			return
-		}
 		// then apply operation
 		switch chg.Operation {
 		case gldap.AddAttribute:
 			if foundAttr != nil {
-				foundAttr.AddValue(converted...)
+				foundAttr.AddValue(chg.Modification.Vals...)
 			} else {
-				entry.Attributes = append(entry.Attributes, gldap.NewEntryAttribute(chg.Modification.Type, converted))
+				entry.Attributes = append(entry.Attributes, gldap.NewEntryAttribute(chg.Modification.Type, chg.Modification.Vals))
 			}
 		case gldap.DeleteAttribute:
 			if foundAttr != nil {
@@ -227,22 +421,16 @@ func (this *ldapServer) Modify(w *gldap.ResponseWriter, r *gldap.Request) {
 			}
 		case gldap.ReplaceAttribute:
 			if foundAttr != nil {
-				*foundAttr = *gldap.NewEntryAttribute(chg.Modification.Type, converted)
+				*foundAttr = *gldap.NewEntryAttribute(chg.Modification.Type, chg.Modification.Vals)
 			}
 		}
 	}
-
-	if err := UpdateEntry(entry); err != nil {
-		log.Println("UpdateEntry error", "op", op, "err", err)
-		return
-	}
-
-	res.SetResultCode(gldap.ResultSuccess)
 }
 
 func (this *ldapServer) Unbind(w *gldap.ResponseWriter, r *gldap.Request) {
 	const op = "ldap.(Directory).handleUnbind"
 	log.Println("operation:", op)
+	this.sessions.Remove(r.ConnectionID())
 }
 
 func (this *ldapServer) Bind(w *gldap.ResponseWriter, r *gldap.Request) {
@@ -258,8 +446,10 @@ func (this *ldapServer) Bind(w *gldap.ResponseWriter, r *gldap.Request) {
 		log.Println("not a simple bind message", "op", op, "err", err)
 		return
 	}
+	// a bind request always resets the connection to anonymous first
+	this.sessions.SetBoundDN(r.ConnectionID(), "")
 
-	log.Println("bind username:", m.UserName, "baseDN:", this.BindBaseDN)
+	log.Println("bind username:", m.UserName)
 
 	if m.AuthChoice != gldap.SimpleAuthChoice {
 		// if it's not a simple auth request, then the bind failed...
@@ -267,37 +457,67 @@ func (this *ldapServer) Bind(w *gldap.ResponseWriter, r *gldap.Request) {
 		return
 	}
 
-	// user + BaseDN
-	userDN := fmt.Sprint("cn=", m.UserName, ",", this.BindBaseDN)
-	//TODO need optimize the query
-	entry, err := FindOneEntry(userDN)
-	if err != nil {
-		log.Println("find children error", "op", op, "err", err)
+	// SASL EXTERNAL of an ldapi connection forwarded by the frontend
+	if isExternalBind(m.UserName, m.Password, this.externalSecret) {
+		log.Println("external bind", "op", op, "DN", m.UserName)
+		this.sessions.SetBoundDN(r.ConnectionID(), m.UserName)
+		resp.SetResultCode(gldap.ResultSuccess)
 		return
 	}
-	if len(entry.DN) > 0 {
-		log.Println("found bind user", "op", op, "DN", userDN)
-		values := entry.GetAttributeValues("userPassword")
-		if len(values) > 0 && string(m.Password) == values[0] {
-			resp.SetResultCode(gldap.ResultSuccess)
-			return
+
+	if dn := this.authenticate(m.UserName, m.Password); len(dn) > 0 {
+		this.sessions.SetBoundDN(r.ConnectionID(), dn)
+		resp.SetResultCode(gldap.ResultSuccess)
+	}
+}
+
+// authenticate returns the DN of the entry the bind name and password
+// identify, empty when they don't
+func (this *ldapServer) authenticate(name string, password gldap.Password) string {
+	return this.resolveBind(name, func(entry *gldap.Entry) bool {
+		return this.checkCredentials(entry, password)
+	})
+}
+
+// bindDN returns the DN of the entry the bind name refers to, without checking
+// any credentials
+func (this *ldapServer) bindDN(name string) string {
+	return this.resolveBind(name, func(*gldap.Entry) bool {
+		return true
+	})
+}
+
+// resolveBind returns the DN of the entry the bind name refers to when check
+// accepts it
+func (this *ldapServer) resolveBind(name string, check func(entry *gldap.Entry) bool) string {
+	const op = "ldap.(Directory).resolveBind"
+
+	// bind name resolved by the rules of every suffix
+	for _, rule := range this.bindRules {
+		entry, err := rule.resolve(this.backend, name)
+		if err != nil {
+			log.Println("resolve bind name error", "op", op, "err", err)
+			continue
+		}
+		if entry != nil && check(entry) {
+			log.Println("found bind user", "op", op, "DN", entry.DN)
+			return entry.DN
 		}
 	}
 
 	// user is full DN
-	entry, err = FindOneEntry(m.UserName)
+	if !inSuffixes(this.bindRules, name) {
+		return ""
+	}
+	entry, err := this.backend.FindOneEntry(name)
 	if err != nil {
 		log.Println("FindOneEntry error", "op", op, "err", err)
-		return
+		return ""
 	}
-	if len(entry.DN) > 0 {
-		values := entry.GetAttributeValues("userPassword")
-		if len(values) > 0 && string(m.Password) == values[0] {
-			resp.SetResultCode(gldap.ResultSuccess)
-			return
-		}
+	if len(entry.DN) > 0 && check(entry) {
+		return entry.DN
 	}
-
+	return ""
 }
 
 func (this *ldapServer) Search(w *gldap.ResponseWriter, r *gldap.Request) {
@@ -308,81 +528,126 @@ func (this *ldapServer) Search(w *gldap.ResponseWriter, r *gldap.Request) {
 	defer w.Write(res)
 	m, err := r.GetSearchMessage()
 	if err != nil {
-		log.Println("not a search message: %s", "op", op, "err", err)
+		log.Println("not a search message", "op", op, "err", err)
 		return
 	}
 	logSearchRequest(m)
 
-	filter := m.Filter
+	if isChangelogDN(m.BaseDN) {
+		if len(this.sessions.BoundDN(r.ConnectionID())) == 0 {
+			res.SetResultCode(gldap.ResultInsufficientAccessRights)
+			res.SetDiagnosticMessage("the changelog requires an authenticated bind")
+			return
+		}
+		this.searchChangelog(w, r, m, res)
+		return
+	}
 
-	switch m.Scope {
-	case gldap.BaseObject:
-		{
-			var entry *gldap.Entry
-			var err error
-			if len(m.BaseDN) > 0 {
-				entry, err = FindOneEntry(m.BaseDN)
-			} else {
-				entry, err = FindSingleRoot()
-			}
-			if err != nil {
-				log.Println("FindOneEntry error: %s", "op", op, "err", err)
-				return
-			}
-			if len(entry.DN) <= 0 {
+	filter, err := CompileEntryFilter(m.Filter)
+	if err != nil {
+		log.Println("compile filter error", "op", op, "err", err)
+		res.SetResultCode(gldap.ResultFilterError)
+		return
+	}
+	psearch, err := getPersistentSearchControl(m.Controls)
+	if err != nil {
+		log.Println("invalid persistent search control", "op", op, "err", err)
+		res.SetResultCode(gldap.ResultProtocolError)
+		return
+	}
+	if psearch != nil && psearch.ReturnECs {
+		res.SetResultCode(gldap.ResultUnavailableCriticalExtension)
+		res.SetDiagnosticMessage("entry change notification controls are not supported")
+		return
+	}
+	if psearch != nil {
+		// subscribe before the initial search so that no change in between is lost
+		subId, ch := this.notifier.Subscribe()
+		defer this.notifier.Unsubscribe(subId)
+		if !psearch.ChangesOnly {
+			if !this.searchEntries(w, r, m, filter, res) {
 				return
-			} else {
-				//TODO filter entries
-				var _ = filter
 			}
+		}
+		this.persistSearch(w, r, m, filter, psearch, ch, res)
+		return
+	}
 
-			res.SetResultCode(gldap.ResultSuccess)
-			result := r.NewSearchResponseEntry(entry.DN)
-			for _, attr := range entry.Attributes {
-				result.AddAttribute(attr.Name, attr.Values)
-			}
-			if err := w.Write(result); err != nil {
-				log.Println("write result error: %s", "op", op, "err", err)
-				return
-			}
+	this.searchEntries(w, r, m, filter, res)
+}
+
+// searchEntries writes the stored entries matching the request and reports
+// whether the search completed without error
+func (this *ldapServer) searchEntries(w *gldap.ResponseWriter, r *gldap.Request, m *gldap.SearchMessage, filter *EntryFilter, res *gldap.SearchResponseDone) bool {
+	const op = "ldap.(Directory).handleSearchEntries"
+
+	base, ok := this.searchBase(m.BaseDN, m.Controls, m.DerefAliases, res)
+	if !ok {
+		return false
+	}
+
+	// secret attributes are neither returned nor matched, except for administrators
+	admin := this.isAdmin(this.sessions.BoundDN(r.ConnectionID()))
+	visited := 0
+	writeErr := false
+	err := this.walkSearch(base, m.Scope, m.DerefAliases, hasManageDsaITControl(m.Controls), func(entry *gldap.Entry) bool {
+		visited++
+		entry = expandDynamicGroup(this.backend, entry)
+		if !admin {
+			entry = withoutSecrets(entry)
 		}
-	case gldap.SingleLevel:
-		{
-			var entries []*gldap.Entry
-			var err error
-			if len(m.BaseDN) > 0 {
-				entries, err = FindChildren(m.BaseDN)
-			} else {
-				entries, err = FindAllRoots()
-			}
+		if !filter.Match(entry) {
+			return true
+		}
+		if err := writeSearchEntry(w, r, m, entry); err != nil {
+			log.Println("write result error", "op", op, "err", err)
+			writeErr = true
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		log.Println("search entries error", "op", op, "err", err)
+		return false
+	}
+	if writeErr || visited <= 0 {
+		return false
+	}
+	res.SetResultCode(gldap.ResultSuccess)
+	return true
+}
+
+// searchBase checks the base of a search for referrals and dereferences an
+// alias base when requested. It returns false when the search ends here.
+func (this *ldapServer) searchBase(base string, controls []gldap.Control, deref int, res resultSetter) (string, bool) {
+	const op = "ldap.(Directory).searchBase"
+
+	if referral, err := this.checkReferral(base, controls, res); err != nil {
+		log.Println("check referral error", "op", op, "err", err)
+		return "", false
+	} else if referral {
+		return "", false
+	}
+	if len(base) > 0 && deref&derefFindingBaseObj != 0 {
+		entry, err := this.backend.FindOneEntry(base)
+		if err != nil {
+			log.Println("FindOneEntry error", "op", op, "err", err)
+			return "", false
+		}
+		if len(entry.DN) > 0 {
+			target, code, err := this.dereferenceAlias(entry)
 			if err != nil {
-				log.Println("FindChildren error: %s", "op", op, "err", err)
-				return
-			}
-			if len(entries) <= 0 {
-				return
-			} else {
-				//TODO filter entries
-				var _ = filter
+				log.Println("dereference alias error", "op", op, "err", err)
 			}
-			for _, e := range entries {
-				result := r.NewSearchResponseEntry(e.DN)
-				for _, attr := range e.Attributes {
-					result.AddAttribute(attr.Name, attr.Values)
-				}
-				if err := w.Write(result); err != nil {
-					log.Println("write result error: %s", "op", op, "err", err)
-					return
-				}
+			if code != gldap.ResultSuccess {
+				res.SetResultCode(code)
+				res.SetMatchedDN(entry.DN)
+				return "", false
 			}
-			res.SetResultCode(gldap.ResultSuccess)
-		}
-	case gldap.WholeSubtree:
-		{
-
-			//TODO need support whole subtree
+			base = target.DN
 		}
 	}
+	return base, true
 }
 
 func (this *ldapServer) Delete(w *gldap.ResponseWriter, r *gldap.Request) {
@@ -393,28 +658,59 @@ func (this *ldapServer) Delete(w *gldap.ResponseWriter, r *gldap.Request) {
 	defer w.Write(res)
 	m, err := r.GetDeleteMessage()
 	if err != nil {
-		log.Println("not a delete message: %s", "op", op, "err", err)
+		log.Println("not a delete message", "op", op, "err", err)
 		return
 	}
 	log.Println("delete request", "dn", m.DN)
 
-	entry, err := FindOneEntry(m.DN)
+	if !this.isAdmin(this.sessions.BoundDN(r.ConnectionID())) {
+		res.SetResultCode(gldap.ResultInsufficientAccessRights)
+		res.SetDiagnosticMessage("only administrators delete entries")
+		return
+	}
+
+	if referral, err := this.checkReferral(m.DN, m.Controls, res); err != nil {
+		log.Println("check referral error", "op", op, "err", err)
+		res.SetResultCode(gldap.ResultOperationsError)
+		return
+	} else if referral {
+		return
+	}
+
+	if queued, code := this.queueTxnOp(r, m.Controls, &txnOp{
+		MessageId: m.GetID(),
+		Kind:      ChangeTypeDelete,
+		DN:        m.DN,
+	}); queued {
+		res.SetResultCode(code)
+		return
+	}
+
+	this.removeEntry(this.sessions.BoundDN(r.ConnectionID()), m.DN, res)
+}
+
+// removeEntry deletes the entry at dn and sets the result on res
+func (this *ldapServer) removeEntry(boundDN, dn string, res resultSetter) {
+	const op = "ldap.(Directory).removeEntry"
+
+	entry, err := this.backend.FindOneEntry(dn)
 	if err != nil {
-		log.Println("find entry error: %s", "op", op, "err", err)
+		log.Println("find entry error", "op", op, "err", err)
 		res.SetResultCode(gldap.ResultOperationsError)
 		res.SetDiagnosticMessage(fmt.Sprintf("find entry error"))
 		return
 	}
-	if len(entry.DN) > 0 {
-		if err := DeleteEntry(m.DN); err != nil {
-			log.Println("delete entry error: %s", "op", op, "err", err)
-			res.SetResultCode(gldap.ResultOperationsError)
-			res.SetDiagnosticMessage(fmt.Sprintf("delete entry error"))
-			return
-		}
+	if len(entry.DN) <= 0 {
+		res.SetResultCode(gldap.ResultNoSuchObject)
+		return
 	}
-
-	return
+	if err := this.backend.DeleteEntry(dn, NewDeleteChange(boundDN, entry.DN)); err != nil {
+		log.Println("delete entry error", "op", op, "err", err)
+		res.SetResultCode(gldap.ResultOperationsError)
+		res.SetDiagnosticMessage(fmt.Sprintf("delete entry error"))
+		return
+	}
+	res.SetResultCode(gldap.ResultSuccess)
 }
 
 func (this *ldapServer) Add(w *gldap.ResponseWriter, r *gldap.Request) {
@@ -425,35 +721,70 @@ func (this *ldapServer) Add(w *gldap.ResponseWriter, r *gldap.Request) {
 	defer w.Write(res)
 	m, err := r.GetAddMessage()
 	if err != nil {
-		log.Println("not an add message: %s", "op", op, "err", err)
+		log.Println("not an add message", "op", op, "err", err)
 		return
 	}
 	log.Println("add request", "dn", m.DN)
 
-	entry, err := FindOneEntry(m.DN)
+	attrs := map[string][]string{}
+	for _, a := range m.Attributes {
+		attrs[a.Type] = a.Vals
+	}
+	newEntry := gldap.NewEntry(m.DN, attrs)
+
+	if !this.isAdmin(this.sessions.BoundDN(r.ConnectionID())) {
+		res.SetResultCode(gldap.ResultInsufficientAccessRights)
+		res.SetDiagnosticMessage("only administrators add entries")
+		return
+	}
+
+	if referral, err := this.checkReferral(m.DN, m.Controls, res); err != nil {
+		log.Println("check referral error", "op", op, "err", err)
+		res.SetResultCode(gldap.ResultOperationsError)
+		return
+	} else if referral {
+		return
+	}
+
+	if queued, code := this.queueTxnOp(r, m.Controls, &txnOp{
+		MessageId: m.GetID(),
+		Kind:      ChangeTypeAdd,
+		DN:        m.DN,
+		Entry:     newEntry,
+	}); queued {
+		res.SetResultCode(code)
+		return
+	}
+
+	this.addEntry(this.sessions.BoundDN(r.ConnectionID()), newEntry, res)
+}
+
+// addEntry stores newEntry and sets the result on res
+func (this *ldapServer) addEntry(boundDN string, newEntry *gldap.Entry, res resultSetter) {
+	const op = "ldap.(Directory).addEntry"
+
+	entry, err := this.backend.FindOneEntry(newEntry.DN)
 	if err != nil {
-		log.Println("FindOneEntry error: %s", "op", op, "err", err)
+		log.Println("FindOneEntry error", "op", op, "err", err)
+		res.SetResultCode(gldap.ResultOperationsError)
 		return
 	}
 	if len(entry.DN) > 0 {
 		res.SetResultCode(gldap.ResultEntryAlreadyExists)
-		res.SetDiagnosticMessage(fmt.Sprintf("entry exists for DN: %s", m.DN))
+		res.SetDiagnosticMessage(fmt.Sprintf("entry exists for DN: %s", newEntry.DN))
 		return
 	}
 
-	attrs := map[string][]string{}
-	for _, a := range m.Attributes {
-		attrs[a.Type] = a.Vals
-	}
-	newEntry := gldap.NewEntry(m.DN, attrs)
 	id, err := this.IdGen.Next()
 	if err != nil {
-		log.Println("generate id error: %s", "op", op, "err", err)
+		log.Println("generate id error", "op", op, "err", err)
+		res.SetResultCode(gldap.ResultOperationsError)
 		return
 	}
-	err = SaveEntry(newEntry, id)
+	err = this.backend.SaveEntry(newEntry, id, NewAddChange(boundDN, newEntry))
 	if err != nil {
-		log.Println("SaveEntry error: %s", "op", op, "err", err)
+		log.Println("SaveEntry error", "op", op, "err", err)
+		res.SetResultCode(gldap.ResultOperationsError)
 		return
 	}
 	res.SetResultCode(gldap.ResultSuccess)
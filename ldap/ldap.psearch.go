@@ -0,0 +1,140 @@
+package ldap
+
+import (
+	"errors"
+	"log"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/jimlambrt/gldap"
+)
+
+// Persistent Search control, see draft-ietf-ldapext-psearch-03
+const (
+	ControlTypePersistentSearch = "2.16.840.1.113730.3.4.3"
+
+	psearchChangeAdd    = 1
+	psearchChangeDelete = 2
+	psearchChangeModify = 4
+	psearchChangeModDN  = 8
+)
+
+type persistentSearchControl struct {
+	ChangeTypes int64
+	ChangesOnly bool
+	// ReturnECs is rejected by Search, since gldap can't attach Entry Change
+	// Notification controls to search result entries
+	ReturnECs bool
+}
+
+func getPersistentSearchControl(controls []gldap.Control) (*persistentSearchControl, error) {
+	for _, c := range controls {
+		if c.GetControlType() != ControlTypePersistentSearch {
+			continue
+		}
+		cs, ok := c.(*gldap.ControlString)
+		if !ok {
+			return nil, errors.New("unexpected persistent search control type")
+		}
+		p, err := ber.DecodePacketErr([]byte(cs.ControlValue))
+		if err != nil {
+			return nil, err
+		}
+		if len(p.Children) != 3 {
+			return nil, errors.New("persistent search control requires 3 elements")
+		}
+		changeTypes, ok1 := p.Children[0].Value.(int64)
+		changesOnly, ok2 := p.Children[1].Value.(bool)
+		returnECs, ok3 := p.Children[2].Value.(bool)
+		if !ok1 || !ok2 || !ok3 {
+			return nil, errors.New("malformed persistent search control")
+		}
+		return &persistentSearchControl{
+			ChangeTypes: changeTypes,
+			ChangesOnly: changesOnly,
+			ReturnECs:   returnECs,
+		}, nil
+	}
+	return nil, nil
+}
+
+func (this *persistentSearchControl) wants(op string) bool {
+	var t int64
+	switch op {
+	case ChangeTypeAdd:
+		t = psearchChangeAdd
+	case ChangeTypeDelete:
+		t = psearchChangeDelete
+	case ChangeTypeModify:
+		t = psearchChangeModify
+	case ChangeTypeModRDN:
+		t = psearchChangeModDN
+	}
+	return this.ChangeTypes&t != 0
+}
+
+// persistSearch writes every matching change until the notification channel
+// is closed, the connection stops reading requests or the client can't be
+// written to anymore. The search done response is only sent when the server
+// stops the search.
+func (this *ldapServer) persistSearch(w *gldap.ResponseWriter, r *gldap.Request, m *gldap.SearchMessage, filter *EntryFilter, ctl *persistentSearchControl, ch <-chan *EntryNotification, res *gldap.SearchResponseDone) {
+	const op = "ldap.(Directory).handlePersistentSearch"
+
+	admin := this.isAdmin(this.sessions.BoundDN(r.ConnectionID()))
+	for {
+		var n *EntryNotification
+		var ok bool
+		select {
+		case <-r.Done():
+			// the client disconnected or unbound, or the server stops
+			res.SetResultCode(gldap.ResultUnavailable)
+			res.SetDiagnosticMessage("connection closed")
+			return
+		case n, ok = <-ch:
+		}
+		if !ok {
+			break
+		}
+		if !ctl.wants(n.Op) || !IsDNInScope(n.DN, m.BaseDN, m.Scope) {
+			continue
+		}
+
+		var entry *gldap.Entry
+		if n.Op == ChangeTypeDelete {
+			entry = n.Entry
+			if entry == nil {
+				// the old entry is gone, the filter can't be applied
+				log.Println("delete notification without entry", "op", op, "dn", n.DN)
+				continue
+			}
+		} else {
+			e, err := this.backend.FindOneEntry(n.DN)
+			if err != nil {
+				log.Println("FindOneEntry error", "op", op, "err", err)
+				continue
+			}
+			if len(e.DN) <= 0 {
+				// already removed again
+				continue
+			}
+			entry = expandDynamicGroup(this.backend, e)
+		}
+		if !admin {
+			entry = withoutSecrets(entry)
+		}
+		if !filter.Match(entry) {
+			continue
+		}
+		if err := writeSearchEntry(w, r, m, entry); err != nil {
+			log.Println("write result error, stop persistent search", "op", op, "err", err)
+			return
+		}
+	}
+
+	if this.notifier.Closed() {
+		res.SetResultCode(gldap.ResultUnavailable)
+		res.SetDiagnosticMessage("server stopping")
+	} else {
+		res.SetResultCode(gldap.ResultAdminLimitExceeded)
+		res.SetDiagnosticMessage("persistent search fell behind")
+	}
+}
@@ -0,0 +1,286 @@
+package ldap
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/jimlambrt/gldap"
+)
+
+// LDAP Transactions, see RFC 5805
+//
+// A connection has at most one transaction at a time. Its updates are buffered
+// until End Transaction commits them, an abort or closing the connection
+// discards them.
+const (
+	ExtendedOperationStartTxn gldap.ExtendedOperationName = "1.3.6.1.1.21.1"
+	ExtendedOperationEndTxn   gldap.ExtendedOperationName = "1.3.6.1.1.21.3"
+
+	ControlTypeTxnSpec = "1.3.6.1.1.21.2"
+)
+
+// txnOp is an update buffered until its transaction is committed
+type txnOp struct {
+	MessageId int64
+	Kind      string
+	DN        string
+	Entry     *gldap.Entry
+	Changes   []gldap.Change
+	BoundDN   string
+	// Assert has to hold for the stored entry, else the update fails with
+	// assertionFailed
+	Assert func(entry *gldap.Entry) bool
+
+	// modrdn
+	NewRDN       string
+	DeleteOldRDN bool
+	NewSuperior  string
+}
+
+type ldapTxn struct {
+	id string
+
+	lock sync.Mutex
+	ops  []*txnOp
+}
+
+func newTxnId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (this *ldapTxn) add(op *txnOp) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.ops = append(this.ops, op)
+}
+
+// sortedOps returns the buffered updates in request order. Requests of a
+// connection are handled concurrently, so the queue order may differ.
+func (this *ldapTxn) sortedOps() []*txnOp {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	ops := make([]*txnOp, len(this.ops))
+	copy(ops, this.ops)
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].MessageId < ops[j].MessageId
+	})
+	return ops
+}
+
+type txnError struct {
+	MessageId int64
+	Code      int
+	Message   string
+}
+
+func (this *txnError) Error() string {
+	return fmt.Sprint("update of message ", this.MessageId, " failed: ", this.Message)
+}
+
+// txnSpecControl returns the transaction identifier of the transaction
+// specification control among controls
+func txnSpecControl(controls []gldap.Control) (string, bool) {
+	for _, c := range controls {
+		if c.GetControlType() != ControlTypeTxnSpec {
+			continue
+		}
+		if cs, ok := c.(*gldap.ControlString); ok {
+			return cs.ControlValue, true
+		}
+		return "", true
+	}
+	return "", false
+}
+
+// queueTxnOp buffers the update when it carries a transaction specification
+// control. It reports whether the request was handled and the result code
+// to respond with.
+func (this *ldapServer) queueTxnOp(r *gldap.Request, controls []gldap.Control, op *txnOp) (bool, int) {
+	txnId, ok := txnSpecControl(controls)
+	if !ok {
+		return false, gldap.ResultSuccess
+	}
+	txn := this.sessions.Txn(r.ConnectionID(), txnId)
+	if txn == nil {
+		return true, gldap.ResultUnwillingToPerform
+	}
+	op.BoundDN = this.sessions.BoundDN(r.ConnectionID())
+	txn.add(op)
+	return true, gldap.ResultSuccess
+}
+
+func (this *ldapServer) ExtendedOperationStartTxn(w *gldap.ResponseWriter, r *gldap.Request) {
+	const op = "ldap.(Directory).handleStartTxn"
+	log.Println("operation:", op)
+
+	res := r.NewExtendedResponse(gldap.WithResponseCode(gldap.ResultSuccess))
+	defer w.Write(res)
+
+	txnId, err := newTxnId()
+	if err != nil {
+		log.Println("create transaction id error", "op", op, "err", err)
+		res.SetResultCode(gldap.ResultOperationsError)
+		return
+	}
+	if !this.sessions.BeginTxn(r.ConnectionID(), txnId) {
+		res.SetResultCode(gldap.ResultUnwillingToPerform)
+		res.SetDiagnosticMessage("a transaction is already in progress")
+		return
+	}
+	res.SetResponseValue(txnId)
+}
+
+func (this *ldapServer) ExtendedOperationEndTxn(w *gldap.ResponseWriter, r *gldap.Request) {
+	const op = "ldap.(Directory).handleEndTxn"
+	log.Println("operation:", op)
+
+	res := r.NewExtendedResponse(gldap.WithResponseCode(gldap.ResultSuccess))
+	defer w.Write(res)
+
+	m, err := r.GetExtendedOperationMessage()
+	if err != nil {
+		log.Println("not an extended operation message", "op", op, "err", err)
+		res.SetResultCode(gldap.ResultProtocolError)
+		return
+	}
+	commit, txnId, err := decodeEndTxnValue(m.Value)
+	if err != nil {
+		res.SetResultCode(gldap.ResultProtocolError)
+		res.SetDiagnosticMessage(err.Error())
+		return
+	}
+	txn := this.sessions.EndTxn(r.ConnectionID(), txnId)
+	if txn == nil {
+		res.SetResultCode(gldap.ResultUnwillingToPerform)
+		res.SetDiagnosticMessage("unknown transaction identifier")
+		return
+	}
+	if !commit {
+		log.Println("transaction aborted", "op", op, "updates", len(txn.sortedOps()))
+		return
+	}
+
+	if err := this.commitTxn(txn.sortedOps()); err != nil {
+		log.Println("commit transaction error", "op", op, "err", err)
+		var te *txnError
+		if errors.As(err, &te) {
+			res.SetResultCode(te.Code)
+			// the update which failed
+			res.SetResponseValue(encodeEndTxnValue(te.MessageId))
+		} else {
+			res.SetResultCode(gldap.ResultOperationsError)
+		}
+		res.SetDiagnosticMessage(err.Error())
+		return
+	}
+}
+
+// decodeEndTxnValue decodes
+//
+//	txnEndReq ::= SEQUENCE {
+//	    commit         BOOLEAN DEFAULT TRUE,
+//	    identifier     OCTET STRING }
+func decodeEndTxnValue(value string) (bool, string, error) {
+	p, err := ber.DecodePacketErr([]byte(value))
+	if err != nil || p.Tag != ber.TagSequence || len(p.Children) < 1 || len(p.Children) > 2 {
+		return false, "", errors.New("malformed end transaction request")
+	}
+	commit := true
+	if len(p.Children) == 2 {
+		b, ok := p.Children[0].Value.(bool)
+		if !ok {
+			return false, "", errors.New("malformed end transaction commit flag")
+		}
+		commit = b
+	}
+	return commit, p.Children[len(p.Children)-1].Data.String(), nil
+}
+
+// encodeEndTxnValue encodes the txnEndRes of a failed update
+func encodeEndTxnValue(messageId int64) string {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "txnEndRes")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageId, "messageID"))
+	return string(p.Bytes())
+}
+
+// commitTxn applies the updates in a single backend transaction
+func (this *ldapServer) commitTxn(ops []*txnOp) error {
+	return this.backend.RunTx(func(tx DirectoryBackend) error {
+		for _, op := range ops {
+			if err := this.applyTxnOp(tx, op); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// commitOps applies the updates in a single backend transaction and sets the
+// result on res
+func (this *ldapServer) commitOps(ops []*txnOp, res resultSetter) {
+	const op = "ldap.(Directory).commitOps"
+
+	if err := this.commitTxn(ops); err != nil {
+		log.Println("commit updates error", "op", op, "err", err)
+		var te *txnError
+		if errors.As(err, &te) {
+			res.SetResultCode(te.Code)
+			res.SetDiagnosticMessage(te.Message)
+		} else {
+			res.SetResultCode(gldap.ResultOperationsError)
+		}
+		return
+	}
+	res.SetResultCode(gldap.ResultSuccess)
+}
+
+func (this *ldapServer) applyTxnOp(tx DirectoryBackend, op *txnOp) error {
+	entry, err := tx.FindOneEntry(op.DN)
+	if err != nil {
+		return err
+	}
+	exists := len(entry.DN) > 0
+	if exists && op.Assert != nil && !op.Assert(entry) {
+		return &txnError{MessageId: op.MessageId, Code: gldap.ResultAssertionFailed, Message: "entry has been modified: " + op.DN}
+	}
+
+	switch op.Kind {
+	case ChangeTypeAdd:
+		if exists {
+			return &txnError{MessageId: op.MessageId, Code: gldap.ResultEntryAlreadyExists, Message: "entry exists for DN: " + op.DN}
+		}
+		newId, err := this.IdGen.Next()
+		if err != nil {
+			return err
+		}
+		return tx.SaveEntry(op.Entry, newId, NewAddChange(op.BoundDN, op.Entry))
+	case ChangeTypeModify:
+		if !exists {
+			return &txnError{MessageId: op.MessageId, Code: gldap.ResultNoSuchObject, Message: "no such entry: " + op.DN}
+		}
+		applyChanges(entry, op.Changes)
+		return tx.UpdateEntry(entry, NewModifyChange(op.BoundDN, entry.DN, op.Changes))
+	case ChangeTypeDelete:
+		if !exists {
+			return &txnError{MessageId: op.MessageId, Code: gldap.ResultNoSuchObject, Message: "no such entry: " + op.DN}
+		}
+		return tx.DeleteEntry(op.DN, NewDeleteChange(op.BoundDN, entry.DN))
+	case ChangeTypeModRDN:
+		if !exists {
+			return &txnError{MessageId: op.MessageId, Code: gldap.ResultNoSuchObject, Message: "no such entry: " + op.DN}
+		}
+		return this.moveEntry(tx, entry, op)
+	default:
+		return &txnError{MessageId: op.MessageId, Code: gldap.ResultUnwillingToPerform, Message: "unsupported update: " + op.Kind}
+	}
+}
@@ -0,0 +1,399 @@
+package ldap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meidomx/misc-service/config"
+	"github.com/meidomx/misc-service/id"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/jimlambrt/gldap"
+)
+
+// startTestServer serves a memory backend with alice and root below ou=people
+// on a loopback listener, root being a member of the admins group
+func startTestServer(t *testing.T, limits frontendLimits, throttle *bindThrottle) (string, *MemoryDirectoryBackend) {
+	t.Helper()
+	addr, backend, _ := startTestNotifyingServer(t, limits, throttle)
+	return addr, backend
+}
+
+func startTestNotifyingServer(t *testing.T, limits frontendLimits, throttle *bindThrottle) (string, *MemoryDirectoryBackend, *ChangeNotifier) {
+	t.Helper()
+	c := new(config.Config)
+	c.LDAP.Suffixes = []config.LdapSuffix{{
+		Suffix:     "dc=example",
+		BindBaseDN: "ou=people,dc=example",
+		BindFilter: "(|(uid=%s)(mail=%s))",
+	}}
+	c.LDAP.AdminDNs = []string{"cn=admins,dc=example"}
+	backend := newTestMemoryBackend(t, "", 0)
+	idGen := id.NewIdGen(1, 1)
+	saveTestEntry(t, backend, idGen, "dc=example", map[string][]string{"objectClass": {"top", "domain"}})
+	saveTestEntry(t, backend, idGen, "ou=people,dc=example", map[string][]string{"objectClass": {"top", "organizationalUnit"}})
+	saveTestEntry(t, backend, idGen, "cn=alice,ou=people,dc=example", map[string][]string{
+		"objectClass":  {"top", "inetOrgPerson"},
+		"cn":           {"alice"},
+		"uid":          {"alice"},
+		"mail":         {"alice@example.com"},
+		"userPassword": {"secret"},
+	})
+	saveTestEntry(t, backend, idGen, "cn=root,ou=people,dc=example", map[string][]string{
+		"objectClass":  {"top", "inetOrgPerson"},
+		"cn":           {"root"},
+		"uid":          {"root"},
+		"userPassword": {"secret"},
+	})
+	saveTestEntry(t, backend, idGen, "cn=admins,dc=example", map[string][]string{
+		"objectClass": {"top", "groupOfNames"},
+		"cn":          {"admins"},
+		"member":      {"cn=root,ou=people,dc=example"},
+	})
+
+	notifier := NewChangeNotifier(backend)
+	if throttle != nil {
+		throttle.resolve = newLdapServer(idGen, c, backend, notifier, "external", nil).bindDN
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newGldapServer(idGen, c, backend, notifier, "external", nil)
+	fe := newFrontend(l, nil, "external", limits, throttle)
+	go s.Serve(fe)
+	for !s.Ready() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Cleanup(func() {
+		fe.Close()
+		s.Stop()
+	})
+	return "ldap://" + l.Addr().String(), backend, notifier
+}
+
+func dialTestServer(t *testing.T, addr string) *goldap.Conn {
+	t.Helper()
+	conn, err := goldap.DialURL(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return conn
+}
+
+func TestBindNames(t *testing.T) {
+	addr, _ := startTestServer(t, frontendLimits{}, nil)
+	conn := dialTestServer(t, addr)
+
+	for _, name := range []string{"alice", "alice@example.com", "cn=alice,ou=people,dc=example"} {
+		if err := conn.Bind(name, "secret"); err != nil {
+			t.Errorf("bind %s: %v", name, err)
+		}
+	}
+	if err := conn.Bind("alice", "wrong"); !goldap.IsErrorWithCode(err, goldap.LDAPResultInvalidCredentials) {
+		t.Errorf("bind with a wrong password: %v", err)
+	}
+	if err := conn.Bind("cn=alice,dc=other", "secret"); !goldap.IsErrorWithCode(err, goldap.LDAPResultInvalidCredentials) {
+		t.Errorf("bind outside the suffixes: %v", err)
+	}
+}
+
+func TestAddModifyDelete(t *testing.T) {
+	addr, backend := startTestServer(t, frontendLimits{}, nil)
+	conn := dialTestServer(t, addr)
+	if err := conn.Bind("root", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	add := goldap.NewAddRequest("cn=bob,ou=people,dc=example", nil)
+	add.Attribute("objectClass", []string{"top", "inetOrgPerson"})
+	add.Attribute("cn", []string{"bob"})
+	add.Attribute("userPassword", []string{"hunter2"})
+	if err := conn.Add(add); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Add(add); !goldap.IsErrorWithCode(err, goldap.LDAPResultEntryAlreadyExists) {
+		t.Errorf("adding an existing entry: %v", err)
+	}
+
+	modify := goldap.NewModifyRequest("cn=bob,ou=people,dc=example", nil)
+	modify.Add("mail", []string{"bob@example.com"})
+	if err := conn.Modify(modify); err != nil {
+		t.Fatal(err)
+	}
+	r, err := conn.Search(goldap.NewSearchRequest("ou=people,dc=example", goldap.ScopeSingleLevel, goldap.NeverDerefAliases,
+		0, 0, false, "(mail=bob@example.com)", []string{"cn"}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Entries) != 1 || r.Entries[0].GetAttributeValue("cn") != "bob" {
+		t.Errorf("search after modify = %d entries", len(r.Entries))
+	}
+
+	if err := conn.Del(goldap.NewDelRequest("cn=bob,ou=people,dc=example", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := backend.FindOneEntry("cn=bob,ou=people,dc=example"); len(e.DN) > 0 {
+		t.Error("entry kept after delete")
+	}
+
+	// the 5 seed entries, then the add, modify and delete
+	changes, _ := backend.FindChanges(6, 10)
+	if len(changes) != 3 {
+		t.Fatalf("changes = %d, want 3", len(changes))
+	}
+	if changes[0].BoundDN != "cn=root,ou=people,dc=example" {
+		t.Errorf("change bound DN = %s", changes[0].BoundDN)
+	}
+	if strings.Contains(changes[0].Changes, "hunter2") || !strings.Contains(changes[0].Changes, redactedValue) {
+		t.Errorf("password not redacted in change: %s", changes[0].Changes)
+	}
+}
+
+func TestChangelogRequiresBind(t *testing.T) {
+	addr, _ := startTestServer(t, frontendLimits{}, nil)
+	conn := dialTestServer(t, addr)
+
+	search := goldap.NewSearchRequest("cn=changelog", goldap.ScopeWholeSubtree, goldap.NeverDerefAliases,
+		0, 0, false, "(objectClass=*)", nil, nil)
+	if _, err := conn.Search(search); !goldap.IsErrorWithCode(err, goldap.LDAPResultInsufficientAccessRights) {
+		t.Errorf("anonymous changelog search: %v", err)
+	}
+	if err := conn.Bind("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Search(search); err != nil {
+		t.Errorf("bound changelog search: %v", err)
+	}
+}
+
+func TestBindThrottleByEntry(t *testing.T) {
+	throttle := newBindThrottle(0, 2, time.Minute, time.Minute)
+	addr, _ := startTestServer(t, frontendLimits{}, throttle)
+	conn := dialTestServer(t, addr)
+
+	// the failures of different forms of the name count for the same entry
+	conn.Bind("alice", "wrong")
+	conn.Bind("alice@example.com", "wrong")
+	if err := conn.Bind("cn=alice,ou=people,dc=example", "secret"); !goldap.IsErrorWithCode(err, goldap.LDAPResultUnwillingToPerform) {
+		t.Errorf("bind after failures: %v", err)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	addr, _ := startTestServer(t, frontendLimits{MaxConnections: 1}, nil)
+	first := dialTestServer(t, addr)
+	if err := first.Bind("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	second := dialTestServer(t, addr)
+	if err := second.Bind("alice", "secret"); err == nil {
+		t.Error("bind beyond the connection limit succeeded")
+	}
+
+	first.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		third := dialTestServer(t, addr)
+		err := third.Bind("alice", "secret")
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connection slot not released: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReadPDUDefaultLimit(t *testing.T) {
+	// a sequence declaring 4 GiB - 1 of content
+	r := bufio.NewReader(bytes.NewReader([]byte{0x30, 0x84, 0xff, 0xff, 0xff, 0xff}))
+	if _, err := readPDU(r, 0); !errors.Is(err, errPDUTooLarge) {
+		t.Errorf("read without max pdu size: %v", err)
+	}
+}
+
+func TestDeactivatedBind(t *testing.T) {
+	addr, backend := startTestServer(t, frontendLimits{}, nil)
+	entry, err := backend.FindOneEntry("cn=alice,ou=people,dc=example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.Attributes = append(entry.Attributes, gldap.NewEntryAttribute(attributeScimActive, []string{"FALSE"}))
+	if err := backend.UpdateEntry(entry, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := dialTestServer(t, addr)
+	if err := conn.Bind("alice", "secret"); !goldap.IsErrorWithCode(err, goldap.LDAPResultInvalidCredentials) {
+		t.Errorf("bind of a deactivated account: %v", err)
+	}
+}
+
+func TestMfaAttributesAdminOnly(t *testing.T) {
+	addr, _ := startTestServer(t, frontendLimits{}, nil)
+	conn := dialTestServer(t, addr)
+	if err := conn.Bind("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	modify := goldap.NewModifyRequest("cn=alice,ou=people,dc=example", nil)
+	modify.Add(attributeMfaRequired, []string{"FALSE"})
+	if err := conn.Modify(modify); !goldap.IsErrorWithCode(err, goldap.LDAPResultInsufficientAccessRights) {
+		t.Errorf("modify of mfaRequired: %v", err)
+	}
+	add := goldap.NewAddRequest("cn=carol,ou=people,dc=example", nil)
+	add.Attribute("objectClass", []string{"top", "person"})
+	add.Attribute(attributeTotpSecret, []string{"secret"})
+	if err := conn.Add(add); !goldap.IsErrorWithCode(err, goldap.LDAPResultInsufficientAccessRights) {
+		t.Errorf("add with totpSecret: %v", err)
+	}
+}
+
+func TestLdapWriteAuthorization(t *testing.T) {
+	addr, backend := startTestServer(t, frontendLimits{}, nil)
+	anonymous := dialTestServer(t, addr)
+	alice := dialTestServer(t, addr)
+	if err := alice.Bind("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	root := dialTestServer(t, addr)
+	if err := root.Bind("root", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	modify := func(dn, attribute, value string) *goldap.ModifyRequest {
+		m := goldap.NewModifyRequest(dn, nil)
+		m.Replace(attribute, []string{value})
+		return m
+	}
+	for _, c := range []struct {
+		name    string
+		conn    *goldap.Conn
+		request *goldap.ModifyRequest
+		allowed bool
+	}{
+		{"anonymous mail", anonymous, modify("cn=alice,ou=people,dc=example", "mail", "eve@example.com"), false},
+		{"anonymous password", anonymous, modify("cn=alice,ou=people,dc=example", "userPassword", "eve"), false},
+		{"own mail", alice, modify("cn=alice,ou=people,dc=example", "mail", "alice@example.org"), true},
+		{"own scimActive", alice, modify("cn=alice,ou=people,dc=example", attributeScimActive, "TRUE"), false},
+		{"other password", alice, modify("cn=root,ou=people,dc=example", "userPassword", "eve"), false},
+		{"admins member", alice, modify("cn=admins,dc=example", "member", "cn=alice,ou=people,dc=example"), false},
+		{"admin password", root, modify("cn=alice,ou=people,dc=example", "userPassword", "changed"), true},
+	} {
+		err := c.conn.Modify(c.request)
+		if c.allowed && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if !c.allowed && !goldap.IsErrorWithCode(err, goldap.LDAPResultInsufficientAccessRights) {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+
+	add := goldap.NewAddRequest("cn=eve,ou=people,dc=example", nil)
+	add.Attribute("objectClass", []string{"top", "inetOrgPerson"})
+	add.Attribute("cn", []string{"eve"})
+	for name, conn := range map[string]*goldap.Conn{"anonymous": anonymous, "alice": alice} {
+		if err := conn.Add(add); !goldap.IsErrorWithCode(err, goldap.LDAPResultInsufficientAccessRights) {
+			t.Errorf("add by %s: %v", name, err)
+		}
+		if err := conn.Del(goldap.NewDelRequest("cn=alice,ou=people,dc=example", nil)); !goldap.IsErrorWithCode(err, goldap.LDAPResultInsufficientAccessRights) {
+			t.Errorf("delete by %s: %v", name, err)
+		}
+	}
+	if e, _ := backend.FindOneEntry("cn=alice,ou=people,dc=example"); len(e.DN) <= 0 {
+		t.Fatal("entry deleted")
+	}
+	if err := root.Add(add); err != nil {
+		t.Errorf("add by root: %v", err)
+	}
+	if err := root.Del(goldap.NewDelRequest("cn=eve,ou=people,dc=example", nil)); err != nil {
+		t.Errorf("delete by root: %v", err)
+	}
+}
+
+func TestSearchWithoutSecrets(t *testing.T) {
+	addr, _ := startTestServer(t, frontendLimits{}, nil)
+	anonymous := dialTestServer(t, addr)
+	alice := dialTestServer(t, addr)
+	if err := alice.Bind("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	root := dialTestServer(t, addr)
+	if err := root.Bind("root", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	search := func(filter string) *goldap.SearchRequest {
+		return goldap.NewSearchRequest("ou=people,dc=example", goldap.ScopeWholeSubtree, goldap.NeverDerefAliases,
+			0, 0, false, filter, nil, nil)
+	}
+	for name, conn := range map[string]*goldap.Conn{"anonymous": anonymous, "alice": alice} {
+		r, err := conn.Search(search("(uid=alice)"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Entries) != 1 || len(r.Entries[0].GetAttributeValues("userPassword")) > 0 {
+			t.Errorf("search by %s returned userPassword", name)
+		}
+		r, err = conn.Search(search("(userPassword=secret)"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Entries) != 0 {
+			t.Errorf("search by %s matched userPassword", name)
+		}
+	}
+	r, err := root.Search(search("(uid=alice)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Entries) != 1 || r.Entries[0].GetAttributeValue("userPassword") != "secret" {
+		t.Error("search by root without userPassword")
+	}
+}
+
+func TestPersistentSearchEndsOnDisconnect(t *testing.T) {
+	addr, _, notifier := startTestNotifyingServer(t, frontendLimits{}, nil)
+	subscribers := func() int {
+		notifier.lock.Lock()
+		defer notifier.lock.Unlock()
+		return len(notifier.subscribers)
+	}
+
+	value := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "persistent search")
+	value.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(15), "changeTypes"))
+	value.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, true, "changesOnly"))
+	value.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, false, "returnECs"))
+	control := goldap.NewControlString(ControlTypePersistentSearch, true, string(value.Bytes()))
+
+	conn := dialTestServer(t, addr)
+	go conn.Search(goldap.NewSearchRequest("dc=example", goldap.ScopeWholeSubtree, goldap.NeverDerefAliases,
+		0, 0, false, "(objectClass=*)", nil, []goldap.Control{control}))
+	deadline := time.Now().Add(time.Second)
+	for subscribers() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("persistent search not started")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	conn.Close()
+	deadline = time.Now().Add(time.Second)
+	for subscribers() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("persistent search kept after the client disconnected")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,489 @@
+package ldap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/meidomx/misc-service/id"
+
+	"github.com/jimlambrt/gldap"
+)
+
+const (
+	defaultSnapshotInterval    = 5 * time.Second
+	defaultChangelogMaxEntries = 10000
+)
+
+// MemoryDirectoryBackend keeps the directory in memory. When a snapshot file
+// is configured, the state is loaded from it on start and written to it when
+// changed, at most once per snapshot interval and on Close. It suits small
+// deployments and tests. The changelog keeps the latest maxChanges changes.
+type MemoryDirectoryBackend struct {
+	lock  sync.RWMutex
+	state *memState
+	// dirty is 1 when the state has changed since the last snapshot
+	dirty int32
+
+	snapshotFile     string
+	snapshotInterval time.Duration
+	snapshotLock     sync.Mutex
+	maxChanges       int
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	done      chan struct{}
+
+	listenerLock sync.Mutex
+	listeners    map[int]func(n *EntryNotification)
+	nextListener int
+}
+
+type memState struct {
+	// Entries is keyed by the normalized DN
+	Entries          map[string]*memEntry `json:"entries"`
+	Changes          []*ChangeRecord      `json:"changes"`
+	LastChangeNumber int64                `json:"last_change_number"`
+}
+
+type memEntry struct {
+	Id          string       `json:"id"`
+	Entry       *gldap.Entry `json:"entry"`
+	TimeCreated int64        `json:"time_created"`
+	TimeUpdated int64        `json:"time_updated"`
+}
+
+// memTx operates on the state while the backend lock is held. The entries it
+// replaces are kept to roll back, notifications are collected and published
+// after commit.
+type memTx struct {
+	state         *memState
+	maxChanges    int
+	notifications []*EntryNotification
+
+	// undo holds the entries before the transaction, nil when absent
+	undo             map[string]*memEntry
+	changes          []*ChangeRecord
+	lastChangeNumber int64
+}
+
+// NewMemoryDirectoryBackend loads the snapshot file when set. A zero interval
+// or maxChanges uses the defaults.
+func NewMemoryDirectoryBackend(snapshotFile string, snapshotInterval time.Duration, maxChanges int) (*MemoryDirectoryBackend, error) {
+	if snapshotInterval <= 0 {
+		snapshotInterval = defaultSnapshotInterval
+	}
+	if maxChanges <= 0 {
+		maxChanges = defaultChangelogMaxEntries
+	}
+	b := &MemoryDirectoryBackend{
+		state: &memState{
+			Entries: map[string]*memEntry{},
+		},
+		snapshotFile:     snapshotFile,
+		snapshotInterval: snapshotInterval,
+		maxChanges:       maxChanges,
+		closed:           make(chan struct{}),
+		done:             make(chan struct{}),
+		listeners:        map[int]func(n *EntryNotification){},
+	}
+	if len(snapshotFile) > 0 {
+		data, err := os.ReadFile(snapshotFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, b.state); err != nil {
+				return nil, err
+			}
+			if b.state.Entries == nil {
+				b.state.Entries = map[string]*memEntry{}
+			}
+		}
+	}
+	go b.writeSnapshots()
+	return b, nil
+}
+
+func (this *MemoryDirectoryBackend) writeSnapshots() {
+	defer close(this.done)
+	if len(this.snapshotFile) == 0 {
+		return
+	}
+	ticker := time.NewTicker(this.snapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.closed:
+			return
+		case <-ticker.C:
+			if err := this.Flush(); err != nil {
+				log.Println("write ldap snapshot error:", err)
+			}
+		}
+	}
+}
+
+// Close stops the snapshots and writes the last one
+func (this *MemoryDirectoryBackend) Close() error {
+	this.closeOnce.Do(func() {
+		close(this.closed)
+	})
+	<-this.done
+	return this.Flush()
+}
+
+// Flush writes the snapshot when the state has changed since the last one
+func (this *MemoryDirectoryBackend) Flush() error {
+	if len(this.snapshotFile) == 0 {
+		return nil
+	}
+	this.snapshotLock.Lock()
+	defer this.snapshotLock.Unlock()
+
+	this.lock.RLock()
+	if !atomic.CompareAndSwapInt32(&this.dirty, 1, 0) {
+		this.lock.RUnlock()
+		return nil
+	}
+	data, err := json.Marshal(this.state)
+	this.lock.RUnlock()
+	if err == nil {
+		err = writeSnapshot(this.snapshotFile, data)
+	}
+	if err != nil {
+		atomic.StoreInt32(&this.dirty, 1)
+	}
+	return err
+}
+
+func (this *MemoryDirectoryBackend) read(f func(tx *memTx) error) error {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return f(&memTx{state: this.state})
+}
+
+func (this *MemoryDirectoryBackend) RunTx(f func(tx DirectoryBackend) error) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	tx := &memTx{
+		state:            this.state,
+		maxChanges:       this.maxChanges,
+		undo:             map[string]*memEntry{},
+		changes:          this.state.Changes,
+		lastChangeNumber: this.state.LastChangeNumber,
+	}
+	if err := f(tx); err != nil {
+		tx.rollback()
+		return err
+	}
+	if len(tx.undo) > 0 || tx.state.LastChangeNumber != tx.lastChangeNumber {
+		atomic.StoreInt32(&this.dirty, 1)
+	}
+
+	this.listenerLock.Lock()
+	defer this.listenerLock.Unlock()
+	for _, n := range tx.notifications {
+		for _, l := range this.listeners {
+			l(n)
+		}
+	}
+	return nil
+}
+
+func writeSnapshot(file string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+func (this *MemoryDirectoryBackend) Listen(ctx context.Context, f func(n *EntryNotification)) error {
+	this.listenerLock.Lock()
+	this.nextListener++
+	listenerId := this.nextListener
+	this.listeners[listenerId] = f
+	this.listenerLock.Unlock()
+
+	<-ctx.Done()
+
+	this.listenerLock.Lock()
+	delete(this.listeners, listenerId)
+	this.listenerLock.Unlock()
+	return ctx.Err()
+}
+
+func (this *MemoryDirectoryBackend) FindOneEntry(dn string) (r *gldap.Entry, err error) {
+	err = this.read(func(tx *memTx) error {
+		r, err = tx.FindOneEntry(dn)
+		return err
+	})
+	return
+}
+
+func (this *MemoryDirectoryBackend) FindChildren(dn string) (r []*gldap.Entry, err error) {
+	err = this.read(func(tx *memTx) error {
+		r, err = tx.FindChildren(dn)
+		return err
+	})
+	return
+}
+
+func (this *MemoryDirectoryBackend) FindRoots() (r []*gldap.Entry, err error) {
+	err = this.read(func(tx *memTx) error {
+		r, err = tx.FindRoots()
+		return err
+	})
+	return
+}
+
+func (this *MemoryDirectoryBackend) FindByAttribute(name, value string) (r []*gldap.Entry, err error) {
+	err = this.read(func(tx *memTx) error {
+		r, err = tx.FindByAttribute(name, value)
+		return err
+	})
+	return
+}
+
+func (this *MemoryDirectoryBackend) FindChanges(fromNumber int64, limit int) (r []*ChangeRecord, err error) {
+	err = this.read(func(tx *memTx) error {
+		r, err = tx.FindChanges(fromNumber, limit)
+		return err
+	})
+	return
+}
+
+func (this *MemoryDirectoryBackend) SaveEntry(entry *gldap.Entry, i id.ItemId, change *ChangeRecord) error {
+	return this.RunTx(func(tx DirectoryBackend) error {
+		return tx.SaveEntry(entry, i, change)
+	})
+}
+
+func (this *MemoryDirectoryBackend) UpdateEntry(entry *gldap.Entry, change *ChangeRecord) error {
+	return this.RunTx(func(tx DirectoryBackend) error {
+		return tx.UpdateEntry(entry, change)
+	})
+}
+
+func (this *MemoryDirectoryBackend) DeleteEntry(dn string, change *ChangeRecord) error {
+	return this.RunTx(func(tx DirectoryBackend) error {
+		return tx.DeleteEntry(dn, change)
+	})
+}
+
+func (this *MemoryDirectoryBackend) MoveEntry(dn string, entry *gldap.Entry, change *ChangeRecord) error {
+	return this.RunTx(func(tx DirectoryBackend) error {
+		return tx.MoveEntry(dn, entry, change)
+	})
+}
+
+// put replaces the entry at key, keeping the previous one to roll back
+func (this *memTx) put(key string, e *memEntry) {
+	if _, ok := this.undo[key]; !ok {
+		this.undo[key] = this.state.Entries[key]
+	}
+	if e == nil {
+		delete(this.state.Entries, key)
+		return
+	}
+	this.state.Entries[key] = e
+}
+
+func (this *memTx) rollback() {
+	for key, e := range this.undo {
+		if e == nil {
+			delete(this.state.Entries, key)
+		} else {
+			this.state.Entries[key] = e
+		}
+	}
+	this.state.Changes = this.changes
+	this.state.LastChangeNumber = this.lastChangeNumber
+}
+
+func (this *memTx) RunTx(f func(tx DirectoryBackend) error) error {
+	return f(this)
+}
+
+func (this *memTx) Listen(ctx context.Context, f func(n *EntryNotification)) error {
+	return errListenInTx
+}
+
+func (this *memTx) FindOneEntry(dn string) (*gldap.Entry, error) {
+	if e, ok := this.state.Entries[NormalizeDN(dn)]; ok {
+		return cloneEntry(e.Entry), nil
+	}
+	return new(gldap.Entry), nil
+}
+
+func (this *memTx) FindChildren(dn string) ([]*gldap.Entry, error) {
+	parent := NormalizeDN(dn)
+	return this.findEntries(func(key string) bool {
+		return NormalizeDN(CombineParentDN(SplitDN(key))) == parent
+	}), nil
+}
+
+func (this *memTx) FindRoots() ([]*gldap.Entry, error) {
+	return this.findEntries(func(key string) bool {
+		return len(SplitDN(key)) == 1
+	}), nil
+}
+
+func (this *memTx) FindByAttribute(name, value string) ([]*gldap.Entry, error) {
+	var entries []*gldap.Entry
+	for _, e := range this.state.Entries {
+		for _, v := range EntryAttributeValues(e.Entry, name) {
+			if strings.EqualFold(v, value) {
+				entries = append(entries, cloneEntry(e.Entry))
+				break
+			}
+		}
+	}
+	return entries, nil
+}
+
+func (this *memTx) findEntries(match func(key string) bool) []*gldap.Entry {
+	var keys []string
+	for k := range this.state.Entries {
+		if match(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var entries []*gldap.Entry
+	for _, k := range keys {
+		entries = append(entries, cloneEntry(this.state.Entries[k].Entry))
+	}
+	return entries
+}
+
+func (this *memTx) SaveEntry(entry *gldap.Entry, i id.ItemId, change *ChangeRecord) error {
+	key := NormalizeDN(entry.DN)
+	if _, ok := this.state.Entries[key]; ok {
+		return errors.New("entry already exists: " + entry.DN)
+	}
+	now := time.Now().UnixMilli()
+	this.put(key, &memEntry{
+		Id:          i.HexString(),
+		Entry:       cloneEntry(entry),
+		TimeCreated: now,
+		TimeUpdated: now,
+	})
+	this.notify(ChangeTypeAdd, entry.DN, nil)
+	this.insertChange(change)
+	return nil
+}
+
+func (this *memTx) UpdateEntry(entry *gldap.Entry, change *ChangeRecord) error {
+	key := NormalizeDN(entry.DN)
+	if old, ok := this.state.Entries[key]; ok {
+		this.put(key, &memEntry{
+			Id:          old.Id,
+			Entry:       cloneEntry(entry),
+			TimeCreated: old.TimeCreated,
+			TimeUpdated: time.Now().UnixMilli(),
+		})
+		this.notify(ChangeTypeModify, entry.DN, nil)
+	}
+	this.insertChange(change)
+	return nil
+}
+
+func (this *memTx) DeleteEntry(dn string, change *ChangeRecord) error {
+	key := NormalizeDN(dn)
+	if old, ok := this.state.Entries[key]; ok {
+		this.put(key, nil)
+		this.notify(ChangeTypeDelete, old.Entry.DN, cloneEntry(old.Entry))
+	}
+	this.insertChange(change)
+	return nil
+}
+
+func (this *memTx) MoveEntry(dn string, entry *gldap.Entry, change *ChangeRecord) error {
+	key := NormalizeDN(dn)
+	newKey := NormalizeDN(entry.DN)
+	if old, ok := this.state.Entries[key]; ok {
+		if _, ok := this.state.Entries[newKey]; ok && newKey != key {
+			return errors.New("entry already exists: " + entry.DN)
+		}
+		this.put(key, nil)
+		this.put(newKey, &memEntry{
+			Id:          old.Id,
+			Entry:       cloneEntry(entry),
+			TimeCreated: old.TimeCreated,
+			TimeUpdated: time.Now().UnixMilli(),
+		})
+		this.notify(ChangeTypeModRDN, entry.DN, nil)
+	}
+	this.insertChange(change)
+	return nil
+}
+
+func (this *memTx) FindChanges(fromNumber int64, limit int) ([]*ChangeRecord, error) {
+	changes := this.state.Changes
+	// change numbers are ascending but not necessarily contiguous after a reload
+	start := sort.Search(len(changes), func(i int) bool {
+		return changes[i].ChangeNumber >= fromNumber
+	})
+	var result []*ChangeRecord
+	for i := start; i < len(changes) && len(result) < limit; i++ {
+		c := *changes[i]
+		result = append(result, &c)
+	}
+	return result, nil
+}
+
+func (this *memTx) insertChange(change *ChangeRecord) {
+	if change == nil {
+		return
+	}
+	this.state.LastChangeNumber++
+	change.ChangeNumber = this.state.LastChangeNumber
+	change.TimeCreated = time.Now().UnixMilli()
+	c := *change
+	changes := append(this.state.Changes, &c)
+	if len(changes) > this.maxChanges {
+		// the oldest changes are dropped, FindChanges starts after a gap
+		changes = changes[len(changes)-this.maxChanges:]
+	}
+	this.state.Changes = changes
+}
+
+func (this *memTx) notify(op, dn string, entry *gldap.Entry) {
+	this.notifications = append(this.notifications, &EntryNotification{
+		Op:    op,
+		DN:    dn,
+		Entry: entry,
+	})
+}
+
+func cloneEntry(entry *gldap.Entry) *gldap.Entry {
+	c := &gldap.Entry{
+		DN:         entry.DN,
+		Attributes: make([]*gldap.EntryAttribute, 0, len(entry.Attributes)),
+	}
+	for _, a := range entry.Attributes {
+		values := make([]string, len(a.Values))
+		copy(values, a.Values)
+		c.Attributes = append(c.Attributes, gldap.NewEntryAttribute(a.Name, values))
+	}
+	return c
+}
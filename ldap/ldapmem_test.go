@@ -0,0 +1,103 @@
+package ldap
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/meidomx/misc-service/id"
+
+	"github.com/jimlambrt/gldap"
+)
+
+func newTestMemoryBackend(t *testing.T, snapshotFile string, maxChanges int) *MemoryDirectoryBackend {
+	t.Helper()
+	b, err := NewMemoryDirectoryBackend(snapshotFile, 0, maxChanges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		b.Close()
+	})
+	return b
+}
+
+func saveTestEntry(t *testing.T, backend DirectoryBackend, idGen *id.IdGen, dn string, attributes map[string][]string) {
+	t.Helper()
+	i, err := idGen.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := gldap.NewEntry(dn, attributes)
+	if err := backend.SaveEntry(entry, i, NewAddChange("", entry)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryRunTxRollback(t *testing.T) {
+	b := newTestMemoryBackend(t, "", 0)
+	idGen := id.NewIdGen(1, 1)
+	saveTestEntry(t, b, idGen, "dc=example", map[string][]string{"objectClass": {"top"}})
+
+	errAbort := errors.New("abort")
+	err := b.RunTx(func(tx DirectoryBackend) error {
+		saveTestEntry(t, tx, idGen, "cn=a,dc=example", map[string][]string{"cn": {"a"}})
+		if err := tx.DeleteEntry("dc=example", NewDeleteChange("", "dc=example")); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("RunTx error = %v", err)
+	}
+
+	if e, _ := b.FindOneEntry("cn=a,dc=example"); len(e.DN) > 0 {
+		t.Error("added entry kept after rollback")
+	}
+	if e, _ := b.FindOneEntry("dc=example"); len(e.DN) == 0 {
+		t.Error("deleted entry lost after rollback")
+	}
+	changes, _ := b.FindChanges(0, 10)
+	if len(changes) != 1 || changes[0].ChangeNumber != 1 {
+		t.Errorf("changes after rollback = %d", len(changes))
+	}
+}
+
+func TestMemoryChangelogCap(t *testing.T) {
+	b := newTestMemoryBackend(t, "", 3)
+	idGen := id.NewIdGen(1, 1)
+	for _, dn := range []string{"cn=a", "cn=b", "cn=c", "cn=d", "cn=e"} {
+		saveTestEntry(t, b, idGen, dn, map[string][]string{"cn": {dn[3:]}})
+	}
+
+	changes, _ := b.FindChanges(0, 10)
+	if len(changes) != 3 {
+		t.Fatalf("changes = %d, want 3", len(changes))
+	}
+	if changes[0].ChangeNumber != 3 || changes[2].ChangeNumber != 5 {
+		t.Errorf("change numbers = %d..%d, want 3..5", changes[0].ChangeNumber, changes[2].ChangeNumber)
+	}
+}
+
+func TestMemorySnapshot(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ldap.json")
+	idGen := id.NewIdGen(1, 1)
+
+	b, err := NewMemoryDirectoryBackend(file, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saveTestEntry(t, b, idGen, "dc=example", map[string][]string{"objectClass": {"top"}})
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := newTestMemoryBackend(t, file, 0)
+	if e, _ := reloaded.FindOneEntry("dc=example"); len(e.DN) == 0 {
+		t.Error("entry missing after reload")
+	}
+	changes, _ := reloaded.FindChanges(0, 10)
+	if len(changes) != 1 {
+		t.Errorf("changes after reload = %d, want 1", len(changes))
+	}
+}
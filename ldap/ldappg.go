@@ -2,11 +2,15 @@ package ldap
 
 import (
 	"context"
+	"encoding/json"
+	"log"
+	"strings"
 	"time"
 
 	"github.com/meidomx/misc-service/id"
 	"github.com/meidomx/misc-service/pgbackend"
 
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/jimlambrt/gldap"
 )
@@ -22,191 +26,346 @@ const (
 
 const (
 	ServiceName = "ldap"
+
+	entryNotifyChannel = "misc_ldap_entries"
+	// writeLockKey is the advisory lock every write transaction holds until
+	// it ends, so change numbers are assigned in commit order and a consumer
+	// polling change_number >= from can't skip a change committed late
+	writeLockKey int64 = 0x6c646170 // "ldap"
 )
 
-func FindSingleRoot() (*gldap.Entry, error) {
-	entry := new(gldap.Entry)
-	r, err := pgbackend.RunQuery(ServiceName, entry, func(conn *pgxpool.Conn, result *gldap.Entry) error {
-		rows, err := conn.Query(context.Background(),
-			"select attribute from misc_ldap_entries where parent_full_entry_path IS NULL LIMIT 1",
-		)
-		if err != nil {
-			return err
-		}
-		defer rows.Close()
+// pgQuerier is satisfied by both pooled connections and transactions
+type pgQuerier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+}
 
-		if rows.Next() {
-			if err := rows.Scan(result); err != nil {
-				return err
-			}
-		}
+// PgDirectoryBackend stores the directory in misc_ldap_entries and
+// misc_ldap_changelog through pgbackend
+type PgDirectoryBackend struct {
+	// tx is set for the backend passed to RunTx callbacks
+	tx pgx.Tx
+}
 
-		return nil
-	})
+func NewPgDirectoryBackend() *PgDirectoryBackend {
+	return new(PgDirectoryBackend)
+}
 
-	return r, err
+func (this *PgDirectoryBackend) query(f func(q pgQuerier) error) error {
+	if this.tx != nil {
+		return f(this.tx)
+	}
+	_, err := pgbackend.RunQuery(ServiceName, nil, func(conn *pgxpool.Conn, result any) error {
+		return f(conn)
+	})
+	return err
 }
 
-func FindAllRoots() ([]*gldap.Entry, error) {
-	var entries []*gldap.Entry
+func (this *PgDirectoryBackend) exec(f func(tx pgx.Tx) error) error {
+	if this.tx != nil {
+		return f(this.tx)
+	}
+	_, err := pgbackend.RunTx(ServiceName, nil, func(tx pgx.Tx, result any) error {
+		if err := lockWrites(tx); err != nil {
+			return err
+		}
+		return f(tx)
+	})
+	return err
+}
 
-	r, err := pgbackend.RunQuery(ServiceName, &entries, func(conn *pgxpool.Conn, r *[]*gldap.Entry) error {
-		rows, err := conn.Query(context.Background(),
-			"select attribute from misc_ldap_entries where parent_full_entry_path IS NULL",
-		)
-		if err != nil {
+func (this *PgDirectoryBackend) RunTx(f func(tx DirectoryBackend) error) error {
+	if this.tx != nil {
+		return f(this)
+	}
+	_, err := pgbackend.RunTx(ServiceName, nil, func(tx pgx.Tx, result any) error {
+		if err := lockWrites(tx); err != nil {
 			return err
 		}
-		defer rows.Close()
+		return f(&PgDirectoryBackend{tx: tx})
+	})
+	return err
+}
 
-		var rr []*gldap.Entry
-		for rows.Next() {
-			result := new(gldap.Entry)
-			if err := rows.Scan(result); err != nil {
-				return err
+// lockWrites is called before the first write of a transaction, taking the
+// lock later could deadlock with the row locks of another writer
+func lockWrites(tx pgx.Tx) error {
+	_, err := tx.Exec(context.Background(), "select pg_advisory_xact_lock($1)", writeLockKey)
+	return err
+}
+
+func (this *PgDirectoryBackend) Listen(ctx context.Context, f func(n *EntryNotification)) error {
+	if this.tx != nil {
+		return errListenInTx
+	}
+	return pgbackend.Listen(ctx, entryNotifyChannel, func(payload string) {
+		n := new(EntryNotification)
+		if err := json.Unmarshal([]byte(payload), n); err != nil {
+			log.Println("invalid entry notification:", err)
+			return
+		}
+		if n.Op == ChangeTypeDelete && n.Entry == nil && len(n.EntryId) > 0 {
+			entry, err := this.findDeletedEntry(n.EntryId)
+			if err != nil {
+				log.Println("find deleted entry error:", err, "dn:", n.DN)
 			}
-			rr = append(rr, result)
+			n.Entry = entry
 		}
-		*r = rr
+		f(n)
+	})
+}
 
-		return nil
+// findDeletedEntry returns the old entry of a delete notification, nil when
+// it has been purged already
+func (this *PgDirectoryBackend) findDeletedEntry(entryId string) (*gldap.Entry, error) {
+	var entry *gldap.Entry
+	err := this.query(func(q pgQuerier) error {
+		entries, err := queryEntries(q, "select attribute from misc_ldap_deleted_entries where entry_id = $1", entryId)
+		if len(entries) > 0 {
+			entry = entries[0]
+		}
+		return err
 	})
+	return entry, err
+}
 
-	return *r, err
+func (this *PgDirectoryBackend) FindRoots() ([]*gldap.Entry, error) {
+	var entries []*gldap.Entry
+	err := this.query(func(q pgQuerier) error {
+		var err error
+		entries, err = queryEntries(q, "select attribute from misc_ldap_entries where parent_full_entry_path IS NULL")
+		return err
+	})
+	return entries, err
 }
 
-func FindOneEntry(dn string) (*gldap.Entry, error) {
-	entryPath := SplitDN(dn)
+func (this *PgDirectoryBackend) FindOneEntry(dn string) (*gldap.Entry, error) {
 	entry := new(gldap.Entry)
-	r, err := pgbackend.RunQuery(ServiceName, entry, func(conn *pgxpool.Conn, result *gldap.Entry) error {
-		parent := CombineParentDN(entryPath)
-		if len(parent) != 0 {
-			rows, err := conn.Query(context.Background(),
-				"select attribute from misc_ldap_entries where entry_name = $1 and parent_full_entry_path = $2",
-				entryPath[0], parent)
-			if err != nil {
-				return err
-			}
-			defer rows.Close()
+	err := this.query(func(q pgQuerier) error {
+		return findOneEntry(q, dn, entry)
+	})
+	return entry, err
+}
 
-			if rows.Next() {
-				if err := rows.Scan(result); err != nil {
-					return err
-				}
-			}
+func findOneEntry(q pgQuerier, dn string, result *gldap.Entry) error {
+	entryPath := SplitDN(dn)
+	parent := CombineParentDN(entryPath)
+	var rows pgx.Rows
+	var err error
+	if len(parent) != 0 {
+		rows, err = q.Query(context.Background(),
+			"select attribute from misc_ldap_entries where entry_name = $1 and parent_full_entry_path = $2",
+			entryPath[0], parent)
+	} else {
+		rows, err = q.Query(context.Background(),
+			"select attribute from misc_ldap_entries where entry_name = $1 and parent_full_entry_path is NULL",
+			entryPath[0])
+	}
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
 
-			return nil
-		} else {
-			rows, err := conn.Query(context.Background(),
-				"select attribute from misc_ldap_entries where entry_name = $1 and parent_full_entry_path is NULL",
-				entryPath[0])
-			if err != nil {
-				return err
-			}
-			defer rows.Close()
+	if rows.Next() {
+		if err := rows.Scan(result); err != nil {
+			return err
+		}
+	}
 
-			if rows.Next() {
-				if err := rows.Scan(result); err != nil {
-					return err
-				}
-			}
+	return nil
+}
 
-			return nil
-		}
+func (this *PgDirectoryBackend) FindByAttribute(name, value string) ([]*gldap.Entry, error) {
+	// matches the lower-cased json of misc_ldap_entries_attr_lower
+	contains, err := json.Marshal(map[string]interface{}{
+		"attributes": []map[string]interface{}{{
+			"name":   strings.ToLower(name),
+			"values": []string{strings.ToLower(value)},
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var entries []*gldap.Entry
+	err = this.query(func(q pgQuerier) error {
+		var err error
+		entries, err = queryEntries(q, "select attribute from misc_ldap_entries where lower(attribute::text)::jsonb @> $1::jsonb", string(contains))
+		return err
 	})
+	return entries, err
+}
 
-	return r, err
+func (this *PgDirectoryBackend) FindChildren(dn string) ([]*gldap.Entry, error) {
+	parent := CombineDN(SplitDN(dn))
+	var entries []*gldap.Entry
+	err := this.query(func(q pgQuerier) error {
+		var err error
+		entries, err = queryEntries(q, "select attribute from misc_ldap_entries where parent_full_entry_path = $1", parent)
+		return err
+	})
+	return entries, err
 }
 
-func FindChildren(dn string) ([]*gldap.Entry, error) {
+func queryEntries(q pgQuerier, sql string, args ...interface{}) ([]*gldap.Entry, error) {
+	rows, err := q.Query(context.Background(), sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	entryPath := SplitDN(dn)
-	var entries []*gldap.Entry
-	r, err := pgbackend.RunQuery(ServiceName, &entries, func(conn *pgxpool.Conn, r *[]*gldap.Entry) error {
-		parent := CombineDN(entryPath)
-		rows, err := conn.Query(context.Background(),
-			"select attribute from misc_ldap_entries where parent_full_entry_path = $1",
-			parent)
-		if err != nil {
-			return err
+	var rr []*gldap.Entry
+	for rows.Next() {
+		result := new(gldap.Entry)
+		if err := rows.Scan(result); err != nil {
+			return nil, err
 		}
-		defer rows.Close()
+		rr = append(rr, result)
+	}
+	return rr, rows.Err()
+}
 
-		var rr []*gldap.Entry
-		for rows.Next() {
-			result := new(gldap.Entry)
-			if err := rows.Scan(result); err != nil {
-				return err
-			}
-			rr = append(rr, result)
+func (this *PgDirectoryBackend) SaveEntry(entry *gldap.Entry, i id.ItemId, change *ChangeRecord) error {
+	return this.exec(func(tx pgx.Tx) error {
+		return saveEntry(tx, entry, i, change)
+	})
+}
+
+func saveEntry(tx pgx.Tx, entry *gldap.Entry, i id.ItemId, change *ChangeRecord) error {
+	sp := SplitDN(entry.DN)
+	entryType := EntryType(sp[0])
+	parent := CombineParentDN(sp)
+	now := time.Now().UnixMilli()
+	if len(parent) > 0 {
+		if _, err := tx.Exec(context.Background(),
+			"insert into misc_ldap_entries(entry_id, entry_name, parent_full_entry_path, entry_type, attribute, metadata, time_created, time_updated) values($1, $2, $3, $4, $5, $6, $7, $8)",
+			i, sp[0], parent, entryType, entry, nil, now, now); err != nil {
+			return err
 		}
-		*r = rr
+	} else {
+		if _, err := tx.Exec(context.Background(),
+			"insert into misc_ldap_entries(entry_id, entry_name, entry_type, attribute, metadata, time_created, time_updated) values($1, $2, $3, $4, $5, $6, $7)",
+			i, sp[0], entryType, entry, nil, now, now); err != nil {
+			return err
+		}
+	}
+	return insertChange(tx, change)
+}
 
-		return nil
+func (this *PgDirectoryBackend) UpdateEntry(entry *gldap.Entry, change *ChangeRecord) error {
+	return this.exec(func(tx pgx.Tx) error {
+		return updateEntry(tx, entry, change)
 	})
-
-	return *r, err
 }
 
-func SaveEntry(entry *gldap.Entry, i id.ItemId) error {
-	_, err := pgbackend.RunQuery(ServiceName, entry, func(conn *pgxpool.Conn, result *gldap.Entry) error {
-		sp := SplitDN(entry.DN)
-		entryType := EntryType(sp[0])
-		parent := CombineParentDN(sp)
-		now := time.Now().UnixMilli()
-		if len(parent) > 0 {
-			_, err := conn.Exec(context.Background(),
-				"insert into misc_ldap_entries(entry_id, entry_name, parent_full_entry_path, entry_type, attribute, metadata, time_created, time_updated) values($1, $2, $3, $4, $5, $6, $7, $8)",
-				i.HexString(), sp[0], parent, entryType, result, nil, now, now)
+func updateEntry(tx pgx.Tx, entry *gldap.Entry, change *ChangeRecord) error {
+	sp := SplitDN(entry.DN)
+	entryType := EntryType(sp[0])
+	parent := CombineParentDN(sp)
+	now := time.Now().UnixMilli()
+	if len(parent) > 0 {
+		if _, err := tx.Exec(context.Background(),
+			"update misc_ldap_entries set attribute = $1, time_updated = $2 where entry_name = $3 and parent_full_entry_path = $4 and entry_type = $5",
+			entry, now, sp[0], parent, entryType); err != nil {
 			return err
-		} else {
-			_, err := conn.Exec(context.Background(),
-				"insert into misc_ldap_entries(entry_id, entry_name, entry_type, attribute, metadata, time_created, time_updated) values($1, $2, $3, $4, $5, $6, $7)",
-				i.HexString(), sp[0], entryType, result, nil, now, now)
+		}
+	} else {
+		if _, err := tx.Exec(context.Background(),
+			"update misc_ldap_entries set attribute = $1, time_updated = $2 where entry_name = $3 and parent_full_entry_path IS NULL and entry_type = $4",
+			entry, now, sp[0], entryType); err != nil {
 			return err
 		}
+	}
+	return insertChange(tx, change)
+}
+
+func (this *PgDirectoryBackend) DeleteEntry(dn string, change *ChangeRecord) error {
+	return this.exec(func(tx pgx.Tx) error {
+		return deleteEntry(tx, dn, change)
 	})
-	return err
 }
 
-func UpdateEntry(entry *gldap.Entry) error {
-	_, err := pgbackend.RunQuery(ServiceName, entry, func(conn *pgxpool.Conn, result *gldap.Entry) error {
-		sp := SplitDN(entry.DN)
-		entryType := EntryType(sp[0])
-		parent := CombineParentDN(sp)
-		now := time.Now().UnixMilli()
-		if len(parent) > 0 {
-			_, err := conn.Exec(context.Background(),
-				"update misc_ldap_entries set attribute = $1, time_updated = $2 where entry_name = $3 and parent_full_entry_path = $4 and entry_type = $5",
-				entry, now, sp[0], parent, entryType)
+func deleteEntry(tx pgx.Tx, dn string, change *ChangeRecord) error {
+	sp := SplitDN(dn)
+	entryType := EntryType(sp[0])
+	parent := CombineParentDN(sp)
+	if len(parent) > 0 {
+		if _, err := tx.Exec(context.Background(),
+			"delete from misc_ldap_entries where entry_name = $1 and entry_type = $2 and parent_full_entry_path = $3",
+			sp[0], entryType, parent); err != nil {
 			return err
-		} else {
-			_, err := conn.Exec(context.Background(),
-				"update misc_ldap_entries set attribute = $1, time_updated = $2 where entry_name = $3 and parent_full_entry_path IS NULL and entry_type = $4",
-				entry, now, sp[0], entryType)
+		}
+	} else {
+		if _, err := tx.Exec(context.Background(),
+			"delete from misc_ldap_entries where entry_name = $1 and entry_type = $2 and parent_full_entry_path IS NULL",
+			sp[0], entryType); err != nil {
 			return err
 		}
+	}
+	return insertChange(tx, change)
+}
+
+func (this *PgDirectoryBackend) MoveEntry(dn string, entry *gldap.Entry, change *ChangeRecord) error {
+	return this.exec(func(tx pgx.Tx) error {
+		return moveEntry(tx, dn, entry, change)
 	})
-	return err
 }
 
-func DeleteEntry(dn string) error {
-	_, err := pgbackend.RunQuery(ServiceName, nil, func(conn *pgxpool.Conn, result interface{}) error {
-		sp := SplitDN(dn)
-		entryType := EntryType(sp[0])
-		parent := CombineParentDN(sp)
-		if len(parent) > 0 {
-			_, err := conn.Exec(context.Background(),
-				"delete from misc_ldap_entries where entry_name = $1 and entry_type = $2 and parent_full_entry_path = $3",
-				sp[0], entryType, parent)
+func moveEntry(tx pgx.Tx, dn string, entry *gldap.Entry, change *ChangeRecord) error {
+	sp := SplitDN(dn)
+	entryType := EntryType(sp[0])
+	parent := CombineParentDN(sp)
+	newSp := SplitDN(entry.DN)
+	var newParent *string
+	if p := CombineParentDN(newSp); len(p) > 0 {
+		newParent = &p
+	}
+	now := time.Now().UnixMilli()
+	if len(parent) > 0 {
+		if _, err := tx.Exec(context.Background(),
+			"update misc_ldap_entries set entry_name = $1, parent_full_entry_path = $2, entry_type = $3, attribute = $4, time_updated = $5 where entry_name = $6 and parent_full_entry_path = $7 and entry_type = $8",
+			newSp[0], newParent, EntryType(newSp[0]), entry, now, sp[0], parent, entryType); err != nil {
 			return err
-		} else {
-			_, err := conn.Exec(context.Background(),
-				"delete from misc_ldap_entries where entry_name = $1 and entry_type = $2 and parent_full_entry_path IS NULL",
-				sp[0], entryType)
+		}
+	} else {
+		if _, err := tx.Exec(context.Background(),
+			"update misc_ldap_entries set entry_name = $1, parent_full_entry_path = $2, entry_type = $3, attribute = $4, time_updated = $5 where entry_name = $6 and parent_full_entry_path IS NULL and entry_type = $7",
+			newSp[0], newParent, EntryType(newSp[0]), entry, now, sp[0], entryType); err != nil {
+			return err
+		}
+	}
+	return insertChange(tx, change)
+}
+
+func (this *PgDirectoryBackend) FindChanges(fromNumber int64, limit int) ([]*ChangeRecord, error) {
+	var changes []*ChangeRecord
+	err := this.query(func(q pgQuerier) error {
+		rows, err := q.Query(context.Background(),
+			"select change_number, time_created, bound_dn, target_dn, change_type, changes from misc_ldap_changelog where change_number >= $1 order by change_number limit $2",
+			fromNumber, limit)
+		if err != nil {
 			return err
 		}
+		defer rows.Close()
+
+		for rows.Next() {
+			c := new(ChangeRecord)
+			if err := rows.Scan(&c.ChangeNumber, &c.TimeCreated, &c.BoundDN, &c.TargetDN, &c.ChangeType, &c.Changes); err != nil {
+				return err
+			}
+			changes = append(changes, c)
+		}
+
+		return rows.Err()
 	})
+	return changes, err
+}
 
-	return err
+func insertChange(tx pgx.Tx, change *ChangeRecord) error {
+	if change == nil {
+		return nil
+	}
+	change.TimeCreated = time.Now().UnixMilli()
+	row := tx.QueryRow(context.Background(),
+		"insert into misc_ldap_changelog(time_created, bound_dn, target_dn, change_type, changes) values($1, $2, $3, $4, $5) returning change_number",
+		change.TimeCreated, change.BoundDN, change.TargetDN, change.ChangeType, change.Changes)
+	return row.Scan(&change.ChangeNumber)
 }
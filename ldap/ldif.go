@@ -0,0 +1,160 @@
+package ldap
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// LdifRecord is a single content record of an LDIF file (RFC 2849).
+// Attribute names keep the order in which they first appear in the record.
+type LdifRecord struct {
+	DN         string
+	AttrNames  []string
+	Attributes map[string][]string
+}
+
+func (this *LdifRecord) addValue(name, value string) {
+	if this.Attributes == nil {
+		this.Attributes = map[string][]string{}
+	}
+	if _, ok := this.Attributes[name]; !ok {
+		this.AttrNames = append(this.AttrNames, name)
+	}
+	this.Attributes[name] = append(this.Attributes[name], value)
+}
+
+func ReadLdifFile(path string) ([]*LdifRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records, err := ParseLdif(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return records, nil
+}
+
+// ParseLdif parses LDIF content records. Supported: comments, folded lines,
+// base64 values ("::"), an optional "version: 1" line and "changetype: add".
+// Other change types are rejected since seed files only describe content.
+func ParseLdif(reader io.Reader) ([]*LdifRecord, error) {
+	lines, err := unfoldLdifLines(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*LdifRecord
+	var current *LdifRecord
+	for _, l := range lines {
+		if len(l.text) == 0 {
+			if current != nil {
+				records = append(records, current)
+				current = nil
+			}
+			continue
+		}
+
+		name, value, err := parseLdifLine(l.text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", l.number, err)
+		}
+
+		if current == nil {
+			switch {
+			case strings.EqualFold(name, "version") && len(records) == 0:
+				if value != "1" {
+					return nil, fmt.Errorf("line %d: unsupported ldif version: %s", l.number, value)
+				}
+				continue
+			case strings.EqualFold(name, "dn"):
+				current = &LdifRecord{DN: value, Attributes: map[string][]string{}}
+				continue
+			default:
+				return nil, fmt.Errorf("line %d: record must start with dn", l.number)
+			}
+		}
+
+		if strings.EqualFold(name, "changetype") {
+			if !strings.EqualFold(value, "add") {
+				return nil, fmt.Errorf("line %d: unsupported changetype: %s", l.number, value)
+			}
+			continue
+		}
+		current.addValue(name, value)
+	}
+	if current != nil {
+		records = append(records, current)
+	}
+
+	return records, nil
+}
+
+type ldifLine struct {
+	number int
+	text   string
+}
+
+func unfoldLdifLines(reader io.Reader) ([]ldifLine, error) {
+	scanner := bufio.NewScanner(reader)
+	var lines []ldifLine
+	number := 0
+	inComment := false
+	for scanner.Scan() {
+		number++
+		text := strings.TrimRight(scanner.Text(), "\r")
+
+		// continuation of the previous line
+		if strings.HasPrefix(text, " ") {
+			if inComment {
+				continue
+			}
+			if len(lines) == 0 || len(lines[len(lines)-1].text) == 0 {
+				return nil, fmt.Errorf("line %d: unexpected continuation line", number)
+			}
+			lines[len(lines)-1].text += text[1:]
+			continue
+		}
+
+		if strings.HasPrefix(text, "#") {
+			inComment = true
+			continue
+		}
+		inComment = false
+
+		lines = append(lines, ldifLine{number: number, text: text})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+func parseLdifLine(text string) (string, string, error) {
+	idx := strings.Index(text, ":")
+	if idx <= 0 {
+		return "", "", errors.New("missing attribute separator")
+	}
+	name := strings.TrimSpace(text[:idx])
+	rest := text[idx+1:]
+
+	switch {
+	case strings.HasPrefix(rest, ":"):
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(rest[1:]))
+		if err != nil {
+			return "", "", fmt.Errorf("invalid base64 value of %s: %w", name, err)
+		}
+		return name, string(data), nil
+	case strings.HasPrefix(rest, "<"):
+		return "", "", fmt.Errorf("url values are not supported: %s", name)
+	default:
+		return name, strings.TrimLeft(rest, " "), nil
+	}
+}
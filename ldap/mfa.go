@@ -0,0 +1,400 @@
+package ldap
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/meidomx/misc-service/config"
+	"github.com/meidomx/misc-service/pgbackend"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/jimlambrt/gldap"
+)
+
+// TOTP (RFC 6238, SHA-1, 6 digits, 30 seconds) second factor of binds. An
+// account with mfaRequired TRUE binds with its password followed by the
+// current code, e.g. secret123456 or secret+123456. The secret is stored
+// AES-GCM encrypted in totpSecret. A code is accepted once per account, the
+// last accepted time step is kept in misc_ldap_totp_steps and shared by the
+// instances.
+const (
+	attributeMfaRequired       = "mfaRequired"
+	attributeTotpSecret        = "totpSecret"
+	attributeTotpPendingSecret = "totpPendingSecret"
+
+	totpDigits = 6
+	totpPeriod = 30
+	// totpSkew is the number of time steps accepted before and after now
+	totpSkew = 1
+
+	totpSecretPrefix = "{AESGCM}"
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type mfaService struct {
+	aead   cipher.AEAD
+	issuer string
+
+	// claimStep records step as the last accepted one of the account, false
+	// when the account has accepted it or a later one already
+	claimStep func(dn string, step int64) (bool, error)
+}
+
+type MfaConfirmRequest struct {
+	Code string `json:"code"`
+}
+
+type MfaEnrollment struct {
+	// Secret is base32 encoded for authenticator apps
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+func newMfaService(c *config.Config) (*mfaService, error) {
+	key, err := base64.StdEncoding.DecodeString(c.LDAP.MFA.EncryptionKey)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("ldap.mfa.encryption_key has to be 32 bytes base64 encoded")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	issuer := c.LDAP.MFA.Issuer
+	if len(issuer) == 0 {
+		issuer = "misc-service"
+	}
+	return &mfaService{
+		aead:      aead,
+		issuer:    issuer,
+		claimStep: claimTotpStep,
+	}, nil
+}
+
+// checkCredentials checks the password of the entry, and the totp code
+// following it when the entry requires mfa
+func (this *ldapServer) checkCredentials(entry *gldap.Entry, password gldap.Password) bool {
+	const op = "ldap.(Directory).checkCredentials"
+
+	if this.mfa == nil || !isMfaRequired(entry) {
+		return checkPassword(entry, password)
+	}
+	if len(EntryAttributeValues(entry, attributeTotpSecret)) == 0 {
+		log.Println("mfa required without enrolled totp", "op", op, "DN", entry.DN)
+		return false
+	}
+	return this.mfa.checkPasswordAndCode(entry, string(password))
+}
+
+func isMfaRequired(entry *gldap.Entry) bool {
+	values := EntryAttributeValues(entry, attributeMfaRequired)
+	return len(values) > 0 && strings.EqualFold(values[0], "TRUE")
+}
+
+func (this *mfaService) checkPasswordAndCode(entry *gldap.Entry, password string) bool {
+	const op = "ldap.(Directory).checkTotp"
+
+	if len(password) <= totpDigits {
+		return false
+	}
+	code := password[len(password)-totpDigits:]
+	password = password[:len(password)-totpDigits]
+	if !checkPassword(entry, gldap.Password(password)) {
+		if !strings.HasSuffix(password, "+") || !checkPassword(entry, gldap.Password(strings.TrimSuffix(password, "+"))) {
+			return false
+		}
+	}
+	secret, err := this.decrypt(EntryAttributeValues(entry, attributeTotpSecret)[0])
+	if err != nil {
+		log.Println("decrypt totp secret error", "op", op, "DN", entry.DN, "err", err)
+		return false
+	}
+	return this.verify(entry.DN, secret, code)
+}
+
+// verify accepts a code of the time steps around now which is newer than
+// the last code accepted for the account
+func (this *mfaService) verify(dn string, secret []byte, code string) bool {
+	const op = "ldap.(Directory).verifyTotp"
+
+	now := time.Now().Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if !hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			continue
+		}
+		claimed, err := this.claimStep(NormalizeDN(dn), step)
+		if err != nil {
+			log.Println("claim totp step error", "op", op, "DN", dn, "err", err)
+			return false
+		}
+		if claimed {
+			return true
+		}
+	}
+	return false
+}
+
+// claimTotpStep updates the last step of the account only when it is later,
+// so concurrent binds with the same code can't both succeed
+func claimTotpStep(dn string, step int64) (bool, error) {
+	var claimed int64
+	_, err := pgbackend.RunQuery(ServiceName, &claimed, func(conn *pgxpool.Conn, result *int64) error {
+		tag, err := conn.Exec(context.Background(), `
+insert into misc_ldap_totp_steps (dn, last_step, time_updated)
+values ($1, $2, $3)
+on conflict (dn) do update
+    set last_step    = excluded.last_step,
+        time_updated = excluded.time_updated
+where misc_ldap_totp_steps.last_step < excluded.last_step`,
+			dn, step, time.Now().UnixMilli())
+		if err != nil {
+			return err
+		}
+		*result = tag.RowsAffected()
+		return nil
+	})
+	return claimed > 0, err
+}
+
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+func (this *mfaService) encrypt(secret []byte) (string, error) {
+	nonce := make([]byte, this.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := this.aead.Seal(nonce, nonce, secret, nil)
+	return totpSecretPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (this *mfaService) decrypt(value string) ([]byte, error) {
+	if !strings.HasPrefix(value, totpSecretPrefix) {
+		return nil, errors.New("totp secret is not encrypted")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(value[len(totpSecretPrefix):])
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < this.aead.NonceSize() {
+		return nil, errors.New("totp secret is too short")
+	}
+	n := this.aead.NonceSize()
+	return this.aead.Open(nil, sealed[:n], sealed[n:], nil)
+}
+
+// InitMfa adds the totp enrollment of the authenticated user. Accounts
+// without an enrolled secret authenticate with their password only, so
+// they can enroll even when mfa is required.
+func InitMfa(engine *gin.Engine, server *ldapServer, throttle *bindThrottle) {
+	g := engine.Group("/ldap/mfa", MfaAuth(server, throttle))
+	g.POST("/totp", EnrollTotp(server))
+	g.POST("/totp/confirm", ConfirmTotp(server))
+	g.DELETE("/totp", RemoveTotp(server))
+}
+
+// MfaAuth is RestAuth with the password only check for accounts without totp
+func MfaAuth(server *ldapServer, throttle *bindThrottle) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		name, password, ok := ctx.Request.BasicAuth()
+		if !ok || len(name) == 0 || len(password) == 0 {
+			ctx.Header("WWW-Authenticate", `Basic realm="ldap"`)
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, ResponseErr("4010", "authentication required"))
+			return
+		}
+		ip := ctx.ClientIP()
+		key := throttle.Key(name)
+		if !throttle.Allowed(ip, key) {
+			ctx.AbortWithStatusJSON(http.StatusTooManyRequests, ResponseErr("4290", "too many failed binds, try again later"))
+			return
+		}
+		dn := server.resolveBind(name, func(entry *gldap.Entry) bool {
+			if len(EntryAttributeValues(entry, attributeTotpSecret)) == 0 {
+				return checkPassword(entry, gldap.Password(password))
+			}
+			return server.mfa.checkPasswordAndCode(entry, password)
+		})
+		if len(dn) == 0 {
+			throttle.Failed(ip, key)
+			ctx.Header("WWW-Authenticate", `Basic realm="ldap"`)
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, ResponseErr("4010", "invalid credentials"))
+			return
+		}
+		throttle.Succeeded(ip, key)
+		ctx.Set(restBoundDNKey, dn)
+		ctx.Next()
+	}
+}
+
+// EnrollTotp creates a new secret, which replaces the enrolled one once it
+// is confirmed with a code
+func EnrollTotp(server *ldapServer) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		const op = "ldap.(Directory).enrollTotp"
+
+		secret := make([]byte, 20)
+		if _, err := rand.Read(secret); err != nil {
+			log.Println("generate totp secret error", "op", op, "err", err)
+			ctx.JSON(http.StatusInternalServerError, ResponseErr("5000", "internal error"))
+			return
+		}
+		encrypted, err := server.mfa.encrypt(secret)
+		if err != nil {
+			log.Println("encrypt totp secret error", "op", op, "err", err)
+			ctx.JSON(http.StatusInternalServerError, ResponseErr("5000", "internal error"))
+			return
+		}
+		dn := restBoundDN(ctx)
+		entry, ok := findMfaEntry(ctx, server, dn)
+		if !ok {
+			return
+		}
+		res := newRestResult()
+		server.modifyEntry(dn, dn, []gldap.Change{setAttributeChange(entry, attributeTotpPendingSecret, encrypted)}, res)
+		if res.Code != gldap.ResultSuccess {
+			writeRestResult(ctx, res)
+			return
+		}
+
+		name, _, _ := ctx.Request.BasicAuth()
+		encoded := base32NoPadding.EncodeToString(secret)
+		query := url.Values{
+			"secret":    {encoded},
+			"issuer":    {server.mfa.issuer},
+			"algorithm": {"SHA1"},
+			"digits":    {fmt.Sprint(totpDigits)},
+			"period":    {fmt.Sprint(totpPeriod)},
+		}
+		uri := "otpauth://totp/" + url.PathEscape(server.mfa.issuer+":"+name) + "?" + query.Encode()
+		ctx.JSON(http.StatusOK, ResponseBody(&MfaEnrollment{Secret: encoded, URI: uri}))
+	}
+}
+
+// ConfirmTotp enrolls the pending secret when the code matches it
+func ConfirmTotp(server *ldapServer) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		const op = "ldap.(Directory).confirmTotp"
+
+		req := new(MfaConfirmRequest)
+		if err := ctx.ShouldBindJSON(req); err != nil {
+			ctx.JSON(http.StatusBadRequest, ResponseErr("4000", "invalid request body"))
+			return
+		}
+		dn := restBoundDN(ctx)
+		entry, ok := findMfaEntry(ctx, server, dn)
+		if !ok {
+			return
+		}
+		pending := EntryAttributeValues(entry, attributeTotpPendingSecret)
+		if len(pending) == 0 {
+			ctx.JSON(http.StatusConflict, ResponseErr("4090", "no pending totp enrollment"))
+			return
+		}
+		secret, err := server.mfa.decrypt(pending[0])
+		if err != nil {
+			log.Println("decrypt totp secret error", "op", op, "err", err)
+			ctx.JSON(http.StatusInternalServerError, ResponseErr("5000", "internal error"))
+			return
+		}
+		if !server.mfa.verify(entry.DN, secret, req.Code) {
+			ctx.JSON(http.StatusUnprocessableEntity, ResponseErr("4220", "invalid code"))
+			return
+		}
+
+		res := newRestResult()
+		server.modifyEntry(dn, dn, []gldap.Change{
+			setAttributeChange(entry, attributeTotpSecret, pending[0]),
+			{Operation: int64(gldap.DeleteAttribute), Modification: gldap.PartialAttribute{Type: attributeTotpPendingSecret}},
+		}, res)
+		if res.Code != gldap.ResultSuccess {
+			writeRestResult(ctx, res)
+			return
+		}
+		log.Println("enrolled totp", "op", op, "DN", dn)
+		ctx.JSON(http.StatusOK, ResponseOk())
+	}
+}
+
+// RemoveTotp removes the enrolled secret unless the account requires mfa
+func RemoveTotp(server *ldapServer) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		dn := restBoundDN(ctx)
+		entry, ok := findMfaEntry(ctx, server, dn)
+		if !ok {
+			return
+		}
+		if isMfaRequired(entry) {
+			ctx.JSON(http.StatusForbidden, ResponseErr("4030", "mfa is required for the account"))
+			return
+		}
+		var changes []gldap.Change
+		for _, attr := range []string{attributeTotpSecret, attributeTotpPendingSecret} {
+			if len(EntryAttributeValues(entry, attr)) > 0 {
+				changes = append(changes, gldap.Change{Operation: int64(gldap.DeleteAttribute), Modification: gldap.PartialAttribute{Type: attr}})
+			}
+		}
+		if len(changes) == 0 {
+			ctx.JSON(http.StatusOK, ResponseOk())
+			return
+		}
+		res := newRestResult()
+		server.modifyEntry(dn, dn, changes, res)
+		writeRestResult(ctx, res)
+	}
+}
+
+func findMfaEntry(ctx *gin.Context, server *ldapServer, dn string) (*gldap.Entry, bool) {
+	const op = "ldap.(Directory).findMfaEntry"
+
+	entry, err := server.backend.FindOneEntry(dn)
+	if err != nil {
+		log.Println("FindOneEntry error", "op", op, "err", err)
+		ctx.JSON(http.StatusInternalServerError, ResponseErr("5000", "internal error"))
+		return nil, false
+	}
+	if len(entry.DN) == 0 {
+		ctx.JSON(http.StatusNotFound, ResponseErr("4040", "no such entry"))
+		return nil, false
+	}
+	return entry, true
+}
+
+// setAttributeChange replaces the values of an attribute of the entry, or
+// adds it when missing since a replace of a missing attribute is ignored
+func setAttributeChange(entry *gldap.Entry, name string, values ...string) gldap.Change {
+	operation := gldap.AddAttribute
+	if len(EntryAttributeValues(entry, name)) > 0 {
+		operation = gldap.ReplaceAttribute
+	}
+	return gldap.Change{
+		Operation:    int64(operation),
+		Modification: gldap.PartialAttribute{Type: name, Vals: values},
+	}
+}
@@ -0,0 +1,31 @@
+package ldap
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTotpReplay(t *testing.T) {
+	lastSteps := map[string]int64{}
+	mfa := &mfaService{
+		claimStep: func(dn string, step int64) (bool, error) {
+			if step <= lastSteps[dn] {
+				return false, nil
+			}
+			lastSteps[dn] = step
+			return true, nil
+		},
+	}
+	secret := []byte("12345678901234567890")
+	code := totpCode(secret, time.Now().Unix()/totpPeriod)
+
+	if !mfa.verify("cn=alice,dc=example", secret, code) {
+		t.Fatal("current code rejected")
+	}
+	if mfa.verify("CN=Alice,DC=example", secret, code) {
+		t.Error("code accepted twice")
+	}
+	if !mfa.verify("cn=bob,dc=example", secret, code) {
+		t.Error("code of another account rejected")
+	}
+}
@@ -0,0 +1,166 @@
+package ldap
+
+import (
+	"strings"
+
+	"github.com/jimlambrt/gldap"
+)
+
+// Rename (ModifyDN) of entries. gldap doesn't route ModifyDN requests, so it
+// is only available to the http gateway.
+//
+// The store keys entries by their DN, a rename therefore moves the entry and
+// each entry of its subtree to the new DN in place, keeping their ids. Only
+// the renamed entry is recorded in the changelog.
+
+// renameEntry moves the entry at dn to newRDN below newSuperior, or below its
+// current parent when newSuperior is empty, and sets the result on res
+func (this *ldapServer) renameEntry(boundDN, dn, newRDN string, deleteOldRDN bool, newSuperior string, res resultSetter) {
+	this.commitOps([]*txnOp{{
+		Kind:         ChangeTypeModRDN,
+		DN:           dn,
+		BoundDN:      boundDN,
+		NewRDN:       newRDN,
+		DeleteOldRDN: deleteOldRDN,
+		NewSuperior:  newSuperior,
+	}}, res)
+}
+
+func (this *ldapServer) moveEntry(tx DirectoryBackend, entry *gldap.Entry, op *txnOp) error {
+	newAVAs, ok := parseRDN(op.NewRDN)
+	if !ok || strings.Contains(op.NewRDN, ",") {
+		return &txnError{MessageId: op.MessageId, Code: gldap.ResultInvalidDNSyntax, Message: "invalid rdn: " + op.NewRDN}
+	}
+	levels := SplitDN(entry.DN)
+	parent := CombineParentDN(levels)
+	if len(op.NewSuperior) > 0 {
+		superior, err := tx.FindOneEntry(op.NewSuperior)
+		if err != nil {
+			return err
+		}
+		if len(superior.DN) <= 0 {
+			return &txnError{MessageId: op.MessageId, Code: gldap.ResultNoSuchObject, Message: "no such entry: " + op.NewSuperior}
+		}
+		if IsDNInScope(superior.DN, entry.DN, gldap.WholeSubtree) {
+			return &txnError{MessageId: op.MessageId, Code: gldap.ResultUnwillingToPerform, Message: "new superior is below the entry"}
+		}
+		parent = superior.DN
+	}
+	newDN := strings.TrimSpace(op.NewRDN)
+	if len(parent) > 0 {
+		newDN = newDN + "," + parent
+	}
+	if NormalizeDN(newDN) != NormalizeDN(entry.DN) {
+		existing, err := tx.FindOneEntry(newDN)
+		if err != nil {
+			return err
+		}
+		if len(existing.DN) > 0 {
+			return &txnError{MessageId: op.MessageId, Code: gldap.ResultEntryAlreadyExists, Message: "entry exists for DN: " + newDN}
+		}
+	}
+
+	var subtree []*gldap.Entry
+	if err := WalkSubtree(tx, entry.DN, func(e *gldap.Entry) bool {
+		subtree = append(subtree, e)
+		return true
+	}); err != nil {
+		return err
+	}
+	// parents are walked first, so each entry is moved below its moved parent
+	newLevels := SplitDN(newDN)
+	for i, e := range subtree {
+		oldDN := e.DN
+		var change *ChangeRecord
+		if i == 0 {
+			oldAVAs, _ := parseRDN(levels[0])
+			setRDNAttributes(e, oldAVAs, newAVAs, op.DeleteOldRDN)
+			change = NewModRDNChange(op.BoundDN, entry.DN, op.NewRDN, op.DeleteOldRDN, op.NewSuperior)
+		}
+		// keep the levels below the renamed entry
+		eLevels := SplitDN(e.DN)
+		e.DN = CombineDN(append(eLevels[:len(eLevels)-len(levels):len(eLevels)-len(levels)], newLevels...))
+		if err := tx.MoveEntry(oldDN, e, change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseRDN splits a (multi-valued) RDN into its attribute value assertions
+func parseRDN(rdn string) ([][2]string, bool) {
+	var avas [][2]string
+	for _, ava := range strings.Split(rdn, "+") {
+		kv := strings.SplitN(ava, "=", 2)
+		if len(kv) != 2 {
+			return nil, false
+		}
+		name, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if len(name) == 0 || len(value) == 0 {
+			return nil, false
+		}
+		avas = append(avas, [2]string{name, value})
+	}
+	return avas, true
+}
+
+// setRDNAttributes adds the values of the new RDN to the entry and removes the
+// values of the old one when deleteOld is set
+func setRDNAttributes(entry *gldap.Entry, oldAVAs, newAVAs [][2]string, deleteOld bool) {
+	var changes []gldap.Change
+	if deleteOld {
+		for _, ava := range oldAVAs {
+			name := attributeName(entry, ava[0])
+			remaining := withoutValue(EntryAttributeValues(entry, name), ava[1])
+			operation := int64(gldap.ReplaceAttribute)
+			if len(remaining) == 0 {
+				operation = gldap.DeleteAttribute
+			}
+			changes = append(changes, gldap.Change{
+				Operation:    operation,
+				Modification: gldap.PartialAttribute{Type: name, Vals: remaining},
+			})
+		}
+	}
+	applyChanges(entry, changes)
+	changes = nil
+	for _, ava := range newAVAs {
+		if containsFold(EntryAttributeValues(entry, ava[0]), ava[1]) {
+			continue
+		}
+		changes = append(changes, gldap.Change{
+			Operation:    gldap.AddAttribute,
+			Modification: gldap.PartialAttribute{Type: attributeName(entry, ava[0]), Vals: []string{ava[1]}},
+		})
+	}
+	applyChanges(entry, changes)
+}
+
+// attributeName returns the name the entry uses for the attribute
+func attributeName(entry *gldap.Entry, name string) string {
+	for _, a := range entry.Attributes {
+		if strings.EqualFold(a.Name, name) {
+			return a.Name
+		}
+	}
+	return name
+}
+
+func withoutValue(values []string, value string) []string {
+	var r []string
+	for _, v := range values {
+		if !strings.EqualFold(v, value) {
+			r = append(r, v)
+		}
+	}
+	return r
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package ldap
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jimlambrt/gldap"
+)
+
+const (
+	notifyRetryInterval  = 3 * time.Second
+	notifySubscriberSize = 256
+)
+
+// EntryNotification is published by the backend after every committed write.
+// Entry is the old entry of deletes. With PostgreSQL an old entry not fitting
+// into the notification payload is kept in misc_ldap_deleted_entries for a
+// while, EntryId refers to it.
+type EntryNotification struct {
+	Op      string       `json:"op"`
+	DN      string       `json:"dn"`
+	Entry   *gldap.Entry `json:"entry,omitempty"`
+	EntryId string       `json:"entry_id,omitempty"`
+}
+
+// ChangeNotifier fans out the write notifications of the backend to
+// subscribers. With PostgreSQL they are received through LISTEN/NOTIFY, so
+// writes from every misc-service instance are observed.
+type ChangeNotifier struct {
+	backend DirectoryBackend
+
+	lock        sync.Mutex
+	subscribers map[int]chan *EntryNotification
+	nextId      int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewChangeNotifier(backend DirectoryBackend) *ChangeNotifier {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ChangeNotifier{
+		backend:     backend,
+		subscribers: map[int]chan *EntryNotification{},
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+func (this *ChangeNotifier) Start() {
+	go func() {
+		for {
+			err := this.backend.Listen(this.ctx, this.dispatch)
+			if this.ctx.Err() != nil {
+				return
+			}
+			log.Println("listen entry notification error, retrying:", err)
+			select {
+			case <-this.ctx.Done():
+				return
+			case <-time.After(notifyRetryInterval):
+			}
+		}
+	}()
+}
+
+func (this *ChangeNotifier) dispatch(n *EntryNotification) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for id, ch := range this.subscribers {
+		select {
+		case ch <- n:
+		default:
+			// a subscriber which can't keep up is dropped instead of blocking everyone
+			log.Println("entry notification subscriber overflow, dropping:", id)
+			close(ch)
+			delete(this.subscribers, id)
+		}
+	}
+}
+
+// Subscribe returns a channel of notifications. The channel is closed when the
+// subscriber falls behind or the notifier is closed.
+func (this *ChangeNotifier) Subscribe() (int, <-chan *EntryNotification) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	ch := make(chan *EntryNotification, notifySubscriberSize)
+	if this.ctx.Err() != nil {
+		close(ch)
+		return 0, ch
+	}
+	this.nextId++
+	this.subscribers[this.nextId] = ch
+	return this.nextId, ch
+}
+
+func (this *ChangeNotifier) Unsubscribe(id int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if ch, ok := this.subscribers[id]; ok {
+		close(ch)
+		delete(this.subscribers, id)
+	}
+}
+
+func (this *ChangeNotifier) Closed() bool {
+	return this.ctx.Err() != nil
+}
+
+func (this *ChangeNotifier) Close() error {
+	this.cancel()
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for id, ch := range this.subscribers {
+		close(ch)
+		delete(this.subscribers, id)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package ldap
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/jimlambrt/gldap"
+)
+
+const (
+	oidcScopeOpenId        = "openid"
+	oidcScopeProfile       = "profile"
+	oidcScopeEmail         = "email"
+	oidcScopePhone         = "phone"
+	oidcScopeGroups        = "groups"
+	oidcScopeOfflineAccess = "offline_access"
+
+	oidcClaimGroups = "groups"
+
+	attributeMemberOf = "memberOf"
+)
+
+var (
+	// oidcDefaultClaims maps the standard claims to directory attributes,
+	// ldap.oidc.claims adds to or replaces them
+	oidcDefaultClaims = map[string]string{
+		"name":               "cn",
+		"given_name":         "givenName",
+		"family_name":        "sn",
+		"preferred_username": "uid",
+		"locale":             "preferredLanguage",
+		"email":              "mail",
+		"phone_number":       "telephoneNumber",
+	}
+	// oidcClaimScopes are the scopes requesting the standard claims, other
+	// claims come with the profile scope
+	oidcClaimScopes = map[string]string{
+		"email":        oidcScopeEmail,
+		"phone_number": oidcScopePhone,
+	}
+	oidcSingleClaims = map[string]bool{
+		"name": true, "given_name": true, "family_name": true, "middle_name": true, "nickname": true,
+		"preferred_username": true, "profile": true, "picture": true, "website": true, "gender": true,
+		"birthdate": true, "zoneinfo": true, "locale": true, "email": true, "phone_number": true,
+	}
+	oidcScopes = []string{oidcScopeOpenId, oidcScopeProfile, oidcScopeEmail, oidcScopePhone, oidcScopeGroups, oidcScopeOfflineAccess}
+)
+
+func newOidcClaimMapping(claims map[string]string) map[string]string {
+	m := map[string]string{}
+	for k, v := range oidcDefaultClaims {
+		m[k] = v
+	}
+	for k, v := range claims {
+		if len(v) == 0 {
+			delete(m, k)
+		} else {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+func oidcClaimScope(claim string) string {
+	if scope, ok := oidcClaimScopes[claim]; ok {
+		return scope
+	}
+	return oidcScopeProfile
+}
+
+// userClaims returns the claims of the user entry granted by the scopes.
+// Attributes with several values become arrays, except for the standard
+// claims which are single strings.
+func (this *oidcService) userClaims(entry *gldap.Entry, scope []string) map[string]interface{} {
+	claims := map[string]interface{}{"sub": entry.DN}
+	for claim, attr := range this.claims {
+		if !containsScope(scope, oidcClaimScope(claim)) {
+			continue
+		}
+		values := EntryAttributeValues(entry, attr)
+		switch {
+		case len(values) == 0:
+		case len(values) == 1 || oidcSingleClaims[claim]:
+			claims[claim] = values[0]
+		default:
+			claims[claim] = values
+		}
+	}
+	if containsScope(scope, oidcScopeGroups) {
+		claims[oidcClaimGroups] = this.userGroups(entry)
+	}
+	return claims
+}
+
+// userGroups returns the cn of the groups of the user, see findMemberGroups.
+// Without groups_base_dn the memberOf values of the entry are used.
+func (this *oidcService) userGroups(entry *gldap.Entry) []string {
+	groups := []string{}
+	if len(this.groupsBaseDN) == 0 {
+		return append(groups, EntryAttributeValues(entry, attributeMemberOf)...)
+	}
+	for _, group := range findMemberGroups(this.server.backend, this.groupsBaseDN, entry.DN) {
+		if cn := EntryAttributeValues(group, "cn"); len(cn) > 0 {
+			groups = append(groups, cn[0])
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// claimsSupported lists the claims for the discovery document
+func (this *oidcService) claimsSupported() []string {
+	claims := []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", oidcClaimGroups}
+	for claim := range this.claims {
+		claims = append(claims, claim)
+	}
+	sort.Strings(claims[len(claims)-len(this.claims):])
+	return claims
+}
+
+func parseOidcScope(scope string) []string {
+	var scopes []string
+	for _, s := range strings.Fields(scope) {
+		if !containsScope(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+// containsScope compares case-sensitively as scopes are
+func containsScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,612 @@
+package ldap
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/meidomx/misc-service/config"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jimlambrt/gldap"
+)
+
+// OpenID Connect provider of the directory. Users sign in on the login page
+// with a bind name and password checked like an LDAP simple bind, their
+// claims are read from the attributes of their entry. The subject is the
+// DN of the entry. There is no single sign-on session, every authorization
+// request shows the login page.
+const (
+	oidcGrantAuthorizationCode = "authorization_code"
+	oidcGrantRefreshToken      = "refresh_token"
+	oidcGrantClientCredentials = "client_credentials"
+
+	oidcCodeLifetime           = time.Minute
+	oidcDefaultAccessLifetime  = time.Hour
+	oidcDefaultRefreshLifetime = 30 * 24 * time.Hour
+	oidcDefaultKeyRotation     = 24 * time.Hour
+
+	oidcChallengePlain = "plain"
+	oidcChallengeS256  = "S256"
+)
+
+type oidcService struct {
+	server   *ldapServer
+	throttle *bindThrottle
+	keys     *oidcKeySet
+	grants   *oidcGrants
+
+	issuer          string
+	accessLifetime  time.Duration
+	refreshLifetime time.Duration
+	clients         map[string]*config.OidcClient
+	claims          map[string]string
+	groupsBaseDN    string
+}
+
+// oidcError is an OAuth 2.0 error response
+type oidcError struct {
+	Status      int
+	Code        string
+	Description string
+}
+
+func (this *oidcError) Error() string {
+	return this.Description
+}
+
+func newOidcError(code, description string) *oidcError {
+	return &oidcError{Status: http.StatusBadRequest, Code: code, Description: description}
+}
+
+// oidcAuthRequest holds the parameters of an authorization request, they
+// are carried through the login form
+type oidcAuthRequest struct {
+	ClientId            string
+	RedirectURI         string
+	ResponseType        string
+	Scope               string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	LoginHint           string
+
+	Error    string
+	Username string
+}
+
+var oidcLoginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Sign in</title></head>
+<body>
+<form method="post">
+<h1>Sign in to {{.ClientId}}</h1>
+{{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+<p><label>User name <input name="username" value="{{.Username}}" autocomplete="username" required autofocus></label></p>
+<p><label>Password <input name="password" type="password" autocomplete="current-password" required></label></p>
+<input type="hidden" name="client_id" value="{{.ClientId}}">
+<input type="hidden" name="redirect_uri" value="{{.RedirectURI}}">
+<input type="hidden" name="response_type" value="{{.ResponseType}}">
+<input type="hidden" name="scope" value="{{.Scope}}">
+<input type="hidden" name="state" value="{{.State}}">
+<input type="hidden" name="nonce" value="{{.Nonce}}">
+<input type="hidden" name="code_challenge" value="{{.CodeChallenge}}">
+<input type="hidden" name="code_challenge_method" value="{{.CodeChallengeMethod}}">
+<p><button type="submit">Sign in</button></p>
+</form>
+</body>
+</html>
+`))
+
+func InitOidc(engine *gin.Engine, c *config.Config, server *ldapServer, throttle *bindThrottle, keys *oidcKeySet) {
+	issuer, err := url.Parse(c.LDAP.OIDC.Issuer)
+	if err != nil || len(issuer.Scheme) == 0 || len(issuer.Host) == 0 || len(issuer.RawQuery) > 0 || len(issuer.Fragment) > 0 {
+		log.Fatalf("oidc requires ldap.oidc.issuer to be an absolute url without query")
+	}
+	this := &oidcService{
+		server:          server,
+		throttle:        throttle,
+		keys:            keys,
+		grants:          newOidcGrants(),
+		issuer:          strings.TrimSuffix(c.LDAP.OIDC.Issuer, "/"),
+		accessLifetime:  oidcAccessLifetime(c),
+		refreshLifetime: oidcDefaultRefreshLifetime,
+		clients:         map[string]*config.OidcClient{},
+		claims:          newOidcClaimMapping(c.LDAP.OIDC.Claims),
+		groupsBaseDN:    c.LDAP.OIDC.GroupsBaseDN,
+	}
+	if c.LDAP.OIDC.RefreshTokenSeconds > 0 {
+		this.refreshLifetime = time.Duration(c.LDAP.OIDC.RefreshTokenSeconds) * time.Second
+	}
+	for i := range c.LDAP.OIDC.Clients {
+		client := &c.LDAP.OIDC.Clients[i]
+		if len(client.ClientId) == 0 || this.clients[client.ClientId] != nil {
+			log.Fatalf("oidc client without or with duplicate client_id: %s", client.ClientId)
+		}
+		if len(client.GrantTypes) == 0 {
+			client.GrantTypes = []string{oidcGrantAuthorizationCode, oidcGrantRefreshToken}
+		}
+		this.clients[client.ClientId] = client
+	}
+
+	// endpoints are below the path of the issuer
+	prefix := strings.TrimSuffix(issuer.Path, "/")
+	engine.GET(prefix+"/.well-known/openid-configuration", this.Discovery)
+	g := engine.Group(prefix + "/oidc")
+	g.GET("/jwks", this.Keys)
+	g.GET("/authorize", this.AuthorizeForm)
+	g.POST("/authorize", this.Authorize)
+	g.POST("/token", this.Token)
+	g.GET("/userinfo", this.UserInfo)
+	g.POST("/userinfo", this.UserInfo)
+}
+
+// oidcAccessLifetime is the lifetime of access and id tokens, keys are kept
+// as long after their rotation
+func oidcAccessLifetime(c *config.Config) time.Duration {
+	if c.LDAP.OIDC.AccessTokenSeconds > 0 {
+		return time.Duration(c.LDAP.OIDC.AccessTokenSeconds) * time.Second
+	}
+	return oidcDefaultAccessLifetime
+}
+
+func oidcKeyRotation(c *config.Config) time.Duration {
+	if c.LDAP.OIDC.KeyRotationHours > 0 {
+		return time.Duration(c.LDAP.OIDC.KeyRotationHours) * time.Hour
+	}
+	return oidcDefaultKeyRotation
+}
+
+func (this *oidcService) Discovery(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, map[string]interface{}{
+		"issuer":                                         this.issuer,
+		"authorization_endpoint":                         this.issuer + "/oidc/authorize",
+		"token_endpoint":                                 this.issuer + "/oidc/token",
+		"userinfo_endpoint":                              this.issuer + "/oidc/userinfo",
+		"jwks_uri":                                       this.issuer + "/oidc/jwks",
+		"scopes_supported":                               oidcScopes,
+		"response_types_supported":                       []string{"code"},
+		"response_modes_supported":                       []string{"query"},
+		"grant_types_supported":                          []string{oidcGrantAuthorizationCode, oidcGrantRefreshToken, oidcGrantClientCredentials},
+		"subject_types_supported":                        []string{"public"},
+		"id_token_signing_alg_values_supported":          []string{"RS256"},
+		"token_endpoint_auth_methods_supported":          []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":               []string{oidcChallengeS256, oidcChallengePlain},
+		"authorization_response_iss_parameter_supported": true,
+		"claims_supported":                               this.claimsSupported(),
+	})
+}
+
+func (this *oidcService) Keys(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, this.keys.JWKS())
+}
+
+// AuthorizeForm shows the login page of an authorization request
+func (this *oidcService) AuthorizeForm(ctx *gin.Context) {
+	r := readOidcAuthRequest(ctx.Query)
+	client := this.checkAuthRequest(ctx, r)
+	if client == nil {
+		return
+	}
+	if ctx.Query("prompt") == "none" {
+		this.redirectAuthError(ctx, r, newOidcError("login_required", "the user has to sign in"))
+		return
+	}
+	r.Username = r.LoginHint
+	this.writeLoginPage(ctx, http.StatusOK, r)
+}
+
+// Authorize signs the user in with the login form and redirects with the
+// authorization code
+func (this *oidcService) Authorize(ctx *gin.Context) {
+	const op = "ldap.(Directory).oidcAuthorize"
+
+	r := readOidcAuthRequest(ctx.PostForm)
+	client := this.checkAuthRequest(ctx, r)
+	if client == nil {
+		return
+	}
+	r.Username = ctx.PostForm("username")
+	password := ctx.PostForm("password")
+	if len(r.Username) == 0 || len(password) == 0 {
+		r.Error = "User name and password are required."
+		this.writeLoginPage(ctx, http.StatusBadRequest, r)
+		return
+	}
+	ip := ctx.ClientIP()
+	key := this.throttle.Key(r.Username)
+	if !this.throttle.Allowed(ip, key) {
+		r.Error = "Too many failed sign-ins, try again later."
+		this.writeLoginPage(ctx, http.StatusTooManyRequests, r)
+		return
+	}
+	dn := this.server.authenticate(r.Username, gldap.Password(password))
+	if len(dn) == 0 {
+		this.throttle.Failed(ip, key)
+		r.Error = "Invalid user name or password."
+		this.writeLoginPage(ctx, http.StatusUnauthorized, r)
+		return
+	}
+	this.throttle.Succeeded(ip, key)
+
+	code, err := this.grants.NewCode(&oidcGrant{
+		ClientId:        client.ClientId,
+		DN:              dn,
+		Scope:           parseOidcScope(r.Scope),
+		AuthTime:        time.Now(),
+		Expires:         time.Now().Add(oidcCodeLifetime),
+		RedirectURI:     r.RedirectURI,
+		Nonce:           r.Nonce,
+		Challenge:       r.CodeChallenge,
+		ChallengeMethod: r.CodeChallengeMethod,
+	})
+	if err != nil {
+		log.Println("create authorization code error", "op", op, "err", err)
+		this.redirectAuthError(ctx, r, newOidcError("server_error", "unable to create the authorization code"))
+		return
+	}
+	log.Println("oidc sign in", "op", op, "DN", dn, "client", client.ClientId)
+	this.redirectAuth(ctx, r, url.Values{"code": {code}})
+}
+
+func readOidcAuthRequest(param func(key string) string) *oidcAuthRequest {
+	return &oidcAuthRequest{
+		ClientId:            param("client_id"),
+		RedirectURI:         param("redirect_uri"),
+		ResponseType:        param("response_type"),
+		Scope:               param("scope"),
+		State:               param("state"),
+		Nonce:               param("nonce"),
+		CodeChallenge:       param("code_challenge"),
+		CodeChallengeMethod: param("code_challenge_method"),
+		LoginHint:           param("login_hint"),
+	}
+}
+
+// checkAuthRequest returns the client of a valid request, otherwise it
+// writes the error response and returns nil. Errors before the redirect uri
+// is verified are shown to the user instead of being redirected.
+func (this *oidcService) checkAuthRequest(ctx *gin.Context, r *oidcAuthRequest) *config.OidcClient {
+	client := this.clients[r.ClientId]
+	if client == nil || !containsScope(client.RedirectURIs, r.RedirectURI) {
+		ctx.String(http.StatusBadRequest, "unknown client or redirect uri")
+		return nil
+	}
+	var err *oidcError
+	scope := parseOidcScope(r.Scope)
+	switch {
+	case r.ResponseType != "code":
+		err = newOidcError("unsupported_response_type", "only the code response type is supported")
+	case !containsScope(client.GrantTypes, oidcGrantAuthorizationCode):
+		err = newOidcError("unauthorized_client", "the client may not use the authorization code grant")
+	case !this.allowedScope(client, scope):
+		err = newOidcError("invalid_scope", "scope not allowed for the client")
+	case len(client.ClientSecret) == 0 && len(r.CodeChallenge) == 0:
+		err = newOidcError("invalid_request", "public clients have to use PKCE")
+	case len(r.CodeChallenge) > 0 && len(r.CodeChallengeMethod) == 0:
+		r.CodeChallengeMethod = oidcChallengePlain
+	case len(r.CodeChallenge) > 0 && r.CodeChallengeMethod != oidcChallengePlain && r.CodeChallengeMethod != oidcChallengeS256:
+		err = newOidcError("invalid_request", "unsupported code challenge method")
+	}
+	if err != nil {
+		this.redirectAuthError(ctx, r, err)
+		return nil
+	}
+	return client
+}
+
+func (this *oidcService) allowedScope(client *config.OidcClient, scope []string) bool {
+	if len(client.Scopes) == 0 {
+		return true
+	}
+	for _, s := range scope {
+		if !containsScope(client.Scopes, s) {
+			return false
+		}
+	}
+	return true
+}
+
+func (this *oidcService) writeLoginPage(ctx *gin.Context, status int, r *oidcAuthRequest) {
+	const op = "ldap.(Directory).oidcLoginPage"
+
+	ctx.Header("Cache-Control", "no-store")
+	ctx.Header("X-Frame-Options", "DENY")
+	ctx.Header("Content-Type", "text/html; charset=utf-8")
+	ctx.Status(status)
+	if err := oidcLoginPage.Execute(ctx.Writer, r); err != nil {
+		log.Println("write login page error", "op", op, "err", err)
+	}
+}
+
+func (this *oidcService) redirectAuthError(ctx *gin.Context, r *oidcAuthRequest, err *oidcError) {
+	this.redirectAuth(ctx, r, url.Values{"error": {err.Code}, "error_description": {err.Description}})
+}
+
+func (this *oidcService) redirectAuth(ctx *gin.Context, r *oidcAuthRequest, values url.Values) {
+	if len(r.State) > 0 {
+		values.Set("state", r.State)
+	}
+	values.Set("iss", this.issuer)
+	target := r.RedirectURI
+	if strings.Contains(target, "?") {
+		target += "&" + values.Encode()
+	} else {
+		target += "?" + values.Encode()
+	}
+	ctx.Header("Cache-Control", "no-store")
+	ctx.Redirect(http.StatusFound, target)
+}
+
+// Token serves the authorization_code, refresh_token and client_credentials
+// grants. Clients authenticate with basic auth or client_id and
+// client_secret form parameters, public clients with client_id only.
+func (this *oidcService) Token(ctx *gin.Context) {
+	ctx.Header("Cache-Control", "no-store")
+	ctx.Header("Pragma", "no-cache")
+
+	client, err := this.authenticateClient(ctx)
+	if err != nil {
+		writeOidcError(ctx, err)
+		return
+	}
+	grantType := ctx.PostForm("grant_type")
+	if !containsScope(client.GrantTypes, grantType) {
+		writeOidcError(ctx, newOidcError("unauthorized_client", "grant type not allowed for the client: "+grantType))
+		return
+	}
+
+	var resp map[string]interface{}
+	switch grantType {
+	case oidcGrantAuthorizationCode:
+		resp, err = this.exchangeCode(ctx, client)
+	case oidcGrantRefreshToken:
+		resp, err = this.refresh(ctx, client)
+	case oidcGrantClientCredentials:
+		resp, err = this.clientCredentials(ctx, client)
+	default:
+		err = newOidcError("unsupported_grant_type", "unsupported grant type: "+grantType)
+	}
+	if err != nil {
+		writeOidcError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+func (this *oidcService) authenticateClient(ctx *gin.Context) (*config.OidcClient, *oidcError) {
+	clientId, secret, basic := ctx.Request.BasicAuth()
+	if basic {
+		// the credentials are form encoded before basic encoding
+		var err1, err2 error
+		clientId, err1 = url.QueryUnescape(clientId)
+		secret, err2 = url.QueryUnescape(secret)
+		if err1 != nil || err2 != nil {
+			return nil, &oidcError{Status: http.StatusUnauthorized, Code: "invalid_client", Description: "invalid client credentials"}
+		}
+	} else {
+		clientId = ctx.PostForm("client_id")
+		secret = ctx.PostForm("client_secret")
+	}
+	client := this.clients[clientId]
+	if client == nil || len(client.ClientSecret) == 0 && len(secret) > 0 ||
+		subtle.ConstantTimeCompare([]byte(client.ClientSecret), []byte(secret)) != 1 {
+		if basic {
+			ctx.Header("WWW-Authenticate", `Basic realm="oidc"`)
+		}
+		return nil, &oidcError{Status: http.StatusUnauthorized, Code: "invalid_client", Description: "invalid client credentials"}
+	}
+	return client, nil
+}
+
+func (this *oidcService) exchangeCode(ctx *gin.Context, client *config.OidcClient) (map[string]interface{}, *oidcError) {
+	grant := this.grants.TakeCode(ctx.PostForm("code"))
+	if grant == nil || grant.ClientId != client.ClientId {
+		return nil, newOidcError("invalid_grant", "invalid or expired authorization code")
+	}
+	if grant.RedirectURI != ctx.PostForm("redirect_uri") {
+		return nil, newOidcError("invalid_grant", "redirect uri does not match the authorization request")
+	}
+	if len(grant.Challenge) > 0 && !verifyCodeChallenge(grant.Challenge, grant.ChallengeMethod, ctx.PostForm("code_verifier")) {
+		return nil, newOidcError("invalid_grant", "invalid code verifier")
+	}
+	return this.issueUserTokens(client, grant)
+}
+
+func verifyCodeChallenge(challenge, method, verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	if method == oidcChallengeS256 {
+		sum := sha256.Sum256([]byte(verifier))
+		verifier = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(challenge), []byte(verifier)) == 1
+}
+
+func (this *oidcService) refresh(ctx *gin.Context, client *config.OidcClient) (map[string]interface{}, *oidcError) {
+	grant := this.grants.TakeRefreshToken(ctx.PostForm("refresh_token"))
+	if grant == nil || grant.ClientId != client.ClientId {
+		return nil, newOidcError("invalid_grant", "invalid or expired refresh token")
+	}
+	// the scope may be narrowed
+	if scope := parseOidcScope(ctx.PostForm("scope")); len(scope) > 0 {
+		for _, s := range scope {
+			if !containsScope(grant.Scope, s) {
+				return nil, newOidcError("invalid_scope", "scope exceeds the granted scope")
+			}
+		}
+		grant.Scope = scope
+	}
+	grant.Nonce = ""
+	return this.issueUserTokens(client, grant)
+}
+
+func (this *oidcService) clientCredentials(ctx *gin.Context, client *config.OidcClient) (map[string]interface{}, *oidcError) {
+	const op = "ldap.(Directory).oidcClientCredentials"
+
+	if len(client.ClientSecret) == 0 {
+		return nil, newOidcError("unauthorized_client", "public clients cannot use client credentials")
+	}
+	scope := parseOidcScope(ctx.PostForm("scope"))
+	if !this.allowedScope(client, scope) || containsScope(scope, oidcScopeOpenId) {
+		return nil, newOidcError("invalid_scope", "scope not allowed for the client")
+	}
+	now := time.Now()
+	accessToken, err := this.accessToken(client.ClientId, client.ClientId, scope, now)
+	if err != nil {
+		log.Println("sign access token error", "op", op, "err", err)
+		return nil, &oidcError{Status: http.StatusInternalServerError, Code: "server_error", Description: "unable to issue the token"}
+	}
+	return map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(this.accessLifetime.Seconds()),
+		"scope":        strings.Join(scope, " "),
+	}, nil
+}
+
+// issueUserTokens creates the access token, the id token for the openid
+// scope and a refresh token when the client may use them. The entry is read
+// again, a deleted or deactivated user gets no tokens.
+func (this *oidcService) issueUserTokens(client *config.OidcClient, grant *oidcGrant) (map[string]interface{}, *oidcError) {
+	const op = "ldap.(Directory).oidcIssueTokens"
+
+	serverError := &oidcError{Status: http.StatusInternalServerError, Code: "server_error", Description: "unable to issue the tokens"}
+	entry, err := this.server.backend.FindOneEntry(grant.DN)
+	if err != nil {
+		log.Println("FindOneEntry error", "op", op, "err", err)
+		return nil, serverError
+	}
+	if len(entry.DN) == 0 {
+		return nil, newOidcError("invalid_grant", "the user no longer exists")
+	}
+	if isDeactivated(entry) {
+		return nil, newOidcError("invalid_grant", "the user is deactivated")
+	}
+
+	now := time.Now()
+	accessToken, err := this.accessToken(entry.DN, client.ClientId, grant.Scope, now)
+	if err != nil {
+		log.Println("sign access token error", "op", op, "err", err)
+		return nil, serverError
+	}
+	resp := map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(this.accessLifetime.Seconds()),
+		"scope":        strings.Join(grant.Scope, " "),
+	}
+
+	if containsScope(grant.Scope, oidcScopeOpenId) {
+		claims := this.userClaims(entry, grant.Scope)
+		claims["iss"] = this.issuer
+		claims["aud"] = client.ClientId
+		claims["azp"] = client.ClientId
+		claims["iat"] = now.Unix()
+		claims["exp"] = now.Add(this.accessLifetime).Unix()
+		claims["auth_time"] = grant.AuthTime.Unix()
+		if len(grant.Nonce) > 0 {
+			claims["nonce"] = grant.Nonce
+		}
+		sum := sha256.Sum256([]byte(accessToken))
+		claims["at_hash"] = base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+		idToken, err := this.keys.Sign(jwtTypeIdToken, claims)
+		if err != nil {
+			log.Println("sign id token error", "op", op, "err", err)
+			return nil, serverError
+		}
+		resp["id_token"] = idToken
+	}
+
+	if containsScope(client.GrantTypes, oidcGrantRefreshToken) {
+		refreshToken, err := this.grants.NewRefreshToken(&oidcGrant{
+			ClientId: client.ClientId,
+			DN:       entry.DN,
+			Scope:    grant.Scope,
+			AuthTime: grant.AuthTime,
+			Expires:  now.Add(this.refreshLifetime),
+		})
+		if err != nil {
+			log.Println("create refresh token error", "op", op, "err", err)
+			return nil, serverError
+		}
+		resp["refresh_token"] = refreshToken
+	}
+	return resp, nil
+}
+
+// accessToken is a JWT access token (RFC 9068), the subject is the DN of
+// the user or the client id for client credentials
+func (this *oidcService) accessToken(subject, clientId string, scope []string, now time.Time) (string, error) {
+	jti, err := newOidcSecret()
+	if err != nil {
+		return "", err
+	}
+	return this.keys.Sign(jwtTypeAccessToken, map[string]interface{}{
+		"iss":       this.issuer,
+		"sub":       subject,
+		"aud":       clientId,
+		"client_id": clientId,
+		"scope":     strings.Join(scope, " "),
+		"iat":       now.Unix(),
+		"exp":       now.Add(this.accessLifetime).Unix(),
+		"jti":       jti,
+	})
+}
+
+// UserInfo returns the claims of the user of a bearer access token with the
+// openid scope, read from the current entry
+func (this *oidcService) UserInfo(ctx *gin.Context) {
+	const op = "ldap.(Directory).oidcUserInfo"
+
+	ctx.Header("Cache-Control", "no-store")
+	token := strings.TrimSpace(ctx.GetHeader("Authorization"))
+	if len(token) < 7 || !strings.EqualFold(token[:7], "bearer ") {
+		ctx.Header("WWW-Authenticate", `Bearer realm="oidc"`)
+		ctx.JSON(http.StatusUnauthorized, map[string]interface{}{"error": "invalid_request", "error_description": "bearer token required"})
+		return
+	}
+	claims, err := this.keys.Verify(jwtTypeAccessToken, strings.TrimSpace(token[7:]))
+	if err != nil || claims["iss"] != this.issuer {
+		ctx.Header("WWW-Authenticate", `Bearer realm="oidc", error="invalid_token"`)
+		ctx.JSON(http.StatusUnauthorized, map[string]interface{}{"error": "invalid_token", "error_description": "invalid or expired access token"})
+		return
+	}
+	scopeClaim, _ := claims["scope"].(string)
+	scope := parseOidcScope(scopeClaim)
+	if !containsScope(scope, oidcScopeOpenId) {
+		ctx.Header("WWW-Authenticate", `Bearer realm="oidc", error="insufficient_scope"`)
+		ctx.JSON(http.StatusForbidden, map[string]interface{}{"error": "insufficient_scope", "error_description": "the openid scope is required"})
+		return
+	}
+	dn, _ := claims["sub"].(string)
+	entry, err := this.server.backend.FindOneEntry(dn)
+	if err != nil {
+		log.Println("FindOneEntry error", "op", op, "err", err)
+		ctx.JSON(http.StatusInternalServerError, map[string]interface{}{"error": "server_error"})
+		return
+	}
+	if len(entry.DN) == 0 {
+		ctx.Header("WWW-Authenticate", `Bearer realm="oidc", error="invalid_token"`)
+		ctx.JSON(http.StatusUnauthorized, map[string]interface{}{"error": "invalid_token", "error_description": "the user no longer exists"})
+		return
+	}
+	if isDeactivated(entry) {
+		ctx.Header("WWW-Authenticate", `Bearer realm="oidc", error="invalid_token"`)
+		ctx.JSON(http.StatusUnauthorized, map[string]interface{}{"error": "invalid_token", "error_description": "the user is deactivated"})
+		return
+	}
+	ctx.JSON(http.StatusOK, this.userClaims(entry, scope))
+}
+
+func writeOidcError(ctx *gin.Context, err *oidcError) {
+	ctx.JSON(err.Status, map[string]interface{}{"error": err.Code, "error_description": err.Description})
+}
@@ -0,0 +1,152 @@
+package ldap
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/meidomx/misc-service/pgbackend"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const (
+	oidcGrantTypeCode    = "code"
+	oidcGrantTypeRefresh = "refresh"
+)
+
+// oidcGrant is what an authorization code or a refresh token was issued for
+type oidcGrant struct {
+	ClientId string    `json:"client_id"`
+	DN       string    `json:"dn"`
+	Scope    []string  `json:"scope"`
+	AuthTime time.Time `json:"auth_time"`
+	Expires  time.Time `json:"expires"`
+
+	// authorization codes only
+	RedirectURI     string `json:"redirect_uri,omitempty"`
+	Nonce           string `json:"nonce,omitempty"`
+	Challenge       string `json:"challenge,omitempty"`
+	ChallengeMethod string `json:"challenge_method,omitempty"`
+}
+
+// oidcGrants keeps the authorization codes and refresh tokens in
+// misc_ldap_oidc_grants, both are used once. They are stored by their hash.
+type oidcGrants struct {
+	lock      sync.Mutex
+	lastPurge time.Time
+}
+
+func newOidcGrants() *oidcGrants {
+	return &oidcGrants{
+		lastPurge: time.Now(),
+	}
+}
+
+func newOidcSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func oidcTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (this *oidcGrants) NewCode(g *oidcGrant) (string, error) {
+	return this.add(oidcGrantTypeCode, g)
+}
+
+func (this *oidcGrants) TakeCode(code string) *oidcGrant {
+	return this.take(oidcGrantTypeCode, code)
+}
+
+func (this *oidcGrants) NewRefreshToken(g *oidcGrant) (string, error) {
+	return this.add(oidcGrantTypeRefresh, g)
+}
+
+// TakeRefreshToken removes the token, the caller issues a new one
+func (this *oidcGrants) TakeRefreshToken(token string) *oidcGrant {
+	return this.take(oidcGrantTypeRefresh, token)
+}
+
+func (this *oidcGrants) add(grantType string, g *oidcGrant) (string, error) {
+	secret, err := newOidcSecret()
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(g)
+	if err != nil {
+		return "", err
+	}
+	this.purge(time.Now())
+	if _, err := pgbackend.RunQuery(ServiceName, nil, func(conn *pgxpool.Conn, result any) error {
+		_, err := conn.Exec(context.Background(),
+			"insert into misc_ldap_oidc_grants(grant_key, grant_type, grant_data, time_expires) values($1, $2, $3, $4)",
+			oidcTokenHash(secret), grantType, data, g.Expires.UnixMilli())
+		return err
+	}); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// take deletes the grant of the secret, so a concurrent use finds none
+func (this *oidcGrants) take(grantType, secret string) *oidcGrant {
+	const op = "ldap.(Directory).takeOidcGrant"
+
+	if len(secret) == 0 {
+		return nil
+	}
+	g := new(oidcGrant)
+	if _, err := pgbackend.RunQuery(ServiceName, g, func(conn *pgxpool.Conn, result *oidcGrant) error {
+		var data []byte
+		if err := conn.QueryRow(context.Background(),
+			"delete from misc_ldap_oidc_grants where grant_key = $1 and grant_type = $2 returning grant_data",
+			oidcTokenHash(secret), grantType).Scan(&data); err != nil {
+			return err
+		}
+		return json.Unmarshal(data, result)
+	}); err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			log.Println("take oidc grant error", "op", op, "err", err)
+		}
+		return nil
+	}
+	if time.Now().After(g.Expires) {
+		return nil
+	}
+	return g
+}
+
+// purge deletes the expired grants, at most once per interval per instance
+func (this *oidcGrants) purge(now time.Time) {
+	const op = "ldap.(Directory).purgeOidcGrants"
+
+	this.lock.Lock()
+	if now.Sub(this.lastPurge) < throttlePurgeInterval {
+		this.lock.Unlock()
+		return
+	}
+	this.lastPurge = now
+	this.lock.Unlock()
+
+	if _, err := pgbackend.RunQuery(ServiceName, nil, func(conn *pgxpool.Conn, result any) error {
+		_, err := conn.Exec(context.Background(),
+			"delete from misc_ldap_oidc_grants where time_expires < $1", now.UnixMilli())
+		return err
+	}); err != nil {
+		log.Println("purge oidc grants error", "op", op, "err", err)
+	}
+}
@@ -0,0 +1,332 @@
+package ldap
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meidomx/misc-service/pgbackend"
+
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	oidcKeyBits = 2048
+	// oidcKeyRefreshInterval is how often the keys are read from the
+	// database, to pick up the keys rotated by other instances
+	oidcKeyRefreshInterval = time.Minute
+	// oidcKeyLockKey serializes the rotation of the instances
+	oidcKeyLockKey int64 = 0x6f696463 // "oidc"
+	// oidcKeyMinReload limits the reloads for unknown key ids
+	oidcKeyMinReload = 10 * time.Second
+
+	jwtTypeIdToken     = "JWT"
+	jwtTypeAccessToken = "at+jwt"
+)
+
+var errInvalidJwt = errors.New("invalid token")
+
+// oidcKeySet holds the RS256 keys signing the tokens. A new key is generated
+// every rotation interval, retired keys stay in the JWKS for the retention
+// time so tokens signed with them can still be verified. Keys are stored in
+// misc_ldap_oidc_keys and shared by the instances.
+type oidcKeySet struct {
+	rotation  time.Duration
+	retention time.Duration
+
+	lock sync.RWMutex
+	// keys has the signing key first
+	keys     []*oidcKey
+	lastLoad time.Time
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+type oidcKey struct {
+	Id      string
+	Key     *rsa.PrivateKey
+	Created time.Time
+	Retired time.Time
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+func newOidcKeySet(rotation, retention time.Duration) (*oidcKeySet, error) {
+	s := &oidcKeySet{
+		rotation:  rotation,
+		retention: retention,
+		closed:    make(chan struct{}),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func newOidcKey() (*oidcKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, oidcKeyBits)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key.N.Bytes())
+	return &oidcKey{
+		Id:      base64.RawURLEncoding.EncodeToString(sum[:12]),
+		Key:     key,
+		Created: time.Now(),
+	}, nil
+}
+
+// Start rotates and reloads the keys until Close
+func (this *oidcKeySet) Start() {
+	interval := oidcKeyRefreshInterval
+	if this.rotation < interval {
+		interval = this.rotation
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-this.closed:
+				return
+			case <-ticker.C:
+				this.rotate()
+			}
+		}
+	}()
+}
+
+func (this *oidcKeySet) Close() error {
+	this.closeOnce.Do(func() {
+		close(this.closed)
+	})
+	return nil
+}
+
+func (this *oidcKeySet) rotate() {
+	const op = "ldap.(Directory).rotateOidcKeys"
+
+	if err := this.load(); err != nil {
+		log.Println("load oidc keys error", "op", op, "err", err)
+	}
+}
+
+// load generates a signing key when there is none or it is due for rotation,
+// drops the keys retired for longer than the retention and reads the others
+func (this *oidcKeySet) load() error {
+	const op = "ldap.(Directory).loadOidcKeys"
+
+	var keys []*oidcKey
+	_, err := pgbackend.RunTx(ServiceName, &keys, func(tx pgx.Tx, result *[]*oidcKey) error {
+		if _, err := tx.Exec(context.Background(), "select pg_advisory_xact_lock($1)", oidcKeyLockKey); err != nil {
+			return err
+		}
+		now := time.Now()
+		if _, err := tx.Exec(context.Background(),
+			"delete from misc_ldap_oidc_keys where time_retired > 0 and time_retired < $1",
+			now.Add(-this.retention).UnixMilli()); err != nil {
+			return err
+		}
+		keys, err := queryOidcKeys(tx)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 || !keys[0].Retired.IsZero() || now.Sub(keys[0].Created) >= this.rotation {
+			key, err := newOidcKey()
+			if err != nil {
+				return err
+			}
+			der, err := x509.MarshalPKCS8PrivateKey(key.Key)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(context.Background(),
+				"update misc_ldap_oidc_keys set time_retired = $1 where time_retired = 0",
+				now.UnixMilli()); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(context.Background(),
+				"insert into misc_ldap_oidc_keys(key_id, private_key, time_created, time_retired) values($1, $2, $3, 0)",
+				key.Id, der, key.Created.UnixMilli()); err != nil {
+				return err
+			}
+			log.Println("rotated oidc signing key", "op", op, "kid", key.Id)
+			if keys, err = queryOidcKeys(tx); err != nil {
+				return err
+			}
+		}
+		*result = keys
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.keys = keys
+	this.lastLoad = time.Now()
+	return nil
+}
+
+// queryOidcKeys returns the keys, the signing key first
+func queryOidcKeys(tx pgx.Tx) ([]*oidcKey, error) {
+	rows, err := tx.Query(context.Background(),
+		"select key_id, private_key, time_created, time_retired from misc_ldap_oidc_keys order by time_retired = 0 desc, time_created desc")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []*oidcKey
+	for rows.Next() {
+		var kid string
+		var der []byte
+		var created, retired int64
+		if err := rows.Scan(&kid, &der, &created, &retired); err != nil {
+			return nil, err
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("oidc key is no rsa key: " + kid)
+		}
+		k := &oidcKey{Id: kid, Key: key, Created: time.UnixMilli(created)}
+		if retired > 0 {
+			k.Retired = time.UnixMilli(retired)
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// JWKS is the json web key set of the keys verifying tokens
+func (this *oidcKeySet) JWKS() map[string]interface{} {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	var keys []interface{}
+	for _, k := range this.keys {
+		keys = append(keys, map[string]interface{}{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": k.Id,
+			"n":   base64.RawURLEncoding.EncodeToString(k.Key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.Key.E)).Bytes()),
+		})
+	}
+	return map[string]interface{}{"keys": keys}
+}
+
+// Sign creates a JWT of the claims with the signing key
+func (this *oidcKeySet) Sign(typ string, claims map[string]interface{}) (string, error) {
+	this.lock.RLock()
+	key := this.keys[0]
+	this.lock.RUnlock()
+
+	header, err := json.Marshal(&jwtHeader{Alg: "RS256", Typ: typ, Kid: key.Id})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key.Key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify checks the signature, type and expiry of a JWT and returns its claims
+func (this *oidcKeySet) Verify(typ, token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidJwt
+	}
+	headerData, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidJwt
+	}
+	header := new(jwtHeader)
+	if err := json.Unmarshal(headerData, header); err != nil {
+		return nil, errInvalidJwt
+	}
+	if header.Alg != "RS256" || header.Typ != typ {
+		return nil, errInvalidJwt
+	}
+	key := this.find(header.Kid)
+	if key == nil {
+		return nil, errInvalidJwt
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidJwt
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&key.Key.PublicKey, crypto.SHA256, sum[:], signature); err != nil {
+		return nil, errInvalidJwt
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidJwt
+	}
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errInvalidJwt
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || time.Now().Unix() >= int64(exp) {
+		return nil, errors.New("token expired")
+	}
+	return claims, nil
+}
+
+// find reloads the keys for an unknown kid, it may have been rotated by
+// another instance since the last load
+func (this *oidcKeySet) find(kid string) *oidcKey {
+	const op = "ldap.(Directory).findOidcKey"
+
+	if k, lastLoad := this.lookup(kid); k != nil || time.Since(lastLoad) < oidcKeyMinReload {
+		return k
+	}
+	if err := this.load(); err != nil {
+		log.Println("load oidc keys error", "op", op, "err", err)
+		return nil
+	}
+	k, _ := this.lookup(kid)
+	return k
+}
+
+func (this *oidcKeySet) lookup(kid string) (*oidcKey, time.Time) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	for _, k := range this.keys {
+		if k.Id == kid {
+			return k, this.lastLoad
+		}
+	}
+	return nil, this.lastLoad
+}
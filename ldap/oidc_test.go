@@ -0,0 +1,70 @@
+package ldap
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/meidomx/misc-service/config"
+	"github.com/meidomx/misc-service/id"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jimlambrt/gldap"
+)
+
+func TestOidcDeactivatedUser(t *testing.T) {
+	_, backend := startTestGateway(t)
+	key, err := newOidcKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := &oidcService{
+		server:         newLdapServer(id.NewIdGen(1, 1), new(config.Config), backend, nil, "external", nil),
+		keys:           &oidcKeySet{keys: []*oidcKey{key}, lastLoad: time.Now(), closed: make(chan struct{})},
+		issuer:         "https://id.example",
+		accessLifetime: time.Minute,
+		claims:         newOidcClaimMapping(nil),
+	}
+	client := &config.OidcClient{ClientId: "app", GrantTypes: []string{oidcGrantAuthorizationCode}}
+	grant := &oidcGrant{
+		ClientId: "app",
+		DN:       "cn=alice,ou=people,dc=example",
+		Scope:    []string{oidcScopeOpenId},
+		AuthTime: time.Now(),
+	}
+	resp, oerr := service.issueUserTokens(client, grant)
+	if oerr != nil {
+		t.Fatal(oerr)
+	}
+	accessToken := resp["access_token"].(string)
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.GET("/userinfo", service.UserInfo)
+	userInfo := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := userInfo(); code != http.StatusOK {
+		t.Fatalf("userinfo: %d", code)
+	}
+
+	entry, err := backend.FindOneEntry(grant.DN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.Attributes = append(entry.Attributes, gldap.NewEntryAttribute(attributeScimActive, []string{"FALSE"}))
+	if err := backend.UpdateEntry(entry, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, oerr := service.issueUserTokens(client, grant); oerr == nil || oerr.Code != "invalid_grant" {
+		t.Errorf("tokens of a deactivated user: %v", oerr)
+	}
+	if code := userInfo(); code != http.StatusUnauthorized {
+		t.Errorf("userinfo of a deactivated user: %d", code)
+	}
+}
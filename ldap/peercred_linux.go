@@ -0,0 +1,26 @@
+package ldap
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerCredentials returns the uid and gid of the process on the other end of
+// the unix socket (SO_PEERCRED)
+func peerCredentials(c *net.UnixConn) (uint32, uint32, error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return 0, 0, err
+	}
+	if credErr != nil {
+		return 0, 0, credErr
+	}
+	return cred.Uid, cred.Gid, nil
+}
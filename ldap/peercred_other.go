@@ -0,0 +1,12 @@
+//go:build !linux
+
+package ldap
+
+import (
+	"errors"
+	"net"
+)
+
+func peerCredentials(c *net.UnixConn) (uint32, uint32, error) {
+	return 0, 0, errors.New("peer credentials are only supported on linux")
+}
@@ -0,0 +1,90 @@
+package ldap
+
+import (
+	"sync"
+	"time"
+)
+
+// Paging of the http searches. The first page walks the search once and keeps
+// the DNs of the remaining matches in a cursor, the next pages load the
+// entries by DN. Cursors live in the memory of the instance serving the
+// first page.
+const (
+	restCursorTTL = 5 * time.Minute
+	// restCursorMaxEntries caps the DNs kept by a cursor, the result is
+	// truncated beyond
+	restCursorMaxEntries = 10000
+	restMaxCursors       = 1000
+)
+
+type restCursor struct {
+	BoundDN string
+	Filter  *EntryFilter
+	DNs     []string
+	Expires time.Time
+}
+
+type restCursorTable struct {
+	lock    sync.Mutex
+	cursors map[string]*restCursor
+}
+
+func newRestCursorTable() *restCursorTable {
+	return &restCursorTable{
+		cursors: map[string]*restCursor{},
+	}
+}
+
+// Put stores the cursor and returns its id. When the table is full, the
+// cursor expiring first is dropped.
+func (this *restCursorTable) Put(cursor *restCursor) (string, error) {
+	id, err := newTxnId()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	cursor.Expires = now.Add(restCursorTTL)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for k, c := range this.cursors {
+		if now.After(c.Expires) {
+			delete(this.cursors, k)
+		}
+	}
+	if len(this.cursors) >= restMaxCursors {
+		var oldest string
+		for k, c := range this.cursors {
+			if len(oldest) == 0 || c.Expires.Before(this.cursors[oldest].Expires) {
+				oldest = k
+			}
+		}
+		delete(this.cursors, oldest)
+	}
+	this.cursors[id] = cursor
+	return id, nil
+}
+
+// Next removes up to limit DNs from the cursor of boundDN. The cursor is
+// dropped once it has no DNs left.
+func (this *restCursorTable) Next(id, boundDN string, limit int) (*EntryFilter, []string, bool, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	c, ok := this.cursors[id]
+	if !ok || time.Now().After(c.Expires) || NormalizeDN(c.BoundDN) != NormalizeDN(boundDN) {
+		return nil, nil, false, false
+	}
+	n := limit
+	if n > len(c.DNs) {
+		n = len(c.DNs)
+	}
+	dns := c.DNs[:n]
+	c.DNs = c.DNs[n:]
+	more := len(c.DNs) > 0
+	if more {
+		c.Expires = time.Now().Add(restCursorTTL)
+	} else {
+		delete(this.cursors, id)
+	}
+	return c.Filter, dns, more, true
+}
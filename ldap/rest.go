@@ -0,0 +1,538 @@
+package ldap
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/jimlambrt/gldap"
+)
+
+// HTTP gateway of the directory. Requests authenticate with HTTP basic auth
+// using a bind name and password, resolved like an LDAP simple bind, and the
+// updates are recorded in the changelog as done by that DN. Every user may
+// read the entries without their secret attributes, only administrators may
+// create, delete and rename entries, other users may modify their own one.
+const (
+	restBoundDNKey = "ldap_bound_dn"
+
+	restDefaultLimit = 100
+	restMaxLimit     = 1000
+)
+
+type RestEntry struct {
+	DN         string              `json:"dn"`
+	Attributes map[string][]string `json:"attributes"`
+}
+
+type RestChange struct {
+	// Operation is add, delete or replace
+	Operation string   `json:"operation"`
+	Attribute string   `json:"attribute"`
+	Values    []string `json:"values"`
+}
+
+type RestModifyRequest struct {
+	Changes []*RestChange `json:"changes"`
+}
+
+type RestRenameRequest struct {
+	NewRDN       string `json:"new_rdn"`
+	DeleteOldRDN bool   `json:"delete_old_rdn"`
+	NewSuperior  string `json:"new_superior"`
+}
+
+type RestSearchResult struct {
+	Entries []*RestEntry `json:"entries"`
+	// NextCursor is set when more entries match
+	NextCursor string `json:"next_cursor,omitempty"`
+	// Truncated is set when more entries match than a cursor keeps
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// restResult collects the LDAP result of an operation
+type restResult struct {
+	Code      int
+	Message   string
+	MatchedDN string
+}
+
+func newRestResult() *restResult {
+	return &restResult{Code: gldap.ResultOperationsError}
+}
+
+func (this *restResult) SetResultCode(code int) {
+	this.Code = code
+}
+
+func (this *restResult) SetDiagnosticMessage(msg string) {
+	this.Message = msg
+}
+
+func (this *restResult) SetMatchedDN(dn string) {
+	this.MatchedDN = dn
+}
+
+func InitRestGateway(engine *gin.Engine, server *ldapServer, throttle *bindThrottle) {
+	g := engine.Group("/ldap", RestAuth(server, throttle))
+	g.GET("/search", SearchEntries(server, newRestCursorTable()))
+	g.GET("/entries/*dn", GetEntry(server))
+	g.POST("/entries/*dn", CreateEntry(server))
+	g.PATCH("/entries/*dn", ModifyEntry(server))
+	g.DELETE("/entries/*dn", DeleteEntry(server))
+	g.POST("/rename/*dn", RenameEntry(server))
+}
+
+// RestAuth authenticates the request and keeps the DN for the handlers.
+// Failed attempts count against the bind throttle of the LDAP listeners.
+func RestAuth(server *ldapServer, throttle *bindThrottle) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		name, password, ok := ctx.Request.BasicAuth()
+		if !ok || len(name) == 0 || len(password) == 0 {
+			ctx.Header("WWW-Authenticate", `Basic realm="ldap"`)
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, ResponseErr("4010", "authentication required"))
+			return
+		}
+		ip := ctx.ClientIP()
+		key := throttle.Key(name)
+		if !throttle.Allowed(ip, key) {
+			ctx.AbortWithStatusJSON(http.StatusTooManyRequests, ResponseErr("4290", "too many failed binds, try again later"))
+			return
+		}
+		dn := server.authenticate(name, gldap.Password(password))
+		if len(dn) == 0 {
+			throttle.Failed(ip, key)
+			ctx.Header("WWW-Authenticate", `Basic realm="ldap"`)
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, ResponseErr("4010", "invalid credentials"))
+			return
+		}
+		throttle.Succeeded(ip, key)
+		ctx.Set(restBoundDNKey, dn)
+		ctx.Next()
+	}
+}
+
+// SearchEntries searches with the query parameters base, scope (base, one or
+// sub), filter, attributes (comma separated), deref (never, search, find or
+// always), manage_dsa_it and limit. The next page is requested with the
+// cursor and limit parameters only.
+func SearchEntries(server *ldapServer, cursors *restCursorTable) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		const op = "ldap.(Directory).SearchEntries"
+
+		limit, err := strconv.Atoi(ctx.DefaultQuery("limit", strconv.Itoa(restDefaultLimit)))
+		if err != nil || limit <= 0 {
+			ctx.JSON(http.StatusBadRequest, ResponseErr("4000", "invalid limit"))
+			return
+		}
+		if limit > restMaxLimit {
+			limit = restMaxLimit
+		}
+		if cursor := ctx.Query("cursor"); len(cursor) > 0 {
+			filter, dns, more, ok := cursors.Next(cursor, restBoundDN(ctx), limit)
+			if !ok {
+				ctx.JSON(http.StatusNotFound, ResponseErr("4040", "no such cursor"))
+				return
+			}
+			entries, err := server.restLoadEntries(dns, filter)
+			if err != nil {
+				log.Println("load entries error", "op", op, "err", err)
+				ctx.JSON(http.StatusInternalServerError, ResponseErr("5000", "internal error"))
+				return
+			}
+			result := &RestSearchResult{Entries: toRestEntries(entries, restAttributes(ctx))}
+			if more {
+				result.NextCursor = cursor
+			}
+			ctx.JSON(http.StatusOK, ResponseBody(result))
+			return
+		}
+
+		base := ctx.Query("base")
+		if isChangelogDN(base) {
+			ctx.JSON(http.StatusBadRequest, ResponseErr("4000", "the changelog is available at /ldap/changelog"))
+			return
+		}
+		scope, ok := parseRestScope(ctx.DefaultQuery("scope", "sub"))
+		if !ok {
+			ctx.JSON(http.StatusBadRequest, ResponseErr("4000", "invalid scope"))
+			return
+		}
+		deref, ok := parseRestDeref(ctx.DefaultQuery("deref", "never"))
+		if !ok {
+			ctx.JSON(http.StatusBadRequest, ResponseErr("4000", "invalid deref"))
+			return
+		}
+		filter, err := CompileEntryFilter(ctx.DefaultQuery("filter", "(objectClass=*)"))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, ResponseErr("4000", "invalid filter"))
+			return
+		}
+
+		res := newRestResult()
+		entries, rest, truncated := server.restSearch(base, scope, deref, ctx.Query("manage_dsa_it") == "true", filter, limit, res)
+		if res.Code != gldap.ResultSuccess {
+			writeRestResult(ctx, res)
+			return
+		}
+		result := &RestSearchResult{Entries: toRestEntries(entries, restAttributes(ctx)), Truncated: truncated}
+		if len(rest) > 0 {
+			cursor, err := cursors.Put(&restCursor{BoundDN: restBoundDN(ctx), Filter: filter, DNs: rest})
+			if err != nil {
+				log.Println("create cursor error", "op", op, "err", err)
+				ctx.JSON(http.StatusInternalServerError, ResponseErr("5000", "internal error"))
+				return
+			}
+			result.NextCursor = cursor
+		}
+		ctx.JSON(http.StatusOK, ResponseBody(result))
+	}
+}
+
+// GetEntry reads one entry, the attributes query parameter selects attributes
+func GetEntry(server *ldapServer) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		dn, ok := restDN(ctx)
+		if !ok {
+			return
+		}
+		filter, _ := CompileEntryFilter("(objectClass=*)")
+		res := newRestResult()
+		entries, _, _ := server.restSearch(dn, gldap.BaseObject, 0, ctx.Query("manage_dsa_it") == "true", filter, 1, res)
+		if res.Code != gldap.ResultSuccess {
+			writeRestResult(ctx, res)
+			return
+		}
+		if len(entries) == 0 {
+			ctx.JSON(http.StatusNotFound, ResponseErr("4040", "no such entry"))
+			return
+		}
+		ctx.JSON(http.StatusOK, ResponseBody(toRestEntries(entries, restAttributes(ctx))[0]))
+	}
+}
+
+// CreateEntry adds the entry of the path with the attributes of the body
+func CreateEntry(server *ldapServer) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		dn, ok := restDN(ctx)
+		if !ok {
+			return
+		}
+		if !server.isAdmin(restBoundDN(ctx)) {
+			ctx.JSON(http.StatusForbidden, ResponseErr("4030", "insufficient access rights"))
+			return
+		}
+		req := new(RestEntry)
+		if err := ctx.ShouldBindJSON(req); err != nil {
+			ctx.JSON(http.StatusBadRequest, ResponseErr("4000", "invalid request body"))
+			return
+		}
+
+		res := newRestResult()
+		if ok := server.restCheckReferral(dn, ctx, res); !ok {
+			writeRestResult(ctx, res)
+			return
+		}
+		server.addEntry(restBoundDN(ctx), gldap.NewEntry(dn, req.Attributes), res)
+		writeRestResult(ctx, res)
+	}
+}
+
+// ModifyEntry applies the changes of the body to the entry of the path
+func ModifyEntry(server *ldapServer) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		dn, ok := restDN(ctx)
+		if !ok {
+			return
+		}
+		req := new(RestModifyRequest)
+		if err := ctx.ShouldBindJSON(req); err != nil {
+			ctx.JSON(http.StatusBadRequest, ResponseErr("4000", "invalid request body"))
+			return
+		}
+		changes := make([]gldap.Change, 0, len(req.Changes))
+		for _, c := range req.Changes {
+			var operation int64
+			switch strings.ToLower(c.Operation) {
+			case "add":
+				operation = gldap.AddAttribute
+			case "delete":
+				operation = gldap.DeleteAttribute
+			case "replace":
+				operation = gldap.ReplaceAttribute
+			default:
+				ctx.JSON(http.StatusBadRequest, ResponseErr("4000", "invalid operation: "+c.Operation))
+				return
+			}
+			if len(c.Attribute) == 0 {
+				ctx.JSON(http.StatusBadRequest, ResponseErr("4000", "attribute is required"))
+				return
+			}
+			changes = append(changes, gldap.Change{
+				Operation:    operation,
+				Modification: gldap.PartialAttribute{Type: c.Attribute, Vals: c.Values},
+			})
+		}
+
+		if !server.canModify(restBoundDN(ctx), dn, changes) {
+			ctx.JSON(http.StatusForbidden, ResponseErr("4030", "insufficient access rights"))
+			return
+		}
+
+		res := newRestResult()
+		if ok := server.restCheckReferral(dn, ctx, res); !ok {
+			writeRestResult(ctx, res)
+			return
+		}
+		server.modifyEntry(restBoundDN(ctx), dn, changes, res)
+		writeRestResult(ctx, res)
+	}
+}
+
+func DeleteEntry(server *ldapServer) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		dn, ok := restDN(ctx)
+		if !ok {
+			return
+		}
+		if !server.isAdmin(restBoundDN(ctx)) {
+			ctx.JSON(http.StatusForbidden, ResponseErr("4030", "insufficient access rights"))
+			return
+		}
+		res := newRestResult()
+		if ok := server.restCheckReferral(dn, ctx, res); !ok {
+			writeRestResult(ctx, res)
+			return
+		}
+		server.removeEntry(restBoundDN(ctx), dn, res)
+		writeRestResult(ctx, res)
+	}
+}
+
+// RenameEntry moves the entry of the path and its subtree to a new DN
+func RenameEntry(server *ldapServer) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		dn, ok := restDN(ctx)
+		if !ok {
+			return
+		}
+		if !server.isAdmin(restBoundDN(ctx)) {
+			ctx.JSON(http.StatusForbidden, ResponseErr("4030", "insufficient access rights"))
+			return
+		}
+		req := new(RestRenameRequest)
+		if err := ctx.ShouldBindJSON(req); err != nil || len(req.NewRDN) == 0 {
+			ctx.JSON(http.StatusBadRequest, ResponseErr("4000", "invalid request body"))
+			return
+		}
+
+		res := newRestResult()
+		if ok := server.restCheckReferral(dn, ctx, res); !ok {
+			writeRestResult(ctx, res)
+			return
+		}
+		if len(req.NewSuperior) > 0 {
+			if ok := server.restCheckReferral(req.NewSuperior, ctx, res); !ok {
+				writeRestResult(ctx, res)
+				return
+			}
+		}
+		server.renameEntry(restBoundDN(ctx), dn, req.NewRDN, req.DeleteOldRDN, req.NewSuperior, res)
+		writeRestResult(ctx, res)
+	}
+}
+
+// restSearch returns at most limit entries matching the search, the DNs of
+// the further matches and whether more matched than kept. The secret
+// attributes are removed before the filter is applied, so they can't be
+// probed.
+func (this *ldapServer) restSearch(base string, scope gldap.Scope, deref int, manageDsaIT bool, filter *EntryFilter, limit int, res resultSetter) ([]*gldap.Entry, []string, bool) {
+	const op = "ldap.(Directory).restSearch"
+
+	var controls []gldap.Control
+	if manageDsaIT {
+		c, err := gldap.NewControlManageDsaIT()
+		if err != nil {
+			log.Println("create control error", "op", op, "err", err)
+			return nil, nil, false
+		}
+		controls = append(controls, c)
+	}
+	base, ok := this.searchBase(base, controls, deref, res)
+	if !ok {
+		return nil, nil, false
+	}
+
+	var entries []*gldap.Entry
+	var rest []string
+	visited, truncated := 0, false
+	err := this.walkSearch(base, scope, deref, manageDsaIT, func(entry *gldap.Entry) bool {
+		visited++
+		entry = withoutSecrets(expandDynamicGroup(this.backend, entry))
+		if !filter.Match(entry) {
+			return true
+		}
+		if len(entries) < limit {
+			entries = append(entries, entry)
+			return true
+		}
+		if len(rest) >= restCursorMaxEntries {
+			truncated = true
+			return false
+		}
+		rest = append(rest, entry.DN)
+		return true
+	})
+	if err != nil {
+		log.Println("search entries error", "op", op, "err", err)
+		res.SetResultCode(gldap.ResultOperationsError)
+		return nil, nil, false
+	}
+	if visited <= 0 {
+		res.SetResultCode(gldap.ResultNoSuchObject)
+		return nil, nil, false
+	}
+	res.SetResultCode(gldap.ResultSuccess)
+	return entries, rest, truncated
+}
+
+// restLoadEntries loads the entries of a cursor page, skipping the ones
+// removed or not matching anymore
+func (this *ldapServer) restLoadEntries(dns []string, filter *EntryFilter) ([]*gldap.Entry, error) {
+	var entries []*gldap.Entry
+	for _, dn := range dns {
+		entry, err := this.backend.FindOneEntry(dn)
+		if err != nil {
+			return nil, err
+		}
+		if len(entry.DN) <= 0 {
+			continue
+		}
+		entry = withoutSecrets(expandDynamicGroup(this.backend, entry))
+		if filter.Match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// restCheckReferral returns false with the result set when dn is at or below
+// a referral object
+func (this *ldapServer) restCheckReferral(dn string, ctx *gin.Context, res resultSetter) bool {
+	if ctx.Query("manage_dsa_it") == "true" {
+		return true
+	}
+	referral, err := this.checkReferral(dn, nil, res)
+	if err != nil {
+		log.Println("check referral error", "op", "ldap.(Directory).restCheckReferral", "err", err)
+		res.SetResultCode(gldap.ResultOperationsError)
+		return false
+	}
+	return !referral
+}
+
+func restDN(ctx *gin.Context) (string, bool) {
+	dn := strings.TrimPrefix(ctx.Param("dn"), "/")
+	if len(dn) == 0 {
+		ctx.JSON(http.StatusBadRequest, ResponseErr("4000", "dn is required"))
+		return "", false
+	}
+	return dn, true
+}
+
+func restBoundDN(ctx *gin.Context) string {
+	return ctx.GetString(restBoundDNKey)
+}
+
+func restAttributes(ctx *gin.Context) []string {
+	var attributes []string
+	for _, a := range strings.Split(ctx.Query("attributes"), ",") {
+		if a = strings.TrimSpace(a); len(a) > 0 {
+			attributes = append(attributes, a)
+		}
+	}
+	return attributes
+}
+
+func parseRestScope(scope string) (gldap.Scope, bool) {
+	switch strings.ToLower(scope) {
+	case "base":
+		return gldap.BaseObject, true
+	case "one":
+		return gldap.SingleLevel, true
+	case "sub":
+		return gldap.WholeSubtree, true
+	}
+	return 0, false
+}
+
+func parseRestDeref(deref string) (int, bool) {
+	switch strings.ToLower(deref) {
+	case "never":
+		return 0, true
+	case "search":
+		return derefInSearching, true
+	case "find":
+		return derefFindingBaseObj, true
+	case "always":
+		return derefInSearching | derefFindingBaseObj, true
+	}
+	return 0, false
+}
+
+func toRestEntries(entries []*gldap.Entry, attributes []string) []*RestEntry {
+	result := make([]*RestEntry, 0, len(entries))
+	for _, e := range entries {
+		r := &RestEntry{DN: e.DN, Attributes: map[string][]string{}}
+		for _, a := range e.Attributes {
+			if isRequestedAttribute(attributes, a.Name) {
+				r.Attributes[a.Name] = a.Values
+			}
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+func writeRestResult(ctx *gin.Context, res *restResult) {
+	if res.Code == gldap.ResultSuccess {
+		ctx.JSON(http.StatusOK, ResponseOk())
+		return
+	}
+	status := restStatus(res.Code)
+	message := goldap.LDAPResultCodeMap[uint16(res.Code)]
+	if len(res.Message) > 0 {
+		message = message + ": " + res.Message
+	}
+	if len(res.MatchedDN) > 0 && res.Code == gldap.ResultReferral {
+		message = message + " (matched " + res.MatchedDN + ")"
+	}
+	ctx.JSON(status, ResponseErr(fmt.Sprint(status, "0"), message))
+}
+
+// restStatus maps an LDAP result code to the http status of the response
+func restStatus(code int) int {
+	switch code {
+	case gldap.ResultNoSuchObject:
+		return http.StatusNotFound
+	case gldap.ResultEntryAlreadyExists:
+		return http.StatusConflict
+	case gldap.ResultReferral:
+		return http.StatusMisdirectedRequest
+	case gldap.ResultInsufficientAccessRights:
+		return http.StatusForbidden
+	case gldap.ResultUnwillingToPerform:
+		return http.StatusUnprocessableEntity
+	case gldap.ResultAssertionFailed:
+		return http.StatusPreconditionFailed
+	case gldap.ResultProtocolError, gldap.ResultInvalidDNSyntax, gldap.ResultFilterError,
+		gldap.ResultAliasProblem, gldap.ResultAliasDereferencingProblem,
+		gldap.ResultNamingViolation, gldap.ResultObjectClassViolation:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
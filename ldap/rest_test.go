@@ -0,0 +1,181 @@
+package ldap
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/meidomx/misc-service/config"
+	"github.com/meidomx/misc-service/id"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jimlambrt/gldap"
+)
+
+// startTestGateway serves the http gateway of a memory backend with alice and
+// bob below ou=people, bob being a member of the admins group
+func startTestGateway(t *testing.T) (*gin.Engine, *MemoryDirectoryBackend) {
+	t.Helper()
+	c := new(config.Config)
+	c.LDAP.Suffixes = []config.LdapSuffix{{
+		Suffix:     "dc=example",
+		BindBaseDN: "ou=people,dc=example",
+		BindFilter: "(uid=%s)",
+	}}
+	c.LDAP.AdminDNs = []string{"cn=admins,dc=example"}
+	backend := newTestMemoryBackend(t, "", 0)
+	idGen := id.NewIdGen(1, 1)
+	saveTestEntry(t, backend, idGen, "dc=example", map[string][]string{"objectClass": {"top", "domain"}})
+	saveTestEntry(t, backend, idGen, "ou=people,dc=example", map[string][]string{"objectClass": {"top", "organizationalUnit"}})
+	for _, name := range []string{"alice", "bob"} {
+		saveTestEntry(t, backend, idGen, "cn="+name+",ou=people,dc=example", map[string][]string{
+			"objectClass":  {"top", "inetOrgPerson"},
+			"cn":           {name},
+			"uid":          {name},
+			"userPassword": {"secret"},
+		})
+	}
+	saveTestEntry(t, backend, idGen, "cn=admins,dc=example", map[string][]string{
+		"objectClass": {"top", "groupOfNames"},
+		"cn":          {"admins"},
+		"member":      {"cn=bob,ou=people,dc=example"},
+	})
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	server := newLdapServer(idGen, c, backend, NewChangeNotifier(backend), "external", nil)
+	InitRestGateway(engine, server, nil)
+	return engine, backend
+}
+
+func doRestRequest(t *testing.T, engine *gin.Engine, user, method, path, body string) (int, map[string]interface{}) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.SetBasicAuth(user, "secret")
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	result := map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return w.Code, result
+}
+
+func TestRestAuthorization(t *testing.T) {
+	engine, _ := startTestGateway(t)
+
+	code, result := doRestRequest(t, engine, "alice", http.MethodGet, "/ldap/entries/cn=alice,ou=people,dc=example", "")
+	if code != http.StatusOK {
+		t.Fatalf("read: %d %v", code, result)
+	}
+	attributes := result["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+	if _, ok := attributes["userPassword"]; ok {
+		t.Error("userPassword returned")
+	}
+	code, result = doRestRequest(t, engine, "alice", http.MethodGet, "/ldap/search?base=dc=example&filter="+url.QueryEscape("(userPassword=secret)"), "")
+	if entries := result["data"].(map[string]interface{})["entries"].([]interface{}); code != http.StatusOK || len(entries) != 0 {
+		t.Errorf("search by userPassword: %d %v", code, result)
+	}
+
+	for _, c := range []struct {
+		user, method, path, body string
+		status                   int
+	}{
+		{"alice", http.MethodPatch, "/ldap/entries/cn=alice,ou=people,dc=example", `{"changes":[{"operation":"add","attribute":"mail","values":["alice@example.com"]}]}`, http.StatusOK},
+		{"alice", http.MethodPatch, "/ldap/entries/cn=alice,ou=people,dc=example", `{"changes":[{"operation":"add","attribute":"objectClass","values":["extensibleObject"]}]}`, http.StatusForbidden},
+		{"alice", http.MethodPatch, "/ldap/entries/cn=alice,ou=people,dc=example", `{"changes":[{"operation":"add","attribute":"mfaRequired","values":["FALSE"]}]}`, http.StatusForbidden},
+		{"alice", http.MethodPatch, "/ldap/entries/cn=bob,ou=people,dc=example", `{"changes":[{"operation":"add","attribute":"mail","values":["bob@example.com"]}]}`, http.StatusForbidden},
+		{"alice", http.MethodPost, "/ldap/entries/cn=carol,ou=people,dc=example", `{"attributes":{"objectClass":["person"],"cn":["carol"]}}`, http.StatusForbidden},
+		{"alice", http.MethodDelete, "/ldap/entries/cn=bob,ou=people,dc=example", "", http.StatusForbidden},
+		{"bob", http.MethodPatch, "/ldap/entries/cn=alice,ou=people,dc=example", `{"changes":[{"operation":"add","attribute":"objectClass","values":["extensibleObject"]}]}`, http.StatusOK},
+		{"bob", http.MethodPost, "/ldap/entries/cn=carol,ou=people,dc=example", `{"attributes":{"objectClass":["person"],"cn":["carol"]}}`, http.StatusOK},
+		{"bob", http.MethodDelete, "/ldap/entries/cn=carol,ou=people,dc=example", "", http.StatusOK},
+	} {
+		if code, result := doRestRequest(t, engine, c.user, c.method, c.path, c.body); code != c.status {
+			t.Errorf("%s %s %s: %d %v", c.user, c.method, c.path, code, result)
+		}
+	}
+}
+
+func TestRestRenameKeepsIds(t *testing.T) {
+	engine, backend := startTestGateway(t)
+	ids := map[string]string{}
+	for key, e := range backend.state.Entries {
+		ids[key] = e.Id
+	}
+
+	code, result := doRestRequest(t, engine, "bob", http.MethodPost, "/ldap/rename/ou=people,dc=example", `{"new_rdn":"ou=staff","delete_old_rdn":true}`)
+	if code != http.StatusOK {
+		t.Fatalf("rename: %d %v", code, result)
+	}
+	for _, name := range []string{"ou=%s,dc=example", "cn=alice,ou=%s,dc=example", "cn=bob,ou=%s,dc=example"} {
+		e, ok := backend.state.Entries[NormalizeDN(fmt.Sprintf(name, "staff"))]
+		if !ok {
+			t.Errorf("%s not moved", fmt.Sprintf(name, "staff"))
+			continue
+		}
+		if e.Id != ids[NormalizeDN(fmt.Sprintf(name, "people"))] {
+			t.Errorf("%s has a new id", e.Entry.DN)
+		}
+	}
+	if _, ok := backend.state.Entries[NormalizeDN("ou=people,dc=example")]; ok {
+		t.Error("old entry kept")
+	}
+}
+
+func TestRestSearchCursor(t *testing.T) {
+	engine, _ := startTestGateway(t)
+
+	dns := map[string]bool{}
+	path := "/ldap/search?base=dc=example&limit=2"
+	for pages := 0; len(path) > 0; pages++ {
+		if pages > 5 {
+			t.Fatal("cursor doesn't end")
+		}
+		code, result := doRestRequest(t, engine, "alice", http.MethodGet, path, "")
+		if code != http.StatusOK {
+			t.Fatalf("search: %d %v", code, result)
+		}
+		data := result["data"].(map[string]interface{})
+		for _, e := range data["entries"].([]interface{}) {
+			dns[e.(map[string]interface{})["dn"].(string)] = true
+		}
+		path = ""
+		if cursor, ok := data["next_cursor"].(string); ok {
+			path = "/ldap/search?limit=2&cursor=" + cursor
+			if code, _ := doRestRequest(t, engine, "bob", http.MethodGet, path, ""); code != http.StatusNotFound {
+				t.Errorf("cursor used by another user: %d", code)
+			}
+		}
+	}
+	if len(dns) != 5 {
+		t.Errorf("found %d entries: %v", len(dns), dns)
+	}
+}
+
+func TestTxnAssert(t *testing.T) {
+	_, backend := startTestGateway(t)
+	server := newLdapServer(id.NewIdGen(1, 1), new(config.Config), backend, nil, "external", nil)
+	ops := []*txnOp{{
+		Kind:    ChangeTypeModify,
+		DN:      "cn=alice,ou=people,dc=example",
+		Changes: []gldap.Change{{Operation: gldap.AddAttribute, Modification: gldap.PartialAttribute{Type: "mail", Vals: []string{"alice@example.com"}}}},
+		Assert: func(entry *gldap.Entry) bool {
+			return len(EntryAttributeValues(entry, "mail")) > 0
+		},
+	}}
+	res := newRestResult()
+	server.commitOps(ops, res)
+	if res.Code != gldap.ResultAssertionFailed {
+		t.Fatalf("update with a failing assertion: %d", res.Code)
+	}
+	entry, _ := backend.FindOneEntry("cn=alice,ou=people,dc=example")
+	if len(EntryAttributeValues(entry, "mail")) > 0 {
+		t.Error("update applied")
+	}
+}
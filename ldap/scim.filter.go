@@ -0,0 +1,480 @@
+package ldap
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// SCIM filters (RFC 7644 3.4.2.2) evaluated against the JSON representation
+// of a resource. String comparisons are case-insensitive, value paths such as
+// emails[type eq "work"] match when any element matches the inner filter.
+type scimFilter struct {
+	// Op is and, or, not, pr, a comparison operator or [] for a value path
+	Op       string
+	Path     *scimPath
+	Value    interface{}
+	Children []*scimFilter
+}
+
+// scimPath is an attribute path, optionally with a value filter and a sub
+// attribute: [schema:]attr[[filter]][.sub]
+type scimPath struct {
+	Schema string
+	Attr   string
+	Filter *scimFilter
+	Sub    string
+}
+
+type scimToken struct {
+	Text   string
+	Quoted bool
+}
+
+func parseScimFilter(s string) (*scimFilter, error) {
+	tokens, err := tokenizeScim(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &scimFilterParser{tokens: tokens}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, errors.New("unexpected token in filter: " + p.tokens[p.pos].Text)
+	}
+	return f, nil
+}
+
+func tokenizeScim(s string) ([]scimToken, error) {
+	var tokens []scimToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')' || c == '[' || c == ']':
+			tokens = append(tokens, scimToken{Text: string(c)})
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, errors.New("unterminated string in filter")
+			}
+			var v string
+			if err := json.Unmarshal([]byte(s[i:end+1]), &v); err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, scimToken{Text: v, Quoted: true})
+			i = end + 1
+		default:
+			end := i
+			for end < len(s) && !strings.ContainsRune(" \t()[]\"", rune(s[end])) {
+				end++
+			}
+			tokens = append(tokens, scimToken{Text: s[i:end]})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+type scimFilterParser struct {
+	tokens []scimToken
+	pos    int
+}
+
+func (this *scimFilterParser) peek() (scimToken, bool) {
+	if this.pos >= len(this.tokens) {
+		return scimToken{}, false
+	}
+	return this.tokens[this.pos], true
+}
+
+func (this *scimFilterParser) keyword(word string) bool {
+	t, ok := this.peek()
+	if ok && !t.Quoted && strings.EqualFold(t.Text, word) {
+		this.pos++
+		return true
+	}
+	return false
+}
+
+func (this *scimFilterParser) expect(text string) error {
+	t, ok := this.peek()
+	if !ok || t.Quoted || t.Text != text {
+		return errors.New("expected " + text + " in filter")
+	}
+	this.pos++
+	return nil
+}
+
+func (this *scimFilterParser) parseOr() (*scimFilter, error) {
+	left, err := this.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for this.keyword("or") {
+		right, err := this.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &scimFilter{Op: "or", Children: []*scimFilter{left, right}}
+	}
+	return left, nil
+}
+
+func (this *scimFilterParser) parseAnd() (*scimFilter, error) {
+	left, err := this.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for this.keyword("and") {
+		right, err := this.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &scimFilter{Op: "and", Children: []*scimFilter{left, right}}
+	}
+	return left, nil
+}
+
+func (this *scimFilterParser) parseNot() (*scimFilter, error) {
+	if this.keyword("not") {
+		if err := this.expect("("); err != nil {
+			return nil, err
+		}
+		f, err := this.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := this.expect(")"); err != nil {
+			return nil, err
+		}
+		return &scimFilter{Op: "not", Children: []*scimFilter{f}}, nil
+	}
+	return this.parseAtom()
+}
+
+func (this *scimFilterParser) parseAtom() (*scimFilter, error) {
+	t, ok := this.peek()
+	if !ok {
+		return nil, errors.New("unexpected end of filter")
+	}
+	if !t.Quoted && t.Text == "(" {
+		this.pos++
+		f, err := this.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return f, this.expect(")")
+	}
+	if t.Quoted {
+		return nil, errors.New("expected attribute in filter")
+	}
+	this.pos++
+	path, err := parseScimAttrPath(t.Text)
+	if err != nil {
+		return nil, err
+	}
+	if next, ok := this.peek(); ok && !next.Quoted && next.Text == "[" {
+		this.pos++
+		inner, err := this.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := this.expect("]"); err != nil {
+			return nil, err
+		}
+		path.Filter = inner
+		return &scimFilter{Op: "[]", Path: path}, nil
+	}
+
+	op, ok := this.peek()
+	if !ok || op.Quoted {
+		return nil, errors.New("expected operator in filter")
+	}
+	this.pos++
+	switch strings.ToLower(op.Text) {
+	case "pr":
+		return &scimFilter{Op: "pr", Path: path}, nil
+	case "eq", "ne", "co", "sw", "ew", "gt", "ge", "lt", "le":
+	default:
+		return nil, errors.New("unknown filter operator: " + op.Text)
+	}
+	v, ok := this.peek()
+	if !ok {
+		return nil, errors.New("expected value in filter")
+	}
+	this.pos++
+	f := &scimFilter{Op: strings.ToLower(op.Text), Path: path}
+	if v.Quoted {
+		f.Value = v.Text
+	} else {
+		if err := json.Unmarshal([]byte(v.Text), &f.Value); err != nil {
+			return nil, errors.New("invalid value in filter: " + v.Text)
+		}
+	}
+	return f, nil
+}
+
+// parseScimAttrPath parses [schema:]attr[.sub]
+func parseScimAttrPath(s string) (*scimPath, error) {
+	path := new(scimPath)
+	for _, schema := range []string{scimSchemaUser, scimSchemaEnterpriseUser, scimSchemaGroup} {
+		if len(s) > len(schema) && strings.EqualFold(s[:len(schema)+1], schema+":") {
+			path.Schema = schema
+			s = s[len(schema)+1:]
+			break
+		}
+	}
+	attr, sub, _ := strings.Cut(s, ".")
+	if len(attr) == 0 {
+		return nil, errors.New("invalid attribute path")
+	}
+	path.Attr = attr
+	path.Sub = sub
+	return path, nil
+}
+
+// parseScimPath parses the path of a PATCH operation
+func parseScimPath(s string) (*scimPath, error) {
+	open := strings.Index(s, "[")
+	if open < 0 {
+		return parseScimAttrPath(s)
+	}
+	closing := strings.LastIndex(s, "]")
+	if closing < open {
+		return nil, errors.New("invalid path: " + s)
+	}
+	path, err := parseScimAttrPath(s[:open])
+	if err != nil {
+		return nil, err
+	}
+	if len(path.Sub) > 0 {
+		return nil, errors.New("invalid path: " + s)
+	}
+	filter, err := parseScimFilter(s[open+1 : closing])
+	if err != nil {
+		return nil, err
+	}
+	path.Filter = filter
+	if rest := s[closing+1:]; len(rest) > 0 {
+		if !strings.HasPrefix(rest, ".") || len(rest) == 1 {
+			return nil, errors.New("invalid path: " + s)
+		}
+		path.Sub = rest[1:]
+	}
+	return path, nil
+}
+
+// container returns the object holding the attribute of the path, the
+// resource itself or its extension
+func (this *scimPath) container(resource map[string]interface{}, create bool) map[string]interface{} {
+	if len(this.Schema) == 0 || this.Schema == scimSchemaUser || this.Schema == scimSchemaGroup {
+		return resource
+	}
+	key := scimKey(resource, this.Schema)
+	ext, ok := resource[key].(map[string]interface{})
+	if !ok && create {
+		ext = map[string]interface{}{}
+		resource[key] = ext
+	}
+	return ext
+}
+
+// scimKey returns the key of the object matching name case-insensitively,
+// name when there is none
+func scimKey(m map[string]interface{}, name string) string {
+	if _, ok := m[name]; ok {
+		return name
+	}
+	for k := range m {
+		if strings.EqualFold(k, name) {
+			return k
+		}
+	}
+	return name
+}
+
+func (this *scimFilter) Match(resource map[string]interface{}) bool {
+	switch this.Op {
+	case "and":
+		return this.Children[0].Match(resource) && this.Children[1].Match(resource)
+	case "or":
+		return this.Children[0].Match(resource) || this.Children[1].Match(resource)
+	case "not":
+		return !this.Children[0].Match(resource)
+	case "[]":
+		for _, e := range this.Path.elements(resource) {
+			if m, ok := e.(map[string]interface{}); ok && this.Path.Filter.Match(m) {
+				return true
+			}
+		}
+		return false
+	}
+
+	values := this.Path.values(resource)
+	if this.Op == "pr" {
+		for _, v := range values {
+			if !isEmptyScimValue(v) {
+				return true
+			}
+		}
+		return false
+	}
+	if this.Op == "ne" {
+		for _, v := range values {
+			if compareScimValue(v, this.Value) == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	for _, v := range values {
+		if matchScimValue(this.Op, v, this.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// elements returns the values of the attribute, the elements when it is multi-valued
+func (this *scimPath) elements(resource map[string]interface{}) []interface{} {
+	c := this.container(resource, false)
+	if c == nil {
+		return nil
+	}
+	v, ok := c[scimKey(c, this.Attr)]
+	if !ok || v == nil {
+		return nil
+	}
+	if a, ok := v.([]interface{}); ok {
+		return a
+	}
+	return []interface{}{v}
+}
+
+// values returns the values selected by the path, the value sub attribute of
+// multi-valued complex attributes when no sub attribute is given
+func (this *scimPath) values(resource map[string]interface{}) []interface{} {
+	var values []interface{}
+	for _, e := range this.elements(resource) {
+		m, ok := e.(map[string]interface{})
+		if !ok {
+			values = append(values, e)
+			continue
+		}
+		sub := this.Sub
+		if len(sub) == 0 {
+			sub = "value"
+		}
+		if v, ok := m[scimKey(m, sub)]; ok {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func isEmptyScimValue(v interface{}) bool {
+	switch t := v.(type) {
+	case nil:
+		return true
+	case string:
+		return len(t) == 0
+	case []interface{}:
+		return len(t) == 0
+	case map[string]interface{}:
+		return len(t) == 0
+	}
+	return false
+}
+
+// compareScimValue compares strings case-insensitively and numbers
+// numerically, other values are equal or not (-2)
+func compareScimValue(v, assertion interface{}) int {
+	switch a := assertion.(type) {
+	case string:
+		s, ok := v.(string)
+		if !ok {
+			return -2
+		}
+		return strings.Compare(strings.ToLower(s), strings.ToLower(a))
+	case float64:
+		n, ok := v.(float64)
+		if !ok {
+			return -2
+		}
+		switch {
+		case n < a:
+			return -1
+		case n > a:
+			return 1
+		}
+		return 0
+	case bool:
+		if b, ok := v.(bool); ok && b == a {
+			return 0
+		}
+		if s, ok := v.(string); ok && strings.EqualFold(s, boolString(a)) {
+			return 0
+		}
+		return -2
+	case nil:
+		if v == nil {
+			return 0
+		}
+		return -2
+	}
+	return -2
+}
+
+func matchScimValue(op string, v, assertion interface{}) bool {
+	if op == "co" || op == "sw" || op == "ew" {
+		s, ok1 := v.(string)
+		a, ok2 := assertion.(string)
+		if !ok1 || !ok2 {
+			return false
+		}
+		s, a = strings.ToLower(s), strings.ToLower(a)
+		switch op {
+		case "co":
+			return strings.Contains(s, a)
+		case "sw":
+			return strings.HasPrefix(s, a)
+		default:
+			return strings.HasSuffix(s, a)
+		}
+	}
+	c := compareScimValue(v, assertion)
+	if c == -2 && op != "eq" {
+		return false
+	}
+	switch op {
+	case "eq":
+		return c == 0
+	case "gt":
+		return c > 0
+	case "ge":
+		return c >= 0
+	case "lt":
+		return c < 0
+	case "le":
+		return c <= 0
+	}
+	return false
+}
+
+func boolString(b bool) string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
@@ -0,0 +1,610 @@
+package ldap
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/meidomx/misc-service/config"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jimlambrt/gldap"
+)
+
+// SCIM 2.0 (RFC 7643, RFC 7644) provisioning of users and groups stored as
+// directory entries. Requests authenticate like the http gateway. Bulk,
+// sorting and the /Me endpoint are not supported.
+const (
+	scimSchemaUser                  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimSchemaEnterpriseUser        = "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User"
+	scimSchemaGroup                 = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimSchemaListResponse          = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimSchemaError                 = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimSchemaServiceProviderConfig = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimSchemaResourceType          = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+
+	scimContentType  = "application/scim+json"
+	scimDefaultCount = 100
+	scimMaxCount     = 1000
+)
+
+// scimKind is a resource type and where its entries are stored
+type scimKind struct {
+	Name        string
+	Endpoint    string
+	Schema      string
+	BaseDN      string
+	ObjectClass string
+}
+
+type scimService struct {
+	server *ldapServer
+	users  *scimKind
+	groups *scimKind
+}
+
+// scimError is reported with its http status and scimType
+type scimError struct {
+	Status   int
+	ScimType string
+	Detail   string
+}
+
+func (this *scimError) Error() string {
+	return this.Detail
+}
+
+func newScimError(scimType, detail string) error {
+	return &scimError{Status: http.StatusBadRequest, ScimType: scimType, Detail: detail}
+}
+
+func InitScim(engine *gin.Engine, c *config.Config, server *ldapServer, throttle *bindThrottle) {
+	if len(c.LDAP.SCIM.UsersBaseDN) == 0 || len(c.LDAP.SCIM.GroupsBaseDN) == 0 {
+		log.Fatalf("scim requires ldap.scim.users_base_dn and ldap.scim.groups_base_dn")
+	}
+	this := &scimService{
+		server: server,
+		users: &scimKind{
+			Name:        "User",
+			Endpoint:    "Users",
+			Schema:      scimSchemaUser,
+			BaseDN:      c.LDAP.SCIM.UsersBaseDN,
+			ObjectClass: "inetOrgPerson",
+		},
+		groups: &scimKind{
+			Name:        "Group",
+			Endpoint:    "Groups",
+			Schema:      scimSchemaGroup,
+			BaseDN:      c.LDAP.SCIM.GroupsBaseDN,
+			ObjectClass: "groupOfNames",
+		},
+	}
+
+	g := engine.Group("/scim/v2", RestAuth(server, throttle))
+	g.GET("/ServiceProviderConfig", this.ServiceProviderConfig)
+	g.GET("/ResourceTypes", this.ResourceTypes)
+	for _, kind := range []*scimKind{this.users, this.groups} {
+		g.GET("/"+kind.Endpoint, this.ListResources(kind))
+		g.POST("/"+kind.Endpoint, this.RequireAdmin, this.CreateResource(kind))
+		g.GET("/"+kind.Endpoint+"/:id", this.GetResource(kind))
+		g.PUT("/"+kind.Endpoint+"/:id", this.RequireAdmin, this.ReplaceResource(kind))
+		g.PATCH("/"+kind.Endpoint+"/:id", this.RequireAdmin, this.PatchResource(kind))
+		g.DELETE("/"+kind.Endpoint+"/:id", this.RequireAdmin, this.DeleteResource(kind))
+	}
+}
+
+// RequireAdmin restricts provisioning to the administrators of the directory
+func (this *scimService) RequireAdmin(ctx *gin.Context) {
+	if !this.server.isAdmin(restBoundDN(ctx)) {
+		writeScimError(ctx, &scimError{Status: http.StatusForbidden, Detail: "insufficient access rights"})
+		ctx.Abort()
+		return
+	}
+	ctx.Next()
+}
+
+func (this *scimService) ServiceProviderConfig(ctx *gin.Context) {
+	writeScim(ctx, http.StatusOK, map[string]interface{}{
+		"schemas":        []string{scimSchemaServiceProviderConfig},
+		"patch":          map[string]interface{}{"supported": true},
+		"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]interface{}{"supported": true, "maxResults": scimMaxCount},
+		"changePassword": map[string]interface{}{"supported": true},
+		"sort":           map[string]interface{}{"supported": false},
+		"etag":           map[string]interface{}{"supported": true},
+		"authenticationSchemes": []interface{}{map[string]interface{}{
+			"type":        "httpbasic",
+			"name":        "HTTP Basic",
+			"description": "Authentication with a directory bind name and password",
+		}},
+	})
+}
+
+func (this *scimService) ResourceTypes(ctx *gin.Context) {
+	var resources []interface{}
+	for _, kind := range []*scimKind{this.users, this.groups} {
+		r := map[string]interface{}{
+			"schemas":  []string{scimSchemaResourceType},
+			"id":       kind.Name,
+			"name":     kind.Name,
+			"endpoint": "/" + kind.Endpoint,
+			"schema":   kind.Schema,
+		}
+		if kind == this.users {
+			r["schemaExtensions"] = []interface{}{map[string]interface{}{"schema": scimSchemaEnterpriseUser, "required": false}}
+		}
+		resources = append(resources, r)
+	}
+	writeScimList(ctx, resources, len(resources), 1)
+}
+
+// ListResources supports the filter, startIndex, count, attributes and
+// excludedAttributes query parameters
+func (this *scimService) ListResources(kind *scimKind) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		var filter *scimFilter
+		if f := ctx.Query("filter"); len(f) > 0 {
+			var err error
+			if filter, err = parseScimFilter(f); err != nil {
+				writeScimError(ctx, newScimError("invalidFilter", err.Error()))
+				return
+			}
+		}
+		startIndex, err := strconv.Atoi(ctx.DefaultQuery("startIndex", "1"))
+		if err != nil {
+			writeScimError(ctx, newScimError("invalidValue", "invalid startIndex"))
+			return
+		}
+		if startIndex < 1 {
+			startIndex = 1
+		}
+		count, err := strconv.Atoi(ctx.DefaultQuery("count", strconv.Itoa(scimDefaultCount)))
+		if err != nil {
+			writeScimError(ctx, newScimError("invalidValue", "invalid count"))
+			return
+		}
+		if count < 0 {
+			count = 0
+		}
+		if count > scimMaxCount {
+			count = scimMaxCount
+		}
+
+		var matched []map[string]interface{}
+		err = this.walkResources(kind, func(entry *gldap.Entry) bool {
+			r := this.resource(ctx, kind, entry)
+			if filter == nil || filter.Match(r) {
+				matched = append(matched, r)
+			}
+			return true
+		})
+		if err != nil {
+			log.Println("list scim resources error:", err)
+			writeScimError(ctx, &scimError{Status: http.StatusInternalServerError, Detail: "internal error"})
+			return
+		}
+
+		resources := []interface{}{}
+		for i := startIndex - 1; i < len(matched) && len(resources) < count; i++ {
+			resources = append(resources, projectScimResource(ctx, matched[i]))
+		}
+		writeScimList(ctx, resources, len(matched), startIndex)
+	}
+}
+
+func (this *scimService) GetResource(kind *scimKind) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		entry, ok := this.findForRequest(ctx, kind)
+		if !ok {
+			return
+		}
+		version := scimVersion(entry)
+		if match := ctx.GetHeader("If-None-Match"); len(match) > 0 && etagMatches(match, version) {
+			ctx.Header("ETag", version)
+			ctx.Status(http.StatusNotModified)
+			return
+		}
+		ctx.Header("ETag", version)
+		writeScim(ctx, http.StatusOK, projectScimResource(ctx, this.resource(ctx, kind, entry)))
+	}
+}
+
+func (this *scimService) CreateResource(kind *scimKind) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		r, ok := readScimResource(ctx)
+		if !ok {
+			return
+		}
+		entry, err := this.entry(kind, r, nil)
+		if err != nil {
+			writeScimError(ctx, err)
+			return
+		}
+		res := newRestResult()
+		this.server.commitOps([]*txnOp{{
+			Kind:    ChangeTypeAdd,
+			DN:      entry.DN,
+			Entry:   entry,
+			BoundDN: restBoundDN(ctx),
+		}}, res)
+		if res.Code != gldap.ResultSuccess {
+			writeScimResult(ctx, res)
+			return
+		}
+		this.writeStored(ctx, kind, entry.DN, http.StatusCreated)
+	}
+}
+
+func (this *scimService) ReplaceResource(kind *scimKind) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		existing, ok := this.findForRequest(ctx, kind)
+		if !ok || !checkScimPrecondition(ctx, existing) {
+			return
+		}
+		r, ok := readScimResource(ctx)
+		if !ok {
+			return
+		}
+		this.update(ctx, kind, existing, r)
+	}
+}
+
+func (this *scimService) PatchResource(kind *scimKind) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		existing, ok := this.findForRequest(ctx, kind)
+		if !ok || !checkScimPrecondition(ctx, existing) {
+			return
+		}
+		req := new(ScimPatchRequest)
+		if err := json.NewDecoder(ctx.Request.Body).Decode(req); err != nil {
+			writeScimError(ctx, newScimError("invalidSyntax", "invalid request body"))
+			return
+		}
+		r := this.resource(ctx, kind, existing)
+		if err := applyScimPatch(r, req.Operations); err != nil {
+			writeScimError(ctx, err)
+			return
+		}
+		this.update(ctx, kind, existing, r)
+	}
+}
+
+func (this *scimService) DeleteResource(kind *scimKind) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		existing, ok := this.findForRequest(ctx, kind)
+		if !ok || !checkScimPrecondition(ctx, existing) {
+			return
+		}
+		boundDN := restBoundDN(ctx)
+		ops, err := this.memberOps(existing.DN, "", boundDN)
+		if err != nil {
+			log.Println("find scim group members error:", err)
+			writeScimError(ctx, &scimError{Status: http.StatusInternalServerError, Detail: "internal error"})
+			return
+		}
+		ops = append(ops, &txnOp{Kind: ChangeTypeDelete, DN: existing.DN, BoundDN: boundDN, Assert: scimPrecondition(ctx)})
+		res := newRestResult()
+		this.server.commitOps(ops, res)
+		if res.Code != gldap.ResultSuccess {
+			writeScimResult(ctx, res)
+			return
+		}
+		ctx.Status(http.StatusNoContent)
+	}
+}
+
+// update stores resource r in place of the existing entry. A changed
+// userName or group displayName renames the entry, the member values of the
+// groups referring to it follow.
+func (this *scimService) update(ctx *gin.Context, kind *scimKind, existing *gldap.Entry, r map[string]interface{}) {
+	if id := scimString(r, "id"); len(id) > 0 && id != firstValue(existing, attributeEntryUUID) {
+		writeScimError(ctx, newScimError("mutability", "id can't be changed"))
+		return
+	}
+	entry, err := this.entry(kind, r, existing)
+	if err != nil {
+		writeScimError(ctx, err)
+		return
+	}
+	boundDN := restBoundDN(ctx)
+	assert := scimPrecondition(ctx)
+	var ops []*txnOp
+	if NormalizeDN(entry.DN) != NormalizeDN(existing.DN) {
+		ops = append(ops, &txnOp{
+			Kind:         ChangeTypeModRDN,
+			DN:           existing.DN,
+			BoundDN:      boundDN,
+			NewRDN:       SplitDN(entry.DN)[0],
+			DeleteOldRDN: true,
+			Assert:       assert,
+		})
+		assert = nil
+		memberOps, err := this.memberOps(existing.DN, entry.DN, boundDN)
+		if err != nil {
+			log.Println("find scim group members error:", err)
+			writeScimError(ctx, &scimError{Status: http.StatusInternalServerError, Detail: "internal error"})
+			return
+		}
+		ops = append(ops, memberOps...)
+	}
+	if changes := scimChanges(existing, entry); len(changes) > 0 {
+		ops = append(ops, &txnOp{Kind: ChangeTypeModify, DN: entry.DN, Changes: changes, BoundDN: boundDN, Assert: assert})
+	}
+	res := newRestResult()
+	this.server.commitOps(ops, res)
+	if res.Code != gldap.ResultSuccess {
+		writeScimResult(ctx, res)
+		return
+	}
+	this.writeStored(ctx, kind, entry.DN, http.StatusOK)
+}
+
+// memberOps replaces dn by newDN in the member values of the groups, removes
+// it when newDN is empty
+func (this *scimService) memberOps(dn, newDN, boundDN string) ([]*txnOp, error) {
+	var ops []*txnOp
+	err := WalkScope(this.server.backend, this.groups.BaseDN, gldap.WholeSubtree, func(group *gldap.Entry) bool {
+		members := EntryAttributeValues(group, attributeMember)
+		var updated []string
+		found := false
+		for _, m := range members {
+			if NormalizeDN(m) != NormalizeDN(dn) {
+				updated = append(updated, m)
+				continue
+			}
+			found = true
+			if len(newDN) > 0 {
+				updated = append(updated, newDN)
+			}
+		}
+		if !found || NormalizeDN(group.DN) == NormalizeDN(dn) {
+			return true
+		}
+		change := gldap.Change{
+			Operation:    gldap.ReplaceAttribute,
+			Modification: gldap.PartialAttribute{Type: attributeName(group, attributeMember), Vals: updated},
+		}
+		if len(updated) == 0 {
+			change.Operation = gldap.DeleteAttribute
+		}
+		ops = append(ops, &txnOp{Kind: ChangeTypeModify, DN: group.DN, Changes: []gldap.Change{change}, BoundDN: boundDN})
+		return true
+	})
+	return ops, err
+}
+
+func (this *scimService) writeStored(ctx *gin.Context, kind *scimKind, dn string, status int) {
+	entry, err := this.server.backend.FindOneEntry(dn)
+	if err != nil || len(entry.DN) <= 0 {
+		log.Println("read stored scim resource error:", err)
+		writeScimError(ctx, &scimError{Status: http.StatusInternalServerError, Detail: "internal error"})
+		return
+	}
+	r := this.resource(ctx, kind, entry)
+	ctx.Header("ETag", scimVersion(entry))
+	ctx.Header("Location", scimLocation(ctx, kind, firstValue(entry, attributeEntryUUID)))
+	writeScim(ctx, status, r)
+}
+
+func (this *scimService) resource(ctx *gin.Context, kind *scimKind, entry *gldap.Entry) map[string]interface{} {
+	var r map[string]interface{}
+	if kind == this.users {
+		r = this.userResource(entry)
+	} else {
+		r = this.groupResource(entry)
+	}
+	r["meta"] = scimMeta(entry, kind, scimLocation(ctx, kind, firstValue(entry, attributeEntryUUID)))
+	return r
+}
+
+func (this *scimService) entry(kind *scimKind, r map[string]interface{}, existing *gldap.Entry) (*gldap.Entry, error) {
+	if kind == this.users {
+		return this.userEntry(r, existing)
+	}
+	return this.groupEntry(r, existing)
+}
+
+func (this *scimService) walkResources(kind *scimKind, f func(entry *gldap.Entry) bool) error {
+	return WalkScope(this.server.backend, kind.BaseDN, gldap.WholeSubtree, func(entry *gldap.Entry) bool {
+		if !hasObjectClass(entry, kind.ObjectClass) || len(firstValue(entry, attributeEntryUUID)) == 0 {
+			return true
+		}
+		return f(entry)
+	})
+}
+
+// findResource returns the entry of the resource with the id, nil if there is none
+func (this *scimService) findResource(kind *scimKind, id string) (*gldap.Entry, error) {
+	if len(id) == 0 {
+		return nil, nil
+	}
+	entries, err := this.server.backend.FindByAttribute(attributeEntryUUID, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if hasObjectClass(entry, kind.ObjectClass) && IsDNInScope(entry.DN, kind.BaseDN, gldap.WholeSubtree) {
+			return entry, nil
+		}
+	}
+	return nil, nil
+}
+
+func (this *scimService) findForRequest(ctx *gin.Context, kind *scimKind) (*gldap.Entry, bool) {
+	entry, err := this.findResource(kind, ctx.Param("id"))
+	if err != nil {
+		log.Println("find scim resource error:", err)
+		writeScimError(ctx, &scimError{Status: http.StatusInternalServerError, Detail: "internal error"})
+		return nil, false
+	}
+	if entry == nil {
+		writeScimError(ctx, &scimError{Status: http.StatusNotFound, Detail: "resource " + ctx.Param("id") + " not found"})
+		return nil, false
+	}
+	return entry, true
+}
+
+// resourceOf returns the entry at dn when it is a user or group resource
+func (this *scimService) resourceOf(dn string) *gldap.Entry {
+	entry, err := this.server.backend.FindOneEntry(dn)
+	if err != nil || len(entry.DN) <= 0 || len(firstValue(entry, attributeEntryUUID)) == 0 {
+		return nil
+	}
+	if this.kindOf(entry) == nil {
+		return nil
+	}
+	return entry
+}
+
+func (this *scimService) kindOf(entry *gldap.Entry) *scimKind {
+	for _, kind := range []*scimKind{this.users, this.groups} {
+		if hasObjectClass(entry, kind.ObjectClass) && IsDNInScope(entry.DN, kind.BaseDN, gldap.WholeSubtree) {
+			return kind
+		}
+	}
+	return nil
+}
+
+func readScimResource(ctx *gin.Context) (map[string]interface{}, bool) {
+	r := map[string]interface{}{}
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&r); err != nil {
+		writeScimError(ctx, newScimError("invalidSyntax", "invalid request body"))
+		return nil, false
+	}
+	return r, true
+}
+
+// checkScimPrecondition enforces If-Match on updates before the request is
+// processed, scimPrecondition checks it again within the update
+func checkScimPrecondition(ctx *gin.Context, entry *gldap.Entry) bool {
+	match := ctx.GetHeader("If-Match")
+	if len(match) == 0 || etagMatches(match, scimVersion(entry)) {
+		return true
+	}
+	writeScimError(ctx, &scimError{Status: http.StatusPreconditionFailed, Detail: "resource has been modified"})
+	return false
+}
+
+// scimPrecondition returns the If-Match check of the request for the stored
+// entry, nil without If-Match
+func scimPrecondition(ctx *gin.Context) func(entry *gldap.Entry) bool {
+	match := ctx.GetHeader("If-Match")
+	if len(match) == 0 {
+		return nil
+	}
+	return func(entry *gldap.Entry) bool {
+		return etagMatches(match, scimVersion(entry))
+	}
+}
+
+func etagMatches(header, version string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(version, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+func scimLocation(ctx *gin.Context, kind *scimKind, id string) string {
+	scheme := "http"
+	if ctx.Request.TLS != nil || ctx.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + ctx.Request.Host + "/scim/v2/" + kind.Endpoint + "/" + id
+}
+
+// projectScimResource applies the attributes and excludedAttributes query
+// parameters to the top level attributes, id, schemas and meta are kept
+func projectScimResource(ctx *gin.Context, r map[string]interface{}) map[string]interface{} {
+	attributes := scimAttributeNames(ctx.Query("attributes"))
+	excluded := scimAttributeNames(ctx.Query("excludedAttributes"))
+	if len(attributes) == 0 && len(excluded) == 0 {
+		return r
+	}
+	projected := map[string]interface{}{}
+	for k, v := range r {
+		name := strings.ToLower(k)
+		switch {
+		case name == "id" || name == "schemas" || name == "meta":
+		case len(attributes) > 0 && !attributes[name]:
+			continue
+		case excluded[name]:
+			continue
+		}
+		projected[k] = v
+	}
+	return projected
+}
+
+func scimAttributeNames(s string) map[string]bool {
+	names := map[string]bool{}
+	for _, a := range strings.Split(s, ",") {
+		a = strings.TrimSpace(a)
+		if len(a) == 0 {
+			continue
+		}
+		path, err := parseScimAttrPath(a)
+		if err != nil {
+			continue
+		}
+		if path.Schema == scimSchemaEnterpriseUser {
+			names[strings.ToLower(scimSchemaEnterpriseUser)] = true
+		} else {
+			names[strings.ToLower(path.Attr)] = true
+		}
+	}
+	return names
+}
+
+func writeScim(ctx *gin.Context, status int, body interface{}) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		log.Println("encode scim response error:", err)
+		ctx.Status(http.StatusInternalServerError)
+		return
+	}
+	ctx.Data(status, scimContentType, data)
+}
+
+func writeScimList(ctx *gin.Context, resources []interface{}, total, startIndex int) {
+	writeScim(ctx, http.StatusOK, map[string]interface{}{
+		"schemas":      []string{scimSchemaListResponse},
+		"totalResults": total,
+		"itemsPerPage": len(resources),
+		"startIndex":   startIndex,
+		"Resources":    resources,
+	})
+}
+
+func writeScimError(ctx *gin.Context, err error) {
+	se, ok := err.(*scimError)
+	if !ok {
+		log.Println("scim request error:", err)
+		se = &scimError{Status: http.StatusInternalServerError, Detail: "internal error"}
+	}
+	body := map[string]interface{}{
+		"schemas": []string{scimSchemaError},
+		"status":  strconv.Itoa(se.Status),
+		"detail":  se.Detail,
+	}
+	if len(se.ScimType) > 0 {
+		body["scimType"] = se.ScimType
+	}
+	writeScim(ctx, se.Status, body)
+}
+
+// writeScimResult reports a failed directory update
+func writeScimResult(ctx *gin.Context, res *restResult) {
+	se := &scimError{Status: restStatus(res.Code), Detail: res.Message}
+	if res.Code == gldap.ResultEntryAlreadyExists {
+		se.ScimType = "uniqueness"
+	}
+	if len(se.Detail) == 0 {
+		se.Detail = "directory update failed"
+	}
+	writeScimError(ctx, se)
+}
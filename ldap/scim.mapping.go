@@ -0,0 +1,448 @@
+package ldap
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jimlambrt/gldap"
+)
+
+// Users are inetOrgPerson entries uid=<userName>,<users_base_dn>, groups are
+// groupOfNames entries cn=<displayName>,<groups_base_dn>. The SCIM id is kept
+// in entryUUID. Attributes of an entry which have no SCIM counterpart are
+// left as they are by updates.
+const (
+	attributeEntryUUID       = "entryUUID"
+	attributeScimExternalId  = "scimExternalId"
+	attributeScimActive      = "scimActive"
+	attributeCreateTimestamp = "createTimestamp"
+	attributeModifyTimestamp = "modifyTimestamp"
+
+	generalizedTimeLayout = "20060102150405Z"
+)
+
+var (
+	scimUserObjectClasses  = []string{"top", "person", "organizationalPerson", "inetOrgPerson"}
+	scimGroupObjectClasses = []string{"top", "groupOfNames"}
+
+	// scimUserAttributes are the attributes written from a user resource
+	scimUserAttributes = []string{
+		"uid", "cn", "sn", "givenName", "displayName", "mail", "telephoneNumber", "title",
+		"preferredLanguage", "employeeNumber", "departmentNumber", "o", "manager",
+		attributeScimExternalId, attributeScimActive,
+	}
+	// scimGroupAttributes are the attributes written from a group resource,
+	// members which are no SCIM resource are kept
+	scimGroupAttributes = []string{"cn", attributeScimExternalId}
+)
+
+func newScimId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	// uuid version 4
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+}
+
+// scimVersion is the ETag of an entry, a hash of its attributes
+func scimVersion(entry *gldap.Entry) string {
+	var lines []string
+	for _, a := range entry.Attributes {
+		for _, v := range a.Values {
+			lines = append(lines, strings.ToLower(a.Name)+":"+v)
+		}
+	}
+	sort.Strings(lines)
+	sum := sha1.Sum([]byte(strings.Join(lines, "\n")))
+	return `W/"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (this *scimService) userResource(entry *gldap.Entry) map[string]interface{} {
+	r := map[string]interface{}{
+		"schemas":  []interface{}{scimSchemaUser},
+		"id":       firstValue(entry, attributeEntryUUID),
+		"userName": firstValue(entry, "uid"),
+		"active":   !strings.EqualFold(firstValue(entry, attributeScimActive), "FALSE"),
+	}
+	setScimString(r, "externalId", firstValue(entry, attributeScimExternalId))
+	setScimString(r, "displayName", firstValue(entry, "displayName"))
+	setScimString(r, "title", firstValue(entry, "title"))
+	setScimString(r, "preferredLanguage", firstValue(entry, "preferredLanguage"))
+
+	name := map[string]interface{}{}
+	setScimString(name, "formatted", firstValue(entry, "cn"))
+	setScimString(name, "familyName", firstValue(entry, "sn"))
+	setScimString(name, "givenName", firstValue(entry, "givenName"))
+	r["name"] = name
+
+	var emails []interface{}
+	for i, v := range EntryAttributeValues(entry, "mail") {
+		emails = append(emails, map[string]interface{}{"value": v, "type": "work", "primary": i == 0})
+	}
+	if len(emails) > 0 {
+		r["emails"] = emails
+	}
+	var phones []interface{}
+	for _, v := range EntryAttributeValues(entry, "telephoneNumber") {
+		phones = append(phones, map[string]interface{}{"value": v, "type": "work"})
+	}
+	if len(phones) > 0 {
+		r["phoneNumbers"] = phones
+	}
+
+	enterprise := map[string]interface{}{}
+	setScimString(enterprise, "employeeNumber", firstValue(entry, "employeeNumber"))
+	setScimString(enterprise, "department", firstValue(entry, "departmentNumber"))
+	setScimString(enterprise, "organization", firstValue(entry, "o"))
+	if managerDN := firstValue(entry, "manager"); len(managerDN) > 0 {
+		if manager := this.resourceOf(managerDN); manager != nil {
+			m := map[string]interface{}{"value": firstValue(manager, attributeEntryUUID)}
+			setScimString(m, "displayName", firstValue(manager, "displayName"))
+			enterprise["manager"] = m
+		}
+	}
+	if len(enterprise) > 0 {
+		r["schemas"] = []interface{}{scimSchemaUser, scimSchemaEnterpriseUser}
+		r[scimSchemaEnterpriseUser] = enterprise
+	}
+	return r
+}
+
+// userEntry builds the entry of a user resource, existing is the stored entry
+// for updates
+func (this *scimService) userEntry(r map[string]interface{}, existing *gldap.Entry) (*gldap.Entry, error) {
+	userName := strings.TrimSpace(scimString(r, "userName"))
+	if len(userName) == 0 {
+		return nil, newScimError("invalidValue", "userName is required")
+	}
+	if !isScimRDNValue(userName) {
+		return nil, newScimError("invalidValue", "userName contains characters not allowed in a DN")
+	}
+	attrs := keptAttributes(existing, scimUserAttributes)
+	attrs["objectClass"] = mergeValues(attrs["objectClass"], scimUserObjectClasses)
+	attrs["uid"] = []string{userName}
+
+	name := scimObject(r, "name")
+	given := scimString(name, "givenName")
+	family := scimString(name, "familyName")
+	displayName := scimString(r, "displayName")
+	cn := scimString(name, "formatted")
+	if len(cn) == 0 {
+		cn = displayName
+	}
+	if len(cn) == 0 {
+		cn = strings.TrimSpace(given + " " + family)
+	}
+	if len(cn) == 0 {
+		cn = userName
+	}
+	sn := family
+	if len(sn) == 0 {
+		sn = userName
+	}
+	setValues(attrs, "cn", cn)
+	setValues(attrs, "sn", sn)
+	setValues(attrs, "givenName", given)
+	setValues(attrs, "displayName", displayName)
+	setValues(attrs, "title", scimString(r, "title"))
+	setValues(attrs, "preferredLanguage", scimString(r, "preferredLanguage"))
+	setValues(attrs, attributeScimExternalId, scimString(r, "externalId"))
+	setValues(attrs, "mail", scimMultiValues(r, "emails")...)
+	setValues(attrs, "telephoneNumber", scimMultiValues(r, "phoneNumbers")...)
+	active, err := scimBool(r, "active", true)
+	if err != nil {
+		return nil, err
+	}
+	setValues(attrs, attributeScimActive, strings.ToUpper(boolString(active)))
+	if password := scimString(r, "password"); len(password) > 0 {
+		attrs["userPassword"] = []string{password}
+	}
+
+	enterprise := scimObject(r, scimSchemaEnterpriseUser)
+	setValues(attrs, "employeeNumber", scimString(enterprise, "employeeNumber"))
+	setValues(attrs, "departmentNumber", scimString(enterprise, "department"))
+	setValues(attrs, "o", scimString(enterprise, "organization"))
+	if managerId := scimString(scimObject(enterprise, "manager"), "value"); len(managerId) > 0 {
+		manager, err := this.findResource(this.users, managerId)
+		if err != nil {
+			return nil, err
+		}
+		if manager == nil {
+			return nil, newScimError("invalidValue", "unknown manager: "+managerId)
+		}
+		attrs["manager"] = []string{manager.DN}
+	}
+
+	if err := setScimMeta(attrs, existing); err != nil {
+		return nil, err
+	}
+	return gldap.NewEntry("uid="+userName+","+this.users.BaseDN, attrs), nil
+}
+
+func (this *scimService) groupResource(entry *gldap.Entry) map[string]interface{} {
+	r := map[string]interface{}{
+		"schemas":     []interface{}{scimSchemaGroup},
+		"id":          firstValue(entry, attributeEntryUUID),
+		"displayName": firstValue(entry, "cn"),
+	}
+	setScimString(r, "externalId", firstValue(entry, attributeScimExternalId))
+	var members []interface{}
+	for _, dn := range EntryAttributeValues(entry, attributeMember) {
+		member := this.resourceOf(dn)
+		if member == nil {
+			continue
+		}
+		kind := this.kindOf(member)
+		m := map[string]interface{}{
+			"value": firstValue(member, attributeEntryUUID),
+			"type":  kind.Name,
+		}
+		if kind == this.users {
+			setScimString(m, "display", firstValue(member, "displayName"))
+		} else {
+			setScimString(m, "display", firstValue(member, "cn"))
+		}
+		members = append(members, m)
+	}
+	if len(members) > 0 {
+		r["members"] = members
+	}
+	return r
+}
+
+func (this *scimService) groupEntry(r map[string]interface{}, existing *gldap.Entry) (*gldap.Entry, error) {
+	displayName := strings.TrimSpace(scimString(r, "displayName"))
+	if len(displayName) == 0 {
+		return nil, newScimError("invalidValue", "displayName is required")
+	}
+	if !isScimRDNValue(displayName) {
+		return nil, newScimError("invalidValue", "displayName contains characters not allowed in a DN")
+	}
+	attrs := keptAttributes(existing, append(scimGroupAttributes, attributeMember))
+	attrs["objectClass"] = mergeValues(attrs["objectClass"], scimGroupObjectClasses)
+	attrs["cn"] = []string{displayName}
+	setValues(attrs, attributeScimExternalId, scimString(r, "externalId"))
+
+	var members []string
+	if existing != nil {
+		for _, dn := range EntryAttributeValues(existing, attributeMember) {
+			if this.resourceOf(dn) == nil {
+				members = append(members, dn)
+			}
+		}
+	}
+	for _, id := range scimMultiValues(r, "members") {
+		member, err := this.findResource(this.users, id)
+		if err == nil && member == nil {
+			member, err = this.findResource(this.groups, id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if member == nil {
+			return nil, newScimError("invalidValue", "unknown member: "+id)
+		}
+		members = mergeValues(members, []string{member.DN})
+	}
+	setValues(attrs, attributeMember, members...)
+
+	if err := setScimMeta(attrs, existing); err != nil {
+		return nil, err
+	}
+	return gldap.NewEntry("cn="+displayName+","+this.groups.BaseDN, attrs), nil
+}
+
+// setScimMeta keeps the id and creation time of an existing entry and sets
+// the modification time
+func setScimMeta(attrs map[string][]string, existing *gldap.Entry) error {
+	now := time.Now().UTC().Format(generalizedTimeLayout)
+	if existing != nil {
+		attrs[attributeEntryUUID] = []string{firstValue(existing, attributeEntryUUID)}
+		setValues(attrs, attributeCreateTimestamp, firstValue(existing, attributeCreateTimestamp))
+	} else {
+		id, err := newScimId()
+		if err != nil {
+			return err
+		}
+		attrs[attributeEntryUUID] = []string{id}
+		attrs[attributeCreateTimestamp] = []string{now}
+	}
+	attrs[attributeModifyTimestamp] = []string{now}
+	return nil
+}
+
+// scimMeta returns the meta attribute of a resource
+func scimMeta(entry *gldap.Entry, kind *scimKind, location string) map[string]interface{} {
+	meta := map[string]interface{}{
+		"resourceType": kind.Name,
+		"location":     location,
+		"version":      scimVersion(entry),
+	}
+	if t, err := time.Parse(generalizedTimeLayout, firstValue(entry, attributeCreateTimestamp)); err == nil {
+		meta["created"] = t.Format(time.RFC3339)
+	}
+	if t, err := time.Parse(generalizedTimeLayout, firstValue(entry, attributeModifyTimestamp)); err == nil {
+		meta["lastModified"] = t.Format(time.RFC3339)
+	}
+	return meta
+}
+
+// scimChanges returns the modifications turning entry old into new
+func scimChanges(old, new *gldap.Entry) []gldap.Change {
+	var changes []gldap.Change
+	for _, a := range old.Attributes {
+		if len(EntryAttributeValues(new, a.Name)) == 0 {
+			changes = append(changes, gldap.Change{
+				Operation:    gldap.DeleteAttribute,
+				Modification: gldap.PartialAttribute{Type: a.Name},
+			})
+		}
+	}
+	for _, a := range new.Attributes {
+		oldValues := EntryAttributeValues(old, a.Name)
+		switch {
+		case len(oldValues) == 0:
+			changes = append(changes, gldap.Change{
+				Operation:    gldap.AddAttribute,
+				Modification: gldap.PartialAttribute{Type: a.Name, Vals: a.Values},
+			})
+		case !sameValues(oldValues, a.Values):
+			changes = append(changes, gldap.Change{
+				Operation:    gldap.ReplaceAttribute,
+				Modification: gldap.PartialAttribute{Type: attributeName(old, a.Name), Vals: a.Values},
+			})
+		}
+	}
+	return changes
+}
+
+// isScimRDNValue reports whether s can be used as RDN value without escaping
+func isScimRDNValue(s string) bool {
+	return !strings.ContainsAny(s, ",+=\"\\<>;#")
+}
+
+func keptAttributes(entry *gldap.Entry, managed []string) map[string][]string {
+	attrs := map[string][]string{}
+	if entry == nil {
+		return attrs
+	}
+	for _, a := range entry.Attributes {
+		if containsFold(managed, a.Name) || containsFold([]string{attributeEntryUUID, attributeCreateTimestamp, attributeModifyTimestamp}, a.Name) {
+			continue
+		}
+		attrs[a.Name] = a.Values
+	}
+	return attrs
+}
+
+func setValues(attrs map[string][]string, name string, values ...string) {
+	var nonEmpty []string
+	for _, v := range values {
+		if len(v) > 0 {
+			nonEmpty = append(nonEmpty, v)
+		}
+	}
+	if len(nonEmpty) > 0 {
+		attrs[name] = nonEmpty
+	}
+}
+
+func mergeValues(values, added []string) []string {
+	for _, v := range added {
+		if !containsFold(values, v) {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func firstValue(entry *gldap.Entry, name string) string {
+	values := EntryAttributeValues(entry, name)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func setScimString(m map[string]interface{}, key, value string) {
+	if len(value) > 0 {
+		m[key] = value
+	}
+}
+
+func scimObject(m map[string]interface{}, key string) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	o, _ := m[scimKey(m, key)].(map[string]interface{})
+	return o
+}
+
+func scimString(m map[string]interface{}, key string) string {
+	if m == nil {
+		return ""
+	}
+	switch v := m[scimKey(m, key)].(type) {
+	case string:
+		return v
+	case bool:
+		return boolString(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
+
+// scimBool accepts booleans and the strings some clients send for them
+func scimBool(m map[string]interface{}, key string, defaultValue bool) (bool, error) {
+	switch v := m[scimKey(m, key)].(type) {
+	case nil:
+		return defaultValue, nil
+	case bool:
+		return v, nil
+	case string:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return false, newScimError("invalidValue", fmt.Sprint("invalid ", key, ": ", v))
+		}
+		return b, nil
+	}
+	return false, newScimError("invalidValue", "invalid "+key)
+}
+
+// scimMultiValues returns the value sub attributes of a multi-valued
+// attribute, the primary one first
+func scimMultiValues(m map[string]interface{}, key string) []string {
+	elements, _ := m[scimKey(m, key)].([]interface{})
+	var values []string
+	for _, e := range elements {
+		var v string
+		primary := false
+		switch t := e.(type) {
+		case string:
+			v = t
+		case map[string]interface{}:
+			v = scimString(t, "value")
+			primary, _ = scimBool(t, "primary", false)
+		}
+		if len(v) == 0 || containsFold(values, v) {
+			continue
+		}
+		if primary {
+			values = append([]string{v}, values...)
+		} else {
+			values = append(values, v)
+		}
+	}
+	return values
+}
@@ -0,0 +1,254 @@
+package ldap
+
+import (
+	"reflect"
+	"strings"
+)
+
+// SCIM PATCH (RFC 7644 3.5.2) applied to the JSON representation of a
+// resource, which is then stored like a replaced resource.
+
+type ScimPatchRequest struct {
+	Schemas    []string              `json:"schemas"`
+	Operations []*ScimPatchOperation `json:"Operations"`
+}
+
+type ScimPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+func applyScimPatch(resource map[string]interface{}, operations []*ScimPatchOperation) error {
+	for _, op := range operations {
+		kind := strings.ToLower(op.Op)
+		if kind != "add" && kind != "replace" && kind != "remove" {
+			return newScimError("invalidSyntax", "unknown patch operation: "+op.Op)
+		}
+		if len(op.Path) > 0 {
+			if err := applyScimPatchPath(resource, kind, op.Path, op.Value); err != nil {
+				return err
+			}
+			continue
+		}
+		if kind == "remove" {
+			return newScimError("noTarget", "remove requires a path")
+		}
+		// without path the value holds the attributes to add or replace
+		values, ok := op.Value.(map[string]interface{})
+		if !ok {
+			return newScimError("invalidValue", "value must be an object without path")
+		}
+		for k, v := range values {
+			if ext, ok := v.(map[string]interface{}); ok && strings.EqualFold(k, scimSchemaEnterpriseUser) {
+				for sk, sv := range ext {
+					if err := applyScimPatchPath(resource, kind, scimSchemaEnterpriseUser+":"+sk, sv); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if err := applyScimPatchPath(resource, kind, k, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func applyScimPatchPath(resource map[string]interface{}, kind, pathText string, value interface{}) error {
+	path, err := parseScimPath(pathText)
+	if err != nil {
+		return newScimError("invalidPath", err.Error())
+	}
+	c := path.container(resource, kind != "remove")
+	if c == nil {
+		return nil
+	}
+	key := scimKey(c, path.Attr)
+
+	if path.Filter == nil {
+		if len(path.Sub) > 0 {
+			return patchScimSubAttribute(c, key, kind, path.Sub, value)
+		}
+		switch kind {
+		case "add":
+			c[key] = addScimValue(c[key], value)
+		case "replace":
+			c[key] = value
+		case "remove":
+			if elements, ok := c[key].([]interface{}); ok && value != nil {
+				// remove the given elements only, e.g. members
+				c[key] = removeScimElements(elements, value)
+			} else {
+				delete(c, key)
+			}
+		}
+		return nil
+	}
+
+	elements, _ := c[key].([]interface{})
+	var kept []interface{}
+	matched := false
+	for _, e := range elements {
+		m, ok := e.(map[string]interface{})
+		if !ok || !path.Filter.Match(m) {
+			kept = append(kept, e)
+			continue
+		}
+		matched = true
+		switch {
+		case kind == "remove" && len(path.Sub) == 0:
+			continue
+		case kind == "remove":
+			delete(m, scimKey(m, path.Sub))
+		case len(path.Sub) > 0:
+			m[scimKey(m, path.Sub)] = value
+		default:
+			if v, ok := value.(map[string]interface{}); ok {
+				for vk, vv := range v {
+					m[scimKey(m, vk)] = vv
+				}
+			}
+		}
+		kept = append(kept, m)
+	}
+	if !matched && kind != "remove" {
+		// emails[type eq "work"].value adds the element when it is missing
+		e, ok := newScimElement(path.Filter)
+		if !ok {
+			return newScimError("noTarget", "no value matches path: "+pathText)
+		}
+		if len(path.Sub) > 0 {
+			e[path.Sub] = value
+		} else if v, ok := value.(map[string]interface{}); ok {
+			for vk, vv := range v {
+				e[vk] = vv
+			}
+		}
+		kept = append(kept, e)
+	}
+	if len(kept) == 0 {
+		delete(c, key)
+	} else {
+		c[key] = kept
+	}
+	return nil
+}
+
+func patchScimSubAttribute(c map[string]interface{}, key, kind, sub string, value interface{}) error {
+	switch v := c[key].(type) {
+	case map[string]interface{}:
+		if kind == "remove" {
+			delete(v, scimKey(v, sub))
+		} else {
+			v[scimKey(v, sub)] = value
+		}
+	case []interface{}:
+		for _, e := range v {
+			if m, ok := e.(map[string]interface{}); ok {
+				if kind == "remove" {
+					delete(m, scimKey(m, sub))
+				} else {
+					m[scimKey(m, sub)] = value
+				}
+			}
+		}
+	case nil:
+		if kind != "remove" {
+			c[key] = map[string]interface{}{sub: value}
+		}
+	default:
+		return newScimError("invalidPath", "attribute has no sub attributes: "+key)
+	}
+	return nil
+}
+
+// addScimValue appends to multi-valued attributes and merges complex ones
+func addScimValue(existing, value interface{}) interface{} {
+	switch e := existing.(type) {
+	case []interface{}:
+		added, ok := value.([]interface{})
+		if !ok {
+			added = []interface{}{value}
+		}
+		for _, a := range added {
+			if !containsScimElement(e, a) {
+				e = append(e, a)
+			}
+		}
+		return e
+	case map[string]interface{}:
+		if v, ok := value.(map[string]interface{}); ok {
+			for k, vv := range v {
+				e[scimKey(e, k)] = vv
+			}
+			return e
+		}
+	}
+	return value
+}
+
+func containsScimElement(elements []interface{}, value interface{}) bool {
+	for _, e := range elements {
+		if sameScimElement(e, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameScimElement compares complex elements by their value sub attribute
+func sameScimElement(a, b interface{}) bool {
+	am, ok1 := a.(map[string]interface{})
+	bm, ok2 := b.(map[string]interface{})
+	if ok1 && ok2 {
+		av, ok1 := am[scimKey(am, "value")]
+		bv, ok2 := bm[scimKey(bm, "value")]
+		if ok1 && ok2 {
+			return compareScimValue(av, bv) == 0
+		}
+	}
+	if s, ok := b.(string); ok {
+		return compareScimValue(a, s) == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func removeScimElements(elements []interface{}, value interface{}) []interface{} {
+	removed, ok := value.([]interface{})
+	if !ok {
+		removed = []interface{}{value}
+	}
+	var kept []interface{}
+	for _, e := range elements {
+		if !containsScimElement(removed, e) {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// newScimElement builds the element selected by a filter of eq comparisons
+func newScimElement(f *scimFilter) (map[string]interface{}, bool) {
+	switch f.Op {
+	case "eq":
+		if len(f.Path.Sub) > 0 || len(f.Path.Schema) > 0 {
+			return nil, false
+		}
+		return map[string]interface{}{f.Path.Attr: f.Value}, true
+	case "and":
+		e := map[string]interface{}{}
+		for _, c := range f.Children {
+			ce, ok := newScimElement(c)
+			if !ok {
+				return nil, false
+			}
+			for k, v := range ce {
+				e[k] = v
+			}
+		}
+		return e, true
+	}
+	return nil, false
+}
@@ -0,0 +1,86 @@
+package ldap
+
+import "sync"
+
+// ldapSession holds the per connection state of a listener
+type ldapSession struct {
+	BoundDN string
+	Txn     *ldapTxn
+}
+
+type sessionTable struct {
+	lock     sync.Mutex
+	sessions map[int]*ldapSession
+}
+
+func newSessionTable() *sessionTable {
+	return &sessionTable{
+		sessions: map[int]*ldapSession{},
+	}
+}
+
+func (this *sessionTable) get(connId int) *ldapSession {
+	s, ok := this.sessions[connId]
+	if !ok {
+		s = new(ldapSession)
+		this.sessions[connId] = s
+	}
+	return s
+}
+
+func (this *sessionTable) BoundDN(connId int) string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if s, ok := this.sessions[connId]; ok {
+		return s.BoundDN
+	}
+	return ""
+}
+
+func (this *sessionTable) SetBoundDN(connId int, dn string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.get(connId).BoundDN = dn
+}
+
+// Txn returns the open transaction of the connection with the identifier
+func (this *sessionTable) Txn(connId int, txnId string) *ldapTxn {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if s, ok := this.sessions[connId]; ok && s.Txn != nil && s.Txn.id == txnId {
+		return s.Txn
+	}
+	return nil
+}
+
+// BeginTxn opens a transaction with the identifier unless the connection
+// already has one
+func (this *sessionTable) BeginTxn(connId int, txnId string) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	s := this.get(connId)
+	if s.Txn != nil {
+		return false
+	}
+	s.Txn = &ldapTxn{id: txnId}
+	return true
+}
+
+// EndTxn detaches and returns the open transaction of the connection with
+// the identifier
+func (this *sessionTable) EndTxn(connId int, txnId string) *ldapTxn {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if s, ok := this.sessions[connId]; ok && s.Txn != nil && s.Txn.id == txnId {
+		txn := s.Txn
+		s.Txn = nil
+		return txn
+	}
+	return nil
+}
+
+func (this *sessionTable) Remove(connId int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	delete(this.sessions, connId)
+}
@@ -0,0 +1,142 @@
+package ldap
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	throttlePurgeInterval = time.Minute
+)
+
+// bindThrottle counts failed binds per source ip and per bound entry. Once a
+// key reaches its limit within the window, binds for it are rejected until
+// the lockout has passed.
+type bindThrottle struct {
+	lock sync.Mutex
+
+	maxPerIP int
+	maxPerDN int
+	window   time.Duration
+	lockout  time.Duration
+	// resolve returns the DN of the entry a bind name refers to, empty when
+	// there is none
+	resolve func(name string) string
+
+	ips       map[string]*bindFailures
+	dns       map[string]*bindFailures
+	lastPurge time.Time
+}
+
+type bindFailures struct {
+	count       int
+	windowStart time.Time
+	lockedUntil time.Time
+}
+
+func newBindThrottle(maxPerIP, maxPerDN int, window, lockout time.Duration) *bindThrottle {
+	return &bindThrottle{
+		maxPerIP:  maxPerIP,
+		maxPerDN:  maxPerDN,
+		window:    window,
+		lockout:   lockout,
+		ips:       map[string]*bindFailures{},
+		dns:       map[string]*bindFailures{},
+		lastPurge: time.Now(),
+	}
+}
+
+func (this *bindThrottle) enabled() bool {
+	return this != nil && (this.maxPerIP > 0 || this.maxPerDN > 0)
+}
+
+// Key returns the key a bind name is throttled by: the DN of the entry it
+// resolves to, so the uid, mail and DN forms of an account share their
+// failures. Names which resolve to no entry are keyed by themselves.
+func (this *bindThrottle) Key(name string) string {
+	if !this.enabled() || this.maxPerDN <= 0 || len(name) == 0 {
+		return ""
+	}
+	if this.resolve != nil {
+		if dn := this.resolve(name); len(dn) > 0 {
+			return NormalizeDN(dn)
+		}
+	}
+	return NormalizeDN(name)
+}
+
+// Allowed reports whether a bind from ip for the Key of a bind name may be
+// attempted
+func (this *bindThrottle) Allowed(ip, key string) bool {
+	if !this.enabled() {
+		return true
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	now := time.Now()
+	if f, ok := this.ips[ip]; ok && now.Before(f.lockedUntil) {
+		return false
+	}
+	if len(key) > 0 {
+		if f, ok := this.dns[key]; ok && now.Before(f.lockedUntil) {
+			return false
+		}
+	}
+	return true
+}
+
+func (this *bindThrottle) Failed(ip, key string) {
+	if !this.enabled() {
+		return
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	now := time.Now()
+	this.purge(now)
+	if this.maxPerIP > 0 {
+		this.count(this.ips, ip, this.maxPerIP, now)
+	}
+	if this.maxPerDN > 0 && len(key) > 0 {
+		this.count(this.dns, key, this.maxPerDN, now)
+	}
+}
+
+// Succeeded resets the failures of the key. The failures of the ip are kept,
+// so one valid account doesn't allow spraying others.
+func (this *bindThrottle) Succeeded(ip, key string) {
+	if !this.enabled() || len(key) == 0 {
+		return
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	delete(this.dns, key)
+}
+
+func (this *bindThrottle) count(m map[string]*bindFailures, key string, max int, now time.Time) {
+	f, ok := m[key]
+	if !ok || now.Sub(f.windowStart) > this.window {
+		f = &bindFailures{windowStart: now}
+		m[key] = f
+	}
+	f.count++
+	if f.count >= max {
+		f.lockedUntil = now.Add(this.lockout)
+		f.count = 0
+		f.windowStart = now
+	}
+}
+
+// purge drops keys which are neither locked nor within their window anymore
+func (this *bindThrottle) purge(now time.Time) {
+	if now.Sub(this.lastPurge) < throttlePurgeInterval {
+		return
+	}
+	this.lastPurge = now
+	for _, m := range []map[string]*bindFailures{this.ips, this.dns} {
+		for k, f := range m {
+			if now.After(f.lockedUntil) && now.Sub(f.windowStart) > this.window {
+				delete(m, k)
+			}
+		}
+	}
+}
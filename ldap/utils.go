@@ -1,6 +1,10 @@
 package ldap
 
-import "strings"
+import (
+	"strings"
+
+	"github.com/jimlambrt/gldap"
+)
 
 func SplitDN(dn string) []string {
 	ss := strings.Split(dn, ",")
@@ -26,3 +30,26 @@ func CombineDN(levels []string) string {
 func EntryType(dni string) string {
 	return strings.Split(dni, "=")[0]
 }
+
+// NormalizeDN lower-cases the DN and removes the spaces around its RDNs
+func NormalizeDN(dn string) string {
+	return strings.ToLower(CombineDN(SplitDN(dn)))
+}
+
+// IsDNInScope reports whether dn is selected by a search with the given base and scope
+func IsDNInScope(dn, base string, scope gldap.Scope) bool {
+	d := NormalizeDN(dn)
+	b := NormalizeDN(base)
+	switch scope {
+	case gldap.BaseObject:
+		return d == b
+	case gldap.SingleLevel:
+		if len(b) == 0 {
+			return len(SplitDN(d)) == 1
+		}
+		return NormalizeDN(CombineParentDN(SplitDN(d))) == b
+	case gldap.WholeSubtree:
+		return len(b) == 0 || d == b || strings.HasSuffix(d, ","+b)
+	}
+	return false
+}
@@ -8,10 +8,13 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/meidomx/misc-service/config"
+	"github.com/meidomx/misc-service/dratelimiter"
 	"github.com/meidomx/misc-service/fulltextsearch"
 	"github.com/meidomx/misc-service/id"
+	"github.com/meidomx/misc-service/idservice"
 	"github.com/meidomx/misc-service/ldap"
 	"github.com/meidomx/misc-service/pgbackend"
 	"github.com/meidomx/misc-service/smallobj"
@@ -24,8 +27,10 @@ func main() {
 	c := new(config.Config)
 	loadConfig(c)
 
-	idGen := id.NewIdGen(1, 1)
 	engine := gin.New()
+	if err := engine.SetTrustedProxies(c.Http.TrustedProxies); err != nil {
+		panic(err)
+	}
 	{
 		engine.Use(gin.Logger())
 		engine.Use(gin.Recovery())
@@ -35,10 +40,13 @@ func main() {
 	if err := pgbackend.InitDb(c.Storage.ConnString); err != nil {
 		panic(err)
 	}
+	idGen := newIdGen(c, container)
 
-	ldap.StartService(idGen, c, container)
+	ldap.StartService(idGen, c, engine, container)
 	fulltextsearch.InitService(c, engine, container)
 	smallobj.InitSmallObj(c, engine, container)
+	idservice.InitIdService(c, engine, container, idGen)
+	dratelimiter.InitRateLimiter(c, engine, container)
 
 	go func() {
 		// stop server gracefully when ctrl-c, sigint or sigterm occurs
@@ -56,6 +64,57 @@ func main() {
 	}
 }
 
+func newIdGen(c *config.Config, container *config.Container) *id.IdGen {
+	elementId := c.Id.ElementId
+	if elementId == 0 {
+		elementId = 1
+	}
+	if !c.Id.Lease.Enable {
+		nodeId := c.Id.NodeId
+		if nodeId == 0 {
+			nodeId = 1
+		}
+		idGen := id.NewIdGen(nodeId, elementId)
+		var store id.TimeStore
+		if len(c.Id.Clock.TimeFile) > 0 {
+			store = id.NewFileTimeStore(c.Id.Clock.TimeFile)
+		}
+		setIdClock(c, idGen, store)
+		return idGen
+	}
+
+	ttl := time.Duration(c.Id.Lease.TTLSeconds) * time.Second
+	if ttl <= 0 {
+		ttl = 30 * time.Second
+	}
+	heartbeat := time.Duration(c.Id.Lease.HeartbeatSeconds) * time.Second
+	if heartbeat <= 0 {
+		heartbeat = ttl / 3
+	}
+	lease, err := id.ClaimNodeLease(c.Id.Lease.MinNodeId, c.Id.Lease.MaxNodeId, ttl, heartbeat)
+	if err != nil {
+		panic(errors.New(fmt.Sprint("lease node id failed:", err.Error())))
+	}
+	lease.Start()
+	container.IdNodeLease = lease
+	idGen := id.NewLeasedIdGen(lease, elementId)
+	setIdClock(c, idGen, lease)
+	return idGen
+}
+
+func setIdClock(c *config.Config, idGen *id.IdGen, store id.TimeStore) {
+	idGen.SetClockTolerance(
+		time.Duration(c.Id.Clock.WaitToleranceMillis)*time.Millisecond,
+		time.Duration(c.Id.Clock.BorrowLimitMillis)*time.Millisecond,
+	)
+	if store == nil {
+		return
+	}
+	if err := idGen.SetTimeStore(store); err != nil {
+		panic(errors.New(fmt.Sprint("load last id time failed:", err.Error())))
+	}
+}
+
 func loadConfig(c *config.Config) {
 	f, err := os.Open("config.toml")
 	if err != nil {
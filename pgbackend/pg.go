@@ -5,6 +5,7 @@ import (
 	"log"
 	"time"
 
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
@@ -50,3 +51,60 @@ func RunQuery[T any](service string, result T, f func(conn *pgxpool.Conn, result
 
 	return result, f(conn, result)
 }
+
+func RunTx[T any](service string, result T, f func(tx pgx.Tx, result T) error) (R T, err error) {
+	if gPool == nil {
+		panic("pgx pool is not initialized!")
+	}
+
+	ctx, cf := context.WithTimeout(context.Background(), dbResourceAcquireTimeout*time.Second)
+	defer cf()
+
+	conn, err := gPool.Acquire(ctx)
+	if err != nil {
+		return result, err
+	}
+	defer conn.Release()
+
+	tx, err := conn.Begin(context.Background())
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback(context.Background())
+
+	if err := f(tx, result); err != nil {
+		return result, err
+	}
+
+	return result, tx.Commit(context.Background())
+}
+
+// Listen holds a dedicated connection subscribed to the notification channel
+// and calls f for each notification until ctx is done or the connection fails.
+// The connection is opened outside of the pool and closed on return.
+func Listen(ctx context.Context, channel string, f func(payload string)) error {
+	if gPool == nil {
+		panic("pgx pool is not initialized!")
+	}
+
+	acquireCtx, cf := context.WithTimeout(ctx, dbResourceAcquireTimeout*time.Second)
+	defer cf()
+
+	conn, err := pgx.ConnectConfig(acquireCtx, gPool.Config().ConnConfig)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "listen "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		return err
+	}
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		f(n.Payload)
+	}
+}
@@ -0,0 +1,9 @@
+module github.com/jimlambrt/gldap
+
+go 1.20
+
+require (
+	github.com/go-asn1-ber/asn1-ber v1.5.5
+	github.com/go-ldap/ldap/v3 v3.4.6
+	github.com/hashicorp/go-hclog v1.6.2
+)